@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/deahtstroke/protheon/internal/anomaly"
+	bungie "github.com/deahtstroke/protheon/internal/bungie/types"
+	"github.com/deahtstroke/protheon/internal/producer"
+	"github.com/klauspost/compress/zstd"
+)
+
+func checkFile(path string, detector *anomaly.Detector, minScore float64, flags *[]anomaly.Flag) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("Error opening source [%s]: %v", path, err)
+	}
+	defer file.Close()
+
+	decoder, err := zstd.NewReader(bufio.NewReader(file))
+	if err != nil {
+		return 0, fmt.Errorf("Error creating ZSTD reader for source [%s]: %v", path, err)
+	}
+	defer decoder.Close()
+
+	scanner := bufio.NewScanner(decoder)
+	scanner.Buffer(make([]byte, 1024*1024), producer.MAX_CAPACITY)
+
+	var line, checked int64
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var pgcr bungie.PGCR
+		if err := json.Unmarshal(scanner.Bytes(), &pgcr); err != nil {
+			continue
+		}
+		checked++
+
+		for _, f := range detector.Check(&pgcr) {
+			if f.Score >= minScore {
+				*flags = append(*flags, f)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return checked, fmt.Errorf("Error reading source [%s] at line %d: %v", path, line+1, err)
+	}
+	return checked, nil
+}
+
+func main() {
+	sketches := flag.String("sketches", "", "Load the detector's distributions from this file first, and save them back when done")
+	minScore := flag.Float64("min-score", 1, "Only report flags scoring at least this much")
+	minSamples := flag.Int64("min-samples", anomaly.DEFAULT_MIN_SAMPLES, "Values a distribution needs before it judges entries")
+	factor := flag.Float64("factor", anomaly.DEFAULT_FACTOR, "How far past the distribution's quantile an entry must be to be flagged")
+	minClears := flag.String("min-clears", "", "JSON file of director activity hashes and the fastest clear in seconds flagged regardless of the distribution")
+	format := flag.String("format", "csv", "Output format: csv or json")
+	out := flag.String("out", "", "Write the review to this file instead of stdout")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] dump.zst...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *format != "csv" && *format != "json" {
+		fmt.Printf("Unknown format [%s]\n", *format)
+		os.Exit(2)
+	}
+
+	detector := anomaly.NewDetector()
+	detector.MinSamples = *minSamples
+	detector.Factor = *factor
+	if *minClears != "" {
+		floors, err := anomaly.LoadMinClears(*minClears)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		detector.MinClearSeconds = floors
+	}
+	if *sketches != "" {
+		if err := detector.LoadSketches(*sketches); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	var flags []anomaly.Flag
+	var checked int64
+	for _, path := range flag.Args() {
+		n, err := checkFile(path, detector, *minScore, &flags)
+		checked += n
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	anomaly.SortFlags(flags)
+
+	if *sketches != "" {
+		if err := detector.SaveSketches(*sketches); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			fmt.Printf("Error creating review [%s]: %v\n", *out, err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		w = file
+	}
+
+	var err error
+	switch *format {
+	case "csv":
+		err = anomaly.WriteReviewCSV(w, flags)
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(flags)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Checked %d PGCRs, %d flagged entries\n", checked, len(flags))
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/deahtstroke/protheon/internal/certs"
+)
+
+func main() {
+	dir := flag.String("dir", "ca", "Directory of the CA, created if needed, the same as the conductor's --ca-dir")
+	out := flag.String("out", ".", "Directory the certificates and keys are written to, as <name>.crt and <name>.key")
+	hosts := flag.String("hosts", "", "Comma separated names and IPs added to every certificate besides its name")
+	ttl := flag.Duration("ttl", certs.DEFAULT_CERT_TTL, "How long the certificates are valid")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] name...\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Issues a client certificate for each name, which identifies a mind to the conductor.\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ca, err := certs.OpenCA(*dir)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	var extra []string
+	if *hosts != "" {
+		extra = strings.Split(*hosts, ",")
+	}
+	if err := os.MkdirAll(*out, 0o755); err != nil {
+		fmt.Printf("Error creating output directory [%s]: %v\n", *out, err)
+		os.Exit(1)
+	}
+	for _, name := range flag.Args() {
+		certFile := filepath.Join(*out, name+".crt")
+		keyFile := filepath.Join(*out, name+".key")
+		if err := ca.IssueClient(name, extra, *ttl, certFile, keyFile); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "Issued [%s] to %s and %s\n", name, certFile, keyFile)
+	}
+	fmt.Fprintf(os.Stderr, "Minds trust the conductor with --tls-ca %s\n", ca.CertFile())
+}
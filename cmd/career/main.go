@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/deahtstroke/protheon/internal/career"
+)
+
+func printTable(aggregates []career.Aggregate) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PLAYER\tNAME\tACTIVITIES\tCOMPLETIONS\tKILLS\tDEATHS\tASSISTS\tKD\tPRECISION\tABILITY\tHOURS")
+	for _, a := range aggregates {
+		t := a.Totals
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t%d\t%.2f\t%d\t%d\t%.1f\n", a.Key, a.BungieName, t.Activities,
+			t.Completions, t.Kills, t.Deaths, t.Assists, t.KD(), t.PrecisionKills, t.AbilityKills,
+			float64(t.TimePlayedSeconds)/3600)
+	}
+	w.Flush()
+}
+
+func main() {
+	out := flag.String("out", "", "Save the merged partial to this file")
+	player := flag.String("player", "", "Only show this membership ID")
+	byCharacter := flag.Bool("characters", false, "Show one row per character instead of per player")
+	mode := flag.Int("mode", -1, "Show totals for this activity mode only")
+	top := flag.Int("top", 0, "Only show the players with the most activities")
+	format := flag.String("format", "table", "Output format: table, csv or json")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] partial.json...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	merged := career.NewPartial()
+	for _, path := range flag.Args() {
+		partial, err := career.Load(path)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		merged.Merge(partial)
+	}
+
+	if *out != "" {
+		if err := merged.Save(*out); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	var aggregates []career.Aggregate
+	if *byCharacter {
+		aggregates = merged.Aggregates()
+	} else {
+		aggregates = merged.Players()
+	}
+
+	filtered := aggregates[:0]
+	for _, a := range aggregates {
+		if *player != "" && a.MembershipID != *player {
+			continue
+		}
+		if *mode >= 0 {
+			totals, ok := a.Modes[int32(*mode)]
+			if !ok {
+				continue
+			}
+			a.Totals = totals
+		}
+		filtered = append(filtered, a)
+	}
+	aggregates = filtered
+
+	if *top > 0 {
+		sort.SliceStable(aggregates, func(i, j int) bool {
+			return aggregates[i].Totals.Activities > aggregates[j].Totals.Activities
+		})
+		if len(aggregates) > *top {
+			aggregates = aggregates[:*top]
+		}
+	}
+
+	switch *format {
+	case "table":
+		printTable(aggregates)
+	case "csv":
+		if err := career.WriteCSV(os.Stdout, aggregates); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(aggregates)
+	default:
+		fmt.Printf("Unknown format [%s], expected table, csv or json\n", *format)
+		os.Exit(2)
+	}
+}
@@ -2,59 +2,759 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
-	"log"
+	"fmt"
+	"maps"
+	"net"
 	"net/http"
+	"os"
 	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/deahtstroke/protheon/internal/api"
+	"github.com/deahtstroke/protheon/internal/auth"
+	"github.com/deahtstroke/protheon/internal/certs"
+	"github.com/deahtstroke/protheon/internal/dashboard"
+	"github.com/deahtstroke/protheon/internal/dedupe"
+	"github.com/deahtstroke/protheon/internal/events"
+	"github.com/deahtstroke/protheon/internal/file"
+	"github.com/deahtstroke/protheon/internal/health"
+	"github.com/deahtstroke/protheon/internal/ingest"
+	"github.com/deahtstroke/protheon/internal/logging"
+	"github.com/deahtstroke/protheon/internal/metrics"
 	"github.com/deahtstroke/protheon/internal/producer"
 	"github.com/deahtstroke/protheon/internal/rabbitmq"
+	"github.com/deahtstroke/protheon/internal/tracing"
+	"github.com/deahtstroke/protheon/internal/validate"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+func splitPatterns(patterns string) []string {
+	if patterns == "" {
+		return nil
+	}
+	return strings.Split(patterns, ",")
+}
+
+// progress tracks the files of every ingest and the producers working on
+// them, so their progress can be scraped, and publishes when files start and
+// finish.
+type progress struct {
+	mu        sync.Mutex
+	ingests   []*file.StatefulMap
+	producers map[string]*producer.PgcrProducer
+	producing map[string]*producer.PgcrProducer
+	records   map[string]int64
+	bus       *events.Bus
+}
+
+func newProgress(bus *events.Bus) *progress {
+	return &progress{
+		producers: make(map[string]*producer.PgcrProducer),
+		producing: make(map[string]*producer.PgcrProducer),
+		records:   make(map[string]int64),
+		bus:       bus,
+	}
+}
+
+func (p *progress) track(files *file.StatefulMap) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ingests = append(p.ingests, files)
+}
+
+// untrack forgets the files of an ingest that returned, and their producers.
+// Their records stay counted in Records.
+func (p *progress) untrack(files *file.StatefulMap) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ingests = slices.DeleteFunc(p.ingests, func(ingest *file.StatefulMap) bool { return ingest == files })
+	for _, status := range files.Statuses() {
+		if _, ok := p.producing[status.Path]; !ok {
+			delete(p.producers, status.Path)
+		}
+	}
+}
+
+func (p *progress) started(path string, size int64, pp *producer.PgcrProducer) {
+	p.mu.Lock()
+	p.producers[path] = pp
+	p.producing[path] = pp
+	p.mu.Unlock()
+
+	p.bus.Publish(events.FileStarted, events.FileData{Path: path, Size: size})
+}
+
+// recordsOf counts the records of pp by result.
+func recordsOf(pp *producer.PgcrProducer) map[string]int64 {
+	stats := &pp.Stats
+	return map[string]int64{
+		"read":        stats.Read.Load(),
+		"published":   stats.Published.Load(),
+		"filtered":    stats.Filtered.Load(),
+		"duplicate":   stats.Duplicates.Load(),
+		"quarantined": stats.Quarantined.Load(),
+		"failed":      stats.Failed.Load(),
+	}
+}
+
+// finished records that pp is done with a file. An interrupted file is
+// produced again once its job resumes, so it is published as
+// file.interrupted rather than file.finished.
+func (p *progress) finished(path string, size int64, pp *producer.PgcrProducer, err error, interrupted bool) {
+	records := recordsOf(pp)
+	p.mu.Lock()
+	delete(p.producing, path)
+	for result, n := range records {
+		p.records[result] += n
+	}
+	p.mu.Unlock()
+
+	data := events.FileData{
+		Path:    path,
+		Size:    size,
+		Records: records,
+	}
+	if err != nil {
+		data.Error = err.Error()
+	}
+	switch {
+	case interrupted:
+		p.bus.Publish(events.FileInterrupted, data)
+	case errors.Is(err, producer.ErrBudgetExceeded):
+		p.bus.Publish(events.ErrorBudgetExceeded, data)
+		p.bus.Publish(events.FileFinished, data)
+	default:
+		p.bus.Publish(events.FileFinished, data)
+	}
+}
+
+// progressOf counts the records read from the files of an ingest so far, and
+// reports whether one of them is being produced.
+func (p *progress) progressOf(files *file.StatefulMap) (int64, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var read int64
+	producing := false
+	for _, status := range files.Statuses() {
+		if pp, ok := p.producers[status.Path]; ok && status.Started {
+			read += pp.Stats.Read.Load()
+		}
+		if _, ok := p.producing[status.Path]; ok {
+			producing = true
+		}
+	}
+	return read, producing
+}
+
+// Files reports every tracked file once, as of its latest ingest.
+func (p *progress) Files() []metrics.File {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var order []string
+	files := make(map[string]metrics.File)
+	for _, ingest := range p.ingests {
+		for _, status := range ingest.Statuses() {
+			f := metrics.File{Path: status.Path, State: metrics.FilePending, Size: status.Size}
+			switch {
+			case status.Done:
+				f.State = metrics.FileDone
+			case status.Started:
+				f.State = metrics.FileProducing
+			}
+			if pp, ok := p.producers[status.Path]; ok && status.Started {
+				f.Read = pp.Stats.BytesRead.Load()
+				f.Records = recordsOf(pp)
+			}
+			if _, ok := files[f.Path]; !ok {
+				order = append(order, f.Path)
+			}
+			files[f.Path] = f
+		}
+	}
+
+	result := make([]metrics.File, 0, len(order))
+	for _, path := range order {
+		result = append(result, files[path])
+	}
+	return result
+}
+
+// Records counts the records of every file produced since the conductor
+// started, by result.
+func (p *progress) Records() map[string]int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	records := maps.Clone(p.records)
+	for _, pp := range p.producing {
+		for result, n := range recordsOf(pp) {
+			records[result] += n
+		}
+	}
+	return records
+}
+
+// produceAll produces the files of a job, skipping those it already
+// finished, and returns the cause of ctx once ctx is done. A file that fails
+// doesn't stop the others, but fails the job.
+func produceAll(ctx context.Context, job ingest.Job, run *ingest.Run, files *file.StatefulMap, publisher rabbitmq.Publisher, tracker *progress, opts ...producer.Option) error {
+	tracker.track(files)
+	defer tracker.untrack(files)
+	logger := logging.Component("conductor").With("job", job.ID)
+
+	done := make(map[string]bool, len(job.Done))
+	for _, path := range job.Done {
+		done[path] = true
+	}
+
+	var failed []string
+	for {
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
+		run.Found(files.Len())
+
+		path, status, ok := files.GetNext()
+		if !ok {
+			if !job.Watch {
+				break
+			}
+			select {
+			case <-ctx.Done():
+			case <-files.Updated():
+			}
+			continue
+		}
+		if done[path] {
+			files.MarkDone(path)
+			continue
+		}
+
+		logger.Info("Producing PGCRs", logging.KeyFile, path)
+		pgcrProducer := producer.NewPgcrProducer(path, publisher, opts...)
+		tracker.started(path, status.Size, pgcrProducer)
+		err := pgcrProducer.Produce(ctx)
+		files.MarkDone(path)
+		// Produce returns the cause of ctx when it stopped short of the end.
+		interrupted := err != nil && ctx.Err() != nil
+		tracker.finished(path, status.Size, pgcrProducer, err, interrupted)
+		if interrupted {
+			// The file is produced again once the job resumes.
+			return context.Cause(ctx)
+		}
+		if err != nil {
+			logger.Error("Error producing file", logging.KeyFile, path, "error", err)
+			failed = append(failed, path)
+		}
+
+		stats := &pgcrProducer.Stats
+		run.Finished(path, ingest.Stats{
+			Read:        stats.Read.Load(),
+			Published:   stats.Published.Load(),
+			Filtered:    stats.Filtered.Load(),
+			Duplicates:  stats.Duplicates.Load(),
+			Quarantined: stats.Quarantined.Load(),
+			Failed:      stats.Failed.Load(),
+		})
+		logger.Info("Finished file", logging.KeyFile, path,
+			"read", stats.Read.Load(), "published", stats.Published.Load(), "filtered", stats.Filtered.Load(),
+			"duplicates", stats.Duplicates.Load(), "quarantined", stats.Quarantined.Load(), "failed", stats.Failed.Load())
+	}
+
+	logger.Info("All files produced")
+	if len(failed) > 0 {
+		return fmt.Errorf("Error producing %d of %d files: %s", len(failed), files.Len(), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// urlFlags collects repeated URL flags.
+type urlFlags []string
+
+func (f *urlFlags) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *urlFlags) Set(url string) error {
+	*f = append(*f, url)
+	return nil
+}
+
 func main() {
 	url := flag.String("url", "", "AMQPS url to running rabbitmq instance")
 	fileRoot := flag.String("files", "", "URI of where to scan for files")
+	include := flag.String("include", "", "Comma separated glob patterns of files to include")
+	exclude := flag.String("exclude", "", "Comma separated glob patterns of files and directories to exclude")
+	minSize := flag.Int64("min-size", 0, "Skip files smaller than this many bytes")
+	maxSize := flag.Int64("max-size", 0, "Skip files larger than this many bytes")
+	followSymlinks := flag.Bool("follow-symlinks", false, "Follow symbolic links while scanning for files")
+	sortBy := flag.String("sort", "name", "Order in which files are ingested: name or mtime")
+	watch := flag.Bool("watch", false, "Keep watching --files for new dumps and ingest them as they land")
+	ingestRoots := flag.String("ingest-roots", "", "Comma separated directories ingest jobs may read from, besides --files")
+	queues := flag.String("queues", rabbitmq.PGCR_QUEUE, "Comma separated queues ingest jobs may publish to")
+	jobsFile := flag.String("jobs-file", "", "File persisting ingest jobs, which lets interrupted jobs resume after a restart and keeps their history, with their progress in <file>.progress")
+	stableAfter := flag.Duration("stable-after", file.DEFAULT_STABLE_AFTER, "How long a watched file must stop growing before it is ingested")
+	rescanInterval := flag.Duration("rescan-interval", file.DEFAULT_RESCAN, "Interval of the full rescan that backs up watch mode, 0 to disable")
+	filterExpr := flag.String("filter", "", "Only publish PGCRs matching this filter, e.g. \"mode=4 isPrivate=false from=2024-06-04\"")
+	seenFile := flag.String("seen-file", "", "File persisting the instance IDs already published, enables deduplication")
+	force := flag.Bool("force", false, "Publish PGCRs again even if their instance ID was already published")
+	quarantinePath := flag.String("quarantine", "", "Zstd JSONL file collecting the malformed lines and invalid PGCRs an ingest skipped")
+	stallAfter := flag.Duration("stall-after", ingest.DEFAULT_STALL_AFTER, "How long a job may read no records before ingest.stalled is published, 0 to never")
+	errorBudget := flag.Int64("error-budget", 1000, "Malformed lines skipped per file before it is abandoned, 0 for no limit")
+	validateRules := flag.String("validate", "", "Validate PGCRs before publishing, with optional rule overrides such as \"player-count-mismatch=error\"")
+	noValidate := flag.Bool("no-validate", false, "Publish PGCRs without validating them")
+	authFile := flag.String("auth-file", "", "File persisting join tokens and worker credentials, which are lost on restart without one")
+	joinSecret := flag.String("join-secret", os.Getenv("PROTHEON_JOIN_SECRET"), "Shared secret minds can join with besides join tokens, defaults to PROTHEON_JOIN_SECRET")
+	adminKey := flag.String("admin-key", os.Getenv("PROTHEON_ADMIN_KEY"), "API key with the admin role, defaults to PROTHEON_ADMIN_KEY")
+	apiKeys := flag.String("api-keys", "", "JSON file of API keys and their roles: viewer, operator or admin. Without any API key, anonymous callers are viewers and routes for operators can't be reached")
+	tlsCert := flag.String("tls-cert", "", "Certificate file to serve the API over TLS with, reloaded when it changes")
+	tlsKey := flag.String("tls-key", "", "Key file of --tls-cert")
+	tlsClientCA := flag.String("tls-client-ca", "", "CA bundle verifying mind client certificates, which then identify minds")
+	tlsRequireClientCert := flag.Bool("tls-require-client-cert", false, "Refuse connections without a client certificate verified by --tls-client-ca")
+	tlsReloadInterval := flag.Duration("tls-reload-interval", certs.DEFAULT_RELOAD_INTERVAL, "How often certificate files are checked for changes")
+	caDir := flag.String("ca-dir", "", "Directory of a built-in CA, created if needed, that issues the conductor's certificate unless --tls-cert is given and verifies client certificates unless --tls-client-ca is given")
+	tlsHosts := flag.String("tls-hosts", "", "Comma separated names and IPs the built-in CA adds to the conductor's certificate, besides its hostname and localhost")
+	eventHistory := flag.Int("event-history", events.DEFAULT_HISTORY, "How many recent events are kept for clients of /events to resume from")
+	var webhookURLs urlFlags
+	flag.Var(&webhookURLs, "webhook", "URL events are POSTed to, can be repeated")
+	webhookSecret := flag.String("webhook-secret", os.Getenv("PROTHEON_WEBHOOK_SECRET"), "Secret webhook requests are signed with, defaults to PROTHEON_WEBHOOK_SECRET")
+	webhookTypes := flag.String("webhook-types", "", "Comma separated event types delivered to webhooks, such as worker.died,file.finished, defaults to all")
+	traceExporter := flag.String("trace-exporter", tracing.ExporterNone, "Where to send trace spans: none, stdout or otlp")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "host:port of the OTLP/HTTP collector, defaults to localhost:4318 or OTEL_EXPORTER_OTLP_ENDPOINT")
+	otlpInsecure := flag.Bool("otlp-insecure", false, "Send OTLP spans over plain HTTP")
+	traceSampleRatio := tracing.SampleRatio(1)
+	flag.Var(&traceSampleRatio, "trace-sample-ratio", "Fraction of new traces recorded, from 0 for none to 1 for all")
+	logFormat := flag.String("log-format", logging.FormatText, "Log format: text or json")
+	logLevel := flag.String("log-level", "info", "Log level: debug, info, warn or error, can be changed at runtime on /log/level")
+	logSampleFirst := flag.Int("log-sample-first", 100, "Log the first this many info and debug records with the same message every second, 0 to disable sampling")
+	logSampleThereafter := flag.Int("log-sample-thereafter", 100, "After --log-sample-first, log one in every this many records with the same message")
 	flag.Parse()
 
+	level, err := logging.Setup(os.Stderr, logging.Config{
+		Format:           *logFormat,
+		Level:            *logLevel,
+		SampleFirst:      *logSampleFirst,
+		SampleThereafter: *logSampleThereafter,
+		SampleInterval:   time.Second,
+	})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	logger := logging.Component("conductor")
+
+	if *rescanInterval < 0 {
+		logging.Fatal("--rescan-interval must not be negative")
+	}
+	filter, err := producer.ParseFilter(*filterExpr)
+	if err != nil {
+		logging.Fatal("Error parsing filter", "error", err)
+	}
+
+	var seen *dedupe.Store
+	if *seenFile != "" {
+		seen, err = dedupe.Open(*seenFile)
+		if err != nil {
+			logging.Fatal("Error opening seen store", "error", err)
+		}
+		logger.Info("Loaded seen instance IDs", "count", seen.Len(), "path", *seenFile)
+	}
+
+	var validator *validate.Validator
+	if !*noValidate {
+		rules, err := validate.ParseRules(*validateRules)
+		if err != nil {
+			logging.Fatal("Error parsing validation rules", "error", err)
+		}
+		validator = validate.NewValidator(rules)
+	}
+
+	var quarantine *producer.Quarantine
+	if *quarantinePath != "" {
+		quarantine, err = producer.OpenQuarantine(*quarantinePath)
+		if err != nil {
+			logging.Fatal("Error opening quarantine", "error", err)
+		}
+	}
+
+	authority, err := auth.Open(*authFile)
+	if err != nil {
+		logging.Fatal("Error opening auth state", "error", err)
+	}
+	authority.SetSharedSecret(*joinSecret)
+	if *authFile == "" {
+		logger.Warn("No --auth-file, minds must register again after a restart, with the shared secret, a reusable join token or a client certificate")
+	}
+
+	keyring := auth.NewKeyring()
+	if *apiKeys != "" {
+		keyring, err = auth.LoadKeyring(*apiKeys)
+		if err != nil {
+			logging.Fatal("Error loading API keys", "error", err)
+		}
+	}
+	if *adminKey != "" {
+		keyring.Add("admin-key", auth.RoleAdmin, *adminKey)
+	}
+	if keyring.Len() == 0 {
+		logger.Warn("No API keys, anonymous callers are viewers and operator and admin routes can't be reached")
+	}
+	if *joinSecret == "" && keyring.Len() == 0 && len(authority.Tokens()) == 0 {
+		logger.Warn("No --join-secret, API keys or join tokens, minds can't register")
+	}
+
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
-	rabbitPublisher, err := rabbitmq.NewPublisherCtx(ctx, *url, "pgcr")
+	shutdownTracing, err := tracing.Setup(ctx, tracing.Config{
+		Service:     "protheon-conductor",
+		Exporter:    *traceExporter,
+		Endpoint:    *otlpEndpoint,
+		Insecure:    *otlpInsecure,
+		SampleRatio: float64(traceSampleRatio),
+	})
 	if err != nil {
-		log.Fatalf("Error creating rabbitmq publisher: %v", err)
+		logging.Fatal("Error setting up tracing", "error", err)
+	}
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(shutdownCtx); err != nil {
+			logger.Error("Error flushing trace spans", "error", err)
+		}
+	}()
+
+	rabbitPublisher, err := rabbitmq.NewPublisherCtx(ctx, *url, rabbitmq.PGCR_QUEUE)
+	if err != nil {
+		logging.Fatal("Error creating rabbitmq publisher", "error", err)
 	}
 
-	pgcrProducer := producer.NewPgcrProducer(*fileRoot)
+	bus := events.NewBus(*eventHistory)
+	api.Events = bus
+	go api.WatchWorkers(ctx, api.HEARTBEAT_INTERVAL*time.Second)
+	for _, webhookURL := range webhookURLs {
+		webhook := &events.Webhook{URL: webhookURL, Secret: *webhookSecret, Types: events.ParseTypes(*webhookTypes)}
+		go webhook.Run(ctx, bus)
+		logger.Info("Delivering events to webhook", "url", webhookURL, "signed", *webhookSecret != "")
+	}
+
+	tracker := newProgress(bus)
+	conductorMetrics := metrics.NewConductor(prometheus.DefaultRegisterer, tracker.Files, tracker.Records, api.WorkerStates)
+	if err := rabbitPublisher.Instrument(conductorMetrics.Publisher); err != nil {
+		logging.Fatal("Error enabling publisher confirms", "error", err)
+	}
+
+	finder := file.FileFinder{
+		Root:    *fileRoot,
+		Include: splitPatterns(*include),
+		Exclude: splitPatterns(*exclude),
+		MinSize: *minSize,
+		MaxSize: *maxSize,
+	}
+	if *followSymlinks {
+		finder.Symlinks = file.SymlinkFollow
+	}
+	switch *sortBy {
+	case "name":
+		finder.SortBy = file.SortByName
+	case "mtime":
+		finder.SortBy = file.SortByModTime
+	default:
+		logging.Fatal("Unknown sort order, use name or mtime", "sort", *sortBy)
+	}
+
+	// findFiles scans the sources of a job, and returns the finder of each.
+	findFiles := func(spec ingest.Spec) (*file.StatefulMap, []*file.FileFinder, error) {
+		files := file.NewStatefulMap()
+		var finders []*file.FileFinder
+		for _, source := range spec.Sources {
+			sourceFinder := finder
+			sourceFinder.Root = source
+			sourceFinder.Include = spec.Include
+			sourceFinder.Exclude = spec.Exclude
+			found, err := sourceFinder.FindByExtension(".zst")
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, status := range found.Statuses() {
+				files.Add(&status)
+			}
+			finders = append(finders, &sourceFinder)
+		}
+		return files, finders, nil
+	}
+
+	runJob := func(ctx context.Context, job ingest.Job, run *ingest.Run) error {
+		jobFilter, err := producer.ParseFilter(job.Filter)
+		if err != nil {
+			return err
+		}
+		publisher, err := rabbitPublisher.ForQueue(job.Queue)
+		if err != nil {
+			return err
+		}
+		files, finders, err := findFiles(job.Spec)
+		if err != nil {
+			return err
+		}
+		logger.Info("Found files", "job", job.ID, "count", files.Len(), "sources", job.Sources, "done", len(job.Done))
+
+		if job.Watch {
+			for _, sourceFinder := range finders {
+				watcher := file.NewWatcher(sourceFinder, ".zst", files)
+				watcher.StableAfter = *stableAfter
+				watcher.Rescan = *rescanInterval
+				go func() {
+					if err := watcher.Run(ctx); err != nil && ctx.Err() == nil {
+						logger.Error("Watch mode stopped", "job", job.ID, "root", sourceFinder.Root, "error", err)
+					}
+				}()
+			}
+		}
+
+		stallCtx, stopStall := context.WithCancel(ctx)
+		defer stopStall()
+		go run.WatchStall(stallCtx, *stallAfter, func() (int64, bool) { return tracker.progressOf(files) })
+
+		return produceAll(ctx, job, run, files, publisher, tracker, producer.WithFilter(jobFilter), producer.WithDedupe(seen, job.Force), producer.WithQuarantine(quarantine), producer.WithErrorBudget(*errorBudget), producer.WithValidator(validator))
+	}
+
+	jobStore, err := ingest.Open(*jobsFile)
+	if err != nil {
+		logging.Fatal("Error opening ingest jobs", "error", err)
+	}
+	runner := ingest.NewRunner(ctx, jobStore, runJob)
+	runner.Events = bus
+	runner.Prepare = func(spec ingest.Spec) (ingest.Spec, error) {
+		jobFilter, err := producer.ParseFilter(spec.Filter)
+		if err != nil {
+			return spec, err
+		}
+		spec.Filter = jobFilter.String()
+		if spec.Queue == "" {
+			spec.Queue = rabbitmq.PGCR_QUEUE
+		}
+		// Sources outside the ingest roots were refused before Prepare, so
+		// only allowed sources are looked at.
+		for _, source := range spec.Sources {
+			if _, err := os.Stat(source); err != nil {
+				return spec, err
+			}
+		}
+		return spec, nil
+	}
+	runner.Roots = splitPatterns(*ingestRoots)
+	if *fileRoot != "" {
+		runner.Roots = append(runner.Roots, *fileRoot)
+	}
+	runner.Queues = splitPatterns(*queues)
+	if len(runner.Roots) == 0 {
+		logger.Warn("No --ingest-roots or --files, ingest jobs can't be started")
+	}
+	runner.Recover()
+
+	if *fileRoot != "" {
+		job, err := runner.StartOrResume(ingest.Spec{
+			Name:    "files",
+			Sources: []string{*fileRoot},
+			Include: finder.Include,
+			Exclude: finder.Exclude,
+			Filter:  filter.String(),
+			Force:   *force,
+			Watch:   *watch,
+		})
+		if err != nil {
+			logging.Fatal("Error starting ingest of --files", "error", err)
+		}
+		logger.Info("Ingesting --files", "job", job.ID, "root", *fileRoot)
+	}
+
+	if seen != nil {
+		go seen.SaveEvery(ctx, time.Minute)
+	}
+
+	startIngest := func(req api.IngestRequest) (*api.IngestResponse, error) {
+		spec := ingest.Spec{
+			Sources: []string{req.Root},
+			Include: req.Include,
+			Exclude: req.Exclude,
+			Filter:  req.Filter,
+			Force:   req.Force,
+		}
+		job, err := runner.Start(spec)
+		if err != nil {
+			return nil, err
+		}
+		return &api.IngestResponse{
+			Job:    job.ID,
+			Stats:  job.Stats,
+			Filter: job.Filter,
+		}, nil
+	}
+
+	checker := health.NewChecker()
+	checker.Add("broker", rabbitPublisher.Check)
+
+	certFile, keyFile, clientCA := *tlsCert, *tlsKey, *tlsClientCA
+	if *caDir != "" {
+		ca, err := certs.OpenCA(*caDir)
+		if err != nil {
+			logging.Fatal("Error opening CA", "error", err)
+		}
+		if certFile == "" {
+			hostname, _ := os.Hostname()
+			certFile, keyFile = filepath.Join(*caDir, "conductor.crt"), filepath.Join(*caDir, "conductor.key")
+			hosts := append([]string{"localhost", "127.0.0.1", "::1"}, splitPatterns(*tlsHosts)...)
+			issued, err := ca.Ensure(hostname, hosts, certs.DEFAULT_CERT_TTL, certFile, keyFile)
+			if err != nil {
+				logging.Fatal("Error issuing conductor certificate", "error", err)
+			}
+			if issued {
+				logger.Info("Issued conductor certificate", "path", certFile, "hostname", hostname)
+			}
+		}
+		if clientCA == "" {
+			clientCA = ca.CertFile()
+		}
+	}
+
+	var tlsConfig *tls.Config
+	if certFile != "" || keyFile != "" {
+		reloader, err := certs.NewReloader(certFile, keyFile)
+		if err != nil {
+			logging.Fatal("Error loading TLS certificate", "error", err)
+		}
+		go reloader.Watch(ctx, *tlsReloadInterval)
+		checker.Add("tls_certificate", reloader.Check)
+
+		var clientCAs *x509.CertPool
+		if clientCA != "" {
+			clientCAs, err = certs.LoadPool(clientCA)
+			if err != nil {
+				logging.Fatal("Error loading client CA", "error", err)
+			}
+		}
+		if *tlsRequireClientCert && clientCAs == nil {
+			logging.Fatal("--tls-require-client-cert needs --tls-client-ca or --ca-dir")
+		}
+		tlsConfig = certs.ServerConfig(reloader, clientCAs, *tlsRequireClientCert)
+	}
+	if seen != nil {
+		checker.Add("checkpoint_store", func(ctx context.Context) error { return seen.Check() })
+	}
+	httpServer := health.NewIndicator("HTTP server not listening yet")
+	checker.Add("http_server", httpServer.Check)
 
 	r := mux.NewRouter()
-	r.HandleFunc("/mind/register", api.RegisterWorker).Methods("POST")
-	r.HandleFunc("/mind/heartbet", api.ReceiveHeartbeat).Methods("POST")
+	r.HandleFunc("/mind/register", api.RegisterWorker(authority)).Methods("POST").Name(api.RouteRegister)
+	r.HandleFunc("/mind/heartbeat", api.ReceiveHeartbeat(authority)).Methods("POST").Name(api.RouteHeartbeat)
+	r.HandleFunc("/ingest", api.StartIngest(startIngest)).Methods("POST").Name(api.RouteIngest)
+	r.Handle("/metrics", promhttp.Handler()).Methods("GET").Name(api.RouteMetrics)
+	r.HandleFunc("/log/level", logging.LevelHandler(level)).Methods("GET").Name(api.RouteLogLevel)
+	r.HandleFunc("/log/level", logging.LevelHandler(level)).Methods("PUT").Name(api.RouteSetLogLevel)
+	r.HandleFunc("/healthz", checker.Liveness).Methods("GET").Name(api.RouteHealthz)
+	r.HandleFunc("/readyz", checker.Readiness).Methods("GET").Name(api.RouteReadyz)
+	r.HandleFunc("/admin/tokens", api.IssueToken(authority)).Methods("POST").Name(api.RouteIssueToken)
+	r.HandleFunc("/admin/tokens", api.ListTokens(authority)).Methods("GET").Name(api.RouteListTokens)
+	r.HandleFunc("/admin/tokens/{id}", api.RevokeToken(authority)).Methods("DELETE").Name(api.RouteRevokeToken)
+	r.HandleFunc("/admin/workers", api.ListWorkers(authority)).Methods("GET").Name(api.RouteListWorkers)
+	r.HandleFunc("/admin/workers/{id}", api.RevokeWorker(authority)).Methods("DELETE").Name(api.RouteRevokeWorker)
+	r.HandleFunc("/events", events.Handler(bus)).Methods("GET").Name(api.RouteEvents)
+	r.HandleFunc("/jobs", api.CreateJob(runner)).Methods("POST").Name(api.RouteCreateJob)
+	r.HandleFunc("/jobs", api.ListJobs(runner)).Methods("GET").Name(api.RouteListJobs)
+	r.HandleFunc("/jobs/{id}", api.GetJob(runner)).Methods("GET").Name(api.RouteGetJob)
+	r.HandleFunc("/jobs/{id}/pause", api.JobAction(runner.Pause)).Methods("POST").Name(api.RoutePauseJob)
+	r.HandleFunc("/jobs/{id}/resume", api.JobAction(runner.Resume)).Methods("POST").Name(api.RouteResumeJob)
+	r.HandleFunc("/jobs/{id}/cancel", api.JobAction(runner.Cancel)).Methods("POST").Name(api.RouteCancelJob)
+	r.HandleFunc("/jobs/{id}/rerun", api.JobAction(runner.Rerun)).Methods("POST").Name(api.RouteRerunJob)
+
+	board := dashboard.New(dashboard.Sources{
+		Files:   tracker.Files,
+		Workers: func() []api.WorkerInfo { return api.WorkerInfos(authority) },
+		Queue:   rabbitPublisher.Stats,
+	})
+	r.Handle("/", http.RedirectHandler("/dashboard/", http.StatusFound)).Methods("GET").Name(api.RouteRoot)
+	r.HandleFunc("/dashboard/state", board.State).Methods("GET").Name(api.RouteDashboardState)
+	r.HandleFunc("/dashboard/events", board.Events).Methods("GET").Name(api.RouteDashboardEvents)
+	r.PathPrefix("/dashboard/").Handler(board.Page()).Methods("GET").Name(api.RouteDashboard)
+
+	policy := &api.Policy{Routes: api.DefaultPolicy(), Keyring: keyring, Authority: authority}
+	r.Use(policy.Middleware)
 
 	server := http.Server{
-		Addr:    ":8080",
-		Handler: r,
+		Addr:      ":8080",
+		Handler:   r,
+		TLSConfig: tlsConfig,
+		// Requests end with the conductor, so that dashboard streams don't
+		// hold up the shutdown.
+		BaseContext: func(net.Listener) context.Context { return ctx },
 	}
 
-	log.Printf("HTTP server listening on :8080")
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		logging.Fatal("HTTP server failed", "error", err)
+	}
+	httpServer.Up()
+	logger.Info("HTTP server listening", "addr", server.Addr, "tls", tlsConfig != nil, "client_certs", tlsConfig != nil && tlsConfig.ClientCAs != nil)
 	go func() {
-		if err := server.ListenAndServe(); err != nil {
-			log.Fatalf("HTTP server failed: %v", err)
+		serve := server.Serve
+		if tlsConfig != nil {
+			serve = func(l net.Listener) error { return server.ServeTLS(l, "", "") }
+		}
+		if err := serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			httpServer.Down(err)
+			logging.Fatal("HTTP server failed", "error", err)
 		}
 	}()
 
 	<-ctx.Done()
-	log.Println("Shutdown signal received...")
+	logger.Info("Shutdown signal received")
+	httpServer.Down(errors.New("Shutting down"))
 
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	if err := server.Shutdown(shutdownCtx); err != nil {
-		log.Fatalf("Server shutdown failed: %v", err)
+		logging.Fatal("Server shutdown failed", "error", err)
+	}
+
+	// Jobs stop with the conductor, and are resumed once it restarts.
+	runner.Wait()
+
+	if seen != nil {
+		if err := seen.Save(); err != nil {
+			logger.Error("Error saving seen store", "error", err)
+		}
+	}
+
+	if validator != nil {
+		histogram, validated := validator.Histogram()
+		logger.Info("Validated PGCRs", "count", validated)
+		for _, entry := range histogram {
+			if entry.Count > 0 {
+				logger.Info("Validation rule violated", "rule", entry.Rule, "severity", entry.Severity.String(), "count", entry.Count)
+			}
+		}
+	}
+
+	if quarantine != nil {
+		if err := quarantine.Close(); err != nil {
+			logger.Error("Error closing quarantine", "error", err)
+		}
 	}
 
-	log.Print("Server exited gracefully")
+	logger.Info("Server exited gracefully")
 }
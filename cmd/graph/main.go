@@ -0,0 +1,115 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/deahtstroke/protheon/internal/graph"
+)
+
+func printNeighbors(g *graph.Graph, player string, mode int, top int) {
+	neighbors := g.Neighbors(player, int32(mode))
+	if top > 0 && len(neighbors) > top {
+		neighbors = neighbors[:top]
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PLAYER\tNAME\tWEIGHT\tACTIVITIES\tFIRETEAMS\tLAST PLAYED")
+	for _, e := range neighbors {
+		other := e.Other(player)
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%s\n", other, g.Name(other), e.Weight(), e.Activities, e.Fireteams,
+			e.LastPlayed.UTC().Format(time.DateOnly))
+	}
+	w.Flush()
+}
+
+func printCommunities(g *graph.Graph, minWeight int64) {
+	labels := g.Communities(minWeight, 100)
+	communities := make(map[string][]string)
+	for player, label := range labels {
+		communities[label] = append(communities[label], player)
+	}
+
+	ordered := make([]string, 0, len(communities))
+	for label := range communities {
+		ordered = append(ordered, label)
+		sort.Strings(communities[label])
+	}
+	sort.Slice(ordered, func(i, j int) bool {
+		a, b := communities[ordered[i]], communities[ordered[j]]
+		if len(a) != len(b) {
+			return len(a) > len(b)
+		}
+		return ordered[i] < ordered[j]
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "COMMUNITY\tPLAYERS\tMEMBERS")
+	for _, label := range ordered {
+		fmt.Fprintf(w, "%s\t%d\t%v\n", label, len(communities[label]), communities[label])
+	}
+	w.Flush()
+}
+
+func main() {
+	out := flag.String("out", "", "Save the merged graph to this file")
+	player := flag.String("player", "", "List who this membership ID played with")
+	mode := flag.Int("mode", 0, "With --player, only count activities of this mode, such as 4 for raids")
+	top := flag.Int("top", 20, "With --player, number of players to list")
+	format := flag.String("format", "", "Export the graph instead: graphml, csv or communities")
+	minWeight := flag.Int64("min-weight", 3, "With --format communities, ignore edges lighter than this")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] graph.json...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	merged := graph.New()
+	for _, path := range flag.Args() {
+		g, err := graph.Load(path)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		merged.Merge(g)
+	}
+
+	if *out != "" {
+		if err := merged.Save(*out); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	var err error
+	switch *format {
+	case "":
+		if *player != "" {
+			printNeighbors(merged, *player, *mode, *top)
+		} else {
+			fmt.Printf("%d players, %d edges\n", len(merged.Players()), merged.Len())
+		}
+	case "graphml":
+		err = merged.WriteGraphML(os.Stdout)
+	case "csv":
+		err = merged.WriteCSV(os.Stdout)
+	case "communities":
+		printCommunities(merged, *minWeight)
+	default:
+		fmt.Printf("Unknown format [%s], expected graphml, csv or communities\n", *format)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/deahtstroke/protheon/internal/meta"
+)
+
+func main() {
+	out := flag.String("out", "", "Save the merged weapon meta to this file")
+	by := flag.String("by", "week,mode", "Break rows down by any of week, mode and light")
+	mode := flag.Int("mode", -1, "Only show rows of this mode, needs mode in --by")
+	weapon := flag.Int64("weapon", 0, "Only show rows of this weapon reference ID")
+	minUses := flag.Int64("min-uses", 0, "Only show weapons used at least this many times in a row's cell")
+	format := flag.String("format", "csv", "Output format: csv or json")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] meta.json...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var breakdown meta.Breakdown
+	for _, dimension := range strings.Split(*by, ",") {
+		switch strings.TrimSpace(dimension) {
+		case "week":
+			breakdown.Week = true
+		case "mode":
+			breakdown.Mode = true
+		case "light":
+			breakdown.Light = true
+		case "":
+		default:
+			fmt.Printf("Unknown dimension [%s], expected week, mode or light\n", dimension)
+			os.Exit(2)
+		}
+	}
+
+	if *mode >= 0 && !breakdown.Mode {
+		fmt.Println("--mode needs rows broken down by mode, add mode to --by")
+		os.Exit(2)
+	}
+
+	merged := meta.New()
+	for _, path := range flag.Args() {
+		m, err := meta.Load(path)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		merged.Merge(m)
+	}
+
+	if *out != "" {
+		if err := merged.Save(*out); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	var rows []meta.Row
+	for _, row := range merged.Rows(breakdown) {
+		if *mode >= 0 && row.Mode != int32(*mode) {
+			continue
+		}
+		if *weapon != 0 && row.WeaponReferenceID != *weapon {
+			continue
+		}
+		if row.Uses < *minUses {
+			continue
+		}
+		rows = append(rows, row)
+	}
+
+	switch *format {
+	case "csv":
+		if err := meta.WriteCSV(os.Stdout, rows); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(rows); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	default:
+		fmt.Printf("Unknown format [%s], expected csv or json\n", *format)
+		os.Exit(2)
+	}
+}
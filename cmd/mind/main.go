@@ -7,50 +7,157 @@ import (
 	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/deahtstroke/protheon/internal/api"
+	"github.com/deahtstroke/protheon/internal/auth"
+	bungie "github.com/deahtstroke/protheon/internal/bungie/types"
+	"github.com/deahtstroke/protheon/internal/certs"
+	"github.com/deahtstroke/protheon/internal/dedupe"
+	"github.com/deahtstroke/protheon/internal/handler"
+	"github.com/deahtstroke/protheon/internal/health"
+	"github.com/deahtstroke/protheon/internal/logging"
+	"github.com/deahtstroke/protheon/internal/metrics"
+	"github.com/deahtstroke/protheon/internal/rabbitmq"
+	_ "github.com/deahtstroke/protheon/internal/sink"
+	"github.com/deahtstroke/protheon/internal/tracing"
+	"github.com/deahtstroke/protheon/internal/validate"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
-type Job struct {
-	ID   int    `json:"id"`
-	Data string `json:"data"`
+var (
+	// errRevoked is returned for heartbeats the conductor refused because the
+	// worker's credential was revoked.
+	errRevoked = errors.New("Worker credential was revoked")
+
+	// errUnknownCredential is returned for heartbeats the conductor refused
+	// because it doesn't know the worker's credential, such as after it
+	// restarted without --auth-file. The worker registers again.
+	errUnknownCredential = errors.New("Conductor doesn't know the worker's credential")
+)
+
+// jobStats counts the PGCRs a mind acked, for its heartbeats.
+type jobStats struct {
+	done    atomic.Int64
+	lastJob atomic.Int64
+}
+
+func (s *jobStats) ack() {
+	s.done.Add(1)
+	s.lastJob.Store(time.Now().UnixNano())
+}
+
+func (s *jobStats) snapshot() (int, time.Time) {
+	var lastJob time.Time
+	if nanos := s.lastJob.Load(); nanos != 0 {
+		lastJob = time.Unix(0, nanos)
+	}
+	return int(s.done.Load()), lastJob
 }
 
-func sendHeartbeat(managerURL, workerID string, jobsDone int, lastJob time.Time, start time.Time) {
+func sendHeartbeat(ctx context.Context, client *http.Client, heartbeatURL, workerID, credential string, jobs *jobStats, start time.Time) error {
+	jobsDone, lastJob := jobs.snapshot()
 	hb := api.HeartbeatRequest{
 		ID:          workerID,
 		JobsDone:    jobsDone,
-		LastJobTime: time.Now(),
+		LastJobTime: lastJob,
 		Uptime:      time.Since(start).String(),
 	}
 
 	body, err := json.Marshal(hb)
-	resp, err := http.Post(managerURL+"/heartbeat", "application/json", bytes.NewBuffer(body))
 	if err != nil {
-		log.Printf("⚠️ heartbeat failed: %v", err)
-		return
+		return fmt.Errorf("Error encoding heartbeat: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, heartbeatURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("Error creating heartbeat request: %v", err)
 	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+credential)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Error sending heartbeat: %v", err)
+	}
+	defer resp.Body.Close()
 
-	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusGone:
+		return errRevoked
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return errUnknownCredential
+	default:
+		return fmt.Errorf("Heartbeat failed with status %d", resp.StatusCode)
+	}
 }
 
-func startHeartbeat(ctx context.Context, managerURL, workerID string, jobsDone *int, lastJob *time.Time, start *time.Time) {
-	ticker := time.NewTicker(5 * time.Second)
+// MAX_FAILED_HEARTBEATS is how many heartbeats in a row may fail before the
+// mind reports itself not ready, as the conductor soon counts it dead.
+const MAX_FAILED_HEARTBEATS = 3
+
+// startHeartbeat sends heartbeats every interval until ctx is done, or until
+// the conductor revokes the worker's credential, which it reports to revoked.
+// A conductor that forgot the credential gets the worker registered again
+// with reregister. The mind stays ready while heartbeats go through, and
+// turns not ready on registration after MAX_FAILED_HEARTBEATS failed in a
+// row, until one goes through again.
+func startHeartbeat(ctx context.Context, client *http.Client, heartbeatURL string, reg *api.RegisterResponse, interval time.Duration, jobs *jobStats, start time.Time, registration *health.Indicator, reregister func() (*api.RegisterResponse, error), revoked func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	failed := 0
 	for {
 		select {
 		case <-ctx.Done():
-			log.Println("Hearbeat shutting down...")
+			slog.Info("Heartbeat shutting down")
 			return
 		case <-ticker.C:
-			sendHeartbeat(managerURL, workerID, *jobsDone, *lastJob, *start)
+			err := sendHeartbeat(ctx, client, heartbeatURL, reg.ID, reg.Credential, jobs, start)
+			if errors.Is(err, errRevoked) {
+				revoked(err)
+				return
+			}
+			if errors.Is(err, errUnknownCredential) {
+				slog.Warn("Conductor doesn't know this worker, registering again")
+				next, rerr := reregister()
+				if rerr == nil {
+					slog.Info("Registered again with conductor", "new_worker_id", next.ID)
+					reg = next
+				}
+				err = rerr
+			}
+			if ctx.Err() != nil {
+				continue
+			}
+			if err != nil {
+				failed++
+				slog.Warn("Heartbeat failed", "failed", failed, "error", err)
+				if failed >= MAX_FAILED_HEARTBEATS {
+					registration.Down(fmt.Errorf("Error sending heartbeats, %d failed in a row: %v", failed, err))
+				}
+				continue
+			}
+			if failed >= MAX_FAILED_HEARTBEATS {
+				slog.Info("Heartbeats reach the conductor again", "failed", failed)
+			}
+			failed = 0
+			registration.Up()
 		}
 	}
 }
@@ -61,14 +168,14 @@ func dialWithRetry(ctx context.Context, url string, attempts int, backoff time.D
 	for i := range attempts {
 		select {
 		case <-ctx.Done():
-			log.Printf("Context cancelled, dialing cancelled...")
+			slog.Info("Context cancelled, dialing cancelled")
 			return nil, errors.New("Dialing cancelled")
 		default:
 			conn, err = amqp091.Dial(url)
 			if err == nil {
 				return conn, nil
 			}
-			log.Printf("amqp dial failed (attempt %d/%d): %v", i+1, attempts, err)
+			slog.Warn("AMQP dial failed", "attempt", i+1, "attempts", attempts, "error", err)
 			time.Sleep(backoff)
 			backoff *= 2
 		}
@@ -76,58 +183,220 @@ func dialWithRetry(ctx context.Context, url string, attempts int, backoff time.D
 	return nil, err
 }
 
-func register(serverAddr string) (*api.RegisterResponse, error) {
-	log.Printf("Registering with Conductor mind@[%s]...", serverAddr)
-	registerURL := fmt.Sprintf("http://%s:8080/mind/register", serverAddr)
+func register(client *http.Client, conductorURL, token string) (*api.RegisterResponse, error) {
+	slog.Info("Registering with conductor", "conductor", conductorURL)
+	registerURL := conductorURL + "/mind/register"
 	hostname, _ := os.Hostname()
 	os := runtime.GOOS
 	registerRequest := api.RegisterRequest{
 		Hostname: hostname,
 		OS:       os,
+		Token:    token,
 	}
 
 	data, err := json.Marshal(registerRequest)
 	if err != nil {
-		log.Fatalf("Failed to marshal register request: %v", err)
-		return nil, err
+		return nil, fmt.Errorf("Error encoding register request: %v", err)
 	}
-	resp, err := http.Post(registerURL, "application/json", bytes.NewBuffer(data))
+	resp, err := client.Post(registerURL, "application/json", bytes.NewBuffer(data))
 	if err != nil {
-		log.Fatalf("Failed to register with conductor: %v", err)
-		return nil, err
+		return nil, fmt.Errorf("Error reaching conductor [%s]: %v", registerURL, err)
 	}
 
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, errors.New("Conductor refused the join token, check --join-token or --tls-cert")
+	}
 	if resp.StatusCode != http.StatusOK {
-		log.Fatalf("Registration failed: status %d", resp.StatusCode)
-		return nil, err
+		return nil, fmt.Errorf("Registration failed with status %d", resp.StatusCode)
 	}
 
 	var regResp api.RegisterResponse
 	if err := json.NewDecoder(resp.Body).Decode(&regResp); err != nil {
-		log.Fatalf("Failed to decode response: %v", err)
-		return nil, err
+		return nil, fmt.Errorf("Error decoding registration response: %v", err)
 	}
 
 	return &regResp, nil
 }
 
-func DoJobs(ctx context.Context, serverAddr string) {
+// MAX_FLUSH_LINKS caps the deliveries a flush span links to, tracing
+// backends drop spans with too many links.
+const MAX_FLUSH_LINKS = 128
+
+// pendingDelivery is a delivery whose PGCR was written to sinks but not yet
+// flushed. written tracks which sinks accepted it, and span is its consumer
+// span, which the flush spans link to.
+type pendingDelivery struct {
+	delivery amqp091.Delivery
+	pgcr     *bungie.PGCR
+	written  []bool
+	span     trace.SpanContext
+}
+
+// namedSink is a sink with its type name, which labels its metrics.
+type namedSink struct {
+	handler.Sink
+	name string
+}
+
+// checkpoint flushes every sink and settles the pending deliveries. A
+// delivery is acked once its PGCR is durable in at least one sink, and
+// requeued otherwise.
+func checkpoint(ctx context.Context, h handler.Handler, sinks []namedSink, pending []pendingDelivery, m *metrics.Mind, jobs *jobStats) {
+	if len(pending) == 0 {
+		return
+	}
+
+	links := make([]trace.Link, 0, min(len(pending), MAX_FLUSH_LINKS))
+	for _, p := range pending[:min(len(pending), MAX_FLUSH_LINKS)] {
+		links = append(links, trace.Link{SpanContext: p.span})
+	}
+
+	flushed := make([]bool, len(sinks))
+	for i, s := range sinks {
+		flushCtx, span := tracing.Tracer().Start(ctx, "sink flush",
+			trace.WithNewRoot(),
+			trace.WithLinks(links...),
+			trace.WithAttributes(attribute.String("sink.name", s.name), attribute.Int("sink.pending", len(pending)),
+				attribute.Int("sink.unlinked", len(pending)-len(links))))
+		start := time.Now()
+		err := s.Flush(flushCtx)
+		m.SinkFlushDuration.WithLabelValues(s.name).Observe(time.Since(start).Seconds())
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			span.End()
+			m.SinkFlushErrors.WithLabelValues(s.name).Inc()
+			slog.ErrorContext(flushCtx, "Error flushing sink", "sink", i, "sink_name", s.name, "error", err)
+			continue
+		}
+		span.End()
+		flushed[i] = true
+	}
+
+	acked := 0
+	for _, p := range pending {
+		durable := false
+		for i := range sinks {
+			if p.written[i] && flushed[i] {
+				durable = true
+				break
+			}
+		}
+		if !durable {
+			h.Abandoned(p.pgcr)
+			p.delivery.Nack(false, true)
+			m.Nack(true)
+			continue
+		}
+		h.Processed(p.pgcr)
+		p.delivery.Ack(false)
+		m.Acked.Inc()
+		jobs.ack()
+		acked++
+	}
+	slog.Info("Checkpoint", "acked", acked, "requeued", len(pending)-acked)
+}
+
+// consume handles a delivery within a consumer span continuing the trace
+// from its headers, and writes its PGCR to every sink. It settles the
+// delivery itself, unless it returns it pending until the next checkpoint.
+func consume(ctx context.Context, queueName string, d amqp091.Delivery, h handler.Handler, sinks []namedSink, m *metrics.Mind, jobs *jobStats) (*pendingDelivery, bool) {
+	ctx = otel.GetTextMapPropagator().Extract(ctx, rabbitmq.HeaderCarrier(d.Headers))
+	ctx, span := tracing.Tracer().Start(ctx, queueName+" process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			semconv.MessagingSystemRabbitMQ,
+			semconv.MessagingDestinationName(queueName),
+			semconv.MessagingOperationTypeDeliver,
+			semconv.MessagingRabbitMQMessageDeliveryTag(int(d.DeliveryTag)),
+			attribute.Bool("messaging.rabbitmq.redelivered", d.Redelivered),
+		))
+	defer span.End()
+
+	m.Consumed.Inc()
+	if d.Redelivered {
+		m.Redelivered.Inc()
+	}
+
+	start := time.Now()
+	pgcr, err := h.Handle(ctx, d.Body)
+	m.HandleDuration.Observe(time.Since(start).Seconds())
+	if pgcr != nil {
+		ctx = logging.WithAttrs(ctx, logging.KeyInstanceID, pgcr.ActivityDetails.InstanceID.String())
+	}
+	if errors.Is(err, handler.ErrDuplicate) {
+		slog.DebugContext(ctx, "Skipping already processed PGCR", "redelivered", d.Redelivered)
+		span.SetAttributes(attribute.Bool("pgcr.duplicate", true))
+		d.Ack(false)
+		m.Acked.Inc()
+		jobs.ack()
+		return nil, false
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "Bad PGCR", "error", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		d.Nack(false, false)
+		m.Nack(false)
+		return nil, false
+	}
+	span.SetAttributes(attribute.String("pgcr.instance_id", pgcr.ActivityDetails.InstanceID.String()))
+	if len(sinks) == 0 {
+		h.Processed(pgcr)
+		d.Ack(false)
+		m.Acked.Inc()
+		jobs.ack()
+		return nil, false
+	}
+
+	p := &pendingDelivery{delivery: d, pgcr: pgcr, written: make([]bool, len(sinks)), span: span.SpanContext()}
+	accepted := false
+	for i, s := range sinks {
+		writeCtx, writeSpan := tracing.Tracer().Start(ctx, "sink write", trace.WithAttributes(attribute.String("sink.name", s.name)))
+		err := s.Write(writeCtx, []*bungie.PGCR{pgcr})
+		if err != nil {
+			writeSpan.RecordError(err)
+			writeSpan.SetStatus(codes.Error, err.Error())
+			writeSpan.End()
+			slog.ErrorContext(writeCtx, "Error writing PGCR to sink", "sink", i, "sink_name", s.name, "error", err)
+			continue
+		}
+		writeSpan.End()
+		p.written[i] = true
+		accepted = true
+	}
+	if !accepted {
+		span.SetStatus(codes.Error, "No sink accepted the PGCR")
+		h.Abandoned(pgcr)
+		d.Nack(false, true)
+		m.Nack(true)
+		return nil, false
+	}
+	return p, true
+}
+
+// DoJobs consumes PGCRs and writes them to sinks, acking them in batches once
+// the sinks flushed. A batch is flushed when it reaches batchSize, which is
+// also the channel's prefetch, or every flushInterval.
+// The consumer indicator is up while the mind is subscribed to the queue, and
+// jobs counts the acked PGCRs.
+func DoJobs(ctx context.Context, serverAddr, queueName string, h handler.Handler, sinks []namedSink, batchSize int, flushInterval time.Duration, m *metrics.Mind, consumer *health.Indicator, jobs *jobStats) {
 	rabbitURL := fmt.Sprintf("amqp://protheon:secretpassword@%s:5672/", serverAddr)
 	conn, err := dialWithRetry(ctx, rabbitURL, 5, 1*time.Second)
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal("Error connecting to RabbitMQ", "error", err)
 	}
 	defer conn.Close()
-	log.Printf("Connected to Host RabbitMQ!")
+	slog.Info("Connected to RabbitMQ", "server", serverAddr)
 
 	ch, err := conn.Channel()
 	if err != nil {
-		log.Fatalf("Channel open failed: %v", err)
+		logging.Fatal("Channel open failed", "error", err)
 	}
 	q, err := ch.QueueDeclare(
-		"pgcr_jobs",
+		queueName,
 		true,
 		false,
 		false,
@@ -135,12 +404,12 @@ func DoJobs(ctx context.Context, serverAddr string) {
 		nil)
 
 	if err != nil {
-		log.Fatalf("Queue declared failed: %v", err)
+		logging.Fatal("Queue declare failed", "error", err)
 	}
 
-	err = ch.Qos(5, 0, false)
+	err = ch.Qos(batchSize, 0, false)
 	if err != nil {
-		log.Fatalf("Error setting QoS for Rabbit channel: %v", err)
+		logging.Fatal("Error setting QoS for Rabbit channel", "error", err)
 	}
 	msgs, err := ch.ConsumeWithContext(
 		ctx,
@@ -152,53 +421,267 @@ func DoJobs(ctx context.Context, serverAddr string) {
 		false,
 		nil)
 	if err != nil {
-		log.Fatalf("Consume failed: %v", err)
+		logging.Fatal("Consume failed", "error", err)
 	}
+	consumer.Up()
+	defer consumer.Down(errors.New("Worker stopped"))
+
+	flushTicker := time.NewTicker(flushInterval)
+	defer flushTicker.Stop()
 
-	log.Println("Worker started. Press Ctrl+C to stop gracefully.")
+	var pending []pendingDelivery
+
+	slog.Info("Worker started, press Ctrl+C to stop gracefully", "queue", q.Name, "batch_size", batchSize)
 	for {
 		select {
 		case <-ctx.Done():
-			log.Print("Worker shutting down...")
+			slog.Info("Worker shutting down")
+			checkpoint(context.Background(), h, sinks, pending, m, jobs)
 			return
+		case <-flushTicker.C:
+			checkpoint(ctx, h, sinks, pending, m, jobs)
+			pending = pending[:0]
 		case d, ok := <-msgs:
 			if !ok {
-				log.Printf("Msgs channel is closed, retrying...")
+				consumer.Down(errors.New("Consumer channel is closed"))
+				slog.Warn("Msgs channel is closed, retrying")
 				time.Sleep(2 * time.Second)
 				continue
 			}
-			var job Job
-			if err := json.Unmarshal(d.Body, &job); err != nil {
-				log.Printf("Bad job json: %v", err)
+			p, ok := consume(ctx, q.Name, d, h, sinks, m, jobs)
+			if !ok {
 				continue
 			}
-			d.Ack(false)
-			log.Printf("Job %+v done", job)
+
+			pending = append(pending, *p)
+			if len(pending) >= batchSize {
+				checkpoint(ctx, h, sinks, pending, m, jobs)
+				pending = pending[:0]
+			}
 		}
 	}
 }
 
+// sinkFlags collects repeated --sink flags.
+type sinkFlags []string
+
+func (f *sinkFlags) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *sinkFlags) Set(spec string) error {
+	*f = append(*f, spec)
+	return nil
+}
+
+// requireKey refuses requests without a bearer key in keyring.
+func requireKey(keyring *auth.Keyring, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := keyring.Authenticate(auth.BearerToken(r.Header.Get("Authorization"))); !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Missing or unknown key", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
 func main() {
 	serverAddr := flag.String("server-addr", "", "Server URL")
+	useTLS := flag.Bool("tls", false, "Reach the conductor over TLS, implied by the other --tls flags")
+	tlsCA := flag.String("tls-ca", "", "CA bundle verifying the conductor's certificate, such as the built-in CA's ca.crt, defaults to the system's")
+	tlsCert := flag.String("tls-cert", "", "Client certificate identifying this mind to the conductor, reloaded when it changes")
+	tlsKey := flag.String("tls-key", "", "Key file of --tls-cert")
+	joinToken := flag.String("join-token", os.Getenv("PROTHEON_JOIN_TOKEN"), "Join token or shared secret to register with, defaults to PROTHEON_JOIN_TOKEN")
+	seenFile := flag.String("seen-file", "", "File persisting the instance IDs already processed by this mind")
+	validateRules := flag.String("validate", "", "Validate PGCRs, with optional rule overrides such as \"player-count-mismatch=error,no-entries=off\"")
+	noValidate := flag.Bool("no-validate", false, "Skip PGCR validation")
+	var sinkSpecs sinkFlags
+	flag.Var(&sinkSpecs, "sink", fmt.Sprintf("Write processed PGCRs to a sink such as \"parquet:dir=/data/parquet\", can be repeated (sinks: %s)", strings.Join(handler.SinkNames(), ", ")))
+	batchSize := flag.Int("batch-size", 500, "Flush sinks and ack once this many PGCRs are pending")
+	flushInterval := flag.Duration("flush-interval", 30*time.Second, "Flush sinks and ack pending PGCRs at least this often")
+	metricsAddr := flag.String("metrics-addr", ":9091", "Address serving Prometheus metrics on /metrics, probes on /healthz and /readyz, and /log/level, empty to disable")
+	logLevelKey := flag.String("log-level-key", os.Getenv("PROTHEON_LOG_LEVEL_KEY"), "Bearer key required to change the log level on /log/level, which is read-only without one, defaults to PROTHEON_LOG_LEVEL_KEY")
+	traceExporter := flag.String("trace-exporter", tracing.ExporterNone, "Where to send trace spans: none, stdout or otlp")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "host:port of the OTLP/HTTP collector, defaults to localhost:4318 or OTEL_EXPORTER_OTLP_ENDPOINT")
+	otlpInsecure := flag.Bool("otlp-insecure", false, "Send OTLP spans over plain HTTP")
+	traceSampleRatio := tracing.SampleRatio(1)
+	flag.Var(&traceSampleRatio, "trace-sample-ratio", "Fraction of new traces recorded, from 0 for none to 1 for all")
+	logFormat := flag.String("log-format", logging.FormatText, "Log format: text or json")
+	logLevel := flag.String("log-level", "info", "Log level: debug, info, warn or error, can be changed at runtime on the metrics listener's /log/level with --log-level-key")
+	logSampleFirst := flag.Int("log-sample-first", 100, "Log the first this many info and debug records with the same message every second, 0 to disable sampling")
+	logSampleThereafter := flag.Int("log-sample-thereafter", 100, "After --log-sample-first, log one in every this many records with the same message")
 	flag.Parse()
+
+	level, err := logging.Setup(os.Stderr, logging.Config{
+		Format:           *logFormat,
+		Level:            *logLevel,
+		SampleFirst:      *logSampleFirst,
+		SampleThereafter: *logSampleThereafter,
+		SampleInterval:   time.Second,
+	})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
+
+	shutdownTracing, err := tracing.Setup(ctx, tracing.Config{
+		Service:     "protheon-mind",
+		Exporter:    *traceExporter,
+		Endpoint:    *otlpEndpoint,
+		Insecure:    *otlpInsecure,
+		SampleRatio: float64(traceSampleRatio),
+	})
+	if err != nil {
+		logging.Fatal("Error setting up tracing", "error", err)
+	}
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(shutdownCtx); err != nil {
+			slog.Error("Error flushing trace spans", "error", err)
+		}
+	}()
 	start := time.Now()
 
 	if *serverAddr == "" {
-		fmt.Println("Unknown server url, use --server-addr")
-		os.Exit(1)
+		logging.Fatal("Unknown server url, use --server-addr")
 	}
+	if *batchSize <= 0 {
+		logging.Fatal("--batch-size must be positive")
+	}
+
+	checker := health.NewChecker()
+	registration := health.NewIndicator("Not registered with the conductor yet")
+	consumer := health.NewIndicator("Not subscribed to the queue yet")
+	checker.Add("registration", registration.Check)
+	checker.Add("consumer", consumer.Check)
 
-	resp, err := register(*serverAddr)
+	mindMetrics := metrics.NewMind(prometheus.DefaultRegisterer)
+	var metricsServer *http.Server
+	if *metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		mux.HandleFunc("GET /log/level", logging.LevelHandler(level))
+		if *logLevelKey != "" {
+			// The metrics listener has no other authentication, so changing
+			// the level takes its own key.
+			keyring := auth.NewKeyring()
+			if err := keyring.Add("log-level-key", auth.RoleOperator, *logLevelKey); err != nil {
+				logging.Fatal("Error adding log level key", "error", err)
+			}
+			mux.HandleFunc("PUT /log/level", requireKey(keyring, logging.LevelHandler(level)))
+		}
+		mux.HandleFunc("GET /healthz", checker.Liveness)
+		mux.HandleFunc("GET /readyz", checker.Readiness)
+		metricsServer = &http.Server{Addr: *metricsAddr, Handler: mux}
+		go func() {
+			if err := metricsServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("Metrics server failed", "error", err)
+			}
+		}()
+		slog.Info("Serving metrics", "addr", *metricsAddr)
+	}
+
+	client := http.DefaultClient
+	conductorURL := fmt.Sprintf("http://%s:8080", *serverAddr)
+	if *useTLS || *tlsCA != "" || *tlsCert != "" || *tlsKey != "" {
+		var reloader *certs.Reloader
+		if *tlsCert != "" || *tlsKey != "" {
+			reloader, err = certs.NewReloader(*tlsCert, *tlsKey)
+			if err != nil {
+				logging.Fatal("Error loading client certificate", "error", err)
+			}
+			go reloader.Watch(ctx, certs.DEFAULT_RELOAD_INTERVAL)
+			checker.Add("tls_certificate", reloader.Check)
+		}
+		tlsConfig, err := certs.ClientConfig(*tlsCA, reloader)
+		if err != nil {
+			logging.Fatal("Error configuring TLS", "error", err)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		client = &http.Client{Transport: transport}
+		conductorURL = fmt.Sprintf("https://%s:8080", *serverAddr)
+	}
+
+	resp, err := register(client, conductorURL, *joinToken)
 	if err != nil {
-		fmt.Printf("Error register worker: %v", err)
-		os.Exit(1)
+		logging.Fatal("Error registering worker", "error", err)
+	}
+	slog.SetDefault(slog.Default().With(logging.KeyWorkerID, resp.ID))
+	slog.Info("Registered with conductor", "queue", resp.QueueName)
+	registration.Up()
+
+	seen, err := dedupe.Open(*seenFile)
+	if err != nil {
+		logging.Fatal("Error opening seen store", "error", err)
+	}
+
+	var validator *validate.Validator
+	if !*noValidate {
+		rules, err := validate.ParseRules(*validateRules)
+		if err != nil {
+			logging.Fatal("Error parsing validation rules", "error", err)
+		}
+		validator = validate.NewValidator(rules)
+	}
+
+	var sinks []namedSink
+	for _, spec := range sinkSpecs {
+		name, _, err := handler.ParseSinkSpec(spec)
+		if err != nil {
+			logging.Fatal("Error opening sink", "sink", spec, "error", err)
+		}
+		s, err := handler.OpenSink(ctx, spec)
+		if err != nil {
+			logging.Fatal("Error opening sink", "sink", spec, "error", err)
+		}
+		sinks = append(sinks, namedSink{Sink: s, name: name})
+	}
+
+	go seen.SaveEvery(ctx, 30*time.Second)
+
+	heartbeatInterval := time.Duration(resp.HeartbeatInterval) * time.Second
+	if heartbeatInterval <= 0 {
+		heartbeatInterval = api.HEARTBEAT_INTERVAL * time.Second
+	}
+	jobs := &jobStats{}
+	reregister := func() (*api.RegisterResponse, error) {
+		return register(client, conductorURL, *joinToken)
 	}
+	go startHeartbeat(ctx, client, conductorURL+"/mind/heartbeat", resp, heartbeatInterval, jobs, start, registration, reregister, func(err error) {
+		registration.Down(err)
+		slog.Error("Conductor revoked this worker, shutting down", "error", err)
+		stop()
+	})
 
-	go startHeartbeat(ctx, fmt.Sprintf("%s:8080", *serverAddr), resp.ID, nil, nil, &start)
-	go DoJobs(ctx, *serverAddr)
+	done := make(chan struct{})
+	go func() {
+		DoJobs(ctx, *serverAddr, resp.QueueName, handler.NewPgcrHandler(seen, validator), sinks, *batchSize, *flushInterval, mindMetrics, consumer, jobs)
+		close(done)
+	}()
 
 	<-ctx.Done()
-	log.Printf("Shutting down worker gracefully")
+	slog.Info("Shutting down worker gracefully")
+	<-done
+
+	if metricsServer != nil {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		metricsServer.Shutdown(shutdownCtx)
+		cancel()
+	}
+
+	for _, s := range sinks {
+		if err := s.Close(); err != nil {
+			slog.Error("Error closing sink", "sink_name", s.name, "error", err)
+		}
+	}
+
+	if err := seen.Save(); err != nil {
+		slog.Error("Error saving seen store", "error", err)
+	}
 }
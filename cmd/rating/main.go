@@ -0,0 +1,155 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/deahtstroke/protheon/internal/rating"
+)
+
+// matchLogs expands directories into the match logs under them.
+func matchLogs(paths []string) ([]string, error) {
+	var logs []string
+	for _, path := range paths {
+		err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() && strings.HasSuffix(p, ".jsonl.zst") && !strings.HasPrefix(d.Name(), ".") {
+				logs = append(logs, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return logs, nil
+}
+
+func printLeaderboard(engine *rating.Engine, mode int32, minMatches int64, top int) {
+	standings := engine.Leaderboard(mode, minMatches)
+	if top > 0 && len(standings) > top {
+		standings = standings[:top]
+	}
+
+	fmt.Printf("Mode %d\n", mode)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "RANK\tPLAYER\tRATING\tDEVIATION\tCONSERVATIVE\tMATCHES\tLAST PLAYED")
+	for i, s := range standings {
+		fmt.Fprintf(w, "%d\t%s\t%.0f\t%.0f\t%.0f\t%d\t%s\n", i+1, s.MembershipID, s.Rating.Rating, s.Deviation,
+			s.Conservative(), s.Matches, s.LastPlayed.UTC().Format(time.DateOnly))
+	}
+	w.Flush()
+	fmt.Println()
+}
+
+func main() {
+	snapshot := flag.String("snapshot", "", "Continue from the ratings saved in this file, and save them back")
+	rebuild := flag.Bool("rebuild", false, "Ignore the snapshot and replay every match from scratch")
+	history := flag.String("history", "", "Write the rating changes of this run as CSV to this file")
+	mode := flag.Int("mode", -1, "Only rate and show this playlist mode")
+	window := flag.Duration("window", rating.DEFAULT_WINDOW, "How long matches are held back for matches logged late, saved with --snapshot")
+	minMatches := flag.Int64("min-matches", 10, "Leave players with fewer matches off the leaderboard")
+	top := flag.Int("top", 25, "Number of players to show per mode")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] match-log-or-dir...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if *mode >= 0 && *snapshot != "" {
+		// The snapshot records the logs it rated, rating one mode would skip
+		// the other modes' matches in those logs for good.
+		fmt.Println("--mode can't be combined with --snapshot")
+		os.Exit(2)
+	}
+
+	engine := rating.NewEngine()
+	if *snapshot != "" && !*rebuild {
+		var err error
+		if engine, err = rating.Load(*snapshot); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	engine.RecordHistory = *history != ""
+	engine.Window = *window
+
+	logs, err := matchLogs(flag.Args())
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	// Logs are only renamed into place once complete, and named uniquely,
+	// so a log rated by an earlier run has nothing new.
+	var matches []rating.Match
+	read := 0
+	for _, path := range logs {
+		name := filepath.Base(path)
+		if engine.SeenLog(name) {
+			continue
+		}
+		m, err := rating.ReadMatches(path)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		matches = append(matches, m...)
+		engine.AddLog(name)
+		read++
+	}
+	if *mode >= 0 {
+		matches = rating.PartitionByMode(matches)[int32(*mode)]
+	}
+
+	before := engine.Rated()
+	late := engine.Replay(matches)
+	if *snapshot == "" {
+		// Nothing continues from this run, so nothing waits for late matches.
+		engine.Flush()
+	}
+	fmt.Printf("Rated %d new matches from %d new logs, %d matches were already rated or too late, %d are held back\n\n",
+		engine.Rated()-before, read, late, engine.Pending())
+
+	if *history != "" {
+		file, err := os.Create(*history)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		err = rating.WriteHistoryCSV(file, engine.History())
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	if *snapshot != "" {
+		if err := engine.Save(*snapshot); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	for _, m := range engine.Modes() {
+		if *mode >= 0 && m != int32(*mode) {
+			continue
+		}
+		printLeaderboard(engine, m, *minMatches, *top)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	bungie "github.com/deahtstroke/protheon/internal/bungie/types"
+	"github.com/deahtstroke/protheon/internal/producer"
+	"github.com/deahtstroke/protheon/internal/validate"
+	"github.com/klauspost/compress/zstd"
+)
+
+type report struct {
+	Files      int                       `json:"files"`
+	Validated  int64                     `json:"validated"`
+	Malformed  int64                     `json:"malformed"`
+	Failing    int64                     `json:"failing"`
+	Histogram  []validate.HistogramEntry `json:"histogram"`
+	Violations []lineViolation           `json:"violations,omitempty"`
+}
+
+type lineViolation struct {
+	Source string `json:"source"`
+	Line   int64  `json:"line"`
+	validate.Violation
+}
+
+func validateFile(path string, validator *validate.Validator, failOn validate.Severity, show int, r *report) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Error opening source [%s]: %v", path, err)
+	}
+	defer file.Close()
+
+	decoder, err := zstd.NewReader(bufio.NewReader(file))
+	if err != nil {
+		return fmt.Errorf("Error creating ZSTD reader for source [%s]: %v", path, err)
+	}
+	defer decoder.Close()
+
+	scanner := bufio.NewScanner(decoder)
+	scanner.Buffer(make([]byte, 1024*1024), producer.MAX_CAPACITY)
+
+	var line int64
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var pgcr bungie.PGCR
+		if err := json.Unmarshal(scanner.Bytes(), &pgcr); err != nil {
+			r.Malformed++
+			continue
+		}
+
+		violations := validator.Validate(&pgcr)
+		if validate.Err(violations, failOn) != nil {
+			r.Failing++
+		}
+		for _, violation := range violations {
+			if len(r.Violations) >= show {
+				break
+			}
+			r.Violations = append(r.Violations, lineViolation{Source: path, Line: line, Violation: violation})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("Error reading source [%s] at line %d: %v", path, line+1, err)
+	}
+	return nil
+}
+
+func printReport(r *report) {
+	for _, v := range r.Violations {
+		fmt.Printf("%s:%d: %s\n", v.Source, v.Line, v.Violation)
+	}
+	if len(r.Violations) > 0 {
+		fmt.Println()
+	}
+
+	fmt.Printf("Validated %d PGCRs from %d files, %d malformed, %d failing\n\n", r.Validated, r.Files, r.Malformed, r.Failing)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "RULE\tSEVERITY\tVIOLATIONS")
+	for _, entry := range r.Histogram {
+		fmt.Fprintf(w, "%s\t%s\t%d\n", entry.Rule, entry.Severity, entry.Count)
+	}
+	w.Flush()
+}
+
+func main() {
+	rulesSpec := flag.String("rules", "", "Rule overrides such as \"player-count-mismatch=error,no-entries=off\"")
+	failOnFlag := flag.String("fail-on", "error", "Lowest severity that makes a PGCR count as failing: info, warning or error")
+	show := flag.Int("show", 20, "Number of individual violations to print")
+	asJSON := flag.Bool("json", false, "Print the report as JSON")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] dump.zst...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	rules, err := validate.ParseRules(*rulesSpec)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	failOn, err := validate.ParseSeverity(*failOnFlag)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
+	validator := validate.NewValidator(rules)
+	r := &report{}
+	for _, path := range flag.Args() {
+		if err := validateFile(path, validator, failOn, *show, r); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		r.Files++
+	}
+	r.Histogram, r.Validated = validator.Histogram()
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(r)
+	} else {
+		printReport(r)
+	}
+
+	if r.Failing > 0 || r.Malformed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,177 @@
+package anomaly
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	bungie "github.com/deahtstroke/protheon/internal/bungie/types"
+)
+
+func TestSketchQuantiles(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	a, b := NewSketch(DEFAULT_SKETCH_ACCURACY), NewSketch(DEFAULT_SKETCH_ACCURACY)
+	var values []float64
+	for i := 0; i < 20000; i++ {
+		v := r.ExpFloat64() * 3
+		values = append(values, v)
+		if i%2 == 0 {
+			a.Add(v)
+		} else {
+			b.Add(v)
+		}
+	}
+	a.Merge(b)
+	sort.Float64s(values)
+
+	if a.Count() != int64(len(values)) {
+		t.Fatalf("Expected %d values, got %d", len(values), a.Count())
+	}
+	for _, q := range []float64{0.001, 0.5, 0.99, 0.999} {
+		exact := values[int(q*float64(len(values)-1))]
+		got := a.Quantile(q)
+		if math.Abs(got-exact)/exact > DEFAULT_SKETCH_ACCURACY*1.01 {
+			t.Fatalf("Quantile %.3f: expected about %.4f, got %.4f", q, exact, got)
+		}
+	}
+}
+
+func entry(id string, kills, precision, played, duration float64) bungie.Entry {
+	e := bungie.Entry{CharacterID: id}
+	e.Player.DestinyUserInfo.MembershipID = json.Number("4611686018" + id)
+	e.Values.Kills = kills
+	e.Values.Efficiency = kills / 10
+	e.Values.TimePlayedSeconds = played
+	e.Values.ActivityDuration = duration
+	e.Values.Completed = 1
+	e.Extended.Values.PrecisionKills = precision
+	return e
+}
+
+func pvp(instance string, entries ...bungie.Entry) *bungie.PGCR {
+	return &bungie.PGCR{
+		Period:          time.Date(2024, 7, 3, 20, 0, 0, 0, time.UTC),
+		ActivityDetails: bungie.ActivityDetails{InstanceID: json.Number(instance), Mode: "5"},
+		Entries:         entries,
+	}
+}
+
+func rules(flags []Flag) map[string]bool {
+	found := make(map[string]bool)
+	for _, f := range flags {
+		found[f.Rule] = true
+	}
+	return found
+}
+
+func TestDetectorFlagsOutliers(t *testing.T) {
+	d := NewDetector()
+	d.MinSamples = 100
+	r := rand.New(rand.NewSource(2))
+	for i := 0; i < 300; i++ {
+		kills := 10 + float64(r.Intn(15))
+		if flags := d.Check(pvp("1", entry("1", kills, kills/3, 600, 600))); len(flags) > 0 {
+			t.Fatalf("Expected ordinary entries not to be flagged, got %+v", flags)
+		}
+	}
+
+	flags := d.Check(pvp("2",
+		entry("1", 200, 20, 600, 600),
+		entry("2", 40, 40, 600, 600),
+		entry("3", 12, 4, 900, 600),
+	))
+	found := rules(flags)
+	for _, rule := range []string{RuleKillsPerMinute, RuleEfficiency, RulePrecision, RuleTimePlayed} {
+		if !found[rule] {
+			t.Fatalf("Expected a %s flag, got %+v", rule, flags)
+		}
+	}
+	for _, f := range flags {
+		if f.Score < 1 {
+			t.Fatalf("Expected flags to score at least 1, got %+v", f)
+		}
+	}
+
+	// Outliers were checked before they were added, and are far too few to
+	// move the quantile.
+	if again := d.Check(pvp("3", entry("1", 200, 20, 600, 600))); !rules(again)[RuleKillsPerMinute] {
+		t.Fatalf("Expected the outlier to still be flagged, got %+v", again)
+	}
+}
+
+func TestDetectorWarmsUp(t *testing.T) {
+	d := NewDetector()
+	flags := d.Check(pvp("1", entry("1", 200, 20, 600, 600)))
+	if rules(flags)[RuleKillsPerMinute] {
+		t.Fatalf("Expected no distribution based flags before MinSamples values, got %+v", flags)
+	}
+}
+
+func TestSketchesRoundTrip(t *testing.T) {
+	d := NewDetector()
+	for i := 0; i < 50; i++ {
+		d.Check(pvp("1", entry("1", float64(10+i%5), 3, 600, 600)))
+	}
+	path := filepath.Join(t.TempDir(), "sketches.json")
+	if err := d.SaveSketches(path); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewDetector()
+	if err := loaded.LoadSketches(path); err != nil {
+		t.Fatal(err)
+	}
+	k := key{Metric: RuleKillsPerMinute, Mode: 5}
+	if loaded.sketch(k).Count() != 50 || loaded.sketch(k).Quantile(0.5) != d.sketch(k).Quantile(0.5) {
+		t.Fatalf("Expected the loaded sketch to match the saved one")
+	}
+}
+
+func TestMinClearSecondsPerActivity(t *testing.T) {
+	raid := func(activity string, duration float64) *bungie.PGCR {
+		pgcr := pvp("1", entry("1", 100, 30, duration, duration))
+		pgcr.ActivityDetails.Mode = "4"
+		pgcr.ActivityDetails.DirectorActivityHash = json.Number(activity)
+		pgcr.ActivityWasStartedFromBeginning = true
+		return pgcr
+	}
+
+	d := NewDetector()
+	d.MinClearSeconds = map[string]float64{"100": 1200}
+	if flags := d.Check(raid("100", 900)); !rules(flags)[RuleClearDuration] {
+		t.Fatalf("Expected a clear under the activity's floor to be flagged, got %+v", flags)
+	}
+	if flags := d.Check(raid("200", 900)); rules(flags)[RuleClearDuration] {
+		t.Fatalf("Expected other activities to keep the default floor, got %+v", flags)
+	}
+
+	path := filepath.Join(t.TempDir(), "min-clears.json")
+	if err := os.WriteFile(path, []byte(`{"100": 1200, "200": 60}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	floors, err := LoadMinClears(path)
+	if err != nil {
+		t.Fatalf("Error loading minimum clear times: %v", err)
+	}
+	if floors["100"] != 1200 || floors["200"] != 60 {
+		t.Fatalf("Expected the loaded floors, got %v", floors)
+	}
+}
+
+func TestInspectDoesNotObserve(t *testing.T) {
+	d := NewDetector()
+	_, observations := d.Inspect(pvp("1", entry("1", 10, 3, 600, 600)))
+	k := key{Metric: RuleKillsPerMinute, Mode: 5}
+	if d.sketch(k).Count() != 0 {
+		t.Fatalf("Expected Inspect to leave the distributions alone")
+	}
+	d.Observe(observations)
+	if d.sketch(k).Count() != 1 {
+		t.Fatalf("Expected Observe to add the value, got %d", d.sketch(k).Count())
+	}
+}
@@ -0,0 +1,345 @@
+package anomaly
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/deahtstroke/protheon/internal/atomicfile"
+	bungie "github.com/deahtstroke/protheon/internal/bungie/types"
+	"github.com/deahtstroke/protheon/internal/clears"
+)
+
+const (
+	DEFAULT_QUANTILE    = 0.999
+	DEFAULT_FACTOR      = 1.5
+	DEFAULT_MIN_SAMPLES = 500
+
+	// MIN_TIME_PLAYED keeps players who only played a few seconds out of the
+	// rate based rules, where a single kill is an absurd rate.
+	MIN_TIME_PLAYED = 120
+
+	// MIN_PRECISION_KILLS is how many kills a precision ratio needs before it
+	// means anything, and PRECISION_RATIO_LIMIT the ratio flagged regardless
+	// of the mode's distribution.
+	MIN_PRECISION_KILLS   = 25
+	PRECISION_RATIO_LIMIT = 0.95
+
+	// MIN_CLEAR_SECONDS is the fastest full clear flagged regardless of the
+	// activity's distribution, for activities without a floor of their own
+	// in Detector.MinClearSeconds.
+	MIN_CLEAR_SECONDS = 300
+
+	// TIME_PLAYED_SLACK is how far time played may run past the activity's
+	// duration before it is flagged, the two aren't measured identically.
+	TIME_PLAYED_SLACK = 60
+
+	SKETCHES_VERSION = 1
+)
+
+const (
+	RuleKillsPerMinute = "kills-per-minute"
+	RulePrecision      = "precision-ratio"
+	RuleEfficiency     = "efficiency"
+	RuleClearDuration  = "clear-duration"
+	RuleTimePlayed     = "time-played"
+)
+
+// Flag is one implausible entry. Score is how far past its threshold the
+// value is, 1 being right at it, so flags of different rules rank together.
+type Flag struct {
+	InstanceID   string    `json:"instanceId"`
+	Period       time.Time `json:"period"`
+	Mode         int32     `json:"mode"`
+	MembershipID string    `json:"membershipId"`
+	CharacterID  string    `json:"characterId"`
+	Rule         string    `json:"rule"`
+	Value        float64   `json:"value"`
+	Threshold    float64   `json:"threshold"`
+	Score        float64   `json:"score"`
+	Reason       string    `json:"reason"`
+}
+
+// key identifies a distribution: a metric in a mode, and for clear durations
+// in one activity, since raids and dungeons take very different times.
+type key struct {
+	Metric   string `json:"metric"`
+	Mode     int32  `json:"mode"`
+	Activity string `json:"activity,omitempty"`
+}
+
+// Detector flags entries whose stats are implausible next to the
+// distribution of earlier entries of the same mode, which it keeps in
+// streaming quantile sketches. Distributions only judge once they have
+// MinSamples values, fixed limits apply from the start. It is safe for
+// concurrent use.
+type Detector struct {
+	// Entries above the Quantile of their distribution times Factor are
+	// flagged, or below the low quantile divided by Factor for durations.
+	Quantile   float64
+	Factor     float64
+	MinSamples int64
+
+	// MinClearSeconds holds the fastest full clear flagged regardless of the
+	// distribution, by director activity hash, as loaded by LoadMinClears.
+	MinClearSeconds map[string]float64
+
+	mu       sync.Mutex
+	sketches map[key]*Sketch
+}
+
+func NewDetector() *Detector {
+	return &Detector{
+		Quantile:   DEFAULT_QUANTILE,
+		Factor:     DEFAULT_FACTOR,
+		MinSamples: DEFAULT_MIN_SAMPLES,
+		sketches:   make(map[key]*Sketch),
+	}
+}
+
+func (d *Detector) sketch(k key) *Sketch {
+	s, ok := d.sketches[k]
+	if !ok {
+		s = NewSketch(DEFAULT_SKETCH_ACCURACY)
+		d.sketches[k] = s
+	}
+	return s
+}
+
+// high returns the upper threshold of a distribution, or false while it has
+// too few values.
+func (d *Detector) high(k key) (float64, bool) {
+	s := d.sketch(k)
+	if s.Count() < d.MinSamples {
+		return 0, false
+	}
+	return s.Quantile(d.Quantile) * d.Factor, true
+}
+
+func (d *Detector) low(k key) (float64, bool) {
+	s := d.sketch(k)
+	if s.Count() < d.MinSamples {
+		return 0, false
+	}
+	return s.Quantile(1-d.Quantile) / d.Factor, true
+}
+
+// Observation is a value Inspect found, which Observe adds to its
+// distribution.
+type Observation struct {
+	k     key
+	value float64
+}
+
+// Check flags the PGCR's implausible entries, then adds the PGCR's values to
+// the distributions, so an entry never raises its own threshold.
+func (d *Detector) Check(pgcr *bungie.PGCR) []Flag {
+	flags, observations := d.Inspect(pgcr)
+	d.Observe(observations)
+	return flags
+}
+
+// Observe adds the values of inspected PGCRs to their distributions.
+func (d *Detector) Observe(observations []Observation) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, o := range observations {
+		d.sketch(o.k).Add(o.value)
+	}
+}
+
+// Inspect flags the PGCR's implausible entries, and returns its values
+// without adding them to the distributions yet, such as until the flags are
+// stored.
+func (d *Detector) Inspect(pgcr *bungie.PGCR) ([]Flag, []Observation) {
+	mode := int32(0)
+	if n, err := strconv.ParseInt(pgcr.ActivityDetails.Mode.String(), 10, 32); err == nil {
+		mode = int32(n)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var flags []Flag
+	flag := func(entry bungie.Entry, rule string, value, threshold, score float64, reason string) {
+		flags = append(flags, Flag{
+			InstanceID:   pgcr.ActivityDetails.InstanceID.String(),
+			Period:       pgcr.Period,
+			Mode:         mode,
+			MembershipID: entry.Player.DestinyUserInfo.MembershipID.String(),
+			CharacterID:  entry.CharacterID,
+			Rule:         rule,
+			Value:        value,
+			Threshold:    threshold,
+			Score:        score,
+			Reason:       reason,
+		})
+	}
+
+	var observations []Observation
+
+	for _, entry := range pgcr.Entries {
+		values := entry.Values
+		played := values.TimePlayedSeconds
+
+		if values.ActivityDuration > 0 && played > values.ActivityDuration+TIME_PLAYED_SLACK {
+			flag(entry, RuleTimePlayed, played, values.ActivityDuration, played/values.ActivityDuration,
+				fmt.Sprintf("played %.0fs of a %.0fs activity", played, values.ActivityDuration))
+		}
+
+		if played < MIN_TIME_PLAYED {
+			continue
+		}
+
+		kpm := values.Kills / (played / 60)
+		k := key{Metric: RuleKillsPerMinute, Mode: mode}
+		if threshold, ok := d.high(k); ok && threshold > 0 && kpm > threshold {
+			flag(entry, RuleKillsPerMinute, kpm, threshold, kpm/threshold,
+				fmt.Sprintf("%.2f kills per minute, mode's %.1f%% quantile is %.2f", kpm, d.Quantile*100, threshold/d.Factor))
+		}
+		observations = append(observations, Observation{k, kpm})
+
+		k = key{Metric: RuleEfficiency, Mode: mode}
+		if threshold, ok := d.high(k); ok && threshold > 0 && values.Efficiency > threshold {
+			flag(entry, RuleEfficiency, values.Efficiency, threshold, values.Efficiency/threshold,
+				fmt.Sprintf("efficiency of %.2f, mode's %.1f%% quantile is %.2f", values.Efficiency, d.Quantile*100, threshold/d.Factor))
+		}
+		observations = append(observations, Observation{k, values.Efficiency})
+
+		kills := values.Kills
+		if kills >= MIN_PRECISION_KILLS {
+			ratio := entry.Extended.Values.PrecisionKills / kills
+			k = key{Metric: RulePrecision, Mode: mode}
+			threshold := PRECISION_RATIO_LIMIT
+			if q, ok := d.high(k); ok {
+				threshold = math.Max(threshold, math.Min(q/d.Factor, 1))
+			}
+			if ratio >= threshold {
+				flag(entry, RulePrecision, ratio, threshold, ratio/threshold,
+					fmt.Sprintf("%.0f%% of %.0f kills were precision kills", ratio*100, kills))
+			}
+			observations = append(observations, Observation{k, ratio})
+		}
+	}
+
+	if c, ok := clears.Classify(pgcr); ok && c.FullClear {
+		duration := 0.0
+		for _, entry := range pgcr.Entries {
+			duration = math.Max(duration, entry.Values.ActivityDuration)
+		}
+		activity := pgcr.ActivityDetails.DirectorActivityHash.String()
+		k := key{Metric: RuleClearDuration, Mode: mode, Activity: activity}
+		threshold, ok := d.MinClearSeconds[activity]
+		if !ok {
+			threshold = MIN_CLEAR_SECONDS
+		}
+		if low, ok := d.low(k); ok {
+			threshold = math.Max(threshold, low)
+		}
+		if duration > 0 && duration < threshold {
+			for _, entry := range pgcr.Entries {
+				if entry.Values.Completed == 1 {
+					flag(entry, RuleClearDuration, duration, threshold, threshold/duration,
+						fmt.Sprintf("full %s clear in %.0fs", c.Kind, duration))
+				}
+			}
+		}
+		if duration > 0 {
+			observations = append(observations, Observation{k, duration})
+		}
+	}
+
+	return flags, observations
+}
+
+type sketchEntry struct {
+	key
+	Sketch *Sketch `json:"sketch"`
+}
+
+type sketchesFile struct {
+	Version  int           `json:"version"`
+	Sketches []sketchEntry `json:"sketches"`
+}
+
+// SaveSketches writes the distributions to path, so a restarted detector
+// doesn't need to learn them again.
+func (d *Detector) SaveSketches(path string) error {
+	d.mu.Lock()
+	file := sketchesFile{Version: SKETCHES_VERSION}
+	for k, s := range d.sketches {
+		file.Sketches = append(file.Sketches, sketchEntry{key: k, Sketch: s})
+	}
+	data, err := json.Marshal(file)
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return atomicfile.WriteFile(path, data, 0o644)
+}
+
+// LoadSketches merges distributions saved with SaveSketches into d. A
+// missing file is not an error.
+func (d *Detector) LoadSketches(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error reading sketches [%s]: %v", path, err)
+	}
+
+	var file sketchesFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("Error decoding sketches [%s]: %v", path, err)
+	}
+	if file.Version != SKETCHES_VERSION {
+		return fmt.Errorf("Unsupported sketches version %d", file.Version)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, entry := range file.Sketches {
+		d.sketch(entry.key).Merge(entry.Sketch)
+	}
+	return nil
+}
+
+// LoadMinClears reads the fastest full clear flagged regardless of the
+// distribution of each activity, from a JSON object of director activity
+// hashes and seconds, for Detector.MinClearSeconds.
+func LoadMinClears(path string) (map[string]float64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading minimum clear times [%s]: %v", path, err)
+	}
+	var minClears map[string]float64
+	if err := json.Unmarshal(data, &minClears); err != nil {
+		return nil, fmt.Errorf("Error decoding minimum clear times [%s]: %v", path, err)
+	}
+	for activity, seconds := range minClears {
+		if seconds < 0 {
+			return nil, fmt.Errorf("Error loading minimum clear times [%s]: negative time for activity [%s]", path, activity)
+		}
+	}
+	return minClears, nil
+}
+
+// SortFlags orders flags for review, highest score first.
+func SortFlags(flags []Flag) {
+	sort.SliceStable(flags, func(i, j int) bool {
+		if flags[i].Score != flags[j].Score {
+			return flags[i].Score > flags[j].Score
+		}
+		return flags[i].InstanceID < flags[j].InstanceID
+	})
+}
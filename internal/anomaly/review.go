@@ -0,0 +1,28 @@
+package anomaly
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"time"
+)
+
+// WriteReviewCSV writes flags as a CSV table for manual review.
+func WriteReviewCSV(w io.Writer, flags []Flag) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{
+		"score", "rule", "period", "instance_id", "mode", "membership_id", "character_id", "value", "threshold", "reason",
+	})
+	for _, f := range flags {
+		out.Write([]string{
+			formatFloat(f.Score), f.Rule, f.Period.UTC().Format(time.RFC3339), f.InstanceID, strconv.Itoa(int(f.Mode)),
+			f.MembershipID, f.CharacterID, formatFloat(f.Value), formatFloat(f.Threshold), f.Reason,
+		})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', 3, 64)
+}
@@ -0,0 +1,109 @@
+package anomaly
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+)
+
+const (
+	// DEFAULT_SKETCH_ACCURACY is the relative error of sketch quantiles.
+	DEFAULT_SKETCH_ACCURACY = 0.01
+)
+
+// Sketch is a streaming quantile sketch over non-negative values, in the
+// style of DDSketch: values are counted in logarithmic bins, so quantiles are
+// within a relative error of the true value whatever the distribution, memory
+// grows with the value range rather than the number of values, and sketches
+// merge exactly.
+type Sketch struct {
+	accuracy float64
+	gamma    float64
+	bins     map[int]int64
+	zeros    int64
+	count    int64
+}
+
+func NewSketch(accuracy float64) *Sketch {
+	return &Sketch{
+		accuracy: accuracy,
+		gamma:    (1 + accuracy) / (1 - accuracy),
+		bins:     make(map[int]int64),
+	}
+}
+
+func (s *Sketch) Add(v float64) {
+	if math.IsNaN(v) || v < 0 {
+		return
+	}
+	s.count++
+	if v == 0 {
+		s.zeros++
+		return
+	}
+	s.bins[int(math.Ceil(math.Log(v)/math.Log(s.gamma)))]++
+}
+
+func (s *Sketch) Count() int64 {
+	return s.count
+}
+
+// Quantile returns the value below which a q fraction of values fall.
+func (s *Sketch) Quantile(q float64) float64 {
+	if s.count == 0 {
+		return 0
+	}
+	rank := int64(q * float64(s.count-1))
+	if rank < s.zeros {
+		return 0
+	}
+
+	indexes := make([]int, 0, len(s.bins))
+	for i := range s.bins {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	seen := s.zeros
+	for _, i := range indexes {
+		seen += s.bins[i]
+		if seen > rank {
+			return 2 * math.Pow(s.gamma, float64(i)) / (s.gamma + 1)
+		}
+	}
+	return 2 * math.Pow(s.gamma, float64(indexes[len(indexes)-1])) / (s.gamma + 1)
+}
+
+// Merge adds o's values to s. Both need the same accuracy.
+func (s *Sketch) Merge(o *Sketch) {
+	for i, n := range o.bins {
+		s.bins[i] += n
+	}
+	s.zeros += o.zeros
+	s.count += o.count
+}
+
+type sketchFile struct {
+	Accuracy float64       `json:"accuracy"`
+	Bins     map[int]int64 `json:"bins"`
+	Zeros    int64         `json:"zeros"`
+	Count    int64         `json:"count"`
+}
+
+func (s *Sketch) MarshalJSON() ([]byte, error) {
+	return json.Marshal(sketchFile{Accuracy: s.accuracy, Bins: s.bins, Zeros: s.zeros, Count: s.count})
+}
+
+func (s *Sketch) UnmarshalJSON(data []byte) error {
+	var file sketchFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return err
+	}
+	*s = *NewSketch(file.Accuracy)
+	if file.Bins != nil {
+		s.bins = file.Bins
+	}
+	s.zeros = file.Zeros
+	s.count = file.Count
+	return nil
+}
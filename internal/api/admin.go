@@ -0,0 +1,146 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/deahtstroke/protheon/internal/auth"
+	"github.com/deahtstroke/protheon/internal/events"
+	"github.com/deahtstroke/protheon/internal/logging"
+	"github.com/gorilla/mux"
+)
+
+// DEFAULT_TOKEN_TTL is how long join tokens issued without a TTL are valid.
+const DEFAULT_TOKEN_TTL = 24 * time.Hour
+
+// IssueToken creates a join token. The token is only ever shown in this
+// response.
+func IssueToken(authority *auth.Authority) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req IssueTokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+			return
+		}
+
+		ttl := DEFAULT_TOKEN_TTL
+		if req.TTL != "" {
+			var err error
+			ttl, err = time.ParseDuration(req.TTL)
+			if err != nil {
+				http.Error(w, "Invalid TTL, use a duration such as 1h", http.StatusBadRequest)
+				return
+			}
+		}
+
+		token, joinToken, err := authority.IssueToken(ttl, req.Hostname, req.SingleUse)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		joinToken.Hash = ""
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(IssueTokenResponse{Token: token, JoinToken: joinToken})
+
+		logging.Component("api").Info("Join token issued", "token_id", joinToken.ID, "hostname", joinToken.Hostname, "single_use", joinToken.SingleUse, "expires_at", joinToken.ExpiresAt)
+	}
+}
+
+func ListTokens(authority *auth.Authority) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tokens := authority.Tokens()
+		for i := range tokens {
+			tokens[i].Hash = ""
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tokens)
+	}
+}
+
+func RevokeToken(authority *auth.Authority) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if err := authority.RevokeToken(id); err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+		logging.Component("api").Info("Join token revoked", "token_id", id)
+	}
+}
+
+// ListWorkers lists every worker that holds or held a credential, with the
+// state of its heartbeats.
+func ListWorkers(authority *auth.Authority) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(WorkerInfos(authority))
+	}
+}
+
+// WorkerInfos describes every worker that holds or held a credential.
+func WorkerInfos(authority *auth.Authority) []WorkerInfo {
+	registered := make(map[string]Worker)
+	for _, worker := range Workers() {
+		registered[worker.ID] = worker
+	}
+
+	credentials := authority.Credentials()
+	list := make([]WorkerInfo, 0, len(credentials))
+	for _, credential := range credentials {
+		info := WorkerInfo{
+			ID:       credential.WorkerID,
+			Hostname: credential.Hostname,
+			State:    WorkerOffline,
+			TokenID:  credential.TokenID,
+			IssuedAt: credential.IssuedAt,
+		}
+		if worker, ok := registered[credential.WorkerID]; ok {
+			info.OS = worker.OS
+			info.IP = worker.IP
+			info.LastSeen = &worker.LastSeen
+			info.State = worker.state()
+			info.JobsDone = worker.JobsDone
+			info.Throughput = worker.Throughput
+		}
+		if credential.Revoked {
+			info.State = WorkerRevoked
+		}
+		list = append(list, info)
+	}
+	return list
+}
+
+// RevokeWorker revokes a worker's credential, which kicks it out: it is
+// forgotten now, and shuts down on its next heartbeat.
+func RevokeWorker(authority *auth.Authority) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if err := authority.RevokeCredential(id); err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		worker, _ := removeWorker(id)
+		w.WriteHeader(http.StatusNoContent)
+
+		worker.ID = id
+		Events.Publish(events.WorkerRevoked, worker.eventData())
+
+		logging.Component("api").Info("Worker credential revoked", logging.KeyWorkerID, id)
+	}
+}
+
+func writeAdminError(w http.ResponseWriter, err error) {
+	if errors.Is(err, auth.ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	logging.Component("api").Error("Error updating auth state", "error", err)
+	http.Error(w, "Error updating auth state", http.StatusInternalServerError)
+}
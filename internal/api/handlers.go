@@ -1,77 +1,311 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
+	"github.com/deahtstroke/protheon/internal/auth"
+	"github.com/deahtstroke/protheon/internal/certs"
+	"github.com/deahtstroke/protheon/internal/events"
+	"github.com/deahtstroke/protheon/internal/ingest"
+	"github.com/deahtstroke/protheon/internal/logging"
+	"github.com/deahtstroke/protheon/internal/rabbitmq"
 	"github.com/google/uuid"
-	"log"
 	"net"
 	"net/http"
+	"sort"
 	"sync"
+	"time"
+)
+
+const (
+	// HEARTBEAT_INTERVAL is how often, in seconds, minds are told to send
+	// heartbeats. A worker that missed STALE_HEARTBEATS of them is stale.
+	HEARTBEAT_INTERVAL = 30
+	STALE_HEARTBEATS   = 3
+)
+
+const (
+	WorkerActive  = "active"
+	WorkerStale   = "stale"
+	WorkerOffline = "offline"
+	WorkerRevoked = "revoked"
 )
 
 type Worker struct {
-	ID       string `json:"id"`
-	Hostname string `json:"hostname"`
-	OS       string `json:"os"`
-	IP       string `json:"ip"`
+	ID       string    `json:"id"`
+	Hostname string    `json:"hostname"`
+	OS       string    `json:"os"`
+	IP       string    `json:"ip"`
+	LastSeen time.Time `json:"last_seen"`
+
+	// JobsDone is the count of the worker's last heartbeat, and Throughput
+	// the PGCRs per second it acked between its last two heartbeats.
+	JobsDone   int     `json:"jobs_done"`
+	Throughput float64 `json:"throughput"`
+
+	// dead is set once WatchWorkers announced the worker died.
+	dead bool
 }
 
 var (
 	workers   = make(map[string]Worker)
 	workersMu sync.Mutex
+
+	// Events receives what happens to workers. Without a bus, nothing is
+	// published.
+	Events *events.Bus
 )
 
-func RegisterWorker(w http.ResponseWriter, r *http.Request) {
-	var req RegisterRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON request", http.StatusBadRequest)
-		return
-	}
+func (w Worker) eventData() events.WorkerData {
+	return events.WorkerData{ID: w.ID, Hostname: w.Hostname, IP: w.IP, LastSeen: w.LastSeen}
+}
+
+// RegisterWorker registers minds presenting a valid join token or a verified
+// client certificate, and hands each one the credential it authenticates its
+// heartbeats with.
+func RegisterWorker(authority *auth.Authority) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req RegisterRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+			return
+		}
+
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
 
-	host, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		host = r.RemoteAddr
+		// A verified client certificate names the worker, and lets it join
+		// without a token.
+		hostname := req.Hostname
+		identity := certs.Identity(r.TLS)
+		if identity != "" {
+			hostname = identity
+		}
+
+		id := uuid.New().String()
+		var credential string
+		if identity != "" && req.Token == "" {
+			credential, err = authority.Admit(id, hostname, certs.Serial(r.TLS))
+		} else {
+			credential, err = authority.Register(req.Token, id, hostname)
+		}
+		if errors.Is(err, auth.ErrInvalidToken) {
+			// The reason stays in the logs, callers only learn they can't join.
+			logging.Component("api").Warn("Worker registration refused", "hostname", hostname, "ip", host, "error", err)
+			http.Error(w, auth.ErrInvalidToken.Error(), http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			logging.Component("api").Error("Error registering worker", "hostname", hostname, "ip", host, "error", err)
+			http.Error(w, "Error registering worker", http.StatusInternalServerError)
+			return
+		}
+
+		worker := Worker{
+			ID:       id,
+			Hostname: hostname,
+			OS:       req.OS,
+			IP:       host,
+			LastSeen: time.Now(),
+		}
+
+		workersMu.Lock()
+		workers[id] = worker
+		workersMu.Unlock()
+
+		resp := RegisterResponse{
+			ID:                id,
+			Credential:        credential,
+			HeartbeatInterval: HEARTBEAT_INTERVAL,
+			QueueName:         rabbitmq.PGCR_QUEUE,
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+
+		Events.Publish(events.WorkerRegistered, worker.eventData())
+		logging.Component("api").Info("Worker registered", logging.KeyWorkerID, worker.ID, "hostname", worker.Hostname, "os", worker.OS, "ip", worker.IP)
 	}
+}
+
+// ReceiveHeartbeat accepts heartbeats carrying the worker's credential as a
+// bearer token. A worker whose credential was revoked gets 410 Gone and is
+// expected to shut down. A credential the conductor doesn't know, such as
+// after it restarted without --auth-file, gets 401 Unauthorized and the
+// worker is expected to register again.
+func ReceiveHeartbeat(authority *auth.Authority) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req HeartbeatRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+			return
+		}
+
+		credential, err := authority.Verify(auth.BearerToken(r.Header.Get("Authorization")))
+		if errors.Is(err, auth.ErrRevokedCredential) {
+			logging.Component("api").Warn("Heartbeat from a revoked worker", logging.KeyWorkerID, req.ID)
+			http.Error(w, auth.ErrRevokedCredential.Error(), http.StatusGone)
+			return
+		}
+		if err != nil {
+			logging.Component("api").Warn("Heartbeat refused", logging.KeyWorkerID, req.ID, "error", err)
+			http.Error(w, auth.ErrInvalidCredential.Error(), http.StatusUnauthorized)
+			return
+		}
+		if credential.WorkerID != req.ID {
+			logging.Component("api").Warn("Heartbeat for another worker", logging.KeyWorkerID, credential.WorkerID, "claimed_id", req.ID)
+			http.Error(w, "Credential belongs to another worker", http.StatusForbidden)
+			return
+		}
+		if identity := certs.Identity(r.TLS); identity != "" && identity != credential.Hostname {
+			logging.Component("api").Warn("Heartbeat with another worker's certificate", logging.KeyWorkerID, credential.WorkerID, "hostname", credential.Hostname, "identity", identity)
+			http.Error(w, "Credential belongs to another worker", http.StatusForbidden)
+			return
+		}
 
-	id := uuid.New().String()
-	worker := Worker{
-		ID:       id,
-		Hostname: req.Hostname,
-		OS:       req.OS,
-		IP:       host,
+		workersMu.Lock()
+		worker, ok := workers[req.ID]
+		if !ok {
+			// The conductor restarted and forgot the worker, but its
+			// credential is still good.
+			host, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				host = r.RemoteAddr
+			}
+			worker = Worker{ID: req.ID, Hostname: credential.Hostname, IP: host}
+		}
+		now := time.Now()
+		if ok && req.JobsDone >= worker.JobsDone && now.After(worker.LastSeen) {
+			worker.Throughput = float64(req.JobsDone-worker.JobsDone) / now.Sub(worker.LastSeen).Seconds()
+		}
+		recovered := worker.dead
+		worker.dead = false
+		worker.JobsDone = req.JobsDone
+		worker.LastSeen = now
+		workers[req.ID] = worker
+		workersMu.Unlock()
+
+		if recovered {
+			Events.Publish(events.WorkerRecovered, worker.eventData())
+			logging.Component("api").Info("Worker recovered", logging.KeyWorkerID, worker.ID, "hostname", worker.Hostname)
+		}
+		if !ok {
+			logging.Component("api").Info("Worker rejoined", logging.KeyWorkerID, worker.ID, "hostname", worker.Hostname, "ip", worker.IP)
+		} else {
+			logging.Component("api").Debug("Received heartbeat", logging.KeyWorkerID, worker.ID, "hostname", worker.Hostname, "jobs_done", req.JobsDone)
+		}
 	}
+}
 
+// Workers lists the registered workers.
+func Workers() []Worker {
 	workersMu.Lock()
-	workers[id] = worker
-	workersMu.Unlock()
+	defer workersMu.Unlock()
 
-	resp := RegisterResponse{
-		ID:                id,
-		HeartbeatInterval: 30,
-		QueueName:         "jobs",
+	list := make([]Worker, 0, len(workers))
+	for _, worker := range workers {
+		list = append(list, worker)
 	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(resp)
+// removeWorker forgets a worker, and returns it if it was registered.
+func removeWorker(id string) (Worker, bool) {
+	workersMu.Lock()
+	defer workersMu.Unlock()
 
-	fmt.Printf("[Conductor] Worker registered: %+v\n", worker)
+	worker, ok := workers[id]
+	delete(workers, id)
+	return worker, ok
 }
 
-func ReceiveHeartbeat(w http.ResponseWriter, r *http.Request) {
-	var req HeartbeatRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON request", http.StatusBadRequest)
-		return
+// WorkerStates counts the registered workers by state.
+func WorkerStates() map[string]int {
+	workersMu.Lock()
+	defer workersMu.Unlock()
+
+	states := map[string]int{WorkerActive: 0, WorkerStale: 0}
+	for _, worker := range workers {
+		states[worker.state()]++
 	}
+	return states
+}
 
+// WatchWorkers checks the workers every interval, until ctx is done, and
+// publishes that a worker died once it went stale. A heartbeat from it later
+// publishes that it recovered.
+func WatchWorkers(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			checkWorkers()
+		}
+	}
+}
+
+func checkWorkers() {
 	workersMu.Lock()
-	worker, ok := workers[req.ID]
+	var died []Worker
+	for id, worker := range workers {
+		if !worker.dead && worker.state() == WorkerStale {
+			worker.dead = true
+			workers[id] = worker
+			died = append(died, worker)
+		}
+	}
 	workersMu.Unlock()
 
-	if !ok {
-		log.Printf("Unable to find worker with Id [%s]", req.ID)
-	} else {
-		log.Printf("Received heartbet for worker: %+v", worker)
+	for _, worker := range died {
+		Events.Publish(events.WorkerDied, worker.eventData())
+		logging.Component("api").Warn("Worker died, it missed its heartbeats", logging.KeyWorkerID, worker.ID, "hostname", worker.Hostname, "last_seen", worker.LastSeen)
+	}
+}
+
+func (w Worker) state() string {
+	if time.Since(w.LastSeen) > STALE_HEARTBEATS*HEARTBEAT_INTERVAL*time.Second {
+		return WorkerStale
+	}
+	return WorkerActive
+}
+
+// IngestFunc starts an ingest job and reports what it scheduled.
+type IngestFunc func(req IngestRequest) (*IngestResponse, error)
+
+func StartIngest(start IngestFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req IngestRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+			return
+		}
+
+		if req.Root == "" {
+			http.Error(w, "Missing root to ingest", http.StatusBadRequest)
+			return
+		}
+
+		resp, err := start(req)
+		if errors.Is(err, ingest.ErrForbidden) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(resp)
+
+		logging.Component("api").Info("Ingest started", "job", resp.Job, "root", req.Root, "include", req.Include, "exclude", req.Exclude, "filter", req.Filter, "force", req.Force)
 	}
 }
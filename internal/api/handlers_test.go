@@ -0,0 +1,185 @@
+package api
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/deahtstroke/protheon/internal/auth"
+	"github.com/deahtstroke/protheon/internal/events"
+	"github.com/gorilla/mux"
+)
+
+func post(t *testing.T, h http.Handler, target, bearer string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("Error encoding request: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodPost, target, bytes.NewReader(data))
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestRegisterHeartbeatAndRevoke(t *testing.T) {
+	authority, _ := auth.Open("")
+	keyring := auth.NewKeyring()
+	keyring.Add("admin-key", auth.RoleAdmin, "admin-key")
+	r := mux.NewRouter()
+	r.HandleFunc("/mind/register", RegisterWorker(authority)).Methods("POST").Name(RouteRegister)
+	r.HandleFunc("/mind/heartbeat", ReceiveHeartbeat(authority)).Methods("POST").Name(RouteHeartbeat)
+	r.HandleFunc("/admin/tokens", IssueToken(authority)).Methods("POST").Name(RouteIssueToken)
+	r.HandleFunc("/admin/workers/{id}", RevokeWorker(authority)).Methods("DELETE").Name(RouteRevokeWorker)
+	r.Use((&Policy{Routes: DefaultPolicy(), Keyring: keyring, Authority: authority}).Middleware)
+
+	if rec := post(t, r, "/admin/tokens", "wrong-key", IssueTokenRequest{}); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected the admin API to refuse a wrong key, got %d", rec.Code)
+	}
+	rec := post(t, r, "/admin/tokens", "admin-key", IssueTokenRequest{TTL: "1h", SingleUse: true})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Error issuing token: %d %s", rec.Code, rec.Body)
+	}
+	var issued IssueTokenResponse
+	json.NewDecoder(rec.Body).Decode(&issued)
+	if issued.Token == "" || issued.Hash != "" {
+		t.Fatalf("Expected the token without its hash, got %+v", issued)
+	}
+
+	if rec := post(t, r, "/mind/register", "", RegisterRequest{Hostname: "mind-1", Token: "bogus"}); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected registration with a bad token to be refused, got %d", rec.Code)
+	}
+	rec = post(t, r, "/mind/register", "", RegisterRequest{Hostname: "mind-1", Token: issued.Token})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Error registering: %d %s", rec.Code, rec.Body)
+	}
+	var registered RegisterResponse
+	json.NewDecoder(rec.Body).Decode(&registered)
+	t.Cleanup(func() { removeWorker(registered.ID) })
+
+	heartbeat := HeartbeatRequest{ID: registered.ID, LastJobTime: time.Now()}
+	if rec := post(t, r, "/mind/heartbeat", "", heartbeat); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected a heartbeat without credential to be refused, got %d", rec.Code)
+	}
+	if rec := post(t, r, "/mind/heartbeat", registered.ID+".forgotten", heartbeat); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected a heartbeat with an unknown credential to be refused, got %d", rec.Code)
+	}
+	if rec := post(t, r, "/mind/heartbeat", registered.Credential, HeartbeatRequest{ID: "someone-else"}); rec.Code != http.StatusForbidden {
+		t.Fatalf("Expected a heartbeat for another worker to be refused, got %d", rec.Code)
+	}
+	if rec := post(t, r, "/mind/heartbeat", registered.Credential, heartbeat); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the heartbeat to be accepted, got %d %s", rec.Code, rec.Body)
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/admin/workers/"+registered.ID, nil)
+	req.Header.Set("Authorization", "Bearer admin-key")
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Error revoking worker: %d %s", rec.Code, rec.Body)
+	}
+	for _, worker := range Workers() {
+		if worker.ID == registered.ID {
+			t.Fatalf("Expected the revoked worker to be forgotten")
+		}
+	}
+	if rec := post(t, r, "/mind/heartbeat", registered.Credential, heartbeat); rec.Code != http.StatusGone {
+		t.Fatalf("Expected the revoked worker's heartbeat to be refused for good, got %d", rec.Code)
+	}
+}
+
+func TestClientCertificateIdentifiesWorker(t *testing.T) {
+	authority, _ := auth.Open("")
+	register := RegisterWorker(authority)
+	heartbeat := ReceiveHeartbeat(authority)
+
+	withCert := func(req *http.Request, name string) *http.Request {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: name}, SerialNumber: big.NewInt(int64(len(name)))}
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		return req
+	}
+
+	data, _ := json.Marshal(RegisterRequest{Hostname: "laptop"})
+	rec := httptest.NewRecorder()
+	register(rec, withCert(httptest.NewRequest(http.MethodPost, "/mind/register", bytes.NewReader(data)), "mind-1"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected a verified certificate to register without a token, got %d %s", rec.Code, rec.Body)
+	}
+	var registered RegisterResponse
+	json.NewDecoder(rec.Body).Decode(&registered)
+	t.Cleanup(func() { removeWorker(registered.ID) })
+
+	credential, err := authority.Verify(registered.Credential)
+	if err != nil || credential.Hostname != "mind-1" || credential.TokenID != auth.CERTIFICATE_TOKEN_ID {
+		t.Fatalf("Expected the certificate to name the worker, got %+v %v", credential, err)
+	}
+
+	send := func(name string) int {
+		data, _ := json.Marshal(HeartbeatRequest{ID: registered.ID})
+		req := withCert(httptest.NewRequest(http.MethodPost, "/mind/heartbeat", bytes.NewReader(data)), name)
+		req.Header.Set("Authorization", "Bearer "+registered.Credential)
+		rec := httptest.NewRecorder()
+		heartbeat(rec, req)
+		return rec.Code
+	}
+	if code := send("mind-2"); code != http.StatusForbidden {
+		t.Fatalf("Expected a heartbeat with another worker's certificate to be refused, got %d", code)
+	}
+	if code := send("mind-1"); code != http.StatusOK {
+		t.Fatalf("Expected the heartbeat to be accepted, got %d", code)
+	}
+
+	if err := authority.RevokeCredential(registered.ID); err != nil {
+		t.Fatalf("Error revoking worker: %v", err)
+	}
+	rec = httptest.NewRecorder()
+	register(rec, withCert(httptest.NewRequest(http.MethodPost, "/mind/register", bytes.NewReader(data)), "mind-1"))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected the revoked worker's certificate to be refused, got %d", rec.Code)
+	}
+}
+
+func TestWorkerDiesAndRecovers(t *testing.T) {
+	bus := events.NewBus(0)
+	Events = bus
+	t.Cleanup(func() { Events = nil })
+
+	authority, _ := auth.Open("")
+	credential, err := authority.Admit("dying", "mind-9", "9")
+	if err != nil {
+		t.Fatalf("Error admitting worker: %v", err)
+	}
+	workersMu.Lock()
+	workers["dying"] = Worker{ID: "dying", Hostname: "mind-9", LastSeen: time.Now().Add(-time.Hour)}
+	workersMu.Unlock()
+	t.Cleanup(func() { removeWorker("dying") })
+
+	sub := bus.Subscribe(0)
+	defer sub.Cancel()
+
+	checkWorkers()
+	checkWorkers()
+	if event := <-sub.Events; event.Type != events.WorkerDied {
+		t.Fatalf("Expected the stale worker to die, got %+v", event)
+	}
+
+	if rec := post(t, ReceiveHeartbeat(authority), "/mind/heartbeat", credential, HeartbeatRequest{ID: "dying"}); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the heartbeat to be accepted, got %d %s", rec.Code, rec.Body)
+	}
+	if event := <-sub.Events; event.Type != events.WorkerRecovered {
+		t.Fatalf("Expected the worker to recover, got %+v", event)
+	}
+	if bus.Seq() != 2 {
+		t.Fatalf("Expected a worker to die once, got %d events", bus.Seq())
+	}
+}
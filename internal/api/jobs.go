@@ -0,0 +1,94 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/deahtstroke/protheon/internal/ingest"
+	"github.com/deahtstroke/protheon/internal/logging"
+	"github.com/gorilla/mux"
+)
+
+// Jobs runs ingest jobs, as ingest.Runner does.
+type Jobs interface {
+	Jobs() []ingest.Job
+	Job(id string) (ingest.Job, error)
+	Start(spec ingest.Spec) (ingest.Job, error)
+	Pause(id string) (ingest.Job, error)
+	Resume(id string) (ingest.Job, error)
+	Cancel(id string) (ingest.Job, error)
+	Rerun(id string) (ingest.Job, error)
+}
+
+// CreateJob starts an ingest job.
+func CreateJob(jobs Jobs) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var spec ingest.Spec
+		if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+			http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+			return
+		}
+
+		job, err := jobs.Start(spec)
+		if err != nil {
+			writeJobError(w, err)
+			return
+		}
+		writeJob(w, http.StatusCreated, job)
+	}
+}
+
+// ListJobs lists every ingest job, the oldest first.
+func ListJobs(jobs Jobs) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(jobs.Jobs())
+	}
+}
+
+func GetJob(jobs Jobs) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job, err := jobs.Job(mux.Vars(r)["id"])
+		if err != nil {
+			writeJobError(w, err)
+			return
+		}
+		writeJob(w, http.StatusOK, job)
+	}
+}
+
+// JobAction applies an action, such as pausing, to the job named in the path.
+// Rerunning a job answers with the job it created.
+func JobAction(action func(id string) (ingest.Job, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job, err := action(mux.Vars(r)["id"])
+		if err != nil {
+			writeJobError(w, err)
+			return
+		}
+		writeJob(w, http.StatusOK, job)
+	}
+}
+
+func writeJob(w http.ResponseWriter, status int, job ingest.Job) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(job)
+}
+
+func writeJobError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ingest.ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ingest.ErrInvalidTransition):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, ingest.ErrInvalidSpec):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ingest.ErrForbidden):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		logging.Component("api").Error("Error updating ingest job", "error", err)
+		http.Error(w, "Error updating ingest job", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/deahtstroke/protheon/internal/ingest"
+	"github.com/gorilla/mux"
+)
+
+func TestJobRoutes(t *testing.T) {
+	store, _ := ingest.Open("")
+	release := make(chan struct{})
+	runner := ingest.NewRunner(context.Background(), store, func(ctx context.Context, job ingest.Job, run *ingest.Run) error {
+		select {
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		case <-release:
+			return nil
+		}
+	})
+	defer runner.Wait()
+	defer close(release)
+	runner.Roots = []string{"/dumps"}
+	runner.Queues = []string{""}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/jobs", CreateJob(runner)).Methods("POST")
+	r.HandleFunc("/jobs/{id}", GetJob(runner)).Methods("GET")
+	r.HandleFunc("/jobs/{id}/pause", JobAction(runner.Pause)).Methods("POST")
+
+	if rec := post(t, r, "/jobs", "", ingest.Spec{}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected a job without sources to be refused, got %d", rec.Code)
+	}
+	if rec := post(t, r, "/jobs", "", ingest.Spec{Sources: []string{"/etc"}}); rec.Code != http.StatusForbidden {
+		t.Fatalf("Expected a job outside the ingest roots to be forbidden, got %d", rec.Code)
+	}
+	rec := post(t, r, "/jobs", "", ingest.Spec{Name: "june", Sources: []string{"/dumps"}})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Error creating job: %d %s", rec.Code, rec.Body)
+	}
+	var job ingest.Job
+	json.NewDecoder(rec.Body).Decode(&job)
+	if job.ID == "" || job.State != ingest.StateRunning {
+		t.Fatalf("Expected a running job, got %+v", job)
+	}
+
+	if rec := post(t, r, "/jobs/"+job.ID+"/pause", "", nil); rec.Code != http.StatusOK {
+		t.Fatalf("Error pausing job: %d %s", rec.Code, rec.Body)
+	}
+	if rec := post(t, r, "/jobs/"+job.ID+"/pause", "", nil); rec.Code != http.StatusConflict {
+		t.Fatalf("Expected pausing a paused job to conflict, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/jobs/missing", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected an unknown job not to be found, got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/jobs/"+job.ID, nil))
+	json.NewDecoder(rec.Body).Decode(&job)
+	if job.State != ingest.StatePaused || job.Name != "june" {
+		t.Fatalf("Expected the paused job, got %+v", job)
+	}
+}
+
+func TestStartIngestForbidsRootsOutsideTheIngestRoots(t *testing.T) {
+	start := func(req IngestRequest) (*IngestResponse, error) {
+		if req.Root != "/dumps" {
+			return nil, fmt.Errorf("%w [%s]: outside the ingest roots", ingest.ErrForbidden, req.Root)
+		}
+		return &IngestResponse{Job: "1"}, nil
+	}
+
+	if rec := post(t, StartIngest(start), "/ingest", "", IngestRequest{Root: "/etc"}); rec.Code != http.StatusForbidden {
+		t.Fatalf("Expected a root outside the ingest roots to be forbidden, got %d", rec.Code)
+	}
+	if rec := post(t, StartIngest(start), "/ingest", "", IngestRequest{}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected a missing root to be refused, got %d", rec.Code)
+	}
+	if rec := post(t, StartIngest(start), "/ingest", "", IngestRequest{Root: "/dumps"}); rec.Code != http.StatusAccepted {
+		t.Fatalf("Error starting ingest: %d %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,218 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/deahtstroke/protheon/internal/auth"
+	"github.com/deahtstroke/protheon/internal/logging"
+	"github.com/gorilla/mux"
+)
+
+// Names of the conductor's routes, which the policy maps to roles.
+const (
+	RouteRegister        = "mind.register"
+	RouteHeartbeat       = "mind.heartbeat"
+	RouteIngest          = "ingest"
+	RouteMetrics         = "metrics"
+	RouteLogLevel        = "log.level.get"
+	RouteSetLogLevel     = "log.level.set"
+	RouteHealthz         = "healthz"
+	RouteReadyz          = "readyz"
+	RouteIssueToken      = "admin.tokens.issue"
+	RouteListTokens      = "admin.tokens.list"
+	RouteRevokeToken     = "admin.tokens.revoke"
+	RouteListWorkers     = "admin.workers.list"
+	RouteRevokeWorker    = "admin.workers.revoke"
+	RouteRoot            = "root"
+	RouteDashboard       = "dashboard"
+	RouteDashboardState  = "dashboard.state"
+	RouteDashboardEvents = "dashboard.events"
+	RouteEvents          = "events"
+	RouteCreateJob       = "jobs.create"
+	RouteListJobs        = "jobs.list"
+	RouteGetJob          = "jobs.get"
+	RoutePauseJob        = "jobs.pause"
+	RouteResumeJob       = "jobs.resume"
+	RouteCancelJob       = "jobs.cancel"
+	RouteRerunJob        = "jobs.rerun"
+)
+
+const anonymousPrincipal = "anonymous"
+
+// DefaultPolicy is the role each conductor route needs.
+func DefaultPolicy() map[string]auth.Role {
+	return map[string]auth.Role{
+		RouteRegister:        auth.RolePublic,
+		RouteHeartbeat:       auth.RolePublic,
+		RouteMetrics:         auth.RolePublic,
+		RouteHealthz:         auth.RolePublic,
+		RouteReadyz:          auth.RolePublic,
+		RouteRoot:            auth.RolePublic,
+		RouteDashboard:       auth.RolePublic,
+		RouteDashboardState:  auth.RoleViewer,
+		RouteDashboardEvents: auth.RoleViewer,
+		RouteEvents:          auth.RoleViewer,
+		RouteListJobs:        auth.RoleViewer,
+		RouteGetJob:          auth.RoleViewer,
+		RouteLogLevel:        auth.RoleViewer,
+		RouteListTokens:      auth.RoleViewer,
+		RouteListWorkers:     auth.RoleViewer,
+		RouteIngest:          auth.RoleOperator,
+		RouteSetLogLevel:     auth.RoleOperator,
+		RouteRevokeWorker:    auth.RoleOperator,
+		RouteCreateJob:       auth.RoleOperator,
+		RoutePauseJob:        auth.RoleOperator,
+		RouteResumeJob:       auth.RoleOperator,
+		RouteCancelJob:       auth.RoleOperator,
+		RouteRerunJob:        auth.RoleOperator,
+		RouteIssueToken:      auth.RoleAdmin,
+		RouteRevokeToken:     auth.RoleAdmin,
+	}
+}
+
+type principalKey struct{}
+
+// PrincipalFrom returns the caller authenticated by the policy.
+func PrincipalFrom(ctx context.Context) (auth.Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(auth.Principal)
+	return p, ok
+}
+
+// Policy guards the routes of a mux router by their name. Callers present an
+// API key as a bearer token, and reach the routes their role allows. Routes
+// without a role in Routes are refused, so a new route isn't public by
+// mistake. Worker credentials never reach a route that needs a role.
+//
+// Without API keys, anonymous callers are viewers, so that dashboards keep
+// working, and operator and admin routes can't be reached at all.
+type Policy struct {
+	Routes    map[string]auth.Role
+	Keyring   *auth.Keyring
+	Authority *auth.Authority
+}
+
+// Middleware enforces the policy, and audits every mutating call and every
+// refused one.
+func (p *Policy) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := ""
+		if route := mux.CurrentRoute(r); route != nil {
+			name = route.GetName()
+		}
+		required, ok := p.Routes[name]
+		if !ok {
+			logging.Component("api").Error("Route has no policy, refusing it", "route", name, "path", r.URL.Path)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if required == auth.RolePublic {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		principal, status, reason := p.authenticate(r)
+		if status == http.StatusOK && principal.Role < required {
+			status, reason = http.StatusForbidden, "role "+principal.Role.String()+" can't call a route for "+required.String()
+		}
+		if status != http.StatusOK {
+			audit(r, name, principal, status, 0, slog.String("reason", reason))
+			if status == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="protheon"`)
+			}
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), principalKey{}, principal))
+		if !mutating(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(rec, r)
+		audit(r, name, principal, rec.status, time.Since(start))
+	})
+}
+
+// authenticate returns the caller, or the status refusing it and why.
+func (p *Policy) authenticate(r *http.Request) (auth.Principal, int, string) {
+	token := auth.BearerToken(r.Header.Get("Authorization"))
+	if token == "" {
+		if p.Keyring == nil || p.Keyring.Len() == 0 {
+			return auth.Principal{Name: anonymousPrincipal, Role: auth.RoleViewer}, http.StatusOK, ""
+		}
+		return auth.Principal{Name: anonymousPrincipal}, http.StatusUnauthorized, "missing API key"
+	}
+	if p.Keyring != nil {
+		if principal, ok := p.Keyring.Authenticate(token); ok {
+			return principal, http.StatusOK, ""
+		}
+	}
+	if p.Authority != nil {
+		if credential, err := p.Authority.Verify(token); err == nil {
+			return auth.Principal{Name: "worker:" + credential.WorkerID}, http.StatusForbidden, "worker credentials can't reach routes that need a role"
+		}
+	}
+	return auth.Principal{Name: anonymousPrincipal}, http.StatusUnauthorized, "unknown API key"
+}
+
+func mutating(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+// audit logs a call to the audit component.
+func audit(r *http.Request, route string, principal auth.Principal, status int, elapsed time.Duration, attrs ...slog.Attr) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	level := slog.LevelInfo
+	if status >= http.StatusBadRequest {
+		level = slog.LevelWarn
+	}
+	attrs = append([]slog.Attr{
+		slog.String("principal", principal.Name),
+		slog.String("role", principal.Role.String()),
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+		slog.String("route", route),
+		slog.Int("status", status),
+		slog.String("ip", host),
+		slog.Duration("elapsed", elapsed),
+	}, attrs...)
+	logging.Component(logging.ComponentAudit).LogAttrs(r.Context(), level, "API call", attrs...)
+}
+
+// statusRecorder remembers the status a handler wrote.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Hijack hands the connection over, for WebSocket upgrades.
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(r.ResponseWriter).Hijack()
+	if err == nil {
+		r.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
@@ -0,0 +1,128 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deahtstroke/protheon/internal/auth"
+	"github.com/deahtstroke/protheon/internal/logging"
+	"github.com/gorilla/mux"
+)
+
+func policyRouter(policy *Policy) *mux.Router {
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	r := mux.NewRouter()
+	r.HandleFunc("/healthz", ok).Methods("GET").Name(RouteHealthz)
+	r.HandleFunc("/admin/workers", ok).Methods("GET").Name(RouteListWorkers)
+	r.HandleFunc("/ingest", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}).Methods("POST").Name(RouteIngest)
+	r.HandleFunc("/admin/tokens", ok).Methods("POST").Name(RouteIssueToken)
+	r.HandleFunc("/unnamed", ok)
+	r.Use(policy.Middleware)
+	return r
+}
+
+func call(r http.Handler, method, target, bearer string) int {
+	req := httptest.NewRequest(method, target, strings.NewReader("{}"))
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestPolicyRoles(t *testing.T) {
+	authority, _ := auth.Open("")
+	token, _, _ := authority.IssueToken(time.Hour, "", false)
+	credential, err := authority.Register(token, "worker-1", "mind-1")
+	if err != nil {
+		t.Fatalf("Error registering: %v", err)
+	}
+
+	keyring := auth.NewKeyring()
+	keyring.Add("grafana", auth.RoleViewer, "viewer-key")
+	keyring.Add("oncall", auth.RoleOperator, "operator-key")
+	keyring.Add("root", auth.RoleAdmin, "admin-key")
+	r := policyRouter(&Policy{Routes: DefaultPolicy(), Keyring: keyring, Authority: authority})
+
+	cases := []struct {
+		method, target, bearer string
+		want                   int
+	}{
+		{"GET", "/healthz", "", http.StatusOK},
+		{"GET", "/admin/workers", "", http.StatusUnauthorized},
+		{"GET", "/admin/workers", "wrong-key", http.StatusUnauthorized},
+		{"GET", "/admin/workers", "viewer-key", http.StatusOK},
+		{"POST", "/ingest", "viewer-key", http.StatusForbidden},
+		{"POST", "/ingest", "operator-key", http.StatusAccepted},
+		{"POST", "/admin/tokens", "operator-key", http.StatusForbidden},
+		{"POST", "/admin/tokens", "admin-key", http.StatusOK},
+		{"GET", "/admin/workers", credential, http.StatusForbidden},
+		{"POST", "/admin/tokens", credential, http.StatusForbidden},
+		{"GET", "/unnamed", "admin-key", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		if got := call(r, c.method, c.target, c.bearer); got != c.want {
+			t.Errorf("%s %s with %q: expected %d, got %d", c.method, c.target, c.bearer, c.want, got)
+		}
+	}
+}
+
+func TestPolicyWithoutKeys(t *testing.T) {
+	r := policyRouter(&Policy{Routes: DefaultPolicy(), Keyring: auth.NewKeyring()})
+
+	if got := call(r, "GET", "/admin/workers", ""); got != http.StatusOK {
+		t.Fatalf("Expected anonymous callers to be viewers without keys, got %d", got)
+	}
+	if got := call(r, "POST", "/ingest", ""); got != http.StatusForbidden {
+		t.Fatalf("Expected operator routes to be out of reach without keys, got %d", got)
+	}
+	if got := call(r, "POST", "/admin/tokens", ""); got != http.StatusForbidden {
+		t.Fatalf("Expected admin routes to be out of reach without keys, got %d", got)
+	}
+}
+
+func TestPolicyAuditsMutatingCalls(t *testing.T) {
+	previous := slog.Default()
+	defer slog.SetDefault(previous)
+	var out bytes.Buffer
+	if _, err := logging.Setup(&out, logging.Config{Format: logging.FormatJSON}); err != nil {
+		t.Fatal(err)
+	}
+
+	keyring := auth.NewKeyring()
+	keyring.Add("oncall", auth.RoleOperator, "operator-key")
+	r := policyRouter(&Policy{Routes: DefaultPolicy(), Keyring: keyring})
+
+	call(r, "GET", "/admin/workers", "operator-key")
+	call(r, "POST", "/ingest", "operator-key")
+	call(r, "POST", "/admin/tokens", "operator-key")
+
+	var audited []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Error decoding record %q: %v", line, err)
+		}
+		if record[logging.KeyComponent] == logging.ComponentAudit {
+			audited = append(audited, record)
+		}
+	}
+	if len(audited) != 2 {
+		t.Fatalf("Expected the ingest and the refused call to be audited, got %v", audited)
+	}
+	if audited[0]["principal"] != "oncall" || audited[0]["route"] != RouteIngest || audited[0]["status"] != float64(http.StatusAccepted) {
+		t.Fatalf("Unexpected audit record %v", audited[0])
+	}
+	if audited[1]["status"] != float64(http.StatusForbidden) || audited[1]["reason"] == nil {
+		t.Fatalf("Unexpected audit record %v", audited[1])
+	}
+}
@@ -2,15 +2,20 @@ package api
 
 import (
 	"time"
+
+	"github.com/deahtstroke/protheon/internal/auth"
+	"github.com/deahtstroke/protheon/internal/ingest"
 )
 
 type RegisterRequest struct {
 	Hostname string `json:"hostname"`
 	OS       string `json:"os"`
+	Token    string `json:"token"`
 }
 
 type RegisterResponse struct {
 	ID                string `json:"id"`
+	Credential        string `json:"credential"`
 	HeartbeatInterval int    `json:"heart_beat"`
 	QueueName         string `json:"queue_name"`
 }
@@ -21,3 +26,46 @@ type HeartbeatRequest struct {
 	LastJobTime time.Time `json:"last_job_time"`
 	Uptime      string    `json:"uptime"`
 }
+
+type IngestRequest struct {
+	Root    string   `json:"root"`
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+	Filter  string   `json:"filter,omitempty"`
+	Force   bool     `json:"force,omitempty"`
+}
+
+// IngestResponse names the job the ingest runs as, which /jobs/{id} reports
+// on. Stats are the job's as it started, its files are counted once the job
+// scanned its sources.
+type IngestResponse struct {
+	Job    string       `json:"job"`
+	Stats  ingest.Stats `json:"stats"`
+	Filter string       `json:"filter,omitempty"`
+}
+
+type IssueTokenRequest struct {
+	TTL       string `json:"ttl"`
+	Hostname  string `json:"hostname,omitempty"`
+	SingleUse bool   `json:"single_use"`
+}
+
+type IssueTokenResponse struct {
+	Token string `json:"token"`
+	auth.JoinToken
+}
+
+// WorkerInfo is a worker as the admin API shows it.
+type WorkerInfo struct {
+	ID       string     `json:"id"`
+	Hostname string     `json:"hostname"`
+	OS       string     `json:"os,omitempty"`
+	IP       string     `json:"ip,omitempty"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+	State    string     `json:"state"`
+	TokenID  string     `json:"token_id"`
+	IssuedAt time.Time  `json:"issued_at"`
+
+	JobsDone   int     `json:"jobs_done"`
+	Throughput float64 `json:"throughput"`
+}
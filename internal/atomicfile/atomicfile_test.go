@@ -0,0 +1,41 @@
+package atomicfile
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteReplacesOrKeeps(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	if err := WriteFile(path, []byte("old"), 0o600); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0o600 {
+		t.Fatalf("Expected 0600, got %v", info.Mode().Perm())
+	}
+
+	err := Write(path, 0o644, func(w io.Writer) error {
+		io.WriteString(w, "half")
+		return errors.New("disk on fire")
+	})
+	if err == nil {
+		t.Fatal("Expected the failed write to be reported")
+	}
+	if data, _ := os.ReadFile(path); string(data) != "old" {
+		t.Fatalf("Expected a failed write to keep the old file, got %q", data)
+	}
+
+	if err := WriteFile(path, []byte("new"), 0o644); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "new" {
+		t.Fatalf("Expected the new file, got %q", data)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("Expected no temporary files left behind, got %d entries", len(entries))
+	}
+}
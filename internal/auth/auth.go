@@ -0,0 +1,425 @@
+// Package auth authenticates minds. An operator issues join tokens, or
+// configures a shared secret, which a mind presents when it registers. The
+// mind receives a credential of its own, which it presents with every
+// heartbeat. Revoking a worker's credential kicks the
+// worker out: its heartbeats are refused and it shuts down.
+//
+// Tokens and credentials are handed out as "<id>.<secret>". Only a hash of
+// the secret is kept, so a leaked state file can't be used to join.
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deahtstroke/protheon/internal/atomicfile"
+)
+
+const STATE_VERSION = 1
+
+// SHARED_TOKEN_ID and CERTIFICATE_TOKEN_ID are the token IDs recorded for
+// workers that joined with the shared secret, and with a client certificate.
+const (
+	SHARED_TOKEN_ID      = "shared"
+	CERTIFICATE_TOKEN_ID = "certificate"
+)
+
+var (
+	ErrInvalidToken      = errors.New("Invalid join token")
+	ErrInvalidCredential = errors.New("Invalid worker credential")
+	ErrRevokedCredential = errors.New("Worker credential was revoked")
+	ErrNotFound          = errors.New("Not found")
+)
+
+// JoinToken lets minds register. A single use token is spent by its first
+// registration. Hostname, a glob pattern such as "mind-*", scopes the token
+// to minds reporting a matching hostname.
+type JoinToken struct {
+	ID        string    `json:"id"`
+	Hostname  string    `json:"hostname,omitempty"`
+	SingleUse bool      `json:"single_use"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Uses      int       `json:"uses"`
+	Revoked   bool      `json:"revoked"`
+
+	// Hash is omitted from API responses, which clear it.
+	Hash string `json:"hash,omitempty"`
+}
+
+// Usable reports why the token can't be used at now, if it can't.
+func (t *JoinToken) usable(now time.Time) error {
+	switch {
+	case t.Revoked:
+		return errors.New("token was revoked")
+	case !now.Before(t.ExpiresAt):
+		return errors.New("token expired")
+	case t.SingleUse && t.Uses > 0:
+		return errors.New("token was already used")
+	}
+	return nil
+}
+
+// Credential is a registered worker's secret. Certificate is the serial of
+// the client certificate the worker was admitted with, if it joined with one.
+type Credential struct {
+	WorkerID    string    `json:"worker_id"`
+	Hostname    string    `json:"hostname"`
+	TokenID     string    `json:"token_id"`
+	Certificate string    `json:"certificate,omitempty"`
+	IssuedAt    time.Time `json:"issued_at"`
+	Revoked     bool      `json:"revoked"`
+	RevokedAt   time.Time `json:"revoked_at,omitempty"`
+
+	// Hash is omitted from API responses, which clear it.
+	Hash string `json:"hash,omitempty"`
+}
+
+// Authority issues and checks join tokens and worker credentials, persisting
+// them to a state file when it has a path. It is safe for concurrent use.
+type Authority struct {
+	path string
+	now  func() time.Time
+
+	// sharedHash is the hash of the shared secret, if there is one.
+	sharedHash string
+
+	mu          sync.Mutex
+	tokens      map[string]*JoinToken
+	credentials map[string]*Credential
+
+	// revokedCertificates are the serials of client certificates whose
+	// worker was revoked, which can't be admitted again.
+	revokedCertificates map[string]bool
+}
+
+type state struct {
+	Version             int           `json:"version"`
+	Tokens              []*JoinToken  `json:"tokens"`
+	Credentials         []*Credential `json:"credentials"`
+	RevokedCertificates []string      `json:"revoked_certificates,omitempty"`
+}
+
+// Open loads the authority persisted at path, or starts an empty one if the
+// file doesn't exist yet. An empty path keeps everything in memory.
+func Open(path string) (*Authority, error) {
+	a := &Authority{
+		path:        path,
+		now:         time.Now,
+		tokens:      make(map[string]*JoinToken),
+		credentials: make(map[string]*Credential),
+
+		revokedCertificates: make(map[string]bool),
+	}
+	if path == "" {
+		return a, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error reading auth state [%s]: %v", path, err)
+	}
+
+	var s state
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("Error decoding auth state [%s]: %v", path, err)
+	}
+	if s.Version != STATE_VERSION {
+		return nil, fmt.Errorf("Unsupported auth state version %d", s.Version)
+	}
+	for _, t := range s.Tokens {
+		a.tokens[t.ID] = t
+	}
+	for _, c := range s.Credentials {
+		a.credentials[c.WorkerID] = c
+	}
+	for _, serial := range s.RevokedCertificates {
+		a.revokedCertificates[serial] = true
+	}
+	return a, nil
+}
+
+// SetSharedSecret lets minds join with secret as well as with join tokens.
+// Unlike tokens, the shared secret never expires and isn't persisted.
+func (a *Authority) SetSharedSecret(secret string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.sharedHash = ""
+	if secret != "" {
+		a.sharedHash = hash(secret)
+	}
+}
+
+// IssueToken creates a join token valid for ttl and returns it with its
+// secret, which can't be recovered later.
+func (a *Authority) IssueToken(ttl time.Duration, hostname string, singleUse bool) (string, JoinToken, error) {
+	if ttl <= 0 {
+		return "", JoinToken{}, errors.New("Join token TTL must be positive")
+	}
+	if hostname != "" {
+		if _, err := path.Match(hostname, ""); err != nil {
+			return "", JoinToken{}, fmt.Errorf("Invalid hostname pattern [%s]: %v", hostname, err)
+		}
+	}
+
+	id, secret, err := newSecret()
+	if err != nil {
+		return "", JoinToken{}, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := a.now()
+	t := &JoinToken{
+		ID:        id,
+		Hostname:  hostname,
+		SingleUse: singleUse,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+		Hash:      hash(secret),
+	}
+	a.tokens[id] = t
+	if err := a.save(); err != nil {
+		delete(a.tokens, id)
+		return "", JoinToken{}, err
+	}
+	return id + "." + secret, *t, nil
+}
+
+// Tokens lists the join tokens, newest first.
+func (a *Authority) Tokens() []JoinToken {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	tokens := make([]JoinToken, 0, len(a.tokens))
+	for _, t := range a.tokens {
+		tokens = append(tokens, *t)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		if !tokens[i].CreatedAt.Equal(tokens[j].CreatedAt) {
+			return tokens[i].CreatedAt.After(tokens[j].CreatedAt)
+		}
+		return tokens[i].ID < tokens[j].ID
+	})
+	return tokens
+}
+
+// RevokeToken stops a join token from registering more workers. Workers that
+// already registered with it keep their credentials.
+func (a *Authority) RevokeToken(id string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	t, ok := a.tokens[id]
+	if !ok {
+		return ErrNotFound
+	}
+	t.Revoked = true
+	return a.save()
+}
+
+// Register spends a join token for a worker reporting hostname, and returns
+// the worker's new credential. Errors wrap ErrInvalidToken, with the reason
+// the token was refused.
+func (a *Authority) Register(token, workerID, hostname string) (string, error) {
+	if token == "" {
+		return "", fmt.Errorf("%w: missing token", ErrInvalidToken)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var t *JoinToken
+	if a.sharedHash != "" && matches(a.sharedHash, token) {
+		t = &JoinToken{ID: SHARED_TOKEN_ID}
+	} else {
+		id, secret, ok := strings.Cut(token, ".")
+		if !ok {
+			return "", fmt.Errorf("%w: malformed token", ErrInvalidToken)
+		}
+		t, ok = a.tokens[id]
+		if !ok || !matches(t.Hash, secret) {
+			return "", fmt.Errorf("%w: unknown token", ErrInvalidToken)
+		}
+		if err := t.usable(a.now()); err != nil {
+			return "", fmt.Errorf("%w: %v", ErrInvalidToken, err)
+		}
+		if t.Hostname != "" {
+			if matched, _ := path.Match(t.Hostname, hostname); !matched {
+				return "", fmt.Errorf("%w: hostname [%s] doesn't match [%s]", ErrInvalidToken, hostname, t.Hostname)
+			}
+		}
+	}
+
+	t.Uses++
+	credential, err := a.issueCredential(&Credential{WorkerID: workerID, Hostname: hostname, TokenID: t.ID})
+	if err != nil {
+		t.Uses--
+		return "", err
+	}
+	return credential, nil
+}
+
+// Admit returns a new credential for a worker that authenticated otherwise,
+// with the client certificate of serial naming hostname. Errors wrap
+// ErrInvalidToken if the certificate's worker was revoked.
+func (a *Authority) Admit(workerID, hostname, serial string) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if serial == "" {
+		return "", fmt.Errorf("%w: missing certificate serial", ErrInvalidToken)
+	}
+	if a.revokedCertificates[serial] {
+		return "", fmt.Errorf("%w: certificate [%s] was revoked", ErrInvalidToken, serial)
+	}
+	return a.issueCredential(&Credential{WorkerID: workerID, Hostname: hostname, TokenID: CERTIFICATE_TOKEN_ID, Certificate: serial})
+}
+
+// issueCredential stores c with a new secret, and returns it. The caller
+// holds mu.
+func (a *Authority) issueCredential(c *Credential) (string, error) {
+	_, secret, err := newSecret()
+	if err != nil {
+		return "", err
+	}
+	c.IssuedAt = a.now()
+	c.Hash = hash(secret)
+	a.credentials[c.WorkerID] = c
+	if err := a.save(); err != nil {
+		delete(a.credentials, c.WorkerID)
+		return "", err
+	}
+	return c.WorkerID + "." + secret, nil
+}
+
+// Verify checks a worker credential and returns the worker it belongs to.
+// Errors wrap ErrInvalidCredential, and also ErrRevokedCredential for a
+// credential that was revoked, as opposed to one that is unknown.
+func (a *Authority) Verify(credential string) (Credential, error) {
+	workerID, secret, ok := strings.Cut(credential, ".")
+	if !ok {
+		return Credential{}, fmt.Errorf("%w: malformed credential", ErrInvalidCredential)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	c, ok := a.credentials[workerID]
+	if !ok || !matches(c.Hash, secret) {
+		return Credential{}, fmt.Errorf("%w: unknown credential", ErrInvalidCredential)
+	}
+	if c.Revoked {
+		return Credential{}, fmt.Errorf("%w: %w", ErrInvalidCredential, ErrRevokedCredential)
+	}
+	return *c, nil
+}
+
+// Credentials lists the worker credentials, oldest first.
+func (a *Authority) Credentials() []Credential {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	credentials := make([]Credential, 0, len(a.credentials))
+	for _, c := range a.credentials {
+		credentials = append(credentials, *c)
+	}
+	sort.Slice(credentials, func(i, j int) bool {
+		if !credentials[i].IssuedAt.Equal(credentials[j].IssuedAt) {
+			return credentials[i].IssuedAt.Before(credentials[j].IssuedAt)
+		}
+		return credentials[i].WorkerID < credentials[j].WorkerID
+	})
+	return credentials
+}
+
+// RevokeCredential kicks a worker out. A worker admitted with a client
+// certificate can't join with that certificate again.
+func (a *Authority) RevokeCredential(workerID string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	c, ok := a.credentials[workerID]
+	if !ok {
+		return ErrNotFound
+	}
+	c.Revoked = true
+	c.RevokedAt = a.now()
+	if c.Certificate != "" {
+		a.revokedCertificates[c.Certificate] = true
+	}
+	return a.save()
+}
+
+// save persists the state, the caller holds mu.
+func (a *Authority) save() error {
+	if a.path == "" {
+		return nil
+	}
+
+	s := state{Version: STATE_VERSION}
+	for _, t := range a.tokens {
+		s.Tokens = append(s.Tokens, t)
+	}
+	for _, c := range a.credentials {
+		s.Credentials = append(s.Credentials, c)
+	}
+	for serial := range a.revokedCertificates {
+		s.RevokedCertificates = append(s.RevokedCertificates, serial)
+	}
+	sort.Strings(s.RevokedCertificates)
+	sort.Slice(s.Tokens, func(i, j int) bool { return s.Tokens[i].ID < s.Tokens[j].ID })
+	sort.Slice(s.Credentials, func(i, j int) bool { return s.Credentials[i].WorkerID < s.Credentials[j].WorkerID })
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return atomicfile.WriteFile(a.path, data, 0o600)
+}
+
+// newSecret returns a random ID and secret.
+func newSecret() (string, string, error) {
+	buf := make([]byte, 8+32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", fmt.Errorf("Error generating secret: %v", err)
+	}
+	return hex.EncodeToString(buf[:8]), base64.RawURLEncoding.EncodeToString(buf[8:]), nil
+}
+
+func hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func matches(stored, secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(hash(secret))) == 1
+}
+
+// BearerToken returns the token of an "Authorization: Bearer <token>"
+// header, or "" without one.
+func BearerToken(header string) string {
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
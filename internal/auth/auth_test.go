@@ -0,0 +1,191 @@
+package auth
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSingleUseTokenIsSpent(t *testing.T) {
+	a, _ := Open("")
+	token, _, err := a.IssueToken(time.Hour, "", true)
+	if err != nil {
+		t.Fatalf("Error issuing token: %v", err)
+	}
+
+	credential, err := a.Register(token, "worker-1", "mind-1")
+	if err != nil {
+		t.Fatalf("Error registering: %v", err)
+	}
+	if c, err := a.Verify(credential); err != nil || c.WorkerID != "worker-1" {
+		t.Fatalf("Expected the credential of worker-1, got %+v %v", c, err)
+	}
+
+	if _, err := a.Register(token, "worker-2", "mind-2"); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("Expected a spent token to be refused, got %v", err)
+	}
+}
+
+func TestTokenExpiresAndIsScoped(t *testing.T) {
+	a, _ := Open("")
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	a.now = func() time.Time { return now }
+
+	token, _, err := a.IssueToken(time.Hour, "mind-*", false)
+	if err != nil {
+		t.Fatalf("Error issuing token: %v", err)
+	}
+
+	if _, err := a.Register(token, "worker-1", "laptop"); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("Expected a hostname outside the scope to be refused, got %v", err)
+	}
+	if _, err := a.Register(token, "worker-1", "mind-1"); err != nil {
+		t.Fatalf("Error registering: %v", err)
+	}
+	if _, err := a.Register(token, "worker-2", "mind-2"); err != nil {
+		t.Fatalf("Expected a reusable token to register twice, got %v", err)
+	}
+
+	now = now.Add(time.Hour)
+	if _, err := a.Register(token, "worker-3", "mind-3"); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("Expected an expired token to be refused, got %v", err)
+	}
+}
+
+func TestRevokedTokenAndCredential(t *testing.T) {
+	a, _ := Open("")
+	token, joinToken, _ := a.IssueToken(time.Hour, "", false)
+	credential, err := a.Register(token, "worker-1", "mind-1")
+	if err != nil {
+		t.Fatalf("Error registering: %v", err)
+	}
+
+	if err := a.RevokeToken(joinToken.ID); err != nil {
+		t.Fatalf("Error revoking token: %v", err)
+	}
+	if _, err := a.Register(token, "worker-2", "mind-2"); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("Expected a revoked token to be refused, got %v", err)
+	}
+	if _, err := a.Verify(credential); err != nil {
+		t.Fatalf("Expected workers to outlive their token, got %v", err)
+	}
+
+	if err := a.RevokeCredential("worker-1"); err != nil {
+		t.Fatalf("Error revoking credential: %v", err)
+	}
+	if _, err := a.Verify(credential); !errors.Is(err, ErrInvalidCredential) || !errors.Is(err, ErrRevokedCredential) {
+		t.Fatalf("Expected a revoked credential to be refused, got %v", err)
+	}
+	if _, err := a.Verify("worker-9.secret"); errors.Is(err, ErrRevokedCredential) {
+		t.Fatalf("Expected an unknown credential not to be revoked, got %v", err)
+	}
+	if err := a.RevokeCredential("worker-9"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected an unknown worker not to be found, got %v", err)
+	}
+}
+
+func TestSharedSecret(t *testing.T) {
+	a, _ := Open("")
+	if _, err := a.Register("hunter2", "worker-1", "mind-1"); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("Expected no shared secret to be accepted yet, got %v", err)
+	}
+
+	a.SetSharedSecret("hunter2")
+	credential, err := a.Register("hunter2", "worker-1", "mind-1")
+	if err != nil {
+		t.Fatalf("Error registering with the shared secret: %v", err)
+	}
+	if c, err := a.Verify(credential); err != nil || c.TokenID != SHARED_TOKEN_ID {
+		t.Fatalf("Expected a credential from the shared secret, got %+v %v", c, err)
+	}
+	if _, err := a.Register("", "worker-2", "mind-2"); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("Expected a missing token to be refused, got %v", err)
+	}
+}
+
+func TestRevokedCertificateCantBeAdmitted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.json")
+	a, _ := Open(path)
+	if _, err := a.Admit("worker-1", "mind-1", "1f"); err != nil {
+		t.Fatalf("Error admitting worker: %v", err)
+	}
+	if err := a.RevokeCredential("worker-1"); err != nil {
+		t.Fatalf("Error revoking worker: %v", err)
+	}
+
+	reopened, _ := Open(path)
+	if _, err := reopened.Admit("worker-2", "mind-1", "1f"); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("Expected the revoked certificate to be refused, got %v", err)
+	}
+	if _, err := reopened.Admit("worker-3", "mind-1", "2a"); err != nil {
+		t.Fatalf("Expected a certificate issued again to be admitted, got %v", err)
+	}
+}
+
+func TestStatePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.json")
+	a, err := Open(path)
+	if err != nil {
+		t.Fatalf("Error opening authority: %v", err)
+	}
+	token, _, _ := a.IssueToken(time.Hour, "", false)
+	credential, err := a.Register(token, "worker-1", "mind-1")
+	if err != nil {
+		t.Fatalf("Error registering: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Error reading state: %v", err)
+	}
+	for _, handedOut := range []string{token, credential} {
+		_, secret, _ := strings.Cut(handedOut, ".")
+		if strings.Contains(string(data), secret) {
+			t.Fatalf("Expected the state to only keep hashes, found %s", secret)
+		}
+	}
+
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatalf("Error reopening authority: %v", err)
+	}
+	if _, err := reopened.Verify(credential); err != nil {
+		t.Fatalf("Expected the credential to survive a restart, got %v", err)
+	}
+	if tokens := reopened.Tokens(); len(tokens) != 1 || tokens[0].Uses != 1 {
+		t.Fatalf("Expected the token and its use to survive a restart, got %+v", tokens)
+	}
+}
+
+func TestKeyring(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	keys := `[
+		{"name": "grafana", "role": "viewer", "key": "viewer-key"},
+		{"name": "oncall", "role": "Operator", "sha256": "` + hash("operator-key") + `"}
+	]`
+	if err := os.WriteFile(path, []byte(keys), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	k, err := LoadKeyring(path)
+	if err != nil {
+		t.Fatalf("Error loading keys: %v", err)
+	}
+	if p, ok := k.Authenticate("viewer-key"); !ok || p.Name != "grafana" || p.Role != RoleViewer {
+		t.Fatalf("Expected grafana as a viewer, got %+v %v", p, ok)
+	}
+	if p, ok := k.Authenticate("operator-key"); !ok || p.Role != RoleOperator {
+		t.Fatalf("Expected oncall as an operator, got %+v %v", p, ok)
+	}
+	if _, ok := k.Authenticate("sha256:" + hash("operator-key")); ok {
+		t.Fatalf("Expected the hash not to authenticate")
+	}
+
+	os.WriteFile(path, []byte(`[{"name": "root", "role": "superuser", "key": "x"}]`), 0o600)
+	if _, err := LoadKeyring(path); err == nil {
+		t.Fatalf("Expected an unknown role to be refused")
+	}
+}
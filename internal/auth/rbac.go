@@ -0,0 +1,159 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Role is what a caller of the conductor API may do. Each role may do what
+// the roles below it may.
+type Role int
+
+const (
+	// RolePublic marks routes anyone may call, such as probes.
+	RolePublic Role = iota
+	RoleViewer
+	RoleOperator
+	RoleAdmin
+)
+
+var roleNames = map[Role]string{
+	RolePublic:   "public",
+	RoleViewer:   "viewer",
+	RoleOperator: "operator",
+	RoleAdmin:    "admin",
+}
+
+func (r Role) String() string {
+	if name, ok := roleNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("Role(%d)", int(r))
+}
+
+// ParseRole parses viewer, operator or admin.
+func ParseRole(name string) (Role, error) {
+	for role, roleName := range roleNames {
+		if role != RolePublic && strings.EqualFold(name, roleName) {
+			return role, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown role [%s], use viewer, operator or admin", name)
+}
+
+func (r Role) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func (r *Role) UnmarshalText(text []byte) error {
+	role, err := ParseRole(string(text))
+	if err != nil {
+		return err
+	}
+	*r = role
+	return nil
+}
+
+// Principal is an authenticated caller.
+type Principal struct {
+	Name string
+	Role Role
+}
+
+// APIKey grants a role to callers presenting it as a bearer token. Keys
+// files give either the key itself or its hex SHA-256, so that the file
+// doesn't have to hold the secret:
+//
+//	[
+//	  {"name": "grafana", "role": "viewer", "key": "..."},
+//	  {"name": "oncall", "role": "operator", "sha256": "9f86d0..."}
+//	]
+type APIKey struct {
+	Name   string `json:"name"`
+	Role   Role   `json:"role"`
+	Key    string `json:"key,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// Keyring holds the API keys of the conductor.
+type Keyring struct {
+	keys []APIKey
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{}
+}
+
+// LoadKeyring reads a keys file.
+func LoadKeyring(path string) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading API keys [%s]: %v", path, err)
+	}
+	var keys []APIKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("Error decoding API keys [%s]: %v", path, err)
+	}
+
+	k := NewKeyring()
+	for _, key := range keys {
+		if err := k.add(key); err != nil {
+			return nil, fmt.Errorf("Invalid API key in [%s]: %v", path, err)
+		}
+	}
+	return k, nil
+}
+
+// Add grants role to callers presenting key.
+func (k *Keyring) Add(name string, role Role, key string) error {
+	return k.add(APIKey{Name: name, Role: role, Key: key})
+}
+
+func (k *Keyring) add(key APIKey) error {
+	if key.Name == "" {
+		return errors.New("API key without a name")
+	}
+	if key.Role == RolePublic {
+		return fmt.Errorf("API key [%s] without a role", key.Name)
+	}
+	switch {
+	case key.Key != "" && key.SHA256 != "":
+		return fmt.Errorf("API key [%s] has both a key and a SHA-256", key.Name)
+	case key.Key != "":
+		key.SHA256 = hash(key.Key)
+		key.Key = ""
+	case len(key.SHA256) == 64:
+		key.SHA256 = strings.ToLower(key.SHA256)
+	default:
+		return fmt.Errorf("API key [%s] needs a key or a hex SHA-256", key.Name)
+	}
+	k.keys = append(k.keys, key)
+	return nil
+}
+
+func (k *Keyring) Len() int {
+	return len(k.keys)
+}
+
+// Authenticate returns the principal presenting token.
+func (k *Keyring) Authenticate(token string) (Principal, bool) {
+	if token == "" {
+		return Principal{}, false
+	}
+	// Every key is compared, so timing doesn't tell which one matched.
+	sum := hash(token)
+	var found *APIKey
+	for i := range k.keys {
+		if subtle.ConstantTimeCompare([]byte(k.keys[i].SHA256), []byte(sum)) == 1 {
+			found = &k.keys[i]
+		}
+	}
+	if found == nil {
+		return Principal{}, false
+	}
+	return Principal{Name: found.Name, Role: found.Role}, true
+}
@@ -2,6 +2,7 @@ package bungie
 
 import (
 	"encoding/json"
+	"fmt"
 	"time"
 )
 
@@ -57,6 +58,15 @@ type DestinyUserInfo struct {
 	BungieGlobalDisplayNameCode int         `json:"bungieGlobalDisplayNameCode"`
 }
 
+// BungieName returns the player's "Name#1234" Bungie name, or an empty
+// string for players that never claimed one.
+func (u DestinyUserInfo) BungieName() string {
+	if u.BungieGlobalDisplayName == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s#%04d", u.BungieGlobalDisplayName, u.BungieGlobalDisplayNameCode)
+}
+
 type Values struct {
 	Assists           float64 `json:"assists"`
 	Completed         float64 `json:"completed"`
@@ -73,11 +83,24 @@ type Values struct {
 	StartSeconds      float64 `json:"startSeconds"`
 	TimePlayedSeconds float64 `json:"timePlayedSeconds"`
 	PlayerCount       float64 `json:"playerCount"`
+	Team              float64 `json:"team"`
 	TeamScore         float64 `json:"teamScore"`
 }
 
 type Extended struct {
-	Values ExtendedValues `json:"values"`
+	Weapons []Weapon       `json:"weapons"`
+	Values  ExtendedValues `json:"values"`
+}
+
+type Weapon struct {
+	ReferenceID json.Number  `json:"referenceId"`
+	Values      WeaponValues `json:"values"`
+}
+
+type WeaponValues struct {
+	UniqueWeaponKills               float64 `json:"uniqueWeaponKills"`
+	UniqueWeaponPrecisionKills      float64 `json:"uniqueWeaponPrecisionKills"`
+	UniqueWeaponKillsPrecisionKills float64 `json:"uniqueWeaponKillsPrecisionKills"`
 }
 
 type ExtendedValues struct {
@@ -0,0 +1,18 @@
+package bungie
+
+import "testing"
+
+func TestBungieNamePadsTheCode(t *testing.T) {
+	for _, c := range []struct {
+		user DestinyUserInfo
+		want string
+	}{
+		{DestinyUserInfo{BungieGlobalDisplayName: "Foo", BungieGlobalDisplayNameCode: 42}, "Foo#0042"},
+		{DestinyUserInfo{BungieGlobalDisplayName: "Foo", BungieGlobalDisplayNameCode: 1234}, "Foo#1234"},
+		{DestinyUserInfo{DisplayName: "Foo"}, ""},
+	} {
+		if got := c.user.BungieName(); got != c.want {
+			t.Fatalf("Expected %q, got %q", c.want, got)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package career
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	bungie "github.com/deahtstroke/protheon/internal/bungie/types"
+)
+
+// Key identifies one character of one player. Aggregates for a whole player,
+// over all their characters, have an empty CharacterID.
+type Key struct {
+	MembershipID   string `json:"membershipId"`
+	MembershipType int    `json:"membershipType"`
+	CharacterID    string `json:"characterId,omitempty"`
+}
+
+func (k Key) String() string {
+	if k.CharacterID == "" {
+		return fmt.Sprintf("%d/%s", k.MembershipType, k.MembershipID)
+	}
+	return fmt.Sprintf("%d/%s/%s", k.MembershipType, k.MembershipID, k.CharacterID)
+}
+
+func (k Key) less(o Key) bool {
+	if k.MembershipType != o.MembershipType {
+		return k.MembershipType < o.MembershipType
+	}
+	if k.MembershipID != o.MembershipID {
+		return k.MembershipID < o.MembershipID
+	}
+	return k.CharacterID < o.CharacterID
+}
+
+// Totals are the counters kept per character and per mode. They are whole
+// numbers, so summing partials gives the same result in any order.
+type Totals struct {
+	Activities        int64 `json:"activities"`
+	Completions       int64 `json:"completions"`
+	Kills             int64 `json:"kills"`
+	Deaths            int64 `json:"deaths"`
+	Assists           int64 `json:"assists"`
+	PrecisionKills    int64 `json:"precisionKills"`
+	AbilityKills      int64 `json:"abilityKills"`
+	TimePlayedSeconds int64 `json:"timePlayedSeconds"`
+}
+
+func (t *Totals) Add(o Totals) {
+	t.Activities += o.Activities
+	t.Completions += o.Completions
+	t.Kills += o.Kills
+	t.Deaths += o.Deaths
+	t.Assists += o.Assists
+	t.PrecisionKills += o.PrecisionKills
+	t.AbilityKills += o.AbilityKills
+	t.TimePlayedSeconds += o.TimePlayedSeconds
+}
+
+// KD is kills over deaths, or kills when the player never died.
+func (t Totals) KD() float64 {
+	if t.Deaths == 0 {
+		return float64(t.Kills)
+	}
+	return float64(t.Kills) / float64(t.Deaths)
+}
+
+func entryTotals(entry bungie.Entry) Totals {
+	values := entry.Values
+	extended := entry.Extended.Values
+	totals := Totals{
+		Activities:        1,
+		Kills:             count(values.Kills),
+		Deaths:            count(values.Deaths),
+		Assists:           count(values.Assists),
+		PrecisionKills:    count(extended.PrecisionKills),
+		AbilityKills:      count(extended.WeaponKillsGrenade + extended.WeaponKillsMelee + extended.WeaponKillsSuper + extended.WeaponKillsAbility),
+		TimePlayedSeconds: count(values.TimePlayedSeconds),
+	}
+	if values.Completed == 1 {
+		totals.Completions = 1
+	}
+	return totals
+}
+
+func count(v float64) int64 {
+	return int64(math.Round(v))
+}
+
+// Aggregate is the running career of one character, or of a whole player.
+type Aggregate struct {
+	Key
+	DisplayName string           `json:"displayName,omitempty"`
+	BungieName  string           `json:"bungieName,omitempty"`
+	FirstPlayed time.Time        `json:"firstPlayed"`
+	LastPlayed  time.Time        `json:"lastPlayed"`
+	Totals      Totals           `json:"totals"`
+	Modes       map[int32]Totals `json:"modes"`
+}
+
+// Merge adds o's counters to a. Names are taken from whichever aggregate was
+// played last, with ties broken by name, so merging is deterministic.
+func (a *Aggregate) Merge(o *Aggregate) {
+	if a.FirstPlayed.IsZero() || (!o.FirstPlayed.IsZero() && o.FirstPlayed.Before(a.FirstPlayed)) {
+		a.FirstPlayed = o.FirstPlayed
+	}
+	if o.LastPlayed.After(a.LastPlayed) ||
+		(o.LastPlayed.Equal(a.LastPlayed) && o.BungieName+o.DisplayName > a.BungieName+a.DisplayName) {
+		a.LastPlayed = o.LastPlayed
+		a.DisplayName = o.DisplayName
+		a.BungieName = o.BungieName
+	}
+
+	a.Totals.Add(o.Totals)
+	if a.Modes == nil {
+		a.Modes = make(map[int32]Totals, len(o.Modes))
+	}
+	for mode, totals := range o.Modes {
+		t := a.Modes[mode]
+		t.Add(totals)
+		a.Modes[mode] = t
+	}
+}
+
+func (a *Aggregate) clone() *Aggregate {
+	c := &Aggregate{Key: a.Key}
+	c.Merge(a)
+	return c
+}
+
+// Partial is a mergeable set of aggregates. Each mind keeps a partial over
+// the PGCRs it handled, and partials merge into the same result regardless of
+// how PGCRs were spread over minds or in which order partials are merged.
+// Partials don't deduplicate PGCRs, that is the dedupe store's job. It is safe
+// for concurrent use.
+type Partial struct {
+	mu         sync.RWMutex
+	aggregates map[Key]*Aggregate
+}
+
+func NewPartial() *Partial {
+	return &Partial{aggregates: make(map[Key]*Aggregate)}
+}
+
+// Add counts every entry of the PGCR towards its character's aggregate.
+func (p *Partial) Add(pgcr *bungie.PGCR) {
+	mode := int32(0)
+	if n, err := strconv.ParseInt(pgcr.ActivityDetails.Mode.String(), 10, 32); err == nil {
+		mode = int32(n)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, entry := range pgcr.Entries {
+		user := entry.Player.DestinyUserInfo
+		key := Key{
+			MembershipID:   user.MembershipID.String(),
+			MembershipType: user.MembershipType,
+			CharacterID:    entry.CharacterID,
+		}
+		if key.MembershipID == "" {
+			continue
+		}
+
+		totals := entryTotals(entry)
+		p.merge(&Aggregate{
+			Key:         key,
+			DisplayName: user.DisplayName,
+			BungieName:  user.BungieName(),
+			FirstPlayed: pgcr.Period,
+			LastPlayed:  pgcr.Period,
+			Totals:      totals,
+			Modes:       map[int32]Totals{mode: totals},
+		})
+	}
+}
+
+// Merge adds every aggregate of o to p.
+func (p *Partial) Merge(o *Partial) {
+	aggregates := o.Aggregates()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i := range aggregates {
+		p.merge(&aggregates[i])
+	}
+}
+
+func (p *Partial) merge(a *Aggregate) {
+	current, ok := p.aggregates[a.Key]
+	if !ok {
+		p.aggregates[a.Key] = a.clone()
+		return
+	}
+	current.Merge(a)
+}
+
+func (p *Partial) Len() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return len(p.aggregates)
+}
+
+// Get returns the aggregate of one character.
+func (p *Partial) Get(key Key) (Aggregate, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	a, ok := p.aggregates[key]
+	if !ok {
+		return Aggregate{}, false
+	}
+	return *a.clone(), true
+}
+
+// Characters returns the aggregates of every character of a player, ordered
+// by character ID.
+func (p *Partial) Characters(membershipID string) []Aggregate {
+	var characters []Aggregate
+	for _, a := range p.Aggregates() {
+		if a.MembershipID == membershipID {
+			characters = append(characters, a)
+		}
+	}
+	return characters
+}
+
+// Player returns a player's career over all their characters.
+func (p *Partial) Player(membershipID string) (Aggregate, bool) {
+	characters := p.Characters(membershipID)
+	if len(characters) == 0 {
+		return Aggregate{}, false
+	}
+
+	player := Aggregate{Key: Key{MembershipID: membershipID, MembershipType: characters[0].MembershipType}}
+	for i := range characters {
+		player.Merge(&characters[i])
+	}
+	return player, true
+}
+
+// Players returns the career of every player over all their characters,
+// ordered by key.
+func (p *Partial) Players() []Aggregate {
+	var players []Aggregate
+	index := make(map[string]int)
+	for _, a := range p.Aggregates() {
+		i, ok := index[a.MembershipID]
+		if !ok {
+			i = len(players)
+			index[a.MembershipID] = i
+			players = append(players, Aggregate{Key: Key{MembershipID: a.MembershipID, MembershipType: a.MembershipType}})
+		}
+		players[i].Merge(&a)
+	}
+	return players
+}
+
+// Aggregates returns copies of every aggregate, ordered by key.
+func (p *Partial) Aggregates() []Aggregate {
+	p.mu.RLock()
+	aggregates := make([]Aggregate, 0, len(p.aggregates))
+	for _, a := range p.aggregates {
+		aggregates = append(aggregates, *a.clone())
+	}
+	p.mu.RUnlock()
+
+	sort.Slice(aggregates, func(i, j int) bool {
+		return aggregates[i].Key.less(aggregates[j].Key)
+	})
+	return aggregates
+}
+
+func (p *Partial) MarshalJSON() ([]byte, error) {
+	return json.Marshal(partialFile{Version: PARTIAL_VERSION, Aggregates: p.Aggregates()})
+}
+
+func (p *Partial) UnmarshalJSON(data []byte) error {
+	var file partialFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return err
+	}
+	if file.Version != PARTIAL_VERSION {
+		return fmt.Errorf("Unsupported career partial version %d", file.Version)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.aggregates = make(map[Key]*Aggregate, len(file.Aggregates))
+	for i := range file.Aggregates {
+		p.merge(&file.Aggregates[i])
+	}
+	return nil
+}
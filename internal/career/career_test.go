@@ -0,0 +1,148 @@
+package career
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	bungie "github.com/deahtstroke/protheon/internal/bungie/types"
+)
+
+func entry(membershipID, characterID, name string, kills, deaths float64, completed bool) bungie.Entry {
+	e := bungie.Entry{
+		Player: bungie.Player{
+			DestinyUserInfo: bungie.DestinyUserInfo{
+				MembershipID:                json.Number(membershipID),
+				MembershipType:              3,
+				BungieGlobalDisplayName:     name,
+				BungieGlobalDisplayNameCode: 1234,
+			},
+		},
+		CharacterID: characterID,
+		Values:      bungie.Values{Kills: kills, Deaths: deaths, TimePlayedSeconds: 600},
+	}
+	e.Extended.Values.PrecisionKills = kills / 2
+	e.Extended.Values.WeaponKillsGrenade = 1
+	e.Extended.Values.WeaponKillsSuper = 2
+	if completed {
+		e.Values.Completed = 1
+	}
+	return e
+}
+
+func pgcrs() []*bungie.PGCR {
+	day := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+	return []*bungie.PGCR{
+		{
+			Period:          day,
+			ActivityDetails: bungie.ActivityDetails{InstanceID: "1", Mode: "4"},
+			Entries: []bungie.Entry{
+				entry("100", "1", "Old", 10, 1, true),
+				entry("200", "2", "Other", 4, 3, true),
+			},
+		},
+		{
+			Period:          day.Add(time.Hour),
+			ActivityDetails: bungie.ActivityDetails{InstanceID: "2", Mode: "5"},
+			Entries:         []bungie.Entry{entry("100", "1", "New", 20, 5, false)},
+		},
+		{
+			Period:          day.Add(2 * time.Hour),
+			ActivityDetails: bungie.ActivityDetails{InstanceID: "3", Mode: "4"},
+			Entries:         []bungie.Entry{entry("100", "3", "New", 6, 0, true)},
+		},
+	}
+}
+
+func TestPartialAggregatesCharactersAndModes(t *testing.T) {
+	p := NewPartial()
+	for _, pgcr := range pgcrs() {
+		p.Add(pgcr)
+	}
+
+	a, ok := p.Get(Key{MembershipID: "100", MembershipType: 3, CharacterID: "1"})
+	if !ok {
+		t.Fatal("Expected character aggregate")
+	}
+	want := Totals{Activities: 2, Completions: 1, Kills: 30, Deaths: 6, PrecisionKills: 15, AbilityKills: 6, TimePlayedSeconds: 1200}
+	if a.Totals != want {
+		t.Fatalf("Expected %+v, got %+v", want, a.Totals)
+	}
+	if a.Modes[4].Kills != 10 || a.Modes[5].Kills != 20 {
+		t.Fatalf("Unexpected mode breakdown: %+v", a.Modes)
+	}
+	if a.BungieName != "New#1234" {
+		t.Fatalf("Expected the latest name, got %s", a.BungieName)
+	}
+
+	player, ok := p.Player("100")
+	if !ok || player.Totals.Activities != 3 || player.Modes[4].Activities != 2 || len(p.Characters("100")) != 2 {
+		t.Fatalf("Unexpected player career: %+v", player)
+	}
+	if !player.FirstPlayed.Equal(pgcrs()[0].Period) || !player.LastPlayed.Equal(pgcrs()[2].Period) {
+		t.Fatalf("Unexpected played range: %v - %v", player.FirstPlayed, player.LastPlayed)
+	}
+
+	players := p.Players()
+	if len(players) != 2 || !reflect.DeepEqual(players[0], player) || players[1].MembershipID != "200" {
+		t.Fatalf("Expected every player's career, got %+v", players)
+	}
+}
+
+func TestPartialMergeIsDeterministic(t *testing.T) {
+	whole := NewPartial()
+	left, right := NewPartial(), NewPartial()
+	for i, pgcr := range pgcrs() {
+		whole.Add(pgcr)
+		if i%2 == 0 {
+			left.Add(pgcr)
+		} else {
+			right.Add(pgcr)
+		}
+	}
+
+	leftFirst := NewPartial()
+	leftFirst.Merge(left)
+	leftFirst.Merge(right)
+	rightFirst := NewPartial()
+	rightFirst.Merge(right)
+	rightFirst.Merge(left)
+
+	if !reflect.DeepEqual(whole.Aggregates(), leftFirst.Aggregates()) ||
+		!reflect.DeepEqual(leftFirst.Aggregates(), rightFirst.Aggregates()) {
+		t.Fatal("Expected merged partials to match the partial over every PGCR")
+	}
+}
+
+func TestPartialSaveLoadAndCSV(t *testing.T) {
+	p := NewPartial()
+	for _, pgcr := range pgcrs() {
+		p.Add(pgcr)
+	}
+
+	path := filepath.Join(t.TempDir(), "career.json")
+	if err := p.Save(path); err != nil {
+		t.Fatalf("Error saving: %v", err)
+	}
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("Error loading: %v", err)
+	}
+	if !reflect.DeepEqual(p.Aggregates(), loaded.Aggregates()) {
+		t.Fatal("Expected loaded partial to match the saved one")
+	}
+
+	var buf bytes.Buffer
+	if err := WriteCSV(&buf, loaded.Aggregates()); err != nil {
+		t.Fatalf("Error writing CSV: %v", err)
+	}
+	// Header, then each of the three characters has an "all" row and one
+	// row per mode, four modes played in total.
+	if lines := strings.Count(buf.String(), "\n"); lines != 1+3+4 {
+		t.Fatalf("Expected 8 CSV lines, got %d:\n%s", lines, buf.String())
+	}
+}
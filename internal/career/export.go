@@ -0,0 +1,98 @@
+package career
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/deahtstroke/protheon/internal/atomicfile"
+)
+
+const (
+	PARTIAL_VERSION = 1
+)
+
+// partialFile is how a partial is exported, so it can be merged elsewhere.
+type partialFile struct {
+	Version    int         `json:"version"`
+	Aggregates []Aggregate `json:"aggregates"`
+}
+
+// Load reads a partial saved with Save. A missing file is an empty partial.
+func Load(path string) (*Partial, error) {
+	p := NewPartial()
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error reading career partial [%s]: %v", path, err)
+	}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("Error decoding career partial [%s]: %v", path, err)
+	}
+	return p, nil
+}
+
+// Save writes the partial to path through a temporary file, so a crash never
+// leaves a half written partial behind.
+func (p *Partial) Save(path string) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	return atomicfile.WriteFile(path, data, 0o644)
+}
+
+var csvHeader = []string{
+	"membership_type", "membership_id", "character_id", "display_name", "bungie_name", "mode",
+	"first_played", "last_played", "activities", "completions", "kills", "deaths", "assists",
+	"precision_kills", "ability_kills", "time_played_seconds",
+}
+
+// WriteCSV writes one row per aggregate with its overall totals, in the
+// "all" mode, followed by one row per mode played.
+func WriteCSV(w io.Writer, aggregates []Aggregate) error {
+	out := csv.NewWriter(w)
+	if err := out.Write(csvHeader); err != nil {
+		return err
+	}
+
+	for _, a := range aggregates {
+		if err := out.Write(csvRow(a, "all", a.Totals)); err != nil {
+			return err
+		}
+
+		modes := make([]int32, 0, len(a.Modes))
+		for mode := range a.Modes {
+			modes = append(modes, mode)
+		}
+		sort.Slice(modes, func(i, j int) bool { return modes[i] < modes[j] })
+		for _, mode := range modes {
+			if err := out.Write(csvRow(a, strconv.Itoa(int(mode)), a.Modes[mode])); err != nil {
+				return err
+			}
+		}
+	}
+
+	out.Flush()
+	return out.Error()
+}
+
+func csvRow(a Aggregate, mode string, t Totals) []string {
+	return []string{
+		strconv.Itoa(a.MembershipType), a.MembershipID, a.CharacterID, a.DisplayName, a.BungieName, mode,
+		a.FirstPlayed.UTC().Format(time.RFC3339), a.LastPlayed.UTC().Format(time.RFC3339),
+		strconv.FormatInt(t.Activities, 10), strconv.FormatInt(t.Completions, 10),
+		strconv.FormatInt(t.Kills, 10), strconv.FormatInt(t.Deaths, 10), strconv.FormatInt(t.Assists, 10),
+		strconv.FormatInt(t.PrecisionKills, 10), strconv.FormatInt(t.AbilityKills, 10),
+		strconv.FormatInt(t.TimePlayedSeconds, 10),
+	}
+}
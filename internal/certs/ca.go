@@ -0,0 +1,222 @@
+package certs
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/deahtstroke/protheon/internal/atomicfile"
+)
+
+const (
+	CA_CERT_FILE = "ca.crt"
+	CA_KEY_FILE  = "ca.key"
+
+	CA_TTL = 10 * 365 * 24 * time.Hour
+
+	// DEFAULT_CERT_TTL is how long issued certificates are valid, and
+	// RENEW_BEFORE how close to expiring Ensure renews them.
+	DEFAULT_CERT_TTL = 365 * 24 * time.Hour
+	RENEW_BEFORE     = 30 * 24 * time.Hour
+)
+
+// CA is a small certificate authority kept in a directory, for local
+// clusters without one. It issues server certificates for the conductor, and
+// client certificates for minds, which can't serve with them.
+type CA struct {
+	dir  string
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+// OpenCA loads the CA kept in dir, creating it first if dir has none.
+func OpenCA(dir string) (*CA, error) {
+	certFile := filepath.Join(dir, CA_CERT_FILE)
+	keyFile := filepath.Join(dir, CA_KEY_FILE)
+
+	if _, err := os.Stat(certFile); errors.Is(err, os.ErrNotExist) {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, fmt.Errorf("Error creating CA directory [%s]: %v", dir, err)
+		}
+		if err := createCA(certFile, keyFile); err != nil {
+			return nil, err
+		}
+	}
+
+	cert, err := readCert(certFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := readKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &CA{dir: dir, cert: cert, key: key}, nil
+}
+
+func createCA(certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("Error generating CA key: %v", err)
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "Protheon CA", Organization: []string{"Protheon"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(CA_TTL),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return fmt.Errorf("Error creating CA certificate: %v", err)
+	}
+	return writePair(certFile, keyFile, der, key)
+}
+
+// CertFile is the path of the CA's certificate, which clients and servers
+// trust.
+func (ca *CA) CertFile() string {
+	return filepath.Join(ca.dir, CA_CERT_FILE)
+}
+
+// Issue signs a server certificate for name, which is its common name and
+// first DNS name, with hosts as further names. Hosts that are IP addresses
+// are added as such.
+func (ca *CA) Issue(name string, hosts []string, ttl time.Duration, certFile, keyFile string) error {
+	return ca.issue(name, hosts, x509.ExtKeyUsageServerAuth, ttl, certFile, keyFile)
+}
+
+// IssueClient signs a client certificate for name, identifying a mind to the
+// conductor, with hosts as further names like Issue.
+func (ca *CA) IssueClient(name string, hosts []string, ttl time.Duration, certFile, keyFile string) error {
+	return ca.issue(name, hosts, x509.ExtKeyUsageClientAuth, ttl, certFile, keyFile)
+}
+
+func (ca *CA) issue(name string, hosts []string, usage x509.ExtKeyUsage, ttl time.Duration, certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("Error generating key for [%s]: %v", name, err)
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name, Organization: []string{"Protheon"}},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(ttl),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	for _, host := range append([]string{name}, hosts...) {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if host != "" {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return fmt.Errorf("Error signing certificate for [%s]: %v", name, err)
+	}
+	return writePair(certFile, keyFile, der, key)
+}
+
+// Ensure issues a server certificate like Issue unless certFile holds one signed by
+// this CA that isn't about to expire, and reports whether it issued one.
+func (ca *CA) Ensure(name string, hosts []string, ttl time.Duration, certFile, keyFile string) (bool, error) {
+	cert, err := readCert(certFile)
+	if err == nil && cert.CheckSignatureFrom(ca.cert) == nil && time.Until(cert.NotAfter) > RENEW_BEFORE {
+		return false, nil
+	}
+	return true, ca.Issue(name, hosts, ttl, certFile, keyFile)
+}
+
+func newSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("Error generating serial number: %v", err)
+	}
+	return serial, nil
+}
+
+func readCert(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading certificate [%s]: %v", path, err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("No certificate in [%s]", path)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing certificate [%s]: %v", path, err)
+	}
+	return cert, nil
+}
+
+func readKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading key [%s]: %v", path, err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("No private key in [%s]", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing key [%s]: %v", path, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("Key [%s] can't sign", path)
+	}
+	return signer, nil
+}
+
+// writePair writes a certificate and its key, the key first so that a
+// reloader never sees the new certificate with the old key for long.
+func writePair(certFile, keyFile string, der []byte, key crypto.Signer) error {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("Error encoding key: %v", err)
+	}
+	if err := writePEM(keyFile, "PRIVATE KEY", keyDER, 0o600); err != nil {
+		return err
+	}
+	return writePEM(certFile, "CERTIFICATE", der, 0o644)
+}
+
+// writePEM replaces path atomically.
+func writePEM(path, blockType string, der []byte, perm os.FileMode) error {
+	return atomicfile.Write(path, perm, func(w io.Writer) error {
+		return pem.Encode(w, &pem.Block{Type: blockType, Bytes: der})
+	})
+}
@@ -0,0 +1,230 @@
+// Package certs serves the conductor's HTTP API over TLS. Certificates are
+// reloaded from disk when they are rotated, so a renewed certificate is
+// picked up without a restart. With mutual TLS, a mind's client certificate
+// is its identity: the first DNS name of the certificate, or its common name
+// without one.
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/deahtstroke/protheon/internal/logging"
+)
+
+// DEFAULT_RELOAD_INTERVAL is how often certificate files are checked for
+// changes.
+const DEFAULT_RELOAD_INTERVAL = 30 * time.Second
+
+// Reloader holds a certificate and its key loaded from files, and reloads
+// them when the files change. A failed reload keeps the previous
+// certificate.
+type Reloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	leaf    *x509.Certificate
+	stamp   string
+	lastErr error
+}
+
+// NewReloader loads a certificate and its key.
+func NewReloader(certFile, keyFile string) (*Reloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("Both a certificate and a key file are needed")
+	}
+	r := &Reloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// fileStamp identifies the files' versions by size and modification time.
+func (r *Reloader) fileStamp() (string, error) {
+	stamp := ""
+	for _, path := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", fmt.Errorf("Error checking certificate file [%s]: %v", path, err)
+		}
+		stamp += fmt.Sprintf("%d:%d;", info.Size(), info.ModTime().UnixNano())
+	}
+	return stamp, nil
+}
+
+// Reload loads the files again.
+func (r *Reloader) Reload() error {
+	stamp, err := r.fileStamp()
+	if err == nil {
+		err = r.load(stamp)
+	}
+
+	r.mu.Lock()
+	r.lastErr = err
+	r.mu.Unlock()
+	return err
+}
+
+func (r *Reloader) load(stamp string) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("Error loading certificate [%s]: %v", r.certFile, err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("Error parsing certificate [%s]: %v", r.certFile, err)
+	}
+	cert.Leaf = leaf
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.leaf = leaf
+	r.stamp = stamp
+	r.mu.Unlock()
+	return nil
+}
+
+// Watch reloads the certificate whenever its files change, checking every
+// interval until the context is cancelled.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	logger := logging.Component("certs")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			stamp, err := r.fileStamp()
+			r.mu.RLock()
+			changed := stamp != r.stamp
+			r.mu.RUnlock()
+			if err == nil && !changed {
+				continue
+			}
+
+			if err := r.Reload(); err != nil {
+				logger.Error("Error reloading certificate, keeping the previous one", "error", err)
+				continue
+			}
+			logger.Info("Reloaded certificate", "path", r.certFile, "subject", r.Leaf().Subject.String(), "not_after", r.Leaf().NotAfter)
+		}
+	}
+}
+
+// Leaf returns the current certificate.
+func (r *Reloader) Leaf() *x509.Certificate {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.leaf
+}
+
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+func (r *Reloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// Check reports why the certificate needs attention: its last reload failed,
+// or it expired.
+func (r *Reloader) Check(ctx context.Context) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.lastErr != nil {
+		return r.lastErr
+	}
+	if time.Now().After(r.leaf.NotAfter) {
+		return fmt.Errorf("Certificate [%s] expired at %s", r.certFile, r.leaf.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// LoadPool reads the PEM certificates of a CA bundle.
+func LoadPool(caFile string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading CA bundle [%s]: %v", caFile, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("No certificates in CA bundle [%s]", caFile)
+	}
+	return pool, nil
+}
+
+// ServerConfig serves the reloader's certificate. With clientCAs, client
+// certificates are verified against them, and required with
+// requireClientCert.
+func ServerConfig(r *Reloader, clientCAs *x509.CertPool, requireClientCert bool) *tls.Config {
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+	}
+	if clientCAs != nil {
+		config.ClientCAs = clientCAs
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if requireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return config
+}
+
+// ClientConfig trusts the CAs of caFile, or the system's without one, and
+// presents the reloader's certificate when it isn't nil.
+func ClientConfig(caFile string, r *Reloader) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pool, err := LoadPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if r != nil {
+		config.GetClientCertificate = r.GetClientCertificate
+	}
+	return config, nil
+}
+
+// Identity returns the identity of a connection's verified client
+// certificate, or "" without one.
+func Identity(state *tls.ConnectionState) string {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	cert := state.VerifiedChains[0][0]
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	return cert.Subject.CommonName
+}
+
+// Serial returns the serial number of the verified client certificate, in
+// hex, or "" without one. It tells apart certificates issued to the same
+// name.
+func Serial(state *tls.ConnectionState) string {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	if serial := state.VerifiedChains[0][0].SerialNumber; serial != nil {
+		return serial.Text(16)
+	}
+	return ""
+}
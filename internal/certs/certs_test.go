@@ -0,0 +1,165 @@
+package certs
+
+import (
+	"context"
+	"crypto/x509"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMutualTLSIdentifiesMinds(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := OpenCA(filepath.Join(dir, "ca"))
+	if err != nil {
+		t.Fatalf("Error creating CA: %v", err)
+	}
+	serverCert, serverKey := filepath.Join(dir, "conductor.crt"), filepath.Join(dir, "conductor.key")
+	if err := ca.Issue("conductor", []string{"127.0.0.1"}, time.Hour, serverCert, serverKey); err != nil {
+		t.Fatalf("Error issuing server certificate: %v", err)
+	}
+	mindCert, mindKey := filepath.Join(dir, "mind-1.crt"), filepath.Join(dir, "mind-1.key")
+	if err := ca.IssueClient("mind-1", nil, time.Hour, mindCert, mindKey); err != nil {
+		t.Fatalf("Error issuing client certificate: %v", err)
+	}
+
+	serverReloader, err := NewReloader(serverCert, serverKey)
+	if err != nil {
+		t.Fatalf("Error loading server certificate: %v", err)
+	}
+	clientCAs, err := LoadPool(ca.CertFile())
+	if err != nil {
+		t.Fatalf("Error loading CA: %v", err)
+	}
+
+	serve := func(requireClientCert bool) string {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Error listening: %v", err)
+		}
+		server := &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, Identity(r.TLS))
+			}),
+			TLSConfig: ServerConfig(serverReloader, clientCAs, requireClientCert),
+			ErrorLog:  log.New(io.Discard, "", 0),
+		}
+		go server.ServeTLS(listener, "", "")
+		t.Cleanup(func() { server.Close() })
+		return "https://" + listener.Addr().String()
+	}
+
+	get := func(url string, clientReloader *Reloader) (string, error) {
+		config, err := ClientConfig(ca.CertFile(), clientReloader)
+		if err != nil {
+			t.Fatalf("Error configuring client: %v", err)
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+		resp, err := client.Get(url)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body), nil
+	}
+
+	optional := serve(false)
+	if identity, err := get(optional, nil); err != nil || identity != "" {
+		t.Fatalf("Expected no identity without a client certificate, got %q %v", identity, err)
+	}
+	clientReloader, err := NewReloader(mindCert, mindKey)
+	if err != nil {
+		t.Fatalf("Error loading client certificate: %v", err)
+	}
+	if identity, err := get(optional, clientReloader); err != nil || identity != "mind-1" {
+		t.Fatalf("Expected the mind-1 identity, got %q %v", identity, err)
+	}
+
+	required := serve(true)
+	if _, err := get(required, nil); err == nil {
+		t.Fatalf("Expected a connection without a client certificate to be refused")
+	}
+	if identity, err := get(required, clientReloader); err != nil || identity != "mind-1" {
+		t.Fatalf("Expected the mind-1 identity, got %q %v", identity, err)
+	}
+	if _, err := get(required, serverReloader); err == nil {
+		t.Fatalf("Expected a server certificate to be refused as a client certificate")
+	}
+}
+
+func TestReloaderPicksUpRotatedCertificates(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := OpenCA(dir)
+	if err != nil {
+		t.Fatalf("Error creating CA: %v", err)
+	}
+	certFile, keyFile := filepath.Join(dir, "conductor.crt"), filepath.Join(dir, "conductor.key")
+	if err := ca.Issue("old", nil, time.Hour, certFile, keyFile); err != nil {
+		t.Fatalf("Error issuing certificate: %v", err)
+	}
+	r, err := NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Error loading certificate: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Watch(ctx, 10*time.Millisecond)
+
+	// Rotated files may keep their modification time on coarse clocks, the
+	// new name changes their size as well.
+	if err := ca.Issue("rotated-conductor", nil, time.Hour, certFile, keyFile); err != nil {
+		t.Fatalf("Error rotating certificate: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for r.Leaf().Subject.CommonName != "rotated-conductor" {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the rotated certificate to be loaded, still serving %s", r.Leaf().Subject.CommonName)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := r.Check(ctx); err != nil {
+		t.Fatalf("Expected the certificate to be healthy, got %v", err)
+	}
+}
+
+func TestEnsureKeepsValidCertificates(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := OpenCA(dir)
+	if err != nil {
+		t.Fatalf("Error creating CA: %v", err)
+	}
+	certFile, keyFile := filepath.Join(dir, "conductor.crt"), filepath.Join(dir, "conductor.key")
+
+	if issued, err := ca.Ensure("conductor", []string{"localhost"}, DEFAULT_CERT_TTL, certFile, keyFile); err != nil || !issued {
+		t.Fatalf("Expected a certificate to be issued, got %v %v", issued, err)
+	}
+	if issued, err := ca.Ensure("conductor", []string{"localhost"}, DEFAULT_CERT_TTL, certFile, keyFile); err != nil || issued {
+		t.Fatalf("Expected the certificate to be kept, got %v %v", issued, err)
+	}
+	if err := ca.Issue("conductor", nil, RENEW_BEFORE/2, certFile, keyFile); err != nil {
+		t.Fatalf("Error issuing certificate: %v", err)
+	}
+	if issued, _ := ca.Ensure("conductor", nil, DEFAULT_CERT_TTL, certFile, keyFile); !issued {
+		t.Fatalf("Expected a certificate about to expire to be renewed")
+	}
+
+	reopened, err := OpenCA(dir)
+	if err != nil {
+		t.Fatalf("Error reopening CA: %v", err)
+	}
+	cert, err := readCert(certFile)
+	if err != nil {
+		t.Fatalf("Error reading certificate: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(reopened.cert)
+	if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, DNSName: "conductor"}); err != nil {
+		t.Fatalf("Expected the reopened CA to be the same, got %v", err)
+	}
+}
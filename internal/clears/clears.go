@@ -0,0 +1,160 @@
+package clears
+
+import (
+	"strconv"
+	"strings"
+
+	bungie "github.com/deahtstroke/protheon/internal/bungie/types"
+)
+
+const (
+	MODE_RAID    = 4
+	MODE_DUNGEON = 82
+
+	RAID_FIRETEAM_SIZE    = 6
+	DUNGEON_FIRETEAM_SIZE = 3
+
+	// FRESH_JOIN_GRACE is how many seconds into an activity a player may
+	// appear and still count as having been there from the start, loading
+	// in takes a moment.
+	FRESH_JOIN_GRACE = 60
+)
+
+type Kind string
+
+const (
+	Raid    Kind = "raid"
+	Dungeon Kind = "dungeon"
+)
+
+// Classification describes how a raid or dungeon run went.
+type Classification struct {
+	Kind Kind `json:"kind"`
+
+	// Completed is set when anyone in the activity completed it.
+	Completed bool `json:"completed"`
+
+	// StartedFromBeginning is set when the run started at the first
+	// encounter rather than from a checkpoint. FullClear is a completed run
+	// that did, a completed run that didn't is a checkpoint clear.
+	StartedFromBeginning bool `json:"startedFromBeginning"`
+	FullClear            bool `json:"fullClear"`
+	Checkpoint           bool `json:"checkpoint"`
+
+	// Fresh is set when everyone who completed the run was there from the
+	// start, otherwise someone joined partway and the run is partial.
+	Fresh bool `json:"fresh"`
+
+	// Players counts distinct players, however many characters they used,
+	// and Fireteams the distinct fireteams they were in.
+	Players   int `json:"players"`
+	Fireteams int `json:"fireteams"`
+
+	// Lowman is a completion with fewer players than a full fireteam, Solo
+	// one with a single player, and Flawless a full clear nobody died in.
+	Lowman   bool `json:"lowman"`
+	Solo     bool `json:"solo"`
+	Flawless bool `json:"flawless"`
+}
+
+// Classify classifies a raid or dungeon PGCR. It returns false for any other
+// activity.
+func Classify(pgcr *bungie.PGCR) (Classification, bool) {
+	var c Classification
+	switch mode(pgcr) {
+	case MODE_RAID:
+		c.Kind = Raid
+	case MODE_DUNGEON:
+		c.Kind = Dungeon
+	default:
+		return c, false
+	}
+
+	players := make(map[string]bool)
+	fireteams := make(map[float64]bool)
+	deaths := 0.0
+	c.Fresh = true
+	for _, entry := range pgcr.Entries {
+		player := entry.Player.DestinyUserInfo.MembershipID.String()
+		if player == "" {
+			player = "character:" + entry.CharacterID
+		}
+		players[player] = true
+		fireteams[entry.Values.FireteamID] = true
+		deaths += entry.Values.Deaths
+
+		if entry.Values.Completed == 1 {
+			c.Completed = true
+			if entry.Values.StartSeconds > FRESH_JOIN_GRACE {
+				c.Fresh = false
+			}
+		}
+	}
+	c.Players = len(players)
+	c.Fireteams = len(fireteams)
+	if !c.Completed {
+		c.Fresh = false
+	}
+
+	c.StartedFromBeginning = pgcr.ActivityWasStartedFromBeginning ||
+		(pgcr.StartingPhaseIndex != "" && pgcr.StartingPhaseIndex.String() == "0")
+	c.FullClear = c.Completed && c.StartedFromBeginning
+	c.Checkpoint = c.Completed && !c.StartedFromBeginning
+
+	c.Lowman = c.Completed && c.Players < c.Kind.FireteamSize()
+	c.Solo = c.Completed && c.Players == 1
+	c.Flawless = c.FullClear && deaths == 0
+	return c, true
+}
+
+func (k Kind) FireteamSize() int {
+	if k == Dungeon {
+		return DUNGEON_FIRETEAM_SIZE
+	}
+	return RAID_FIRETEAM_SIZE
+}
+
+// Tags lists the classification as short labels, such as
+// "full-clear fresh trio flawless".
+func (c Classification) Tags() []string {
+	var tags []string
+	switch {
+	case c.FullClear:
+		tags = append(tags, "full-clear")
+	case c.Checkpoint:
+		tags = append(tags, "checkpoint")
+	default:
+		return []string{"incomplete"}
+	}
+	if c.Fresh {
+		tags = append(tags, "fresh")
+	} else {
+		tags = append(tags, "partial")
+	}
+	switch {
+	case c.Solo:
+		tags = append(tags, "solo")
+	case c.Lowman && c.Players == 2:
+		tags = append(tags, "duo")
+	case c.Lowman && c.Players == 3:
+		tags = append(tags, "trio")
+	case c.Lowman:
+		tags = append(tags, "lowman-"+strconv.Itoa(c.Players))
+	}
+	if c.Flawless {
+		tags = append(tags, "flawless")
+	}
+	return tags
+}
+
+func (c Classification) String() string {
+	return string(c.Kind) + " " + strings.Join(c.Tags(), " ")
+}
+
+func mode(pgcr *bungie.PGCR) int {
+	n, err := strconv.Atoi(pgcr.ActivityDetails.Mode.String())
+	if err != nil {
+		return 0
+	}
+	return n
+}
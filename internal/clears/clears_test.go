@@ -0,0 +1,79 @@
+package clears
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	bungie "github.com/deahtstroke/protheon/internal/bungie/types"
+)
+
+func entry(membershipID string, fireteam, deaths, startSeconds float64, completed bool) bungie.Entry {
+	e := bungie.Entry{
+		Player: bungie.Player{
+			DestinyUserInfo: bungie.DestinyUserInfo{MembershipID: json.Number(membershipID)},
+		},
+		CharacterID: membershipID + "0",
+		Values:      bungie.Values{FireteamID: fireteam, Deaths: deaths, StartSeconds: startSeconds},
+	}
+	if completed {
+		e.Values.Completed = 1
+	}
+	return e
+}
+
+func run(mode string, fromBeginning bool, entries ...bungie.Entry) *bungie.PGCR {
+	return &bungie.PGCR{
+		ActivityWasStartedFromBeginning: fromBeginning,
+		ActivityDetails:                 bungie.ActivityDetails{Mode: json.Number(mode)},
+		Entries:                         entries,
+	}
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name string
+		pgcr *bungie.PGCR
+		tags []string
+	}{
+		{"flawless trio raid", run("4", true,
+			entry("1", 7, 0, 0, true), entry("2", 7, 0, 0, true), entry("3", 7, 0, 12, true)),
+			[]string{"full-clear", "fresh", "trio", "flawless"}},
+		{"checkpoint six man", run("4", false,
+			entry("1", 7, 1, 0, true), entry("2", 7, 0, 0, true), entry("3", 7, 0, 0, true),
+			entry("4", 7, 0, 0, true), entry("5", 7, 0, 0, true), entry("6", 7, 0, 0, true)),
+			[]string{"checkpoint", "fresh"}},
+		{"partial duo with deaths", run("4", true,
+			entry("1", 7, 2, 0, true), entry("2", 7, 0, 900, true)),
+			[]string{"full-clear", "partial", "duo"}},
+		{"solo flawless dungeon", run("82", true, entry("1", 7, 0, 0, true)),
+			[]string{"full-clear", "fresh", "solo", "flawless"}},
+		{"full dungeon with a character swap", run("82", true,
+			entry("1", 7, 0, 0, true), entry("1", 7, 0, 0, false), entry("2", 7, 0, 0, true), entry("3", 7, 0, 0, true)),
+			[]string{"full-clear", "fresh", "flawless"}},
+		{"incomplete", run("4", true, entry("1", 7, 0, 0, false)), []string{"incomplete"}},
+	}
+
+	for _, tt := range tests {
+		c, ok := Classify(tt.pgcr)
+		if !ok {
+			t.Fatalf("%s: expected a classification", tt.name)
+		}
+		if tags := c.Tags(); !reflect.DeepEqual(tags, tt.tags) {
+			t.Fatalf("%s: expected %v, got %v", tt.name, tt.tags, tags)
+		}
+	}
+}
+
+func TestClassifyCountsPlayersAndFireteams(t *testing.T) {
+	c, _ := Classify(run("4", true, entry("1", 7, 0, 0, true), entry("2", 8, 0, 0, true), entry("1", 7, 0, 0, true)))
+	if c.Players != 2 || c.Fireteams != 2 {
+		t.Fatalf("Expected 2 players in 2 fireteams, got %d in %d", c.Players, c.Fireteams)
+	}
+}
+
+func TestClassifyIgnoresOtherModes(t *testing.T) {
+	if _, ok := Classify(run("5", true, entry("1", 7, 0, 0, true))); ok {
+		t.Fatal("Expected Crucible activities not to be classified")
+	}
+}
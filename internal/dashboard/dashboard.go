@@ -0,0 +1,205 @@
+// Package dashboard serves the conductor's web dashboard: a single page
+// showing ingest progress per file, the workers, the queue and error counts,
+// kept live by a stream of snapshots over Server-Sent Events. The page itself
+// holds no data, so it is public, and its data endpoints are for viewers.
+package dashboard
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/deahtstroke/protheon/internal/api"
+	"github.com/deahtstroke/protheon/internal/logging"
+	"github.com/deahtstroke/protheon/internal/metrics"
+	"github.com/deahtstroke/protheon/internal/rabbitmq"
+)
+
+// DEFAULT_INTERVAL is how often snapshots are sent to the page.
+const DEFAULT_INTERVAL = 2 * time.Second
+
+//go:embed static
+var static embed.FS
+
+// Sources is where snapshots are taken from. Any of them may be nil.
+type Sources struct {
+	Files   func() []metrics.File
+	Workers func() []api.WorkerInfo
+	Queue   func(ctx context.Context) (rabbitmq.QueueStats, error)
+}
+
+type File struct {
+	metrics.File
+	Progress float64 `json:"progress"`
+}
+
+type Queue struct {
+	rabbitmq.QueueStats
+	Error string `json:"error,omitempty"`
+}
+
+// Snapshot is the state the page renders.
+type Snapshot struct {
+	Time    time.Time        `json:"time"`
+	Files   []File           `json:"files"`
+	Workers []api.WorkerInfo `json:"workers"`
+	Queue   *Queue           `json:"queue,omitempty"`
+
+	// Records sums the records of every file by result, such as failed or
+	// quarantined.
+	Records map[string]int64 `json:"records"`
+
+	// Throughput sums the throughput of the workers.
+	Throughput float64 `json:"throughput"`
+}
+
+// Dashboard takes snapshots and serves them. Snapshots are shared by every
+// page for an interval, so the broker is asked about the queue at most once
+// an interval. While a new snapshot is taken, pages are served the previous
+// one rather than waiting for the broker.
+type Dashboard struct {
+	Sources  Sources
+	Interval time.Duration
+
+	mu       sync.Mutex
+	snapshot *Snapshot
+	taking   chan struct{}
+}
+
+func New(sources Sources) *Dashboard {
+	return &Dashboard{Sources: sources, Interval: DEFAULT_INTERVAL}
+}
+
+// Snapshot returns the latest snapshot, taking a new one if it's older than
+// an interval. Only one snapshot is taken at a time, and callers arriving
+// meanwhile get the previous one, or wait for the first.
+func (d *Dashboard) Snapshot(ctx context.Context) *Snapshot {
+	d.mu.Lock()
+	if d.snapshot != nil && time.Since(d.snapshot.Time) < d.Interval {
+		defer d.mu.Unlock()
+		return d.snapshot
+	}
+	if taking := d.taking; taking != nil {
+		if d.snapshot != nil {
+			defer d.mu.Unlock()
+			return d.snapshot
+		}
+		d.mu.Unlock()
+		<-taking
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return d.snapshot
+	}
+	taking := make(chan struct{})
+	d.taking = taking
+	d.mu.Unlock()
+
+	// The snapshot is shared, so it doesn't end with the caller's request.
+	snapshot := d.take(context.WithoutCancel(ctx))
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.snapshot = snapshot
+	d.taking = nil
+	close(taking)
+	return snapshot
+}
+
+func (d *Dashboard) take(ctx context.Context) *Snapshot {
+	s := &Snapshot{
+		Time:    time.Now(),
+		Files:   []File{},
+		Workers: []api.WorkerInfo{},
+		Records: make(map[string]int64),
+	}
+
+	if d.Sources.Files != nil {
+		for _, f := range d.Sources.Files() {
+			file := File{File: f}
+			switch {
+			case f.State == metrics.FileDone:
+				file.Progress = 1
+			case f.Size > 0:
+				file.Progress = min(float64(f.Read)/float64(f.Size), 1)
+			}
+			for result, n := range f.Records {
+				s.Records[result] += n
+			}
+			s.Files = append(s.Files, file)
+		}
+		sort.SliceStable(s.Files, func(i, j int) bool { return s.Files[i].Path < s.Files[j].Path })
+	}
+
+	if d.Sources.Workers != nil {
+		s.Workers = d.Sources.Workers()
+		for _, w := range s.Workers {
+			if w.State == api.WorkerActive {
+				s.Throughput += w.Throughput
+			}
+		}
+	}
+
+	if d.Sources.Queue != nil {
+		queueCtx, cancel := context.WithTimeout(ctx, d.Interval)
+		defer cancel()
+		stats, err := d.Sources.Queue(queueCtx)
+		s.Queue = &Queue{QueueStats: stats}
+		if err != nil {
+			s.Queue.Error = err.Error()
+		}
+	}
+	return s
+}
+
+// Page serves the dashboard's page and its assets.
+func (d *Dashboard) Page() http.Handler {
+	files, err := fs.Sub(static, "static")
+	if err != nil {
+		panic(err)
+	}
+	return http.StripPrefix("/dashboard/", http.FileServer(http.FS(files)))
+}
+
+// State serves the latest snapshot as JSON.
+func (d *Dashboard) State(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(d.Snapshot(r.Context()))
+}
+
+// Events streams a snapshot every interval as Server-Sent Events of type
+// "snapshot", until the page goes away.
+func (d *Dashboard) Events(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	ticker := time.NewTicker(d.Interval)
+	defer ticker.Stop()
+	for {
+		data, err := json.Marshal(d.Snapshot(r.Context()))
+		if err != nil {
+			logging.Component("dashboard").Error("Error encoding snapshot", "error", err)
+			return
+		}
+		if _, err := w.Write([]byte("event: snapshot\ndata: " + string(data) + "\n\n")); err != nil {
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
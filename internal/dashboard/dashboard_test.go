@@ -0,0 +1,161 @@
+package dashboard
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/deahtstroke/protheon/internal/api"
+	"github.com/deahtstroke/protheon/internal/metrics"
+	"github.com/deahtstroke/protheon/internal/rabbitmq"
+)
+
+func testSources() Sources {
+	return Sources{
+		Files: func() []metrics.File {
+			return []metrics.File{
+				{Path: "b.zst", State: metrics.FileProducing, Size: 200, Read: 50, Records: map[string]int64{"published": 10, "failed": 2}},
+				{Path: "a.zst", State: metrics.FileDone, Size: 100, Read: 90, Records: map[string]int64{"published": 5, "quarantined": 1}},
+				{Path: "c.zst", State: metrics.FilePending, Size: 300},
+			}
+		},
+		Workers: func() []api.WorkerInfo {
+			return []api.WorkerInfo{
+				{ID: "1", State: api.WorkerActive, Throughput: 2.5},
+				{ID: "2", State: api.WorkerActive, Throughput: 1.5},
+				{ID: "3", State: api.WorkerStale, Throughput: 100},
+			}
+		},
+		Queue: func(ctx context.Context) (rabbitmq.QueueStats, error) {
+			return rabbitmq.QueueStats{Name: rabbitmq.PGCR_QUEUE, Messages: 42, Consumers: 2}, nil
+		},
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	s := New(testSources()).Snapshot(context.Background())
+
+	if len(s.Files) != 3 || s.Files[0].Path != "a.zst" {
+		t.Fatalf("Expected the files sorted by path, got %+v", s.Files)
+	}
+	if s.Files[0].Progress != 1 || s.Files[1].Progress != 0.25 || s.Files[2].Progress != 0 {
+		t.Fatalf("Unexpected progress %v %v %v", s.Files[0].Progress, s.Files[1].Progress, s.Files[2].Progress)
+	}
+	if s.Records["published"] != 15 || s.Records["failed"] != 2 || s.Records["quarantined"] != 1 {
+		t.Fatalf("Unexpected record totals %v", s.Records)
+	}
+	if s.Throughput != 4 {
+		t.Fatalf("Expected the throughput of active workers, got %v", s.Throughput)
+	}
+	if s.Queue == nil || s.Queue.Messages != 42 || s.Queue.Error != "" {
+		t.Fatalf("Unexpected queue %+v", s.Queue)
+	}
+}
+
+func TestSnapshotIsShared(t *testing.T) {
+	sources := testSources()
+	asked := 0
+	sources.Queue = func(ctx context.Context) (rabbitmq.QueueStats, error) {
+		asked++
+		return rabbitmq.QueueStats{}, errors.New("Broker connection is closed")
+	}
+	d := New(sources)
+	d.Interval = time.Hour
+
+	first := d.Snapshot(context.Background())
+	d.Snapshot(context.Background())
+	if asked != 1 {
+		t.Fatalf("Expected the broker to be asked once an interval, got %d", asked)
+	}
+	if first.Queue.Error != "Broker connection is closed" {
+		t.Fatalf("Expected the queue error in the snapshot, got %+v", first.Queue)
+	}
+}
+
+func TestSnapshotServesStaleWhileTaking(t *testing.T) {
+	sources := testSources()
+	var slow atomic.Bool
+	entered, release := make(chan struct{}), make(chan struct{})
+	sources.Queue = func(ctx context.Context) (rabbitmq.QueueStats, error) {
+		if slow.Load() {
+			close(entered)
+			<-release
+		}
+		return rabbitmq.QueueStats{Messages: 1}, nil
+	}
+	d := New(sources)
+	d.Interval = 10 * time.Millisecond
+
+	stale := d.Snapshot(context.Background())
+	time.Sleep(2 * d.Interval)
+	slow.Store(true)
+	taken := make(chan *Snapshot)
+	go func() { taken <- d.Snapshot(context.Background()) }()
+	<-entered
+
+	if s := d.Snapshot(context.Background()); s != stale {
+		t.Fatalf("Expected the stale snapshot while a new one is taken, got %+v", s)
+	}
+	close(release)
+	if s := <-taken; s == stale {
+		t.Fatal("Expected a new snapshot once taken")
+	}
+}
+
+func TestEventsStreamSnapshots(t *testing.T) {
+	d := New(testSources())
+	d.Interval = 10 * time.Millisecond
+	server := httptest.NewServer(http.HandlerFunc(d.Events))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %s", ct)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	snapshots := 0
+	for snapshots < 2 && scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var s Snapshot
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &s); err != nil {
+			t.Fatalf("Error decoding snapshot: %v", err)
+		}
+		if len(s.Workers) != 3 {
+			t.Fatalf("Unexpected snapshot %+v", s)
+		}
+		snapshots++
+	}
+	if snapshots != 2 {
+		t.Fatalf("Expected snapshots to keep coming, got %d: %v", snapshots, scanner.Err())
+	}
+}
+
+func TestPageIsEmbedded(t *testing.T) {
+	page := New(Sources{}).Page()
+	for _, path := range []string{"/dashboard/", "/dashboard/app.js", "/dashboard/style.css"} {
+		rec := httptest.NewRecorder()
+		page.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusOK || rec.Body.Len() == 0 {
+			t.Fatalf("Expected %s to be served, got %d", path, rec.Code)
+		}
+	}
+}
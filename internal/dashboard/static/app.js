@@ -0,0 +1,198 @@
+// The dashboard reads snapshots streamed by /dashboard/events. The stream is
+// read with fetch rather than EventSource, which can't send the API key.
+"use strict";
+
+const KEY_STORAGE = "protheon.apiKey";
+const RETRY_MS = 3000;
+
+const $ = (id) => document.getElementById(id);
+const number = new Intl.NumberFormat();
+
+function setStatus(text, cls) {
+  const status = $("status");
+  status.textContent = text;
+  status.className = "status " + (cls || "");
+}
+
+function cell(text, cls) {
+  const td = document.createElement("td");
+  td.textContent = text;
+  if (cls) td.className = cls;
+  return td;
+}
+
+function emptyRow(tbody, columns, text) {
+  const tr = document.createElement("tr");
+  const td = cell(text, "empty");
+  td.colSpan = columns;
+  tr.appendChild(td);
+  tbody.appendChild(tr);
+}
+
+function ago(time) {
+  if (!time) return "never";
+  const seconds = Math.max(0, Math.round((Date.now() - new Date(time)) / 1000));
+  if (seconds < 60) return seconds + "s ago";
+  if (seconds < 3600) return Math.round(seconds / 60) + "m ago";
+  return Math.round(seconds / 3600) + "h ago";
+}
+
+function renderWorkers(workers) {
+  const tbody = $("workers");
+  tbody.replaceChildren();
+  if (workers.length === 0) {
+    emptyRow(tbody, 6, "No workers registered");
+    return;
+  }
+  for (const w of workers) {
+    const tr = document.createElement("tr");
+    tr.append(
+      cell(w.hostname || w.id),
+      cell(w.state, "state-" + w.state),
+      cell(w.ip || ""),
+      cell(number.format(w.jobs_done), "num"),
+      cell(w.throughput.toFixed(1), "num"),
+      cell(ago(w.last_seen)),
+    );
+    tbody.appendChild(tr);
+  }
+}
+
+function renderFiles(files) {
+  const tbody = $("files");
+  tbody.replaceChildren();
+  if (files.length === 0) {
+    emptyRow(tbody, 8, "No files ingested yet");
+    return;
+  }
+  for (const f of files) {
+    const records = f.records || {};
+    const count = (result) => cell(number.format(records[result] || 0), "num");
+
+    const bar = document.createElement("div");
+    bar.className = "bar";
+    const fill = document.createElement("div");
+    fill.style.width = (f.progress * 100).toFixed(1) + "%";
+    bar.appendChild(fill);
+    const progress = document.createElement("td");
+    progress.title = (f.progress * 100).toFixed(1) + "%";
+    progress.appendChild(bar);
+
+    const tr = document.createElement("tr");
+    tr.append(
+      cell(f.path),
+      cell(f.state, "state-" + f.state),
+      progress,
+      count("published"),
+      count("filtered"),
+      count("duplicate"),
+      count("quarantined"),
+      count("failed"),
+    );
+    tbody.appendChild(tr);
+  }
+}
+
+function render(snapshot) {
+  const records = snapshot.records || {};
+  $("published").textContent = number.format(records.published || 0);
+  $("read").textContent = number.format(records.read || 0) + " read";
+  $("failed").textContent = number.format(records.failed || 0);
+  $("quarantined").textContent = number.format(records.quarantined || 0);
+  $("throughput").textContent = snapshot.throughput.toFixed(1);
+
+  const queue = snapshot.queue;
+  if (!queue) {
+    $("queue-depth").textContent = "–";
+    $("queue-detail").textContent = "";
+  } else if (queue.error) {
+    $("queue-depth").textContent = "?";
+    $("queue-detail").textContent = queue.error;
+  } else {
+    $("queue-depth").textContent = number.format(queue.messages);
+    $("queue-detail").textContent = queue.name + ", " + queue.consumers + " consumers";
+  }
+
+  renderWorkers(snapshot.workers);
+  renderFiles(snapshot.files);
+}
+
+// parseEvents splits a Server-Sent Events buffer into complete events, and
+// returns them with the incomplete rest.
+function parseEvents(buffer) {
+  const events = [];
+  const blocks = buffer.split("\n\n");
+  const rest = blocks.pop();
+  for (const block of blocks) {
+    let type = "message";
+    const data = [];
+    for (const line of block.split("\n")) {
+      if (line.startsWith("event:")) type = line.slice(6).trim();
+      else if (line.startsWith("data:")) data.push(line.slice(5).trimStart());
+    }
+    events.push({ type, data: data.join("\n") });
+  }
+  return { events, rest };
+}
+
+function askForKey(message) {
+  setStatus(message, "down");
+  $("key-form").hidden = false;
+  $("key").focus();
+}
+
+async function connect() {
+  const key = sessionStorage.getItem(KEY_STORAGE);
+  const headers = key ? { Authorization: "Bearer " + key } : {};
+
+  let resp;
+  try {
+    resp = await fetch("/dashboard/events", { headers });
+  } catch (err) {
+    setStatus("Conductor unreachable, retrying", "down");
+    setTimeout(connect, RETRY_MS);
+    return;
+  }
+  if (resp.status === 401) {
+    askForKey(key ? "API key refused" : "API key needed");
+    return;
+  }
+  if (resp.status === 403) {
+    askForKey("This API key can't view the dashboard");
+    return;
+  }
+  if (!resp.ok) {
+    setStatus("Conductor answered " + resp.status + ", retrying", "down");
+    setTimeout(connect, RETRY_MS);
+    return;
+  }
+
+  $("key-form").hidden = true;
+  setStatus("Live", "live");
+  const reader = resp.body.pipeThrough(new TextDecoderStream()).getReader();
+  let buffer = "";
+  try {
+    for (;;) {
+      const { value, done } = await reader.read();
+      if (done) break;
+      const parsed = parseEvents(buffer + value);
+      buffer = parsed.rest;
+      for (const event of parsed.events) {
+        if (event.type === "snapshot") render(JSON.parse(event.data));
+      }
+    }
+  } catch (err) {
+    // The connection dropped, reconnect below.
+  }
+  setStatus("Disconnected, reconnecting", "down");
+  setTimeout(connect, RETRY_MS);
+}
+
+$("key-form").addEventListener("submit", (e) => {
+  e.preventDefault();
+  sessionStorage.setItem(KEY_STORAGE, $("key").value);
+  $("key").value = "";
+  connect();
+});
+
+connect();
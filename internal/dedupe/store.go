@@ -0,0 +1,202 @@
+package dedupe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/RoaringBitmap/roaring/v2/roaring64"
+	"github.com/deahtstroke/protheon/internal/atomicfile"
+	"github.com/deahtstroke/protheon/internal/logging"
+)
+
+// Store is a set of seen PGCR instance IDs backed by a roaring bitmap. It is
+// kept in memory and persisted to Path with Save, so it survives restarts.
+// Instance IDs are dense and mostly increasing, which is the case roaring
+// bitmaps compress best: hundreds of millions of IDs fit in a few megabytes.
+type Store struct {
+	mu     sync.Mutex
+	path   string
+	bitmap *roaring64.Bitmap
+	dirty  bool
+
+	// claimed holds the IDs taken by AddIfAbsent and not yet committed. They
+	// are never saved, so a claim lost to a crash is taken again.
+	claimed map[uint64]struct{}
+
+	// saveErr is the error of the last save, reported by Check.
+	saveErr error
+}
+
+// Open loads the store persisted at path, or starts an empty one if the file
+// doesn't exist yet. An empty path gives a store that only lives in memory.
+func Open(path string) (*Store, error) {
+	s := &Store{
+		path:    path,
+		bitmap:  roaring64.New(),
+		claimed: make(map[uint64]struct{}),
+	}
+	if path == "" {
+		return s, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return s, nil
+		}
+		return nil, fmt.Errorf("Error opening seen store [%s]: %w", path, err)
+	}
+	defer file.Close()
+
+	if _, err := s.bitmap.ReadFrom(file); err != nil {
+		return nil, fmt.Errorf("Error reading seen store [%s]: %w", path, err)
+	}
+	return s, nil
+}
+
+func ParseInstanceID(id string) (uint64, error) {
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid instance ID [%s]: %w", id, err)
+	}
+	return n, nil
+}
+
+func (s *Store) Path() string {
+	return s.path
+}
+
+func (s *Store) Contains(id uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.bitmap.Contains(id)
+}
+
+// Add records an instance ID and reports whether it was new.
+func (s *Store) Add(id uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	added := s.bitmap.CheckedAdd(id)
+	if added {
+		s.dirty = true
+	}
+	return added
+}
+
+// AddIfAbsent claims an instance ID unless it was seen or is claimed
+// already, and reports whether it did. Checking and claiming at once keeps
+// two deliveries of the same PGCR from both being processed. A claim only
+// lives in memory until Commit records the ID as seen, or Release gives it
+// up so the ID can be claimed again.
+func (s *Store) AddIfAbsent(id uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.claimed[id]; ok || s.bitmap.Contains(id) {
+		return false
+	}
+	s.claimed[id] = struct{}{}
+	return true
+}
+
+// Commit records a claimed instance ID as seen.
+func (s *Store) Commit(id uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.claimed, id)
+	if s.bitmap.CheckedAdd(id) {
+		s.dirty = true
+	}
+}
+
+// Release gives up the claim on an instance ID.
+func (s *Store) Release(id uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.claimed, id)
+}
+
+func (s *Store) Len() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.bitmap.GetCardinality()
+}
+
+// Save writes the store to its path if it changed since the last save. The
+// file is replaced atomically, so a crash mid-save keeps the previous copy.
+func (s *Store) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.saveErr = s.save()
+	return s.saveErr
+}
+
+func (s *Store) save() error {
+	if s.path == "" || !s.dirty {
+		return nil
+	}
+
+	err := atomicfile.Write(s.path, 0o644, func(w io.Writer) error {
+		_, err := s.bitmap.WriteTo(w)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Error saving seen store [%s]: %w", s.path, err)
+	}
+
+	s.dirty = false
+	return nil
+}
+
+// Check reports why the store can't be persisted: its last save failed, or
+// its directory is gone. A store that only lives in memory is always fine.
+func (s *Store) Check() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.path == "" {
+		return nil
+	}
+	if s.saveErr != nil {
+		return s.saveErr
+	}
+	dir := filepath.Dir(s.path)
+	info, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("Error checking seen store directory [%s]: %w", dir, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("Seen store directory [%s] is not a directory", dir)
+	}
+	return nil
+}
+
+// SaveEvery saves the store on every tick of interval until the context is
+// cancelled. Callers should still Save once more on shutdown.
+func (s *Store) SaveEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Save(); err != nil {
+				logging.Component("dedupe").Error("Error saving seen store", "error", err)
+			}
+		}
+	}
+}
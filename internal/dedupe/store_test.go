@@ -0,0 +1,133 @@
+package dedupe
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestStoreAddAndContains(t *testing.T) {
+	store, err := Open("")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if !store.Add(15324001234) {
+		t.Fatal("Expected first add to be new")
+	}
+	if store.Add(15324001234) {
+		t.Fatal("Expected second add to be a duplicate")
+	}
+	if !store.Contains(15324001234) || store.Contains(1) {
+		t.Fatal("Unexpected contains result")
+	}
+	if err := store.Save(); err != nil {
+		t.Fatalf("Expected in-memory save to be a no-op, got %v", err)
+	}
+}
+
+func TestStoreAddIfAbsentClaimsOnce(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seen.roaring")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	var claimed atomic.Int32
+	var wg sync.WaitGroup
+	for range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if store.AddIfAbsent(7) {
+				claimed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if claimed.Load() != 1 {
+		t.Fatalf("Expected exactly one claim, got %d", claimed.Load())
+	}
+
+	// Claims are not saved until they are committed.
+	if err := store.Save(); err != nil {
+		t.Fatalf("Error saving: %v", err)
+	}
+	if reopened, err := Open(path); err != nil || reopened.Contains(7) {
+		t.Fatalf("Expected the claim not to be saved, got %v", err)
+	}
+
+	store.Release(7)
+	if !store.AddIfAbsent(7) {
+		t.Fatal("Expected a released ID to be claimed again")
+	}
+	store.Commit(7)
+	if store.AddIfAbsent(7) || !store.Contains(7) {
+		t.Fatal("Expected a committed ID to be seen")
+	}
+	if err := store.Save(); err != nil {
+		t.Fatalf("Error saving: %v", err)
+	}
+	if reopened, err := Open(path); err != nil || !reopened.Contains(7) {
+		t.Fatalf("Expected the committed ID to be saved, got %v", err)
+	}
+}
+
+func TestStorePersistsBetweenRuns(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seen.roaring")
+
+	store, err := Open(path)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for _, id := range []uint64{1, 2, 15324001234} {
+		store.Add(id)
+	}
+	if err := store.Save(); err != nil {
+		t.Fatalf("Error saving store: %v", err)
+	}
+
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatalf("Error reopening store: %v", err)
+	}
+	if reopened.Len() != 3 {
+		t.Fatalf("Expected 3 IDs, got %d", reopened.Len())
+	}
+	if !reopened.Contains(15324001234) {
+		t.Fatal("Expected persisted ID to be seen")
+	}
+}
+
+func TestParseInstanceID(t *testing.T) {
+	if id, err := ParseInstanceID("15324001234"); err != nil || id != 15324001234 {
+		t.Fatalf("Expected 15324001234, got %d (%v)", id, err)
+	}
+	if _, err := ParseInstanceID(""); err == nil {
+		t.Fatal("Expected error for empty instance ID")
+	}
+}
+
+func TestStoreCheck(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(filepath.Join(dir, "seen.roaring"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Check(); err != nil {
+		t.Fatalf("Expected a fresh store to be fine, got %v", err)
+	}
+
+	s.Add(1)
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(); err == nil {
+		t.Fatal("Expected saving into a removed directory to fail")
+	}
+	if err := s.Check(); err == nil {
+		t.Fatal("Expected Check to report the failed save")
+	}
+}
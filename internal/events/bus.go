@@ -0,0 +1,247 @@
+// Package events is the conductor's event bus. Things that happen, such as a
+// worker registering or a file finishing, are published as typed events,
+// each with the next sequence number. Sequence numbers start over when the
+// conductor restarts, so each bus also has an epoch, and an event's ID is its
+// epoch and sequence number. Recent events are kept, so a client that lost
+// its connection resumes after the last ID it saw rather than polling for
+// what it missed.
+//
+// Events reach clients over Server-Sent Events or WebSocket on /events, and
+// webhooks.
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deahtstroke/protheon/internal/logging"
+)
+
+type Type string
+
+const (
+	WorkerRegistered Type = "worker.registered"
+	WorkerDied       Type = "worker.died"
+	WorkerRecovered  Type = "worker.recovered"
+	WorkerRevoked    Type = "worker.revoked"
+
+	FileStarted         Type = "file.started"
+	FileFinished        Type = "file.finished"
+	FileInterrupted     Type = "file.interrupted"
+	ErrorBudgetExceeded Type = "file.error_budget_exceeded"
+
+	IngestStarted  Type = "ingest.started"
+	IngestPaused   Type = "ingest.paused"
+	IngestStalled  Type = "ingest.stalled"
+	IngestResumed  Type = "ingest.resumed"
+	IngestFinished Type = "ingest.finished"
+)
+
+const (
+	// DEFAULT_HISTORY is how many recent events a bus keeps for resuming.
+	DEFAULT_HISTORY = 1024
+
+	// SUBSCRIBER_BUFFER is how many events a subscriber may fall behind
+	// before it is dropped, and has to resume.
+	SUBSCRIBER_BUFFER = 256
+)
+
+// Event is something that happened in the conductor. Data is the JSON of the
+// payload of its type.
+type Event struct {
+	Epoch string          `json:"epoch"`
+	Seq   uint64          `json:"seq"`
+	Type  Type            `json:"type"`
+	Time  time.Time       `json:"time"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// ID identifies the event across conductor restarts, as <epoch>-<seq>.
+func (e Event) ID() string {
+	return FormatID(e.Epoch, e.Seq)
+}
+
+func FormatID(epoch string, seq uint64) string {
+	return epoch + "-" + strconv.FormatUint(seq, 10)
+}
+
+// ParseID parses an event ID. A bare sequence number has no epoch, so
+// resuming after one other than zero reports a gap.
+func ParseID(id string) (epoch string, seq uint64, err error) {
+	number := id
+	if i := strings.LastIndexByte(id, '-'); i >= 0 {
+		epoch, number = id[:i], id[i+1:]
+	}
+	seq, err = strconv.ParseUint(number, 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("Error parsing event ID [%s]: %v", id, err)
+	}
+	return epoch, seq, nil
+}
+
+// WorkerData is the payload of worker events.
+type WorkerData struct {
+	ID       string    `json:"id"`
+	Hostname string    `json:"hostname"`
+	IP       string    `json:"ip,omitempty"`
+	LastSeen time.Time `json:"last_seen,omitzero"`
+}
+
+// FileData is the payload of file events. Records counts the file's records
+// by result once it finished.
+type FileData struct {
+	Path    string           `json:"path"`
+	Size    int64            `json:"size,omitempty"`
+	Records map[string]int64 `json:"records,omitempty"`
+	Error   string           `json:"error,omitempty"`
+}
+
+// IngestData is the payload of ingest events, which describe an ingest job.
+// State is completed, failed or cancelled once the job finished.
+type IngestData struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name,omitempty"`
+	Sources []string `json:"sources"`
+	Queue   string   `json:"queue"`
+	Filter  string   `json:"filter,omitempty"`
+	Files   int      `json:"files"`
+	State   string   `json:"state"`
+	Reason  string   `json:"reason,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// Bus fans events out to subscribers. A nil bus drops what is published to
+// it, so producers of events don't need one.
+type Bus struct {
+	epoch string
+
+	mu      sync.Mutex
+	seq     uint64
+	history []Event
+	size    int
+	subs    map[*subscription]struct{}
+}
+
+func NewBus(history int) *Bus {
+	if history <= 0 {
+		history = DEFAULT_HISTORY
+	}
+	return &Bus{
+		epoch: strconv.FormatInt(time.Now().UnixNano(), 36),
+		size:  history,
+		subs:  make(map[*subscription]struct{}),
+	}
+}
+
+// Publish sends an event with data as its payload.
+func (b *Bus) Publish(t Type, data any) {
+	if b == nil {
+		return
+	}
+	raw, err := json.Marshal(data)
+	if err != nil {
+		logging.Component("events").Error("Error encoding event", "type", string(t), "error", err)
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.seq++
+	event := Event{Epoch: b.epoch, Seq: b.seq, Type: t, Time: time.Now(), Data: raw}
+	b.history = append(b.history, event)
+	if len(b.history) > b.size {
+		b.history = append(b.history[:0], b.history[len(b.history)-b.size:]...)
+	}
+
+	for sub := range b.subs {
+		select {
+		case sub.ch <- event:
+		default:
+			// Too far behind, the subscriber resumes once it sees the
+			// channel closed.
+			delete(b.subs, sub)
+			close(sub.ch)
+		}
+	}
+}
+
+// Epoch tells this bus's sequence numbers from those of the buses before a
+// restart.
+func (b *Bus) Epoch() string {
+	return b.epoch
+}
+
+// Seq is the sequence number of the latest event.
+func (b *Bus) Seq() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.seq
+}
+
+type subscription struct {
+	ch chan Event
+}
+
+// Subscription receives the events published after it started.
+type Subscription struct {
+	// Replay holds the kept events after the sequence number subscribed
+	// from. Gap is set when events between that number and Replay are no
+	// longer kept, or the number is from another epoch.
+	Replay []Event
+	Gap    bool
+
+	// Events is closed when the subscription falls too far behind, or is
+	// cancelled.
+	Events <-chan Event
+
+	bus *Bus
+	sub *subscription
+}
+
+// Subscribe starts a subscription to the events of this bus after seq. A seq
+// of zero replays every kept event.
+func (b *Bus) Subscribe(after uint64) *Subscription {
+	return b.Resume(b.epoch, after)
+}
+
+// Resume starts a subscription to the events after the one with sequence
+// number after in epoch. Events from another epoch were published before the
+// conductor restarted, so every kept event is replayed after a gap.
+func (b *Bus) Resume(epoch string, after uint64) *Subscription {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := &Subscription{bus: b, sub: &subscription{ch: make(chan Event, SUBSCRIBER_BUFFER)}}
+	s.Events = s.sub.ch
+	b.subs[s.sub] = struct{}{}
+
+	if after > 0 && (epoch != b.epoch || after > b.seq) {
+		s.Gap = true
+		after = 0
+	} else if after > 0 && len(b.history) > 0 && b.history[0].Seq > after+1 {
+		s.Gap = true
+	}
+	for i, event := range b.history {
+		if event.Seq > after {
+			s.Replay = append([]Event(nil), b.history[i:]...)
+			break
+		}
+	}
+	return s
+}
+
+// Cancel ends the subscription.
+func (s *Subscription) Cancel() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+
+	if _, ok := s.bus.subs[s.sub]; ok {
+		delete(s.bus.subs, s.sub)
+		close(s.sub.ch)
+	}
+}
@@ -0,0 +1,283 @@
+package events
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func (b *Bus) subscribers() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs)
+}
+
+func TestSubscribeResumes(t *testing.T) {
+	bus := NewBus(3)
+	for i := 0; i < 5; i++ {
+		bus.Publish(FileStarted, FileData{Path: strconv.Itoa(i)})
+	}
+
+	sub := bus.Subscribe(3)
+	defer sub.Cancel()
+	if sub.Gap || len(sub.Replay) != 2 || sub.Replay[0].Seq != 4 {
+		t.Fatalf("Expected events 4 and 5 replayed, got gap %v and %+v", sub.Gap, sub.Replay)
+	}
+
+	bus.Publish(FileFinished, FileData{Path: "4"})
+	if event := <-sub.Events; event.Seq != 6 || event.Type != FileFinished {
+		t.Fatalf("Unexpected live event %+v", event)
+	}
+}
+
+func TestSubscribeReportsGaps(t *testing.T) {
+	bus := NewBus(3)
+	for i := 0; i < 5; i++ {
+		bus.Publish(FileStarted, FileData{Path: strconv.Itoa(i)})
+	}
+
+	sub := bus.Subscribe(1)
+	defer sub.Cancel()
+	if !sub.Gap || len(sub.Replay) != 3 || sub.Replay[0].Seq != 3 {
+		t.Fatalf("Expected a gap before events 3 to 5, got gap %v and %+v", sub.Gap, sub.Replay)
+	}
+
+	// A number the bus never handed out replays everything kept.
+	ahead := bus.Subscribe(40)
+	defer ahead.Cancel()
+	if !ahead.Gap || len(ahead.Replay) != 3 {
+		t.Fatalf("Expected a gap and every kept event, got gap %v and %+v", ahead.Gap, ahead.Replay)
+	}
+}
+
+func TestResumeAcrossRestartsReportsGaps(t *testing.T) {
+	before := NewBus(0)
+	before.Publish(FileStarted, FileData{Path: "a.zst"})
+	before.Publish(FileStarted, FileData{Path: "b.zst"})
+	last := before.Subscribe(0).Replay[1]
+
+	// A restarted conductor numbers its events from 1 again.
+	bus := NewBus(0)
+	for i := 0; i < 3; i++ {
+		bus.Publish(FileStarted, FileData{Path: strconv.Itoa(i)})
+	}
+	if bus.Epoch() == before.Epoch() {
+		t.Fatal("Expected a new epoch")
+	}
+	epoch, seq, err := ParseID(last.ID())
+	if err != nil {
+		t.Fatalf("Error parsing ID: %v", err)
+	}
+	sub := bus.Resume(epoch, seq)
+	defer sub.Cancel()
+	if !sub.Gap || len(sub.Replay) != 3 || sub.Replay[0].Seq != 1 {
+		t.Fatalf("Expected a gap and every kept event, got gap %v and %+v", sub.Gap, sub.Replay)
+	}
+
+	// A bare sequence number could be from any epoch.
+	bare := bus.Resume("", 2)
+	defer bare.Cancel()
+	if !bare.Gap || len(bare.Replay) != 3 {
+		t.Fatalf("Expected a gap and every kept event, got gap %v and %+v", bare.Gap, bare.Replay)
+	}
+}
+
+func TestSlowSubscriberIsDropped(t *testing.T) {
+	bus := NewBus(0)
+	sub := bus.Subscribe(0)
+	for i := 0; i <= SUBSCRIBER_BUFFER; i++ {
+		bus.Publish(WorkerDied, WorkerData{ID: strconv.Itoa(i)})
+	}
+
+	received := 0
+	for range sub.Events {
+		received++
+	}
+	if received != SUBSCRIBER_BUFFER {
+		t.Fatalf("Expected the buffered events and then a closed channel, got %d", received)
+	}
+	sub.Cancel()
+}
+
+func TestNilBusDropsEvents(t *testing.T) {
+	var bus *Bus
+	bus.Publish(IngestStarted, IngestData{ID: "1", Sources: []string{"/dumps"}})
+}
+
+// readSSE reads Server-Sent Events until count of them were read.
+func readSSE(t *testing.T, body io.Reader, count int) []Event {
+	t.Helper()
+	var result []Event
+	scanner := bufio.NewScanner(body)
+	id := ""
+	for len(result) < count && scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			var event Event
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event); err != nil {
+				t.Fatalf("Error decoding event: %v", err)
+			}
+			if id != event.Epoch+"-"+strconv.FormatUint(event.Seq, 10) {
+				t.Fatalf("Expected the id to be the epoch and sequence number, got %s for %+v", id, event)
+			}
+			result = append(result, event)
+		}
+	}
+	if len(result) != count {
+		t.Fatalf("Expected %d events, got %d: %v", count, len(result), scanner.Err())
+	}
+	return result
+}
+
+func TestSSEResumesAndFilters(t *testing.T) {
+	bus := NewBus(0)
+	bus.Publish(WorkerRegistered, WorkerData{ID: "1"})
+	bus.Publish(FileStarted, FileData{Path: "a.zst"})
+	bus.Publish(WorkerDied, WorkerData{ID: "1"})
+
+	server := httptest.NewServer(Handler(bus))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"?types=worker.registered,worker.died", nil)
+	req.Header.Set("Last-Event-ID", bus.Epoch()+"-1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %s", ct)
+	}
+
+	go bus.Publish(FileFinished, FileData{Path: "a.zst"})
+	go bus.Publish(WorkerRecovered, WorkerData{ID: "1"})
+	got := readSSE(t, resp.Body, 1)
+	if got[0].Seq != 3 || got[0].Type != WorkerDied {
+		t.Fatalf("Expected the replayed worker.died only, got %+v", got)
+	}
+}
+
+func TestSSEBadSequenceNumber(t *testing.T) {
+	rec := httptest.NewRecorder()
+	Handler(NewBus(0)).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/events?after=last", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400, got %d", rec.Code)
+	}
+}
+
+func TestWebSocketStreamsEvents(t *testing.T) {
+	bus := NewBus(2)
+	for i := 0; i < 4; i++ {
+		bus.Publish(FileStarted, FileData{Path: strconv.Itoa(i)})
+	}
+
+	server := httptest.NewServer(Handler(bus))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"?after="+bus.Epoch()+"-1", nil)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer conn.Close()
+
+	var gap Event
+	if err := conn.ReadJSON(&gap); err != nil || gap.Type != GapEvent {
+		t.Fatalf("Expected a gap first, got %+v: %v", gap, err)
+	}
+	var data Gap
+	json.Unmarshal(gap.Data, &data)
+	if data.After != bus.Epoch()+"-1" || data.Epoch != bus.Epoch() || data.Seq != 4 || gap.ID() != data.After {
+		t.Fatalf("Unexpected gap %+v", data)
+	}
+
+	bus.Publish(IngestPaused, IngestData{ID: "1", Sources: []string{"/dumps"}, State: "paused"})
+	var seqs []uint64
+	for len(seqs) < 3 {
+		var event Event
+		if err := conn.ReadJSON(&event); err != nil {
+			t.Fatalf("Error reading event: %v", err)
+		}
+		seqs = append(seqs, event.Seq)
+	}
+	if seqs[0] != 3 || seqs[1] != 4 || seqs[2] != 5 {
+		t.Fatalf("Expected events 3 to 5 in order, got %v", seqs)
+	}
+}
+
+func TestWebhookSignsAndRetries(t *testing.T) {
+	var mu sync.Mutex
+	attempts := 0
+	delivered := make(chan *http.Request, 1)
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if attempts < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ = io.ReadAll(r.Body)
+		delivered <- r
+	}))
+	defer server.Close()
+
+	bus := NewBus(0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	webhook := &Webhook{URL: server.URL, Secret: "s3cret", Types: ParseTypes("worker.died"), Backoff: time.Millisecond}
+	go webhook.Run(ctx, bus)
+
+	// Let the webhook subscribe before publishing.
+	for i := 0; i < 100 && bus.subscribers() == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	bus.Publish(WorkerRegistered, WorkerData{ID: "1"})
+	bus.Publish(WorkerDied, WorkerData{ID: "1"})
+
+	select {
+	case r := <-delivered:
+		if r.Header.Get(HEADER_EVENT) != string(WorkerDied) || r.Header.Get(HEADER_DELIVERY) != bus.Epoch()+"-2" {
+			t.Fatalf("Unexpected event headers %v", r.Header)
+		}
+		timestamp := r.Header.Get(HEADER_TIMESTAMP)
+		if r.Header.Get(HEADER_SIGNATURE) != Sign("s3cret", timestamp, body) {
+			t.Fatalf("Signature doesn't match the body")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Event was never delivered")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts != 3 {
+		t.Fatalf("Expected two retries, got %d attempts", attempts)
+	}
+}
+
+func TestWebhookDoesNotRetryRefusals(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+	webhook := &Webhook{URL: server.URL}
+
+	retry, err := webhook.post(context.Background(), Event{Seq: 1, Type: FileStarted}, []byte("{}"))
+	if err == nil || retry {
+		t.Fatalf("Expected a 400 to fail without a retry, got retry %v: %v", retry, err)
+	}
+}
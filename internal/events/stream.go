@@ -0,0 +1,247 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/deahtstroke/protheon/internal/logging"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// KEEPALIVE_INTERVAL is how often an idle stream is written to, so that
+	// proxies don't close it.
+	KEEPALIVE_INTERVAL = 15 * time.Second
+
+	// WRITE_TIMEOUT bounds writing a WebSocket message.
+	WRITE_TIMEOUT = 10 * time.Second
+)
+
+// GapEvent is the type of the event sent before the replayed events when
+// some of the events a client asked to resume after are no longer kept. Its
+// payload is a Gap.
+const GapEvent Type = "gap"
+
+// Gap names the event the client asked to resume after, and the bus's
+// epoch and latest sequence number.
+type Gap struct {
+	After string `json:"after"`
+	Epoch string `json:"epoch"`
+	Seq   uint64 `json:"seq"`
+}
+
+// gapEvent carries the ID to resume after if the client drops before the
+// replayed events: after, or the start of the bus's epoch when after is from
+// another one.
+func gapEvent(bus *Bus, epoch string, after uint64) Event {
+	seq := bus.Seq()
+	data, _ := json.Marshal(Gap{After: FormatID(epoch, after), Epoch: bus.Epoch(), Seq: seq})
+	resume := after
+	if epoch != bus.Epoch() || after > seq {
+		resume = 0
+	}
+	return Event{Epoch: bus.Epoch(), Seq: resume, Type: GapEvent, Time: time.Now(), Data: data}
+}
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+}
+
+// Handler streams the bus's events on GET /events. Requests upgrading to a
+// WebSocket receive each event as a JSON text message, others receive
+// Server-Sent Events whose id is the event's ID, <epoch>-<seq>.
+//
+// Clients resume with ?after=<epoch>-<seq>, or the Last-Event-ID header
+// EventSource sends when it reconnects, and choose the events they want with
+// ?types=worker.died,file.finished. A client falling too far behind is
+// disconnected, and resumes. A client resuming after an event of another
+// epoch, published before the conductor restarted, gets a gap event first.
+func Handler(bus *Bus) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		epoch, after, err := resumeAfter(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		types := ParseTypes(r.URL.Query().Get("types"))
+
+		if websocket.IsWebSocketUpgrade(r) {
+			streamWebSocket(w, r, bus, epoch, after, types)
+			return
+		}
+		streamSSE(w, r, bus, epoch, after, types)
+	}
+}
+
+func resumeAfter(r *http.Request) (string, uint64, error) {
+	value := r.URL.Query().Get("after")
+	if value == "" {
+		value = r.Header.Get("Last-Event-ID")
+	}
+	if value == "" {
+		return "", 0, nil
+	}
+	return ParseID(value)
+}
+
+// ParseTypes parses a comma separated list of event types. An empty list is
+// nil, which stands for every type.
+func ParseTypes(value string) map[Type]bool {
+	if value == "" {
+		return nil
+	}
+	types := make(map[Type]bool)
+	for _, t := range strings.Split(value, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types[Type(t)] = true
+		}
+	}
+	return types
+}
+
+func wanted(types map[Type]bool, event Event) bool {
+	return types == nil || types[event.Type]
+}
+
+func streamSSE(w http.ResponseWriter, r *http.Request, bus *Bus, epoch string, after uint64, types map[Type]bool) {
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	sub := bus.Resume(epoch, after)
+	defer sub.Cancel()
+
+	write := func(event Event) error {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.ID(), event.Type, data); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	if sub.Gap {
+		if err := write(gapEvent(bus, epoch, after)); err != nil {
+			return
+		}
+	}
+	for _, event := range sub.Replay {
+		if !wanted(types, event) {
+			continue
+		}
+		if err := write(event); err != nil {
+			return
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	keepalive := time.NewTicker(KEEPALIVE_INTERVAL)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-sub.Events:
+			if !ok {
+				logging.Component("events").Warn("Event stream fell behind, closing it", "remote", r.RemoteAddr)
+				return
+			}
+			if !wanted(types, event) {
+				continue
+			}
+			if err := write(event); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := w.Write([]byte(": keepalive\n\n")); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func streamWebSocket(w http.ResponseWriter, r *http.Request, bus *Bus, epoch string, after uint64, types map[Type]bool) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader already answered the client.
+		return
+	}
+	defer conn.Close()
+
+	sub := bus.Resume(epoch, after)
+	defer sub.Cancel()
+
+	// Clients don't send anything but control frames, which are handled
+	// while reading. Reading fails once the client goes away.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	write := func(event Event) error {
+		conn.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
+		return conn.WriteJSON(event)
+	}
+
+	if sub.Gap {
+		if err := write(gapEvent(bus, epoch, after)); err != nil {
+			return
+		}
+	}
+	for _, event := range sub.Replay {
+		if !wanted(types, event) {
+			continue
+		}
+		if err := write(event); err != nil {
+			return
+		}
+	}
+
+	ping := time.NewTicker(KEEPALIVE_INTERVAL)
+	defer ping.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, "Conductor shutting down"), time.Now().Add(time.Second))
+			return
+		case <-closed:
+			return
+		case event, ok := <-sub.Events:
+			if !ok {
+				logging.Component("events").Warn("Event stream fell behind, closing it", "remote", r.RemoteAddr)
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "Fell behind, resume from the last event ID"), time.Now().Add(time.Second))
+				return
+			}
+			if !wanted(types, event) {
+				continue
+			}
+			if err := write(event); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(WRITE_TIMEOUT)); err != nil {
+				return
+			}
+		}
+	}
+}
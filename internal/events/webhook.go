@@ -0,0 +1,175 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/deahtstroke/protheon/internal/logging"
+)
+
+const (
+	DEFAULT_WEBHOOK_ATTEMPTS = 5
+	DEFAULT_WEBHOOK_BACKOFF  = time.Second
+	DEFAULT_WEBHOOK_TIMEOUT  = 10 * time.Second
+
+	// MAX_WEBHOOK_BACKOFF caps the wait between retries of a delivery.
+	MAX_WEBHOOK_BACKOFF = time.Minute
+
+	HEADER_EVENT     = "X-Protheon-Event"
+	HEADER_DELIVERY  = "X-Protheon-Delivery"
+	HEADER_TIMESTAMP = "X-Protheon-Timestamp"
+	HEADER_SIGNATURE = "X-Protheon-Signature"
+)
+
+// Webhook POSTs events, one JSON event per request, to URL. A delivery that
+// fails is retried with exponential backoff, up to MaxAttempts times, unless
+// the endpoint refused it with a 4xx other than 408 or 429. Events are
+// delivered in order, so a failing endpoint holds up the events after it.
+//
+// With a Secret, requests are signed: the X-Protheon-Signature header is
+// "sha256=" and the hex HMAC-SHA256, keyed by the secret, of the
+// X-Protheon-Timestamp header, a period and the body.
+type Webhook struct {
+	URL         string
+	Secret      string
+	Types       map[Type]bool
+	MaxAttempts int
+	Backoff     time.Duration
+	Client      *http.Client
+}
+
+// Sign returns the signature of body sent at timestamp, as it is sent in
+// the X-Protheon-Signature header.
+func Sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Run delivers the bus's events published from now on, until ctx is done.
+// A webhook that falls behind the bus resumes after the last event it
+// delivered, as long as the bus still keeps the events after it.
+func (wh *Webhook) Run(ctx context.Context, bus *Bus) {
+	logger := logging.Component("events").With("webhook", wh.URL)
+	last := bus.Seq()
+	for ctx.Err() == nil {
+		sub := bus.Subscribe(last)
+		if sub.Gap {
+			logger.Warn("Webhook fell behind, events were not delivered", "after", last)
+		}
+		last = wh.deliverAll(ctx, sub, last)
+		sub.Cancel()
+	}
+}
+
+func (wh *Webhook) deliverAll(ctx context.Context, sub *Subscription, last uint64) uint64 {
+	for _, event := range sub.Replay {
+		if ctx.Err() != nil {
+			return last
+		}
+		wh.deliver(ctx, event)
+		last = event.Seq
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return last
+		case event, ok := <-sub.Events:
+			if !ok {
+				return last
+			}
+			wh.deliver(ctx, event)
+			last = event.Seq
+		}
+	}
+}
+
+// deliver sends event, retrying it until it is accepted or refused.
+func (wh *Webhook) deliver(ctx context.Context, event Event) {
+	if wh.Types != nil && !wh.Types[event.Type] {
+		return
+	}
+	logger := logging.Component("events").With("webhook", wh.URL, "seq", event.Seq, "type", string(event.Type))
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		logger.Error("Error encoding event", "error", err)
+		return
+	}
+
+	attempts := wh.MaxAttempts
+	if attempts <= 0 {
+		attempts = DEFAULT_WEBHOOK_ATTEMPTS
+	}
+	backoff := wh.Backoff
+	if backoff <= 0 {
+		backoff = DEFAULT_WEBHOOK_BACKOFF
+	}
+
+	for attempt := 1; ; attempt++ {
+		retry, err := wh.post(ctx, event, body)
+		if err == nil {
+			logger.Debug("Delivered event", "attempt", attempt)
+			return
+		}
+		if !retry || attempt >= attempts {
+			logger.Error("Error delivering event, dropping it", "attempt", attempt, "error", err)
+			return
+		}
+		logger.Warn("Error delivering event, retrying", "attempt", attempt, "backoff", backoff, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, MAX_WEBHOOK_BACKOFF)
+	}
+}
+
+// post sends event once, and returns whether a failure is worth retrying.
+func (wh *Webhook) post(ctx context.Context, event Event, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HEADER_EVENT, string(event.Type))
+	req.Header.Set(HEADER_DELIVERY, event.ID())
+	req.Header.Set(HEADER_TIMESTAMP, timestamp)
+	if wh.Secret != "" {
+		req.Header.Set(HEADER_SIGNATURE, Sign(wh.Secret, timestamp, body))
+	}
+
+	client := wh.Client
+	if client == nil {
+		client = &http.Client{Timeout: DEFAULT_WEBHOOK_TIMEOUT}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return true, fmt.Errorf("Error response from webhook [%s]: %s", wh.URL, resp.Status)
+	default:
+		return false, fmt.Errorf("Error response from webhook [%s]: %s", wh.URL, resp.Status)
+	}
+}
@@ -1,64 +1,337 @@
 package file
 
 import (
+	"errors"
+	"fmt"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/deahtstroke/protheon/internal/logging"
+)
+
+// SortOrder controls the order in which found files are handed out by a
+// StatefulMap, so an ingest over the same tree can be reproduced.
+type SortOrder int
+
+const (
+	SortByName SortOrder = iota
+	SortByModTime
+)
+
+// SymlinkPolicy controls what the finder does when it meets a symbolic link.
+type SymlinkPolicy int
+
+const (
+	SymlinkSkip SymlinkPolicy = iota
+	SymlinkFollow
 )
 
 type FileFinder struct {
 	Root string
+
+	// Include and Exclude are glob patterns (see filepath.Match) matched
+	// against both the base name and the slash separated path relative to
+	// Root. A file is kept when it matches at least one Include pattern (or
+	// Include is empty) and no Exclude pattern. Exclude also prunes
+	// directories.
+	Include []string
+	Exclude []string
+
+	// MinSize and MaxSize bound the size in bytes of accepted files. A zero
+	// value disables the bound.
+	MinSize int64
+	MaxSize int64
+
+	Symlinks SymlinkPolicy
+	SortBy   SortOrder
 }
+
 type StatefulMap struct {
-	mu   sync.Mutex
-	Data map[string]*FileStatus
+	mu      sync.Mutex
+	order   []string
+	updated chan struct{}
+	Data    map[string]*FileStatus
 }
 
 type FileStatus struct {
 	Path    string
+	Size    int64
+	ModTime time.Time
 	Started bool
 	Done    bool
 }
 
+func NewStatefulMap() *StatefulMap {
+	return &StatefulMap{
+		updated: make(chan struct{}, 1),
+		Data:    make(map[string]*FileStatus),
+	}
+}
+
+// Add appends a file to the map, keyed by its path. It returns false if the
+// path is already tracked.
+func (sm *StatefulMap) Add(status *FileStatus) bool {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if _, ok := sm.Data[status.Path]; ok {
+		return false
+	}
+	sm.Data[status.Path] = status
+	sm.order = append(sm.order, status.Path)
+
+	select {
+	case sm.updated <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Updated returns a channel that receives a value whenever a new file is
+// added, so consumers that ran out of work can wait for more.
+func (sm *StatefulMap) Updated() <-chan struct{} {
+	return sm.updated
+}
+
+func (sm *StatefulMap) Contains(path string) bool {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	_, ok := sm.Data[path]
+	return ok
+}
+
+// GetNext returns the first file, in insertion order, that has not been
+// started yet and marks it as started.
 func (sm *StatefulMap) GetNext() (string, *FileStatus, bool) {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
-	for filename, fs := range sm.Data {
+	for _, path := range sm.order {
+		fs := sm.Data[path]
 		if !fs.Started {
 			fs.Started = true
-			return filename, fs, true
+			return path, fs, true
 		}
 	}
 	return "", nil, false
 }
 
-func (f *FileFinder) FindByExtension(extension string) StatefulMap {
-	files := make(map[string]*FileStatus)
-	filepath.WalkDir(f.Root, func(path string, d fs.DirEntry, err error) error {
+func (sm *StatefulMap) MarkDone(path string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if fs, ok := sm.Data[path]; ok {
+		fs.Done = true
+	}
+}
+
+// Paths returns the tracked paths in the order they are handed out.
+func (sm *StatefulMap) Paths() []string {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	return append([]string(nil), sm.order...)
+}
+
+// Statuses returns a copy of every tracked file's status, in the order they
+// are handed out.
+func (sm *StatefulMap) Statuses() []FileStatus {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	statuses := make([]FileStatus, 0, len(sm.order))
+	for _, path := range sm.order {
+		statuses = append(statuses, *sm.Data[path])
+	}
+	return statuses
+}
+
+func (sm *StatefulMap) Len() int {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	return len(sm.order)
+}
+
+// FindByExtension walks Root and returns every file with the given extension
+// that passes the finder's filters, keyed by full path and sorted by SortBy.
+// Directories that cannot be read because of permissions are skipped, any
+// other walk error is returned.
+func (f *FileFinder) FindByExtension(extension string) (*StatefulMap, error) {
+	for _, pattern := range append(append([]string(nil), f.Include...), f.Exclude...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid glob pattern [%s]: %w", pattern, err)
+		}
+	}
+
+	var found []*FileStatus
+	visited := make(map[string]bool)
+	if err := f.walk(f.Root, extension, visited, &found); err != nil {
+		return nil, fmt.Errorf("Error walking root [%s]: %w", f.Root, err)
+	}
+
+	f.sort(found)
+
+	sm := NewStatefulMap()
+	for _, status := range found {
+		sm.Add(status)
+	}
+	return sm, nil
+}
+
+// Accept reports whether a single file passes the finder's filters. It is
+// used by callers that learn about files outside of a walk.
+func (f *FileFinder) Accept(path, extension string, info fs.FileInfo) bool {
+	if !info.Mode().IsRegular() || filepath.Ext(path) != extension {
+		return false
+	}
+	if f.MinSize > 0 && info.Size() < f.MinSize {
+		return false
+	}
+	if f.MaxSize > 0 && info.Size() > f.MaxSize {
+		return false
+	}
+	if f.matches(f.Exclude, path) {
+		return false
+	}
+	return len(f.Include) == 0 || f.matches(f.Include, path)
+}
+
+// walk collects the files under root. visited holds the real path of every
+// directory walked so far, so a directory reached both directly and through
+// a symlink, or through a symlink cycle, is only walked once.
+func (f *FileFinder) walk(root, extension string, visited map[string]bool, found *[]*FileStatus) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
-			if os.IsPermission(err) {
+			if os.IsPermission(err) && path != root {
+				logging.Component("finder").Warn("Skipping unreadable directory", "dir", path, "error", err)
 				return filepath.SkipDir
 			}
 			return err
 		}
 
-		if d.IsDir() && strings.HasPrefix(d.Name(), ".") {
-			return filepath.SkipDir
+		if d.IsDir() {
+			if path != root && (strings.HasPrefix(d.Name(), ".") || f.matches(f.Exclude, path)) {
+				return filepath.SkipDir
+			}
+			real, err := filepath.EvalSymlinks(path)
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return filepath.SkipDir
+				}
+				return err
+			}
+			if visited[real] {
+				return filepath.SkipDir
+			}
+			visited[real] = true
+			return nil
 		}
 
-		if !d.IsDir() && filepath.Ext(d.Name()) == extension {
-			files[d.Name()] = &FileStatus{
-				Path:    path,
-				Started: false,
-				Done:    false,
+		if d.Type()&fs.ModeSymlink != 0 {
+			if f.Symlinks != SymlinkFollow {
+				return nil
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				logging.Component("finder").Warn("Skipping broken symlink", "path", path, "error", err)
+				return nil
 			}
+			if info.IsDir() {
+				if strings.HasPrefix(d.Name(), ".") || f.matches(f.Exclude, path) {
+					return nil
+				}
+				return f.walkLink(path, extension, visited, found)
+			}
+			f.collect(path, extension, info, found)
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
 		}
+		f.collect(path, extension, info, found)
 		return nil
 	})
-	return StatefulMap{
-		Data: files,
+}
+
+// walkLink descends into a symlinked directory. WalkDir never follows links,
+// so the children of the link are walked one by one under the link's path.
+func (f *FileFinder) walkLink(link, extension string, visited map[string]bool, found *[]*FileStatus) error {
+	real, err := filepath.EvalSymlinks(link)
+	if err != nil {
+		return err
+	}
+	if visited[real] {
+		return nil
+	}
+	visited[real] = true
+
+	entries, err := os.ReadDir(link)
+	if err != nil {
+		if os.IsPermission(err) {
+			logging.Component("finder").Warn("Skipping unreadable directory", "dir", link, "error", err)
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		path := filepath.Join(link, entry.Name())
+		if entry.IsDir() && (strings.HasPrefix(entry.Name(), ".") || f.matches(f.Exclude, path)) {
+			continue
+		}
+		if err := f.walk(path, extension, visited, found); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *FileFinder) collect(path, extension string, info fs.FileInfo, found *[]*FileStatus) {
+	if !f.Accept(path, extension, info) {
+		return
 	}
+	*found = append(*found, &FileStatus{
+		Path:    path,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	})
+}
+
+func (f *FileFinder) matches(patterns []string, path string) bool {
+	base := filepath.Base(path)
+	rel, err := filepath.Rel(f.Root, path)
+	if err != nil {
+		rel = path
+	}
+	rel = filepath.ToSlash(rel)
+
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, base); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, rel); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *FileFinder) sort(found []*FileStatus) {
+	sort.SliceStable(found, func(i, j int) bool {
+		if f.SortBy == SortByModTime && !found[i].ModTime.Equal(found[j].ModTime) {
+			return found[i].ModTime.Before(found[j].ModTime)
+		}
+		return found[i].Path < found[j].Path
+	})
 }
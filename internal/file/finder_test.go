@@ -0,0 +1,162 @@
+package file
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, path string, size int, modTime time.Time) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatalf("Error creating directory: %v", err)
+	}
+	if err := os.WriteFile(path, make([]byte, size), 0o644); err != nil {
+		t.Fatalf("Error writing file: %v", err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf("Error setting file times: %v", err)
+	}
+}
+
+func TestFindByExtensionKeysByFullPath(t *testing.T) {
+	root := t.TempDir()
+	now := time.Now()
+	writeFile(t, filepath.Join(root, "a", "dump.zst"), 10, now)
+	writeFile(t, filepath.Join(root, "b", "dump.zst"), 10, now)
+	writeFile(t, filepath.Join(root, "b", "notes.txt"), 10, now)
+	writeFile(t, filepath.Join(root, ".hidden", "dump.zst"), 10, now)
+
+	finder := FileFinder{Root: root}
+	files, err := finder.FindByExtension(".zst")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	paths := files.Paths()
+	want := []string{filepath.Join(root, "a", "dump.zst"), filepath.Join(root, "b", "dump.zst")}
+	if len(paths) != len(want) {
+		t.Fatalf("Expected %d files, got %v", len(want), paths)
+	}
+	for i := range want {
+		if paths[i] != want[i] {
+			t.Fatalf("Expected %s at %d, got %s", want[i], i, paths[i])
+		}
+	}
+}
+
+func TestFindByExtensionFilters(t *testing.T) {
+	root := t.TempDir()
+	now := time.Now()
+	writeFile(t, filepath.Join(root, "raids", "s20.zst"), 100, now)
+	writeFile(t, filepath.Join(root, "raids", "s21.zst"), 100, now)
+	writeFile(t, filepath.Join(root, "raids", "tiny.zst"), 1, now)
+	writeFile(t, filepath.Join(root, "tmp", "s22.zst"), 100, now)
+
+	finder := FileFinder{
+		Root:    root,
+		Include: []string{"s2*.zst"},
+		Exclude: []string{"tmp", "s21.zst"},
+		MinSize: 10,
+	}
+	files, err := finder.FindByExtension(".zst")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	paths := files.Paths()
+	if len(paths) != 1 || paths[0] != filepath.Join(root, "raids", "s20.zst") {
+		t.Fatalf("Expected only s20.zst, got %v", paths)
+	}
+}
+
+func TestFindByExtensionSortByModTime(t *testing.T) {
+	root := t.TempDir()
+	now := time.Now()
+	writeFile(t, filepath.Join(root, "a.zst"), 1, now)
+	writeFile(t, filepath.Join(root, "b.zst"), 1, now.Add(-2*time.Hour))
+	writeFile(t, filepath.Join(root, "c.zst"), 1, now.Add(-1*time.Hour))
+
+	finder := FileFinder{Root: root, SortBy: SortByModTime}
+	files, err := finder.FindByExtension(".zst")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	for _, name := range []string{"b.zst", "c.zst", "a.zst"} {
+		path, _, ok := files.GetNext()
+		if !ok {
+			t.Fatalf("Expected %s, got nothing", name)
+		}
+		if filepath.Base(path) != name {
+			t.Fatalf("Expected %s, got %s", name, path)
+		}
+	}
+	if _, _, ok := files.GetNext(); ok {
+		t.Fatal("Expected all files to be started")
+	}
+}
+
+func TestFindByExtensionSymlinks(t *testing.T) {
+	root := t.TempDir()
+	other := t.TempDir()
+	writeFile(t, filepath.Join(other, "linked.zst"), 1, time.Now())
+	if err := os.Symlink(other, filepath.Join(root, "link")); err != nil {
+		t.Skipf("Symlinks not supported: %v", err)
+	}
+	if err := os.Symlink(root, filepath.Join(other, "loop")); err != nil {
+		t.Fatalf("Error creating symlink: %v", err)
+	}
+
+	skip := FileFinder{Root: root}
+	files, err := skip.FindByExtension(".zst")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if files.Len() != 0 {
+		t.Fatalf("Expected symlinks to be skipped, got %v", files.Paths())
+	}
+
+	follow := FileFinder{Root: root, Symlinks: SymlinkFollow}
+	files, err = follow.FindByExtension(".zst")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if files.Len() != 1 {
+		t.Fatalf("Expected one file through the symlink, got %v", files.Paths())
+	}
+}
+
+func TestFindByExtensionFollowsSiblingLinksOnce(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "dumps", "a.zst"), 1, time.Now())
+	// Links sorting before and after the directory they point to.
+	if err := os.Symlink(filepath.Join(root, "dumps"), filepath.Join(root, "alias")); err != nil {
+		t.Skipf("Symlinks not supported: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(root, "dumps"), filepath.Join(root, "latest")); err != nil {
+		t.Fatalf("Error creating symlink: %v", err)
+	}
+
+	finder := FileFinder{Root: root, Symlinks: SymlinkFollow}
+	files, err := finder.FindByExtension(".zst")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if files.Len() != 1 {
+		t.Fatalf("Expected the linked directory to be walked once, got %v", files.Paths())
+	}
+}
+
+func TestFindByExtensionReportsErrors(t *testing.T) {
+	finder := FileFinder{Root: filepath.Join(t.TempDir(), "missing")}
+	if _, err := finder.FindByExtension(".zst"); err == nil {
+		t.Fatal("Expected error for missing root, got none")
+	}
+
+	finder = FileFinder{Root: t.TempDir(), Include: []string{"["}}
+	if _, err := finder.FindByExtension(".zst"); err == nil {
+		t.Fatal("Expected error for bad pattern, got none")
+	}
+}
@@ -0,0 +1,219 @@
+package file
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/deahtstroke/protheon/internal/logging"
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	DEFAULT_STABLE_AFTER = 30 * time.Second
+	DEFAULT_RESCAN       = 10 * time.Minute
+)
+
+// Watcher keeps a StatefulMap in sync with the files landing under the
+// finder's root. Files reported by inotify, or found by the periodic rescan,
+// are only added once their size and modification time stopped changing for
+// StableAfter, so dumps that are still being written are never scheduled.
+// A Rescan of 0 relies on inotify alone.
+type Watcher struct {
+	Finder      *FileFinder
+	Extension   string
+	Files       *StatefulMap
+	StableAfter time.Duration
+	Rescan      time.Duration
+
+	pending map[string]*pendingFile
+	ready   chan struct{}
+}
+
+type pendingFile struct {
+	size    int64
+	modTime time.Time
+	since   time.Time
+}
+
+func NewWatcher(finder *FileFinder, extension string, files *StatefulMap) *Watcher {
+	return &Watcher{
+		Finder:      finder,
+		Extension:   extension,
+		Files:       files,
+		StableAfter: DEFAULT_STABLE_AFTER,
+		Rescan:      DEFAULT_RESCAN,
+		pending:     make(map[string]*pendingFile),
+		ready:       make(chan struct{}),
+	}
+}
+
+// Ready returns a channel that is closed once Run watches the whole tree, so
+// files landing from then on are seen.
+func (w *Watcher) Ready() <-chan struct{} {
+	return w.ready
+}
+
+// Run watches the finder's root until the context is cancelled.
+func (w *Watcher) Run(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("Error creating file watcher: %w", err)
+	}
+	defer watcher.Close()
+
+	if err := w.watchTree(watcher, w.Finder.Root); err != nil {
+		return fmt.Errorf("Error watching root [%s]: %w", w.Finder.Root, err)
+	}
+	// Files that landed after the caller last looked for them, but before
+	// the tree was watched, raise no events.
+	w.rescan()
+	close(w.ready)
+
+	stableTicker := time.NewTicker(w.checkInterval())
+	defer stableTicker.Stop()
+	var rescan <-chan time.Time
+	if w.Rescan > 0 {
+		rescanTicker := time.NewTicker(w.Rescan)
+		defer rescanTicker.Stop()
+		rescan = rescanTicker.C
+	}
+
+	logging.Component("watcher").Info("Watching for new files", "root", w.Finder.Root, "extension", w.Extension)
+	for {
+		select {
+		case <-ctx.Done():
+			logging.Component("watcher").Info("Context cancelled, stopping watch")
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			w.handleEvent(watcher, event)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			logging.Component("watcher").Warn("Watch error", "error", err)
+		case <-stableTicker.C:
+			w.promoteStable(time.Now())
+		case <-rescan:
+			w.rescan()
+		}
+	}
+}
+
+func (w *Watcher) checkInterval() time.Duration {
+	interval := w.StableAfter / 2
+	if interval < 100*time.Millisecond {
+		interval = 100 * time.Millisecond
+	}
+	return interval
+}
+
+func (w *Watcher) watchTree(watcher *fsnotify.Watcher, root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsPermission(err) && path != root {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if path != w.Finder.Root && (strings.HasPrefix(d.Name(), ".") || w.Finder.matches(w.Finder.Exclude, path)) {
+			return filepath.SkipDir
+		}
+		return watcher.Add(path)
+	})
+}
+
+func (w *Watcher) handleEvent(watcher *fsnotify.Watcher, event fsnotify.Event) {
+	switch {
+	case event.Has(fsnotify.Create) || event.Has(fsnotify.Write):
+		info, err := os.Stat(event.Name)
+		if err != nil {
+			return
+		}
+		if info.IsDir() {
+			if event.Has(fsnotify.Create) {
+				if err := w.watchTree(watcher, event.Name); err != nil {
+					logging.Component("watcher").Warn("Error watching directory", "dir", event.Name, "error", err)
+				}
+				w.rescan()
+			}
+			return
+		}
+		w.track(event.Name, info, time.Now())
+	case event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename):
+		delete(w.pending, event.Name)
+	}
+}
+
+// track records a candidate file, resetting its stability clock whenever its
+// size or modification time changed since it was last seen.
+func (w *Watcher) track(path string, info fs.FileInfo, now time.Time) {
+	if filepath.Ext(path) != w.Extension || w.Files.Contains(path) {
+		return
+	}
+
+	p, ok := w.pending[path]
+	if !ok || p.size != info.Size() || !p.modTime.Equal(info.ModTime()) {
+		w.pending[path] = &pendingFile{
+			size:    info.Size(),
+			modTime: info.ModTime(),
+			since:   now,
+		}
+	}
+}
+
+func (w *Watcher) promoteStable(now time.Time) {
+	for path := range w.pending {
+		info, err := os.Stat(path)
+		if err != nil {
+			delete(w.pending, path)
+			continue
+		}
+
+		w.track(path, info, now)
+		p := w.pending[path]
+		if now.Sub(p.since) < w.StableAfter {
+			continue
+		}
+
+		delete(w.pending, path)
+		if !w.Finder.Accept(path, w.Extension, info) {
+			continue
+		}
+		if w.Files.Add(&FileStatus{Path: path, Size: info.Size(), ModTime: info.ModTime()}) {
+			logging.Component("watcher").Info("Scheduled new file", logging.KeyFile, path)
+		}
+	}
+}
+
+// rescan walks the whole tree as a fallback for events inotify dropped or
+// never delivered, such as files on network mounts.
+func (w *Watcher) rescan() {
+	found, err := w.Finder.FindByExtension(w.Extension)
+	if err != nil {
+		logging.Component("watcher").Error("Rescan failed", "error", err)
+		return
+	}
+
+	now := time.Now()
+	for _, path := range found.Paths() {
+		if w.Files.Contains(path) {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		w.track(path, info, now)
+	}
+}
@@ -0,0 +1,82 @@
+package file
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestWatcherSchedulesStableFiles(t *testing.T) {
+	root := t.TempDir()
+	finder := &FileFinder{Root: root}
+	files := NewStatefulMap()
+
+	watcher := NewWatcher(finder, ".zst", files)
+	watcher.StableAfter = 200 * time.Millisecond
+	// Without a rescan, new files are found by inotify alone.
+	watcher.Rescan = 0
+
+	// A file that landed before the tree was watched raises no event.
+	writeFile(t, filepath.Join(root, "early.zst"), 10, time.Now())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error)
+	go func() { done <- watcher.Run(ctx) }()
+
+	select {
+	case <-watcher.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the watcher to be ready")
+	}
+	writeFile(t, filepath.Join(root, "nested", "new.zst"), 10, time.Now())
+	writeFile(t, filepath.Join(root, "ignored.txt"), 10, time.Now())
+
+	deadline := time.After(5 * time.Second)
+	for len(files.Paths()) < 2 {
+		select {
+		case <-files.Updated():
+		case <-deadline:
+			t.Fatalf("Expected both files to be scheduled, got %v", files.Paths())
+		}
+	}
+
+	paths := files.Paths()
+	sort.Strings(paths)
+	if len(paths) != 2 || paths[0] != filepath.Join(root, "early.zst") || paths[1] != filepath.Join(root, "nested", "new.zst") {
+		t.Fatalf("Expected only early.zst and new.zst to be scheduled, got %v", paths)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Expected watcher to stop cleanly, got %v", err)
+	}
+}
+
+func TestWatcherWaitsForGrowingFiles(t *testing.T) {
+	root := t.TempDir()
+	path := filepath.Join(root, "growing.zst")
+	writeFile(t, path, 10, time.Now())
+
+	watcher := NewWatcher(&FileFinder{Root: root}, ".zst", NewStatefulMap())
+	watcher.StableAfter = time.Minute
+
+	start := time.Now()
+	watcher.rescan()
+	if err := os.WriteFile(path, make([]byte, 20), 0o644); err != nil {
+		t.Fatalf("Error growing file: %v", err)
+	}
+
+	watcher.promoteStable(start.Add(2 * time.Minute))
+	if watcher.Files.Len() != 0 {
+		t.Fatal("Expected growing file to stay pending")
+	}
+
+	watcher.promoteStable(start.Add(4 * time.Minute))
+	if watcher.Files.Len() != 1 {
+		t.Fatal("Expected stable file to be scheduled")
+	}
+}
@@ -0,0 +1,138 @@
+package graph
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/deahtstroke/protheon/internal/atomicfile"
+)
+
+// Load reads a graph saved with Save. A missing file is an empty graph.
+func Load(path string) (*Graph, error) {
+	g := New()
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return g, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error reading graph [%s]: %v", path, err)
+	}
+	if err := json.Unmarshal(data, g); err != nil {
+		return nil, fmt.Errorf("Error decoding graph [%s]: %v", path, err)
+	}
+	return g, nil
+}
+
+// Save writes the graph to path through a temporary file, so a crash never
+// leaves a half written graph behind.
+func (g *Graph) Save(path string) error {
+	data, err := json.Marshal(g)
+	if err != nil {
+		return err
+	}
+
+	return atomicfile.WriteFile(path, data, 0o644)
+}
+
+// WriteCSV writes the graph as an edge list.
+func (g *Graph) WriteCSV(w io.Writer) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"source", "target", "weight", "activities", "fireteams", "last_played"})
+	for _, e := range g.Edges() {
+		out.Write([]string{
+			e.A, e.B, strconv.FormatInt(e.Weight(), 10), strconv.FormatInt(e.Activities, 10),
+			strconv.FormatInt(e.Fireteams, 10), e.LastPlayed.UTC().Format(time.RFC3339),
+		})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+type graphML struct {
+	XMLName xml.Name     `xml:"graphml"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	Keys    []graphMLKey `xml:"key"`
+	Graph   struct {
+		EdgeDefault string        `xml:"edgedefault,attr"`
+		Nodes       []graphMLNode `xml:"node"`
+		Edges       []graphMLEdge `xml:"edge"`
+	} `xml:"graph"`
+}
+
+type graphMLKey struct {
+	ID   string `xml:"id,attr"`
+	For  string `xml:"for,attr"`
+	Name string `xml:"attr.name,attr"`
+	Type string `xml:"attr.type,attr"`
+}
+
+type graphMLData struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+type graphMLNode struct {
+	ID   string        `xml:"id,attr"`
+	Data []graphMLData `xml:"data"`
+}
+
+type graphMLEdge struct {
+	Source string        `xml:"source,attr"`
+	Target string        `xml:"target,attr"`
+	Data   []graphMLData `xml:"data"`
+}
+
+// WriteGraphML writes the graph as undirected GraphML, with Bungie names on
+// nodes and weights, counts and last play times on edges, for tools such as
+// Gephi.
+func (g *Graph) WriteGraphML(w io.Writer) error {
+	doc := graphML{
+		XMLNS: "http://graphml.graphdrawing.org/xmlns",
+		Keys: []graphMLKey{
+			{ID: "name", For: "node", Name: "name", Type: "string"},
+			{ID: "weight", For: "edge", Name: "weight", Type: "long"},
+			{ID: "activities", For: "edge", Name: "activities", Type: "long"},
+			{ID: "fireteams", For: "edge", Name: "fireteams", Type: "long"},
+			{ID: "lastPlayed", For: "edge", Name: "lastPlayed", Type: "string"},
+		},
+	}
+	doc.Graph.EdgeDefault = "undirected"
+
+	for _, id := range g.Players() {
+		node := graphMLNode{ID: id}
+		if name := g.Name(id); name != "" {
+			node.Data = append(node.Data, graphMLData{Key: "name", Value: name})
+		}
+		doc.Graph.Nodes = append(doc.Graph.Nodes, node)
+	}
+	for _, e := range g.Edges() {
+		doc.Graph.Edges = append(doc.Graph.Edges, graphMLEdge{
+			Source: e.A,
+			Target: e.B,
+			Data: []graphMLData{
+				{Key: "weight", Value: strconv.FormatInt(e.Weight(), 10)},
+				{Key: "activities", Value: strconv.FormatInt(e.Activities, 10)},
+				{Key: "fireteams", Value: strconv.FormatInt(e.Fireteams, 10)},
+				{Key: "lastPlayed", Value: e.LastPlayed.UTC().Format(time.RFC3339)},
+			},
+		})
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
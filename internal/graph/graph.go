@@ -0,0 +1,363 @@
+package graph
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	bungie "github.com/deahtstroke/protheon/internal/bungie/types"
+)
+
+const (
+	GRAPH_VERSION = 1
+)
+
+// Edge links two players, by membership ID, who played together. A is
+// always the smaller ID.
+type Edge struct {
+	A string `json:"a"`
+	B string `json:"b"`
+
+	// Activities counts the activities both played in, Fireteams those they
+	// played in the same fireteam, and Modes breaks Activities down by mode.
+	Activities int64           `json:"activities"`
+	Fireteams  int64           `json:"fireteams"`
+	Modes      map[int32]int64 `json:"modes"`
+	LastPlayed time.Time       `json:"lastPlayed"`
+}
+
+// Weight ranks how close two players are: every shared activity counts
+// once, and once more when they were in the same fireteam.
+func (e Edge) Weight() int64 {
+	return e.Activities + e.Fireteams
+}
+
+// Other returns the player on the other end of the edge from id.
+func (e Edge) Other(id string) string {
+	if e.A == id {
+		return e.B
+	}
+	return e.A
+}
+
+func (e *Edge) merge(o *Edge) {
+	e.Activities += o.Activities
+	e.Fireteams += o.Fireteams
+	if o.LastPlayed.After(e.LastPlayed) {
+		e.LastPlayed = o.LastPlayed
+	}
+	if e.Modes == nil {
+		e.Modes = make(map[int32]int64, len(o.Modes))
+	}
+	for mode, n := range o.Modes {
+		e.Modes[mode] += n
+	}
+}
+
+type pair struct {
+	a, b string
+}
+
+// name is a player's Bungie name and when it was last seen, so merges keep
+// the latest one.
+type name struct {
+	Name string    `json:"name"`
+	Seen time.Time `json:"seen"`
+}
+
+func (n name) newer(o name) bool {
+	return n.Seen.After(o.Seen) || (n.Seen.Equal(o.Seen) && n.Name > o.Name)
+}
+
+// Graph is a "played together" graph. Like career partials, graphs built by
+// different minds merge into the same graph whatever the order. It is safe
+// for concurrent use.
+type Graph struct {
+	mu    sync.RWMutex
+	edges map[pair]*Edge
+	names map[string]name
+
+	// adjacent indexes the edges of every player by the player on their
+	// other end.
+	adjacent map[string]map[string]*Edge
+}
+
+func New() *Graph {
+	return &Graph{
+		edges:    make(map[pair]*Edge),
+		names:    make(map[string]name),
+		adjacent: make(map[string]map[string]*Edge),
+	}
+}
+
+// Add links every pair of players in the PGCR. Players appearing on several
+// characters are counted once.
+func (g *Graph) Add(pgcr *bungie.PGCR) {
+	mode := int32(0)
+	if n, err := strconv.ParseInt(pgcr.ActivityDetails.Mode.String(), 10, 32); err == nil {
+		mode = int32(n)
+	}
+
+	fireteams := make(map[string]float64)
+	names := make(map[string]name)
+	for _, entry := range pgcr.Entries {
+		user := entry.Player.DestinyUserInfo
+		id := user.MembershipID.String()
+		if id == "" {
+			continue
+		}
+		fireteams[id] = entry.Values.FireteamID
+		if user.BungieGlobalDisplayName != "" {
+			names[id] = name{
+				Name: user.BungieName(),
+				Seen: pgcr.Period,
+			}
+		}
+	}
+
+	ids := make([]string, 0, len(fireteams))
+	for id := range fireteams {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.mergeNames(names)
+	for i, a := range ids {
+		for _, b := range ids[i+1:] {
+			edge := &Edge{A: a, B: b, Activities: 1, Modes: map[int32]int64{mode: 1}, LastPlayed: pgcr.Period}
+			if fireteams[a] != 0 && fireteams[a] == fireteams[b] {
+				edge.Fireteams = 1
+			}
+			g.merge(edge)
+		}
+	}
+}
+
+func (g *Graph) merge(e *Edge) {
+	key := pair{e.A, e.B}
+	current, ok := g.edges[key]
+	if !ok {
+		current = &Edge{A: e.A, B: e.B}
+		g.edges[key] = current
+		g.link(e.A, e.B, current)
+		g.link(e.B, e.A, current)
+	}
+	current.merge(e)
+}
+
+func (g *Graph) link(id, other string, e *Edge) {
+	neighbors, ok := g.adjacent[id]
+	if !ok {
+		neighbors = make(map[string]*Edge)
+		g.adjacent[id] = neighbors
+	}
+	neighbors[other] = e
+}
+
+// Merge adds every edge of o to g.
+func (g *Graph) Merge(o *Graph) {
+	edges := o.Edges()
+	names := o.copyNames()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for i := range edges {
+		g.merge(&edges[i])
+	}
+	g.mergeNames(names)
+}
+
+func (g *Graph) mergeNames(names map[string]name) {
+	for id, n := range names {
+		if current, ok := g.names[id]; !ok || n.newer(current) {
+			g.names[id] = n
+		}
+	}
+}
+
+func (g *Graph) copyNames() map[string]name {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	names := make(map[string]name, len(g.names))
+	for id, n := range g.names {
+		names[id] = n
+	}
+	return names
+}
+
+func (g *Graph) Len() int {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return len(g.edges)
+}
+
+// Name returns a player's Bungie name, when one was seen.
+func (g *Graph) Name(id string) string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return g.names[id].Name
+}
+
+// Edges returns copies of every edge, ordered by A then B.
+func (g *Graph) Edges() []Edge {
+	g.mu.RLock()
+	edges := make([]Edge, 0, len(g.edges))
+	for _, e := range g.edges {
+		c := Edge{A: e.A, B: e.B}
+		c.merge(e)
+		edges = append(edges, c)
+	}
+	g.mu.RUnlock()
+
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].A != edges[j].A {
+			return edges[i].A < edges[j].A
+		}
+		return edges[i].B < edges[j].B
+	})
+	return edges
+}
+
+// Players returns every player in the graph, ordered by ID.
+func (g *Graph) Players() []string {
+	g.mu.RLock()
+	players := make([]string, 0, len(g.adjacent))
+	for id := range g.adjacent {
+		players = append(players, id)
+	}
+	g.mu.RUnlock()
+
+	sort.Strings(players)
+	return players
+}
+
+// Neighbors returns the players id played with, closest first. With a mode
+// of 0 every activity counts, otherwise only activities of that mode, such as
+// raids (mode 4) for "who does this player raid with".
+func (g *Graph) Neighbors(id string, mode int32) []Edge {
+	g.mu.RLock()
+	neighbors := make([]Edge, 0, len(g.adjacent[id]))
+	for _, edge := range g.adjacent[id] {
+		e := Edge{A: edge.A, B: edge.B}
+		e.merge(edge)
+		if mode != 0 {
+			n := e.Modes[mode]
+			if n == 0 {
+				continue
+			}
+			// Fireteams aren't broken down by mode, so only shared
+			// activities of the mode count.
+			e.Activities, e.Fireteams = n, 0
+		}
+		neighbors = append(neighbors, e)
+	}
+	g.mu.RUnlock()
+
+	sort.Slice(neighbors, func(i, j int) bool {
+		if neighbors[i].Weight() != neighbors[j].Weight() {
+			return neighbors[i].Weight() > neighbors[j].Weight()
+		}
+		if !neighbors[i].LastPlayed.Equal(neighbors[j].LastPlayed) {
+			return neighbors[i].LastPlayed.After(neighbors[j].LastPlayed)
+		}
+		return neighbors[i].Other(id) < neighbors[j].Other(id)
+	})
+	return neighbors
+}
+
+// Communities groups players with label propagation over edges weighing at
+// least minWeight: every player repeatedly takes the label with the most
+// weight among their neighbors, ties going to the smallest label, until
+// labels settle. Players are visited in ID order, so the result is
+// deterministic. It returns each player's community label, which is the ID
+// of one of its members.
+func (g *Graph) Communities(minWeight int64, maxRounds int) map[string]string {
+	adjacency := make(map[string]map[string]int64)
+	for _, e := range g.Edges() {
+		if e.Weight() < minWeight {
+			continue
+		}
+		for _, p := range [][2]string{{e.A, e.B}, {e.B, e.A}} {
+			if adjacency[p[0]] == nil {
+				adjacency[p[0]] = make(map[string]int64)
+			}
+			adjacency[p[0]][p[1]] = e.Weight()
+		}
+	}
+
+	players := make([]string, 0, len(adjacency))
+	labels := make(map[string]string, len(adjacency))
+	for id := range adjacency {
+		players = append(players, id)
+		labels[id] = id
+	}
+	sort.Strings(players)
+
+	for range maxRounds {
+		changed := false
+		for _, id := range players {
+			scores := make(map[string]int64)
+			for neighbor, weight := range adjacency[id] {
+				scores[labels[neighbor]] += weight
+			}
+			best := labels[id]
+			for label, score := range scores {
+				if score > scores[best] || (score == scores[best] && label < best) {
+					best = label
+				}
+			}
+			if best != labels[id] {
+				labels[id] = best
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+	}
+	return labels
+}
+
+type graphFile struct {
+	Version int             `json:"version"`
+	Edges   []Edge          `json:"edges"`
+	Names   map[string]name `json:"names"`
+}
+
+func (g *Graph) MarshalJSON() ([]byte, error) {
+	return json.Marshal(graphFile{Version: GRAPH_VERSION, Edges: g.Edges(), Names: g.copyNames()})
+}
+
+func (g *Graph) UnmarshalJSON(data []byte) error {
+	var file graphFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return err
+	}
+	if file.Version != GRAPH_VERSION {
+		return fmt.Errorf("Unsupported graph version %d", file.Version)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.edges = make(map[pair]*Edge, len(file.Edges))
+	g.adjacent = make(map[string]map[string]*Edge)
+	for i := range file.Edges {
+		g.merge(&file.Edges[i])
+	}
+	g.names = file.Names
+	if g.names == nil {
+		g.names = make(map[string]name)
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package graph
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	bungie "github.com/deahtstroke/protheon/internal/bungie/types"
+)
+
+func activity(mode string, period time.Time, players map[string]float64) *bungie.PGCR {
+	pgcr := &bungie.PGCR{
+		Period:          period,
+		ActivityDetails: bungie.ActivityDetails{Mode: json.Number(mode)},
+	}
+	for id, fireteam := range players {
+		entry := bungie.Entry{CharacterID: id + "0"}
+		entry.Player.DestinyUserInfo.MembershipID = json.Number(id)
+		entry.Player.DestinyUserInfo.BungieGlobalDisplayName = "P" + id
+		entry.Values.FireteamID = fireteam
+		pgcr.Entries = append(pgcr.Entries, entry)
+	}
+	return pgcr
+}
+
+func activities() []*bungie.PGCR {
+	day := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+	return []*bungie.PGCR{
+		activity("4", day, map[string]float64{"1": 9, "2": 9, "3": 9}),
+		activity("4", day.Add(time.Hour), map[string]float64{"1": 9, "2": 9}),
+		activity("5", day.Add(2*time.Hour), map[string]float64{"1": 9, "4": 8}),
+		activity("5", day.Add(3*time.Hour), map[string]float64{"5": 1, "6": 1}),
+	}
+}
+
+func TestGraphEdgesAndNeighbors(t *testing.T) {
+	g := New()
+	for _, pgcr := range activities() {
+		g.Add(pgcr)
+	}
+
+	if g.Len() != 5 {
+		t.Fatalf("Expected 5 edges, got %d", g.Len())
+	}
+
+	neighbors := g.Neighbors("1", 0)
+	if len(neighbors) != 3 || neighbors[0].Other("1") != "2" {
+		t.Fatalf("Expected player 2 to be closest, got %+v", neighbors)
+	}
+	if e := neighbors[0]; e.Activities != 2 || e.Fireteams != 2 || e.Weight() != 4 {
+		t.Fatalf("Unexpected edge: %+v", e)
+	}
+	if e := neighbors[2]; e.Other("1") != "4" || e.Fireteams != 0 {
+		t.Fatalf("Expected opponents not to share a fireteam, got %+v", e)
+	}
+
+	raids := g.Neighbors("1", 4)
+	if len(raids) != 2 {
+		t.Fatalf("Expected 2 raid partners, got %+v", raids)
+	}
+	if g.Name("1") != "P1#0000" {
+		t.Fatalf("Unexpected name: %s", g.Name("1"))
+	}
+}
+
+func TestGraphMergeAndSave(t *testing.T) {
+	whole, left, right := New(), New(), New()
+	for i, pgcr := range activities() {
+		whole.Add(pgcr)
+		if i%2 == 0 {
+			left.Add(pgcr)
+		} else {
+			right.Add(pgcr)
+		}
+	}
+	merged := New()
+	merged.Merge(right)
+	merged.Merge(left)
+	if !reflect.DeepEqual(whole.Edges(), merged.Edges()) {
+		t.Fatal("Expected merged graph to match the graph over every PGCR")
+	}
+
+	path := filepath.Join(t.TempDir(), "graph.json")
+	if err := merged.Save(path); err != nil {
+		t.Fatalf("Error saving: %v", err)
+	}
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("Error loading: %v", err)
+	}
+	if !reflect.DeepEqual(whole.Edges(), loaded.Edges()) || loaded.Name("4") != "P4#0000" {
+		t.Fatal("Expected loaded graph to match the saved one")
+	}
+	if !reflect.DeepEqual(whole.Players(), loaded.Players()) || !reflect.DeepEqual(whole.Neighbors("1", 0), loaded.Neighbors("1", 0)) {
+		t.Fatal("Expected the loaded graph to index the same neighbors")
+	}
+}
+
+func TestGraphCommunities(t *testing.T) {
+	g := New()
+	for _, pgcr := range activities() {
+		g.Add(pgcr)
+	}
+
+	labels := g.Communities(2, 10)
+	if labels["1"] != labels["2"] || labels["2"] != labels["3"] {
+		t.Fatalf("Expected the raid group in one community, got %v", labels)
+	}
+	if labels["5"] != labels["6"] || labels["5"] == labels["1"] {
+		t.Fatalf("Expected a separate community for 5 and 6, got %v", labels)
+	}
+	if _, ok := labels["4"]; ok {
+		t.Fatalf("Expected player 4's light edge to be ignored, got %v", labels)
+	}
+}
+
+func TestGraphExports(t *testing.T) {
+	g := New()
+	for _, pgcr := range activities() {
+		g.Add(pgcr)
+	}
+
+	var buf bytes.Buffer
+	if err := g.WriteCSV(&buf); err != nil {
+		t.Fatalf("Error writing CSV: %v", err)
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines != 6 {
+		t.Fatalf("Expected a header and 5 edges, got %d lines", lines)
+	}
+
+	buf.Reset()
+	if err := g.WriteGraphML(&buf); err != nil {
+		t.Fatalf("Error writing GraphML: %v", err)
+	}
+	var doc graphML
+	if err := xml.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatalf("Error parsing GraphML: %v", err)
+	}
+	if len(doc.Graph.Nodes) != 6 || len(doc.Graph.Edges) != 5 {
+		t.Fatalf("Expected 6 nodes and 5 edges, got %d and %d", len(doc.Graph.Nodes), len(doc.Graph.Edges))
+	}
+}
@@ -0,0 +1,103 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	bungie "github.com/deahtstroke/protheon/internal/bungie/types"
+	"github.com/deahtstroke/protheon/internal/dedupe"
+	"github.com/deahtstroke/protheon/internal/tracing"
+	"github.com/deahtstroke/protheon/internal/validate"
+	"go.opentelemetry.io/otel/codes"
+)
+
+var ErrDuplicate = errors.New("PGCR already processed")
+
+type Handler interface {
+	Handle(ctx context.Context, body []byte) (*bungie.PGCR, error)
+	Processed(pgcr *bungie.PGCR)
+	Abandoned(pgcr *bungie.PGCR)
+}
+
+// PgcrHandler decodes PGCRs consumed by a mind. When Seen is set, PGCRs whose
+// instance ID was already processed or is being processed, such as
+// redeliveries after a mind died before acking or duplicates within a batch,
+// are rejected with ErrDuplicate so they can be acked and skipped. Every
+// other PGCR handled without error claims its instance ID until it is
+// Processed or Abandoned. When Validator is set, PGCRs with error level violations are
+// rejected with an error wrapping validate.ErrInvalid.
+type PgcrHandler struct {
+	Seen      *dedupe.Store
+	Validator *validate.Validator
+}
+
+func NewPgcrHandler(seen *dedupe.Store, validator *validate.Validator) *PgcrHandler {
+	return &PgcrHandler{
+		Seen:      seen,
+		Validator: validator,
+	}
+}
+
+func (h *PgcrHandler) Handle(ctx context.Context, body []byte) (pgcr *bungie.PGCR, err error) {
+	_, span := tracing.Tracer().Start(ctx, "handle pgcr")
+	defer func() {
+		if err != nil && !errors.Is(err, ErrDuplicate) {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	return h.handle(body)
+}
+
+func (h *PgcrHandler) handle(body []byte) (*bungie.PGCR, error) {
+	var pgcr bungie.PGCR
+	if err := json.Unmarshal(body, &pgcr); err != nil {
+		return nil, fmt.Errorf("Error decoding PGCR: %w", err)
+	}
+
+	if h.Validator != nil {
+		if err := validate.Err(h.Validator.Validate(&pgcr), validate.Error); err != nil {
+			return &pgcr, err
+		}
+	}
+
+	if h.Seen == nil {
+		return &pgcr, nil
+	}
+
+	instanceID, err := dedupe.ParseInstanceID(pgcr.ActivityDetails.InstanceID.String())
+	if err != nil {
+		return nil, err
+	}
+	if !h.Seen.AddIfAbsent(instanceID) {
+		return &pgcr, ErrDuplicate
+	}
+	return &pgcr, nil
+}
+
+// Processed records a handled PGCR as seen. It should only be called once
+// the PGCR's data was stored, so a PGCR that failed to store is processed
+// again when it is redelivered.
+func (h *PgcrHandler) Processed(pgcr *bungie.PGCR) {
+	if h.Seen == nil {
+		return
+	}
+	if instanceID, err := dedupe.ParseInstanceID(pgcr.ActivityDetails.InstanceID.String()); err == nil {
+		h.Seen.Commit(instanceID)
+	}
+}
+
+// Abandoned gives up the claim of a handled PGCR that failed to store, so
+// it is processed again when it is redelivered.
+func (h *PgcrHandler) Abandoned(pgcr *bungie.PGCR) {
+	if h.Seen == nil {
+		return
+	}
+	if instanceID, err := dedupe.ParseInstanceID(pgcr.ActivityDetails.InstanceID.String()); err == nil {
+		h.Seen.Release(instanceID)
+	}
+}
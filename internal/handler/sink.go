@@ -0,0 +1,149 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bungie "github.com/deahtstroke/protheon/internal/bungie/types"
+)
+
+// Sink is where a mind stores the PGCRs it handled. Sinks are opened through
+// the registry, with OpenSink.
+//
+// Write may buffer. Flush is the sink's checkpoint: once it returns nil,
+// every PGCR written before it is durable, and the messages they came from
+// may be acked. Close flushes and releases the sink.
+type Sink interface {
+	Write(ctx context.Context, pgcrs []*bungie.PGCR) error
+	Flush(ctx context.Context) error
+	Close() error
+}
+
+// SinkOptions are the key=value options of a sink spec.
+type SinkOptions map[string]string
+
+// OpenSinkFunc opens a sink from its options.
+type OpenSinkFunc func(ctx context.Context, options SinkOptions) (Sink, error)
+
+var (
+	sinksMu sync.RWMutex
+	sinks   = make(map[string]OpenSinkFunc)
+)
+
+// RegisterSink makes a sink available to OpenSink under name. It panics if
+// name is registered twice.
+func RegisterSink(name string, open OpenSinkFunc) {
+	sinksMu.Lock()
+	defer sinksMu.Unlock()
+
+	if _, ok := sinks[name]; ok {
+		panic("handler: sink registered twice: " + name)
+	}
+	sinks[name] = open
+}
+
+// SinkNames lists the registered sinks.
+func SinkNames() []string {
+	sinksMu.RLock()
+	defer sinksMu.RUnlock()
+
+	names := make([]string, 0, len(sinks))
+	for name := range sinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// OpenSink opens the sink described by spec, a registered sink name
+// optionally followed by a colon and comma separated options:
+//
+//	parquet:dir=/data/parquet,max-file-age=15m
+//	stdout
+func OpenSink(ctx context.Context, spec string) (Sink, error) {
+	name, options, err := ParseSinkSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	sinksMu.RLock()
+	open, ok := sinks[name]
+	sinksMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Unknown sink [%s], expected one of %v", name, SinkNames())
+	}
+
+	sink, err := open(ctx, options)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening sink [%s]: %w", name, err)
+	}
+	return sink, nil
+}
+
+func ParseSinkSpec(spec string) (string, SinkOptions, error) {
+	name, rest, _ := strings.Cut(strings.TrimSpace(spec), ":")
+	if name == "" {
+		return "", nil, fmt.Errorf("Invalid sink [%s], expected name[:key=value,...]", spec)
+	}
+
+	options := make(SinkOptions)
+	for _, term := range strings.Split(rest, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(term, "=")
+		if !ok || key == "" {
+			return "", nil, fmt.Errorf("Invalid sink option [%s], expected key=value", term)
+		}
+		options[key] = value
+	}
+	return name, options, nil
+}
+
+// Only returns an error if options has a key other than keys, catching typos
+// in sink specs.
+func (o SinkOptions) Only(keys ...string) error {
+	for key := range o {
+		found := false
+		for _, k := range keys {
+			if key == k {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("Unknown option [%s], expected one of %v", key, keys)
+		}
+	}
+	return nil
+}
+
+func (o SinkOptions) Int64(key string, def int64) (int64, error) {
+	value, ok := o[key]
+	if !ok {
+		return def, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid [%s] option [%s]: %v", key, value, err)
+	}
+	return n, nil
+}
+
+func (o SinkOptions) Duration(key string, def time.Duration) (time.Duration, error) {
+	value, ok := o[key]
+	if !ok {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid [%s] option [%s]: %v", key, value, err)
+	}
+	return d, nil
+}
@@ -0,0 +1,64 @@
+package handler
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	bungie "github.com/deahtstroke/protheon/internal/bungie/types"
+)
+
+type memorySink struct {
+	options SinkOptions
+	written []*bungie.PGCR
+}
+
+func (s *memorySink) Write(ctx context.Context, pgcrs []*bungie.PGCR) error {
+	s.written = append(s.written, pgcrs...)
+	return nil
+}
+
+func (s *memorySink) Flush(ctx context.Context) error { return nil }
+
+func (s *memorySink) Close() error { return nil }
+
+func TestParseSinkSpec(t *testing.T) {
+	name, options, err := ParseSinkSpec("parquet:dir=/data/parquet, max-file-age=15m")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if name != "parquet" || options["dir"] != "/data/parquet" || options["max-file-age"] != "15m" {
+		t.Fatalf("Unexpected spec: %s %v", name, options)
+	}
+	if age, err := options.Duration("max-file-age", 0); err != nil || age != 15*time.Minute {
+		t.Fatalf("Expected 15m, got %v (%v)", age, err)
+	}
+	if err := options.Only("dir"); err == nil {
+		t.Fatal("Expected an error for the unexpected max-file-age option")
+	}
+
+	for _, spec := range []string{"", ":dir=/x", "parquet:dir"} {
+		if _, _, err := ParseSinkSpec(spec); err == nil {
+			t.Fatalf("Expected error for [%s], got none", spec)
+		}
+	}
+}
+
+func TestOpenSink(t *testing.T) {
+	RegisterSink("memory-test", func(ctx context.Context, options SinkOptions) (Sink, error) {
+		return &memorySink{options: options}, nil
+	})
+
+	s, err := OpenSink(context.Background(), "memory-test:size=3")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if s.(*memorySink).options["size"] != "3" {
+		t.Fatalf("Expected options to be passed, got %v", s.(*memorySink).options)
+	}
+
+	if _, err := OpenSink(context.Background(), "nope"); err == nil || !strings.Contains(err.Error(), "memory-test") {
+		t.Fatalf("Expected unknown sink error listing registered sinks, got %v", err)
+	}
+}
@@ -0,0 +1,170 @@
+// Package health serves liveness and readiness probes. /healthz answers as
+// long as the process serves HTTP. /readyz runs every registered component
+// check and reports each one, so operators can see why a process isn't ready:
+//
+//	{
+//	  "status": "fail",
+//	  "components": {
+//	    "broker": {"status": "ok"},
+//	    "checkpoint_store": {"status": "fail", "error": "..."}
+//	  }
+//	}
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	StatusOK   = "ok"
+	StatusFail = "fail"
+
+	// DEFAULT_CHECK_TIMEOUT bounds each component check of a readiness probe.
+	DEFAULT_CHECK_TIMEOUT = 2 * time.Second
+)
+
+// CheckFunc returns why a component isn't ready, or nil when it is.
+type CheckFunc func(ctx context.Context) error
+
+type ComponentStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type Report struct {
+	Status     string                     `json:"status"`
+	Components map[string]ComponentStatus `json:"components,omitempty"`
+}
+
+// Checker holds the component checks of a process.
+type Checker struct {
+	Timeout time.Duration
+
+	mu     sync.Mutex
+	checks map[string]CheckFunc
+}
+
+func NewChecker() *Checker {
+	return &Checker{
+		Timeout: DEFAULT_CHECK_TIMEOUT,
+		checks:  make(map[string]CheckFunc),
+	}
+}
+
+// Add registers a component check, replacing one with the same name.
+func (c *Checker) Add(name string, check CheckFunc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks[name] = check
+}
+
+// Check runs every component check concurrently.
+func (c *Checker) Check(ctx context.Context) Report {
+	c.mu.Lock()
+	names := make([]string, 0, len(c.checks))
+	for name := range c.checks {
+		names = append(names, name)
+	}
+	checks := make([]CheckFunc, len(names))
+	sort.Strings(names)
+	for i, name := range names {
+		checks[i] = c.checks[name]
+	}
+	c.mu.Unlock()
+
+	errs := make([]error, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, c.Timeout)
+			defer cancel()
+			errs[i] = run(checkCtx, check)
+		}()
+	}
+	wg.Wait()
+
+	report := Report{Status: StatusOK, Components: make(map[string]ComponentStatus, len(names))}
+	for i, name := range names {
+		if errs[i] != nil {
+			report.Status = StatusFail
+			report.Components[name] = ComponentStatus{Status: StatusFail, Error: errs[i].Error()}
+			continue
+		}
+		report.Components[name] = ComponentStatus{Status: StatusOK}
+	}
+	return report
+}
+
+// run gives up on checks that don't return in time.
+func run(ctx context.Context, check CheckFunc) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- check(ctx)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return errors.New("Check timed out")
+	}
+}
+
+// Liveness serves /healthz.
+func (c *Checker) Liveness(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, Report{Status: StatusOK})
+}
+
+// Readiness serves /readyz, with 503 Service Unavailable when a component
+// isn't ready.
+func (c *Checker) Readiness(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, c.Check(r.Context()))
+}
+
+func writeReport(w http.ResponseWriter, report Report) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if report.Status != StatusOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// Indicator is a component whose state is set as things happen, such as a
+// subscription starting or ending, rather than probed.
+type Indicator struct {
+	mu  sync.Mutex
+	err error
+}
+
+// NewIndicator returns an indicator that is down with reason until it is
+// set up.
+func NewIndicator(reason string) *Indicator {
+	return &Indicator{err: errors.New(reason)}
+}
+
+func (i *Indicator) Up() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.err = nil
+}
+
+func (i *Indicator) Down(err error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.err = err
+}
+
+// Check is the indicator's CheckFunc.
+func (i *Indicator) Check(ctx context.Context) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.err
+}
@@ -0,0 +1,71 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReadinessReportsEveryComponent(t *testing.T) {
+	c := NewChecker()
+	consumer := NewIndicator("Not subscribed yet")
+	c.Add("broker", func(ctx context.Context) error { return nil })
+	c.Add("consumer", consumer.Check)
+
+	probe := func() (int, Report) {
+		rec := httptest.NewRecorder()
+		c.Readiness(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		var report Report
+		if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+			t.Fatalf("Error decoding report: %v", err)
+		}
+		return rec.Code, report
+	}
+
+	code, report := probe()
+	if code != http.StatusServiceUnavailable || report.Status != StatusFail {
+		t.Fatalf("Expected not ready, got %d %+v", code, report)
+	}
+	if report.Components["broker"].Status != StatusOK || report.Components["consumer"].Error != "Not subscribed yet" {
+		t.Fatalf("Unexpected components: %+v", report.Components)
+	}
+
+	consumer.Up()
+	if code, report := probe(); code != http.StatusOK || report.Status != StatusOK {
+		t.Fatalf("Expected ready, got %d %+v", code, report)
+	}
+
+	consumer.Down(errors.New("Consumer channel is closed"))
+	if code, _ := probe(); code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected not ready after the consumer went down, got %d", code)
+	}
+}
+
+func TestSlowChecksTimeOut(t *testing.T) {
+	c := NewChecker()
+	c.Timeout = 10 * time.Millisecond
+	c.Add("stuck", func(ctx context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	})
+
+	report := c.Check(context.Background())
+	if report.Status != StatusFail || report.Components["stuck"].Error != "Check timed out" {
+		t.Fatalf("Expected the stuck check to time out, got %+v", report)
+	}
+}
+
+func TestLiveness(t *testing.T) {
+	c := NewChecker()
+	c.Add("broken", func(ctx context.Context) error { return errors.New("down") })
+
+	rec := httptest.NewRecorder()
+	c.Liveness(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected liveness to ignore components, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,399 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/deahtstroke/protheon/internal/events"
+)
+
+func TestTransitions(t *testing.T) {
+	store, _ := Open("")
+	job, err := store.Create(Spec{Sources: []string{"/dumps"}}, "")
+	if err != nil || job.State != StatePending {
+		t.Fatalf("Expected a pending job, got %+v: %v", job, err)
+	}
+
+	if _, err := store.Transition(job.ID, StatePaused, nil); !errors.Is(err, ErrInvalidTransition) {
+		t.Fatalf("Expected a pending job not to pause, got %v", err)
+	}
+	job, _ = store.Transition(job.ID, StateRunning, nil)
+	if job.StartedAt == nil {
+		t.Fatalf("Expected the start to be recorded")
+	}
+	store.Transition(job.ID, StatePaused, nil)
+	store.Transition(job.ID, StateRunning, nil)
+	job, err = store.Transition(job.ID, StateFailed, errors.New("Broker connection is closed"))
+	if err != nil || job.FinishedAt == nil || job.Error != "Broker connection is closed" {
+		t.Fatalf("Expected the failure to be recorded, got %+v: %v", job, err)
+	}
+	if _, err := store.Transition(job.ID, StateRunning, nil); !errors.Is(err, ErrInvalidTransition) {
+		t.Fatalf("Expected a failed job to stay failed, got %v", err)
+	}
+	if _, err := store.Transition("missing", StateRunning, nil); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected an unknown job not to be found, got %v", err)
+	}
+}
+
+func TestStorePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs.json")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	spec := Spec{Name: "june", Sources: []string{"/dumps/2024-06"}, Filter: "mode=4", Queue: "pgcr_jobs"}
+	job, _ := store.Create(spec, "")
+	store.Transition(job.ID, StateRunning, nil)
+	store.Update(job.ID, func(j *Job) { j.Stats.Files = 2 })
+	store.Finish(job.ID, "/dumps/2024-06/a.zst", Stats{Read: 10, Published: 10})
+
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatalf("Error reopening store: %v", err)
+	}
+	loaded, err := reopened.Get(job.ID)
+	if err != nil || loaded.State != StateRunning || len(loaded.Done) != 1 || loaded.Stats.Published != 10 || loaded.Stats.Files != 2 ||
+		loaded.Stats.FilesDone != 1 || loaded.Name != "june" {
+		t.Fatalf("Unexpected job after reopening: %+v %v", loaded, err)
+	}
+	if unfinished, ok := reopened.Unfinished(spec); !ok || unfinished.ID != job.ID {
+		t.Fatalf("Expected the running job to be unfinished")
+	}
+}
+
+func TestStoreForgetsFinishedProgress(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs.json")
+	store, _ := Open(path)
+	var first Job
+	for i := range MAX_FINISHED_JOBS + 1 {
+		job, _ := store.Create(Spec{Sources: []string{"/dumps"}}, "")
+		store.Transition(job.ID, StateRunning, nil)
+		store.Finish(job.ID, "/dumps/a.zst", Stats{Published: 1})
+		if _, err := store.Transition(job.ID, StateCompleted, nil); err != nil {
+			t.Fatalf("Error completing job: %v", err)
+		}
+		if i == 0 {
+			first = job
+		}
+	}
+	running, _ := store.Create(Spec{Sources: []string{"/dumps"}}, "")
+	store.Transition(running.ID, StateRunning, nil)
+	store.Finish(running.ID, "/dumps/b.zst", Stats{Published: 1})
+
+	if len(store.List()) != MAX_FINISHED_JOBS+1 {
+		t.Fatalf("Expected %d finished jobs and the running one, got %d", MAX_FINISHED_JOBS, len(store.List()))
+	}
+	if _, err := store.Get(first.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected the job that finished first to be forgotten, got %v", err)
+	}
+
+	progress, err := os.ReadFile(path + ".progress")
+	if err != nil || strings.Count(string(progress), "\n") != 1 {
+		t.Fatalf("Expected only the running job's progress, got %q %v", progress, err)
+	}
+	reopened, _ := Open(path)
+	if job, _ := reopened.Get(running.ID); len(job.Done) != 1 || job.Stats.Published != 1 {
+		t.Fatalf("Unexpected running job after reopening: %+v", job)
+	}
+	for _, job := range reopened.List() {
+		if job.State.Finished() && (len(job.Done) != 0 || job.Stats.Published != 1) {
+			t.Fatalf("Expected finished jobs to keep their stats but not their files, got %+v", job)
+		}
+	}
+}
+
+func TestUpdateRollsBackWhenSaveFails(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := Open(filepath.Join(dir, "jobs.json"))
+	job, _ := store.Create(Spec{Sources: []string{"/dumps"}}, "")
+
+	// A directory in place of the state file can't be replaced.
+	os.Remove(filepath.Join(dir, "jobs.json"))
+	os.MkdirAll(filepath.Join(dir, "jobs.json", "in-the-way"), 0o755)
+	if _, err := store.Update(job.ID, func(j *Job) { j.Stats.Files = 5 }); err == nil {
+		t.Fatal("Expected the save to fail")
+	}
+	if job, _ := store.Get(job.ID); job.Stats.Files != 0 {
+		t.Fatalf("Expected the failed update to be rolled back, got %+v", job)
+	}
+}
+
+// fakeRun produces the files of a job one by one, until it is stopped. Each
+// file is done once the test sends to proceed.
+type fakeRun struct {
+	files   []string
+	started chan string
+	proceed chan struct{}
+	fail    error
+}
+
+func newFakeRun(files ...string) *fakeRun {
+	return &fakeRun{files: files, started: make(chan string, 10), proceed: make(chan struct{})}
+}
+
+func (f *fakeRun) run(ctx context.Context, job Job, run *Run) error {
+	done := make(map[string]bool)
+	for _, path := range job.Done {
+		done[path] = true
+	}
+	run.Found(len(f.files))
+	for _, path := range f.files {
+		if done[path] {
+			continue
+		}
+		f.started <- path
+		select {
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		case <-f.proceed:
+		}
+		run.Finished(path, Stats{Read: 2, Published: 1})
+	}
+	return f.fail
+}
+
+// newRunner runs jobs from /dumps, which don't name a queue.
+func newRunner(ctx context.Context, store *Store, run RunFunc) *Runner {
+	runner := NewRunner(ctx, store, run)
+	runner.Roots = []string{"/dumps"}
+	runner.Queues = []string{""}
+	return runner
+}
+
+func TestRunnerRefusesForbiddenJobs(t *testing.T) {
+	store, _ := Open("")
+	runner := newRunner(context.Background(), store, newFakeRun().run)
+	runner.Queues = []string{"pgcr_jobs"}
+
+	for _, spec := range []Spec{
+		{Sources: []string{"/etc"}, Queue: "pgcr_jobs"},
+		{Sources: []string{"/dumps/../etc"}, Queue: "pgcr_jobs"},
+		{Sources: []string{"/dumps-elsewhere"}, Queue: "pgcr_jobs"},
+		{Sources: []string{"/dumps/2024-06"}, Queue: "other"},
+	} {
+		if _, err := runner.Start(spec); !errors.Is(err, ErrForbidden) {
+			t.Fatalf("Expected %+v to be forbidden, got %v", spec, err)
+		}
+	}
+	if len(store.List()) != 0 {
+		t.Fatalf("Expected no job to be created, got %d", len(store.List()))
+	}
+
+	dir := t.TempDir()
+	os.Symlink("/etc", filepath.Join(dir, "escape"))
+	runner.Roots = []string{dir}
+	if _, err := runner.Start(Spec{Sources: []string{filepath.Join(dir, "escape")}, Queue: "pgcr_jobs"}); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("Expected a link out of the roots to be forbidden, got %v", err)
+	}
+}
+
+func TestRunnerPausesAndResumes(t *testing.T) {
+	store, _ := Open("")
+	fake := newFakeRun("a", "b", "c")
+	runner := newRunner(context.Background(), store, fake.run)
+	runner.Events = events.NewBus(0)
+	sub := runner.Events.Subscribe(0)
+	defer sub.Cancel()
+
+	job, err := runner.Start(Spec{Sources: []string{"/dumps"}})
+	if err != nil || job.State != StateRunning {
+		t.Fatalf("Expected the job to run, got %+v: %v", job, err)
+	}
+	<-fake.started
+	fake.proceed <- struct{}{}
+	<-fake.started
+	job, err = runner.Pause(job.ID)
+	if err != nil || job.State != StatePaused || len(job.Done) != 1 {
+		t.Fatalf("Expected the job paused after one file, got %+v: %v", job, err)
+	}
+	if _, err := runner.Pause(job.ID); !errors.Is(err, ErrInvalidTransition) {
+		t.Fatalf("Expected a paused job not to pause again, got %v", err)
+	}
+
+	if _, err := runner.Resume(job.ID); err != nil {
+		t.Fatalf("Error resuming: %v", err)
+	}
+	if path := <-fake.started; path != "b" {
+		t.Fatalf("Expected the job to resume at b, got %s", path)
+	}
+	fake.proceed <- struct{}{}
+	<-fake.started
+	fake.proceed <- struct{}{}
+	runner.Wait()
+
+	job, _ = runner.Job(job.ID)
+	if job.State != StateCompleted || job.Stats.FilesDone != 3 || job.Stats.Files != 3 || job.Stats.Published != 3 {
+		t.Fatalf("Unexpected completed job %+v", job)
+	}
+
+	var types []events.Type
+	for len(types) < 4 {
+		types = append(types, (<-sub.Events).Type)
+	}
+	want := []events.Type{events.IngestStarted, events.IngestPaused, events.IngestStarted, events.IngestFinished}
+	for i := range want {
+		if types[i] != want[i] {
+			t.Fatalf("Expected events %v, got %v", want, types)
+		}
+	}
+}
+
+func TestRunnerCancelsFailsAndReruns(t *testing.T) {
+	store, _ := Open("")
+	fake := newFakeRun("a")
+	fake.fail = errors.New("Error producing 1 of 1 files")
+	runner := newRunner(context.Background(), store, fake.run)
+
+	failed, _ := runner.Start(Spec{Name: "retry-me", Sources: []string{"/dumps"}, Filter: "mode=4"})
+	<-fake.started
+	fake.proceed <- struct{}{}
+	runner.Wait()
+	failed, _ = runner.Job(failed.ID)
+	if failed.State != StateFailed || failed.Error == "" {
+		t.Fatalf("Expected the job to fail, got %+v", failed)
+	}
+
+	fake.fail = nil
+	rerun, err := runner.Rerun(failed.ID)
+	if err != nil || rerun.RerunOf != failed.ID || rerun.Filter != "mode=4" || rerun.Name != "retry-me" {
+		t.Fatalf("Expected a job with the same parameters, got %+v: %v", rerun, err)
+	}
+	<-fake.started
+	cancelled, err := runner.Cancel(rerun.ID)
+	if err != nil || cancelled.State != StateCancelled {
+		t.Fatalf("Expected the rerun cancelled, got %+v: %v", cancelled, err)
+	}
+	if _, err := runner.Resume(rerun.ID); !errors.Is(err, ErrInvalidTransition) {
+		t.Fatalf("Expected a cancelled job not to resume, got %v", err)
+	}
+	if _, err := runner.Start(Spec{}); !errors.Is(err, ErrInvalidSpec) {
+		t.Fatalf("Expected a job without sources to be refused, got %v", err)
+	}
+}
+
+func TestRunnerRecoversAfterRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs.json")
+	store, _ := Open(path)
+	fake := newFakeRun("a", "b")
+	spec := Spec{Sources: []string{"/dumps"}, Watch: true}
+
+	ctx, shutdown := context.WithCancel(context.Background())
+	runner := newRunner(ctx, store, fake.run)
+	job, _ := runner.StartOrResume(spec)
+	<-fake.started
+	fake.proceed <- struct{}{}
+	<-fake.started
+	shutdown()
+	runner.Wait()
+
+	store, _ = Open(path)
+	if interrupted, _ := store.Get(job.ID); interrupted.State != StateRunning || len(interrupted.Done) != 1 {
+		t.Fatalf("Expected the interrupted job to stay running, got %+v", interrupted)
+	}
+
+	runner = newRunner(context.Background(), store, fake.run)
+	runner.Recover()
+	if path := <-fake.started; path != "b" {
+		t.Fatalf("Expected the job to resume at b, got %s", path)
+	}
+	again, err := runner.StartOrResume(spec)
+	if err != nil || again.ID != job.ID {
+		t.Fatalf("Expected the same job for the same spec, got %+v: %v", again, err)
+	}
+	fake.proceed <- struct{}{}
+	runner.Wait()
+	if len(store.List()) != 1 {
+		t.Fatalf("Expected a single job, got %d", len(store.List()))
+	}
+}
+
+func TestRunReportsStalls(t *testing.T) {
+	store, _ := Open("")
+	var read atomic.Int64
+	runner := newRunner(context.Background(), store, func(ctx context.Context, job Job, run *Run) error {
+		run.WatchStall(ctx, 20*time.Millisecond, func() (int64, bool) { return read.Load(), true })
+		return context.Cause(ctx)
+	})
+	runner.Events = events.NewBus(0)
+	sub := runner.Events.Subscribe(0)
+	defer sub.Cancel()
+
+	job, err := runner.Start(Spec{Sources: []string{"/dumps"}})
+	if err != nil {
+		t.Fatalf("Error starting: %v", err)
+	}
+	next := func() events.Event {
+		select {
+		case event := <-sub.Events:
+			return event
+		case <-time.After(time.Second):
+			t.Fatalf("Expected another event")
+			return events.Event{}
+		}
+	}
+	if event := next(); event.Type != events.IngestStarted {
+		t.Fatalf("Expected the job to start, got %s", event.Type)
+	}
+	event := next()
+	if event.Type != events.IngestStalled || !strings.Contains(string(event.Data), "blocked") {
+		t.Fatalf("Expected the job to stall on the queue, got %s %s", event.Type, event.Data)
+	}
+	read.Add(1)
+	if event := next(); event.Type != events.IngestResumed {
+		t.Fatalf("Expected the job to resume, got %s", event.Type)
+	}
+	runner.Cancel(job.ID)
+	runner.Wait()
+}
+
+func TestRunnerForgetsFilesCutShortByPause(t *testing.T) {
+	store, _ := Open("")
+	started := make(chan struct{})
+	runner := newRunner(context.Background(), store, func(ctx context.Context, job Job, run *Run) error {
+		close(started)
+		<-ctx.Done()
+		// A producer stopped mid-file, reporting it like a finished one.
+		run.Finished("/dumps/a.zst", Stats{Read: 1, Published: 1})
+		return context.Cause(ctx)
+	})
+
+	job, err := runner.Start(Spec{Sources: []string{"/dumps"}})
+	if err != nil {
+		t.Fatalf("Error starting: %v", err)
+	}
+	<-started
+	job, err = runner.Pause(job.ID)
+	if err != nil || job.State != StatePaused {
+		t.Fatalf("Expected the job paused, got %+v: %v", job, err)
+	}
+	if len(job.Done) != 0 || job.Stats.FilesDone != 0 {
+		t.Fatalf("Expected the file cut short not to be done, got %+v", job)
+	}
+}
+
+func TestRunnerRefusesSourcesBeforeLookingAtThem(t *testing.T) {
+	store, _ := Open("")
+	runner := newRunner(context.Background(), store, newFakeRun().run)
+	runner.Roots = []string{t.TempDir()}
+	runner.Prepare = func(spec Spec) (Spec, error) {
+		for _, source := range spec.Sources {
+			if _, err := os.Stat(source); err != nil {
+				return spec, err
+			}
+		}
+		return spec, nil
+	}
+
+	for _, source := range []string{"/etc", "/does/not/exist"} {
+		_, err := runner.Start(Spec{Sources: []string{source}})
+		if !errors.Is(err, ErrForbidden) || errors.Is(err, ErrInvalidSpec) {
+			t.Fatalf("Expected %s to be forbidden whether or not it exists, got %v", source, err)
+		}
+	}
+}
@@ -0,0 +1,482 @@
+// Package ingest keeps the conductor's ingest jobs. A job names what to
+// ingest: the source paths scanned for dumps, the filters applied to them and
+// the queue their PGCRs are published to. It moves through a small state
+// machine while it runs and keeps its final statistics, so that ingests can
+// be compared later, or run again with the same parameters.
+package ingest
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/deahtstroke/protheon/internal/atomicfile"
+	"github.com/deahtstroke/protheon/internal/logging"
+)
+
+const (
+	STATE_VERSION = 1
+
+	// MAX_FINISHED_JOBS is how many finished jobs are kept, the ones that
+	// finished last.
+	MAX_FINISHED_JOBS = 100
+)
+
+type State string
+
+// A job is pending until it starts running. A running job can be paused and
+// resumed, and ends completed, failed or cancelled.
+const (
+	StatePending   State = "pending"
+	StateRunning   State = "running"
+	StatePaused    State = "paused"
+	StateCompleted State = "completed"
+	StateFailed    State = "failed"
+	StateCancelled State = "cancelled"
+)
+
+// transitions lists the states each state can move to.
+var transitions = map[State][]State{
+	StatePending: {StateRunning, StateCancelled},
+	StateRunning: {StatePaused, StateCompleted, StateFailed, StateCancelled},
+	StatePaused:  {StateRunning, StateCancelled},
+}
+
+// Finished reports whether a job in state s is over.
+func (s State) Finished() bool {
+	return s == StateCompleted || s == StateFailed || s == StateCancelled
+}
+
+var (
+	ErrNotFound          = errors.New("Job not found")
+	ErrInvalidTransition = errors.New("Invalid job state transition")
+	ErrInvalidSpec       = errors.New("Invalid job")
+	ErrForbidden         = errors.New("Job not allowed")
+)
+
+// Spec is what a job ingests. Watch keeps the job running, ingesting new
+// dumps as they land in Sources, until it is paused or cancelled.
+type Spec struct {
+	Name    string   `json:"name,omitempty"`
+	Sources []string `json:"sources"`
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+	Filter  string   `json:"filter,omitempty"`
+	Queue   string   `json:"queue"`
+	Force   bool     `json:"force,omitempty"`
+	Watch   bool     `json:"watch,omitempty"`
+}
+
+// Stats counts a job's files, and its records by result.
+type Stats struct {
+	Files       int   `json:"files"`
+	FilesDone   int   `json:"files_done"`
+	Read        int64 `json:"read"`
+	Published   int64 `json:"published"`
+	Filtered    int64 `json:"filtered"`
+	Duplicates  int64 `json:"duplicates"`
+	Quarantined int64 `json:"quarantined"`
+	Failed      int64 `json:"failed"`
+}
+
+// Add adds the counts of o, but not its files.
+func (s *Stats) Add(o Stats) {
+	s.Read += o.Read
+	s.Published += o.Published
+	s.Filtered += o.Filtered
+	s.Duplicates += o.Duplicates
+	s.Quarantined += o.Quarantined
+	s.Failed += o.Failed
+}
+
+// Job is an ingest. Done lists the files it finished, which a resumed job
+// skips, until the job is over, and Stats counts the records of those files.
+// RerunOf is the ID of the job this one repeats.
+type Job struct {
+	ID string `json:"id"`
+	Spec
+	State      State      `json:"state"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	RerunOf    string     `json:"rerun_of,omitempty"`
+	Done       []string   `json:"done,omitempty"`
+	Stats      Stats      `json:"stats"`
+}
+
+func (j *Job) clone() Job {
+	c := *j
+	c.Sources = slices.Clone(j.Sources)
+	c.Include = slices.Clone(j.Include)
+	c.Exclude = slices.Clone(j.Exclude)
+	c.Done = slices.Clone(j.Done)
+	return c
+}
+
+// Store keeps jobs, persisting them to a state file when it has a path. It is
+// safe for concurrent use.
+//
+// The files jobs finish are appended to a progress log next to the state
+// file, so that recording one doesn't rewrite every job. The log only keeps
+// the progress of unfinished jobs, it is compacted when a job finishes and
+// when the store is opened.
+type Store struct {
+	path string
+	now  func() time.Time
+
+	mu       sync.Mutex
+	jobs     map[string]*Job
+	progress *os.File
+}
+
+// progressEntry is a line of the progress log: a file job finished, and the
+// job's stats after it.
+type progressEntry struct {
+	Job   string `json:"job"`
+	File  string `json:"file"`
+	Stats Stats  `json:"stats"`
+}
+
+type state struct {
+	Version int    `json:"version"`
+	Jobs    []*Job `json:"jobs"`
+}
+
+// Open loads the jobs persisted at path, or starts without any if the file
+// doesn't exist yet. An empty path keeps jobs in memory.
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, now: time.Now, jobs: make(map[string]*Job)}
+	if path == "" {
+		return s, nil
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if err := s.loadProgress(); err != nil {
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) load() error {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error reading jobs [%s]: %v", s.path, err)
+	}
+
+	var st state
+	if err := json.Unmarshal(data, &st); err != nil {
+		return fmt.Errorf("Error parsing jobs [%s]: %v", s.path, err)
+	}
+	if st.Version != STATE_VERSION {
+		return fmt.Errorf("Error loading jobs [%s]: unsupported version %d", s.path, st.Version)
+	}
+	for _, job := range st.Jobs {
+		s.jobs[job.ID] = job
+	}
+	return nil
+}
+
+func (s *Store) progressPath() string {
+	return s.path + ".progress"
+}
+
+// loadProgress applies the progress log to the unfinished jobs. A line cut
+// short by a crash is skipped.
+func (s *Store) loadProgress() error {
+	file, err := os.Open(s.progressPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error reading job progress [%s]: %v", s.progressPath(), err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry progressEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		job, ok := s.jobs[entry.Job]
+		if !ok || job.State.Finished() {
+			continue
+		}
+		// The state file keeps how many files the job found, which may be
+		// newer than the progress.
+		files := job.Stats.Files
+		job.Done = append(job.Done, entry.File)
+		job.Stats = entry.Stats
+		job.Stats.Files = files
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("Error reading job progress [%s]: %v", s.progressPath(), err)
+	}
+	return nil
+}
+
+// compact rewrites the progress log with only the progress of unfinished
+// jobs, and reopens it for appending.
+func (s *Store) compact() error {
+	if s.path == "" {
+		return nil
+	}
+
+	err := atomicfile.Write(s.progressPath(), 0o644, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		for _, job := range s.jobs {
+			if job.State.Finished() {
+				continue
+			}
+			for _, file := range job.Done {
+				if err := encoder.Encode(progressEntry{Job: job.ID, File: file, Stats: job.Stats}); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Error compacting job progress: %v", err)
+	}
+
+	if s.progress != nil {
+		s.progress.Close()
+	}
+	s.progress, err = os.OpenFile(s.progressPath(), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("Error opening job progress [%s]: %v", s.progressPath(), err)
+	}
+	return nil
+}
+
+// Create adds a pending job ingesting spec.
+func (s *Store) Create(spec Spec, rerunOf string) (Job, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return Job{}, fmt.Errorf("Error generating job ID: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job := &Job{
+		ID:        hex.EncodeToString(buf),
+		Spec:      spec,
+		State:     StatePending,
+		CreatedAt: s.now(),
+		RerunOf:   rerunOf,
+	}
+	s.jobs[job.ID] = job
+	if err := s.save(); err != nil {
+		delete(s.jobs, job.ID)
+		return Job{}, err
+	}
+	return job.clone(), nil
+}
+
+func (s *Store) Get(id string) (Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[id]
+	if !ok {
+		return Job{}, ErrNotFound
+	}
+	return job.clone(), nil
+}
+
+// List returns every job, the oldest first.
+func (s *Store) List() []Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]Job, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		list = append(list, job.clone())
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].CreatedAt.Equal(list[j].CreatedAt) {
+			return list[i].CreatedAt.Before(list[j].CreatedAt)
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// Unfinished returns the job still to finish ingesting spec, if there is one.
+func (s *Store) Unfinished(spec Spec) (Job, bool) {
+	for _, job := range s.List() {
+		if !job.State.Finished() && reflect.DeepEqual(job.Spec, spec) {
+			return job, true
+		}
+	}
+	return Job{}, false
+}
+
+// Transition moves a job to state to. Moving to a finished state records
+// cause, if any, as the job's error.
+func (s *Store) Transition(id string, to State, cause error) (Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[id]
+	if !ok {
+		return Job{}, ErrNotFound
+	}
+	if !slices.Contains(transitions[job.State], to) {
+		return job.clone(), fmt.Errorf("%w [%s]: %s to %s", ErrInvalidTransition, id, job.State, to)
+	}
+
+	previous := job.clone()
+	now := s.now()
+	job.State = to
+	var expired []*Job
+	switch {
+	case to == StateRunning && job.StartedAt == nil:
+		job.StartedAt = &now
+	case to.Finished():
+		job.FinishedAt = &now
+		if cause != nil {
+			job.Error = cause.Error()
+		}
+		// A finished job is never resumed, so its files are forgotten.
+		job.Done = nil
+		expired = s.expire()
+	}
+	if err := s.save(); err != nil {
+		*job = previous
+		for _, e := range expired {
+			s.jobs[e.ID] = e
+		}
+		return job.clone(), err
+	}
+	if to.Finished() {
+		if err := s.compact(); err != nil {
+			// The progress of finished jobs is ignored when loading, the
+			// next compaction drops it.
+			logging.Component("ingest").Warn("Error compacting job progress", "error", err)
+		}
+	}
+	return job.clone(), nil
+}
+
+// expire removes the finished jobs beyond MAX_FINISHED_JOBS, the ones that
+// finished first, and returns them.
+func (s *Store) expire() []*Job {
+	var finished []*Job
+	for _, job := range s.jobs {
+		if job.State.Finished() {
+			finished = append(finished, job)
+		}
+	}
+	if len(finished) <= MAX_FINISHED_JOBS {
+		return nil
+	}
+	sort.Slice(finished, func(i, j int) bool {
+		if !finished[i].FinishedAt.Equal(*finished[j].FinishedAt) {
+			return finished[i].FinishedAt.After(*finished[j].FinishedAt)
+		}
+		return finished[i].ID < finished[j].ID
+	})
+	expired := finished[MAX_FINISHED_JOBS:]
+	for _, job := range expired {
+		delete(s.jobs, job.ID)
+	}
+	return expired
+}
+
+// Update changes a job with update, such as to record how many files it
+// found. Files it finished are recorded with Finish.
+func (s *Store) Update(id string, update func(*Job)) (Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[id]
+	if !ok {
+		return Job{}, ErrNotFound
+	}
+	previous := job.clone()
+	update(job)
+	if err := s.save(); err != nil {
+		*job = previous
+		return job.clone(), err
+	}
+	return job.clone(), nil
+}
+
+// Finish records that a job is done with the file at path, and adds the
+// file's counts to the job's.
+func (s *Store) Finish(id, path string, stats Stats) (Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[id]
+	if !ok {
+		return Job{}, ErrNotFound
+	}
+	next := job.Stats
+	next.Add(stats)
+	next.FilesDone = len(job.Done) + 1
+
+	if s.path != "" {
+		if s.progress == nil {
+			return job.clone(), fmt.Errorf("Error writing job progress [%s]: not open", s.progressPath())
+		}
+		data, err := json.Marshal(progressEntry{Job: id, File: path, Stats: next})
+		if err != nil {
+			return job.clone(), err
+		}
+		if _, err := s.progress.Write(append(data, '\n')); err != nil {
+			return job.clone(), fmt.Errorf("Error writing job progress [%s]: %v", s.progressPath(), err)
+		}
+		if err := s.progress.Sync(); err != nil {
+			return job.clone(), fmt.Errorf("Error syncing job progress [%s]: %v", s.progressPath(), err)
+		}
+	}
+	job.Done = append(job.Done, path)
+	job.Stats = next
+	return job.clone(), nil
+}
+
+func (s *Store) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	// Done is kept in the progress log.
+	st := state{Version: STATE_VERSION}
+	for _, job := range s.jobs {
+		saved := *job
+		saved.Done = nil
+		st.Jobs = append(st.Jobs, &saved)
+	}
+	sort.Slice(st.Jobs, func(i, j int) bool { return st.Jobs[i].ID < st.Jobs[j].ID })
+
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return atomicfile.WriteFile(s.path, data, 0o644)
+}
@@ -0,0 +1,423 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deahtstroke/protheon/internal/events"
+	"github.com/deahtstroke/protheon/internal/logging"
+)
+
+// DEFAULT_STALL_AFTER is how long a job may make no progress before it is
+// reported stalled.
+const DEFAULT_STALL_AFTER = 5 * time.Minute
+
+var (
+	errPaused    = errors.New("Job paused")
+	errCancelled = errors.New("Job cancelled")
+)
+
+// RunFunc ingests a job, skipping the files in job.Done, and reports its
+// progress to run. It returns once the job is done, or with the cause of ctx
+// once ctx is done.
+type RunFunc func(ctx context.Context, job Job, run *Run) error
+
+// Run is a running job, which RunFunc reports its progress to.
+type Run struct {
+	ctx    context.Context
+	runner *Runner
+	store  *Store
+	id     string
+	found  int
+}
+
+// Found records how many files the job ingests, including those already done.
+func (r *Run) Found(files int) {
+	if files == r.found {
+		return
+	}
+	r.found = files
+	r.update(func(job *Job) { job.Stats.Files = files })
+}
+
+// Finished records that the job is done with a file, and the file's counts.
+// Once the job was stopped, a file may have been cut short, so it isn't
+// recorded and is produced again when the job resumes.
+func (r *Run) Finished(path string, stats Stats) {
+	if r.ctx.Err() != nil {
+		logging.Component("ingest").Info("Not recording file of a stopped job", "job", r.id, logging.KeyFile, path)
+		return
+	}
+	if _, err := r.store.Finish(r.id, path, stats); err != nil {
+		logging.Component("ingest").Error("Error saving job progress", "job", r.id, "error", err)
+	}
+}
+
+// WatchStall publishes ingest.stalled once progress, such as the records read
+// so far, stopped changing for after, and ingest.resumed once it changes
+// again, until ctx is done. Producing reports whether a file is being
+// produced, which tells a blocked broker from a watch waiting for files. An
+// after of 0 watches nothing.
+func (r *Run) WatchStall(ctx context.Context, after time.Duration, progress func() (int64, bool)) {
+	if after <= 0 {
+		return
+	}
+	ticker := time.NewTicker(max(after/4, time.Millisecond))
+	defer ticker.Stop()
+
+	last, _ := progress()
+	since := time.Now()
+	stalled := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n, producing := progress()
+			switch {
+			case n != last:
+				last, since = n, now
+				if stalled {
+					stalled = false
+					r.publish(events.IngestResumed, "")
+				}
+			case !stalled && now.Sub(since) >= after:
+				stalled = true
+				reason := fmt.Sprintf("No files to produce for %s", after)
+				if producing {
+					reason = fmt.Sprintf("No records read for %s, the queue may be blocked", after)
+				}
+				r.publish(events.IngestStalled, reason)
+				logging.Component("ingest").Warn("Job stalled", "job", r.id, "reason", reason)
+			}
+		}
+	}
+}
+
+func (r *Run) publish(t events.Type, reason string) {
+	job, err := r.store.Get(r.id)
+	if err != nil {
+		return
+	}
+	r.runner.Events.Publish(t, r.runner.event(job, reason))
+}
+
+func (r *Run) update(update func(*Job)) {
+	if _, err := r.store.Update(r.id, update); err != nil {
+		logging.Component("ingest").Error("Error saving job progress", "job", r.id, "error", err)
+	}
+}
+
+// Runner runs jobs in the background, each with run. Jobs are checked with
+// Prepare, if set, before they are created, and what happens to them is
+// published to Events.
+//
+// Jobs may only ingest sources within Roots and publish to Queues, others
+// are refused with ErrForbidden.
+type Runner struct {
+	Prepare func(Spec) (Spec, error)
+	Events  *events.Bus
+	Roots   []string
+	Queues  []string
+
+	ctx   context.Context
+	store *Store
+	run   RunFunc
+
+	mu      sync.Mutex
+	running map[string]*running
+	wg      sync.WaitGroup
+}
+
+type running struct {
+	cancel context.CancelCauseFunc
+	done   chan struct{}
+}
+
+// NewRunner runs jobs until ctx is done. Jobs running then stay running in
+// the store, and Recover resumes them once the conductor is back.
+func NewRunner(ctx context.Context, store *Store, run RunFunc) *Runner {
+	return &Runner{ctx: ctx, store: store, run: run, running: make(map[string]*running)}
+}
+
+func (r *Runner) Jobs() []Job {
+	return r.store.List()
+}
+
+func (r *Runner) Job(id string) (Job, error) {
+	return r.store.Get(id)
+}
+
+// Start creates a job ingesting spec, and runs it.
+func (r *Runner) Start(spec Spec) (Job, error) {
+	return r.create(spec, "")
+}
+
+// Rerun creates a job with the parameters of job id, and runs it.
+func (r *Runner) Rerun(id string) (Job, error) {
+	job, err := r.store.Get(id)
+	if err != nil {
+		return Job{}, err
+	}
+	return r.create(job.Spec, id)
+}
+
+func (r *Runner) prepare(spec Spec) (Spec, error) {
+	if len(spec.Sources) == 0 {
+		return spec, fmt.Errorf("%w: no sources", ErrInvalidSpec)
+	}
+	// Sources are checked before Prepare looks at them, so that refusing a
+	// source never tells whether it exists.
+	if err := r.allowSources(spec); err != nil {
+		return spec, err
+	}
+	if r.Prepare != nil {
+		var err error
+		if spec, err = r.Prepare(spec); err != nil {
+			return spec, fmt.Errorf("%w: %v", ErrInvalidSpec, err)
+		}
+	}
+	if err := r.allowSources(spec); err != nil {
+		return spec, err
+	}
+	return spec, r.allowQueue(spec)
+}
+
+func (r *Runner) allowSources(spec Spec) error {
+	for _, source := range spec.Sources {
+		if !slices.ContainsFunc(r.Roots, func(root string) bool { return within(root, source) }) {
+			return fmt.Errorf("%w: source [%s] is outside the ingest roots", ErrForbidden, source)
+		}
+	}
+	return nil
+}
+
+func (r *Runner) allowQueue(spec Spec) error {
+	if !slices.Contains(r.Queues, spec.Queue) {
+		return fmt.Errorf("%w: queue [%s] isn't one of %v", ErrForbidden, spec.Queue, r.Queues)
+	}
+	return nil
+}
+
+// within reports whether path is root or lies under it, once both are
+// absolute and, if they exist, have their symbolic links resolved.
+func within(root, path string) bool {
+	rel, err := filepath.Rel(resolve(root), resolve(path))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func resolve(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		return resolved
+	}
+	return filepath.Clean(path)
+}
+
+func (r *Runner) create(spec Spec, rerunOf string) (Job, error) {
+	spec, err := r.prepare(spec)
+	if err != nil {
+		return Job{}, err
+	}
+	job, err := r.store.Create(spec, rerunOf)
+	if err != nil {
+		return Job{}, err
+	}
+	return r.launch(job.ID)
+}
+
+// Resume runs a paused job again, after the files it already finished.
+func (r *Runner) Resume(id string) (Job, error) {
+	return r.launch(id)
+}
+
+// StartOrResume resumes the unfinished job ingesting spec, so that a
+// conductor restarted with the same --files picks up where it was, or starts
+// a job if there is none.
+func (r *Runner) StartOrResume(spec Spec) (Job, error) {
+	spec, err := r.prepare(spec)
+	if err != nil {
+		return Job{}, err
+	}
+	job, ok := r.store.Unfinished(spec)
+	if !ok {
+		return r.create(spec, "")
+	}
+	if r.isRunning(job.ID) {
+		return job, nil
+	}
+	return r.launch(job.ID)
+}
+
+// Recover runs the jobs that were pending, or running when the conductor
+// stopped.
+func (r *Runner) Recover() {
+	for _, job := range r.store.List() {
+		if job.State != StatePending && job.State != StateRunning {
+			continue
+		}
+		if r.isRunning(job.ID) {
+			continue
+		}
+		if _, err := r.launch(job.ID); err != nil {
+			logging.Component("ingest").Error("Error resuming job", "job", job.ID, "error", err)
+			continue
+		}
+		logging.Component("ingest").Info("Resumed job", "job", job.ID, "name", job.Name, "done", len(job.Done))
+	}
+}
+
+// Pause stops a running job, which can be resumed later.
+func (r *Runner) Pause(id string) (Job, error) {
+	return r.stop(id, StatePaused, errPaused)
+}
+
+// Cancel ends a job for good.
+func (r *Runner) Cancel(id string) (Job, error) {
+	return r.stop(id, StateCancelled, errCancelled)
+}
+
+func (r *Runner) stop(id string, to State, cause error) (Job, error) {
+	r.mu.Lock()
+	run, ok := r.running[id]
+	r.mu.Unlock()
+
+	if !ok {
+		job, err := r.store.Transition(id, to, nil)
+		if err == nil {
+			r.publish(job, "")
+		}
+		return job, err
+	}
+	run.cancel(cause)
+	<-run.done
+	return r.store.Get(id)
+}
+
+// Wait waits for the running jobs to return, once the runner's context is
+// done.
+func (r *Runner) Wait() {
+	r.wg.Wait()
+}
+
+func (r *Runner) isRunning(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.running[id]
+	return ok
+}
+
+func (r *Runner) launch(id string) (Job, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.running[id]; ok {
+		return Job{}, fmt.Errorf("%w [%s]: already running", ErrInvalidTransition, id)
+	}
+	job, err := r.store.Get(id)
+	if err != nil {
+		return Job{}, err
+	}
+	// A job still running in the store was interrupted by a restart.
+	if job.State != StateRunning {
+		if job, err = r.store.Transition(id, StateRunning, nil); err != nil {
+			return job, err
+		}
+	}
+
+	ctx, cancel := context.WithCancelCause(r.ctx)
+	run := &running{cancel: cancel, done: make(chan struct{})}
+	r.running[id] = run
+	r.publish(job, "")
+	logging.Component("ingest").Info("Running job", "job", job.ID, "name", job.Name, "sources", job.Sources, "queue", job.Queue)
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		defer close(run.done)
+		defer cancel(nil)
+
+		err := r.run(ctx, job, &Run{ctx: ctx, runner: r, store: r.store, id: id, found: job.Stats.Files})
+		r.finish(ctx, id, err)
+	}()
+	return job, nil
+}
+
+// finish moves a job that returned to the state it ended in.
+func (r *Runner) finish(ctx context.Context, id string, err error) {
+	// The job stays in running until its state is saved, so that stopping it
+	// meanwhile waits for the state instead of moving it too.
+	defer func() {
+		r.mu.Lock()
+		delete(r.running, id)
+		r.mu.Unlock()
+	}()
+
+	logger := logging.Component("ingest").With("job", id)
+	cause := context.Cause(ctx)
+	var job Job
+	var terr error
+	switch {
+	case err == nil:
+		job, terr = r.store.Transition(id, StateCompleted, nil)
+	case errors.Is(cause, errPaused):
+		job, terr = r.store.Transition(id, StatePaused, nil)
+	case errors.Is(cause, errCancelled):
+		job, terr = r.store.Transition(id, StateCancelled, nil)
+	case r.ctx.Err() != nil:
+		// The job stays running, to be resumed on restart.
+		job, terr = r.store.Get(id)
+		if terr == nil {
+			r.publish(job, "Conductor shutting down")
+			logger.Info("Job interrupted by shutdown", "done", len(job.Done))
+		}
+		return
+	default:
+		job, terr = r.store.Transition(id, StateFailed, err)
+	}
+	if terr != nil {
+		logger.Error("Error saving job state", "error", terr)
+		return
+	}
+	r.publish(job, "")
+
+	stats := job.Stats
+	logger.Info("Job ended", "state", string(job.State), "name", job.Name, "files", stats.FilesDone, "read", stats.Read, "published", stats.Published,
+		"filtered", stats.Filtered, "duplicates", stats.Duplicates, "quarantined", stats.Quarantined, "failed", stats.Failed, "error", job.Error)
+}
+
+// publish sends the event of job's state.
+func (r *Runner) publish(job Job, reason string) {
+	data := r.event(job, reason)
+	switch {
+	case reason != "" || job.State == StatePaused:
+		r.Events.Publish(events.IngestPaused, data)
+	case job.State == StateRunning:
+		r.Events.Publish(events.IngestStarted, data)
+	case job.State.Finished():
+		r.Events.Publish(events.IngestFinished, data)
+	}
+}
+
+// event describes job in ingest events.
+func (r *Runner) event(job Job, reason string) events.IngestData {
+	return events.IngestData{
+		ID:      job.ID,
+		Name:    job.Name,
+		Sources: slices.Clone(job.Sources),
+		Queue:   job.Queue,
+		Filter:  job.Filter,
+		Files:   job.Stats.Files,
+		State:   string(job.State),
+		Reason:  reason,
+		Error:   job.Error,
+	}
+}
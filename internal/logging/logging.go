@@ -0,0 +1,272 @@
+// Package logging sets up structured logging with log/slog for the conductor
+// and the minds. Records carry standard attributes so logs from a fleet of
+// minds can be searched and correlated:
+//
+//	component     which part of a binary logged, e.g. "producer" or "watcher"
+//	worker_id     the mind's ID, as assigned by the conductor
+//	file          the dump a record came from
+//	line          the record's line in that dump
+//	instance_id   the PGCR's instance ID
+//	trace_id      the trace of the context the record was logged with
+//	span_id       the span of the context the record was logged with
+//
+// Attributes can travel with a context through WithAttrs, and are added to
+// records logged with that context, as are the trace and span IDs.
+//
+// Records of the audit component are never sampled.
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Standard attribute keys.
+const (
+	KeyComponent  = "component"
+	KeyWorkerID   = "worker_id"
+	KeyFile       = "file"
+	KeyLine       = "line"
+	KeyInstanceID = "instance_id"
+	KeyTraceID    = "trace_id"
+	KeySpanID     = "span_id"
+)
+
+// ComponentAudit is the component of audit records.
+const ComponentAudit = "audit"
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Config selects how records are written.
+type Config struct {
+	Format string
+	Level  string
+
+	// Info and debug records with the same level and message are sampled:
+	// the first SampleFirst of them every SampleInterval are logged, then one
+	// in every SampleThereafter. Warnings and errors are always logged. A
+	// zero SampleFirst disables sampling.
+	SampleFirst      int
+	SampleThereafter int
+	SampleInterval   time.Duration
+}
+
+// ParseLevel parses a level name such as "debug" or "warn".
+func ParseLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return 0, fmt.Errorf("Unknown log level [%s], use debug, info, warn or error", name)
+	}
+	return level, nil
+}
+
+// Setup makes a logger writing to w the default for both slog and the log
+// package, and returns the level it logs at, which can be changed while
+// running.
+func Setup(w io.Writer, config Config) (*slog.LevelVar, error) {
+	level := new(slog.LevelVar)
+	if config.Level != "" {
+		l, err := ParseLevel(config.Level)
+		if err != nil {
+			return nil, err
+		}
+		level.Set(l)
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch config.Format {
+	case "", FormatText:
+		handler = slog.NewTextHandler(w, opts)
+	case FormatJSON:
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("Unknown log format [%s], use text or json", config.Format)
+	}
+
+	handler = &contextHandler{Handler: handler}
+	if config.SampleFirst > 0 {
+		handler = newSamplingHandler(handler, config.SampleFirst, config.SampleThereafter, config.SampleInterval)
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return level, nil
+}
+
+// Component returns the default logger with a component attribute.
+func Component(name string) *slog.Logger {
+	return slog.Default().With(KeyComponent, name)
+}
+
+type attrsKey struct{}
+
+// WithAttrs returns a context carrying attributes, given as slog key value
+// pairs, that are added to every record logged with it.
+func WithAttrs(ctx context.Context, args ...any) context.Context {
+	attrs := append([]slog.Attr(nil), Attrs(ctx)...)
+	record := slog.Record{}
+	record.Add(args...)
+	record.Attrs(func(attr slog.Attr) bool {
+		attrs = append(attrs, attr)
+		return true
+	})
+	return context.WithValue(ctx, attrsKey{}, attrs)
+}
+
+// Attrs returns the attributes carried by ctx.
+func Attrs(ctx context.Context) []slog.Attr {
+	attrs, _ := ctx.Value(attrsKey{}).([]slog.Attr)
+	return attrs
+}
+
+// contextHandler adds the context's attributes and trace to records.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h *contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if ctx != nil {
+		record.AddAttrs(Attrs(ctx)...)
+		if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+			record.AddAttrs(slog.String(KeyTraceID, span.TraceID().String()), slog.String(KeySpanID, span.SpanID().String()))
+		}
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{Handler: h.Handler.WithGroup(name)}
+}
+
+// samplingHandler drops repetitive records. Counts are shared by the
+// handlers derived from it with WithAttrs and WithGroup.
+type samplingHandler struct {
+	slog.Handler
+	counts *sampleCounts
+}
+
+type sampleCounts struct {
+	first      int
+	thereafter int
+	interval   time.Duration
+
+	mu     sync.Mutex
+	reset  time.Time
+	counts map[sampleKey]int
+}
+
+type sampleKey struct {
+	level   slog.Level
+	message string
+}
+
+func newSamplingHandler(handler slog.Handler, first, thereafter int, interval time.Duration) *samplingHandler {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	return &samplingHandler{
+		Handler: handler,
+		counts: &sampleCounts{
+			first:      first,
+			thereafter: thereafter,
+			interval:   interval,
+			counts:     make(map[sampleKey]int),
+		},
+	}
+}
+
+func (c *sampleCounts) allow(level slog.Level, message string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now.Sub(c.reset) >= c.interval {
+		c.reset = now
+		clear(c.counts)
+	}
+	key := sampleKey{level, message}
+	c.counts[key]++
+	n := c.counts[key]
+	if n <= c.first {
+		return true
+	}
+	return c.thereafter > 0 && (n-c.first)%c.thereafter == 0
+}
+
+func (h *samplingHandler) Handle(ctx context.Context, record slog.Record) error {
+	if record.Level < slog.LevelWarn && !h.counts.allow(record.Level, record.Message, record.Time) {
+		return nil
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *samplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	for _, attr := range attrs {
+		if attr.Key == KeyComponent && attr.Value.String() == ComponentAudit {
+			return h.Handler.WithAttrs(attrs)
+		}
+	}
+	return &samplingHandler{Handler: h.Handler.WithAttrs(attrs), counts: h.counts}
+}
+
+func (h *samplingHandler) WithGroup(name string) slog.Handler {
+	return &samplingHandler{Handler: h.Handler.WithGroup(name), counts: h.counts}
+}
+
+type levelBody struct {
+	Level string `json:"level"`
+}
+
+// LevelHandler serves the log level: GET returns it, PUT changes it with a
+// body such as {"level":"debug"}.
+func LevelHandler(level *slog.LevelVar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			var body levelBody
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+				return
+			}
+			l, err := ParseLevel(body.Level)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if l != level.Level() {
+				slog.Info("Log level changed", "from", level.Level().String(), "to", l.String())
+				level.Set(l)
+			}
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(levelBody{Level: strings.ToLower(level.Level().String())})
+	}
+}
+
+// Fatal logs an error and exits, like log.Fatal.
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
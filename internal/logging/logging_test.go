@@ -0,0 +1,130 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+func records(t *testing.T, out *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var result []map[string]any
+	decoder := json.NewDecoder(out)
+	for decoder.More() {
+		var record map[string]any
+		if err := decoder.Decode(&record); err != nil {
+			t.Fatalf("Error decoding record: %v", err)
+		}
+		result = append(result, record)
+	}
+	return result
+}
+
+func TestContextAttrsAndTrace(t *testing.T) {
+	previous := slog.Default()
+	defer slog.SetDefault(previous)
+
+	var out bytes.Buffer
+	if _, err := Setup(&out, Config{Format: FormatJSON}); err != nil {
+		t.Fatal(err)
+	}
+
+	span := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1, 2, 3},
+		SpanID:     trace.SpanID{4, 5, 6},
+		TraceFlags: trace.FlagsSampled,
+	})
+	ctx := trace.ContextWithSpanContext(context.Background(), span)
+	ctx = WithAttrs(ctx, KeyFile, "dump.zst", KeyLine, 7)
+	ctx = WithAttrs(ctx, KeyInstanceID, "42")
+	Component("producer").InfoContext(ctx, "Published")
+
+	got := records(t, &out)
+	if len(got) != 1 {
+		t.Fatalf("Expected one record, got %v", got)
+	}
+	r := got[0]
+	if r[KeyComponent] != "producer" || r[KeyFile] != "dump.zst" || r[KeyLine] != float64(7) || r[KeyInstanceID] != "42" {
+		t.Fatalf("Expected the context's attributes, got %v", r)
+	}
+	if r[KeyTraceID] != span.TraceID().String() || r[KeySpanID] != span.SpanID().String() {
+		t.Fatalf("Expected the trace and span IDs, got %v", r)
+	}
+}
+
+func TestSamplingDropsRepetitiveRecords(t *testing.T) {
+	previous := slog.Default()
+	defer slog.SetDefault(previous)
+
+	var out bytes.Buffer
+	if _, err := Setup(&out, Config{Format: FormatJSON, SampleFirst: 3, SampleThereafter: 5, SampleInterval: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 20; i++ {
+		slog.Info("Skipping duplicate")
+	}
+	slog.Warn("Something else")
+
+	got := records(t, &out)
+	// The first 3, then the 8th, 13th and 18th, then the other message.
+	if len(got) != 7 {
+		t.Fatalf("Expected 7 records, got %d", len(got))
+	}
+
+	out.Reset()
+	for i := 0; i < 20; i++ {
+		Component(ComponentAudit).Info("API call")
+	}
+	if got := records(t, &out); len(got) != 20 {
+		t.Fatalf("Expected every audit record, got %d", len(got))
+	}
+
+	out.Reset()
+	for i := 0; i < 20; i++ {
+		slog.Error("Flush failed")
+	}
+	if got := records(t, &out); len(got) != 20 {
+		t.Fatalf("Expected every error record, got %d", len(got))
+	}
+}
+
+func TestLevelHandler(t *testing.T) {
+	previous := slog.Default()
+	defer slog.SetDefault(previous)
+
+	var out bytes.Buffer
+	level, err := Setup(&out, Config{Format: FormatJSON, Level: "warn"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := LevelHandler(level)
+
+	slog.Info("Hidden")
+	if out.Len() != 0 {
+		t.Fatalf("Expected info records to be dropped at warn, got %s", out.String())
+	}
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPut, "/log/level", strings.NewReader(`{"level":"debug"}`)))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"debug"`) {
+		t.Fatalf("Unexpected response %d: %s", rec.Code, rec.Body.String())
+	}
+	if level.Level() != slog.LevelDebug {
+		t.Fatalf("Expected the level to change to debug, got %v", level.Level())
+	}
+
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPut, "/log/level", strings.NewReader(`{"level":"loud"}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected an unknown level to be rejected, got %d", rec.Code)
+	}
+}
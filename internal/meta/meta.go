@@ -0,0 +1,237 @@
+package meta
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	bungie "github.com/deahtstroke/protheon/internal/bungie/types"
+)
+
+const (
+	// LIGHT_BUCKET_SIZE is the width of the light level buckets players are
+	// grouped in. It is fixed so that meta saved by different minds merges.
+	LIGHT_BUCKET_SIZE = 10
+
+	META_VERSION = 1
+)
+
+// Bucket is one cell of the breakdown: a week, starting on Monday, a mode
+// and a light level bucket, identified by its lower bound.
+type Bucket struct {
+	Week  string `json:"week"`
+	Mode  int32  `json:"mode"`
+	Light int32  `json:"light"`
+}
+
+func (b Bucket) less(o Bucket) bool {
+	if b.Week != o.Week {
+		return b.Week < o.Week
+	}
+	if b.Mode != o.Mode {
+		return b.Mode < o.Mode
+	}
+	return b.Light < o.Light
+}
+
+// Totals count every entry of a bucket, whatever weapons were used.
+type Totals struct {
+	Entries int64 `json:"entries"`
+	Wins    int64 `json:"wins"`
+}
+
+// Usage counts the entries of a bucket that got kills with a weapon.
+type Usage struct {
+	Entries        int64 `json:"entries"`
+	Wins           int64 `json:"wins"`
+	Kills          int64 `json:"kills"`
+	PrecisionKills int64 `json:"precisionKills"`
+}
+
+func (u *Usage) add(o Usage) {
+	u.Entries += o.Entries
+	u.Wins += o.Wins
+	u.Kills += o.Kills
+	u.PrecisionKills += o.PrecisionKills
+}
+
+type bucketStats struct {
+	totals  Totals
+	weapons map[int64]*Usage
+}
+
+// Meta counts weapon usage per bucket. Counters only ever add up, so meta
+// computed by different minds merges into the same result in any order. It is
+// safe for concurrent use.
+type Meta struct {
+	mu      sync.RWMutex
+	buckets map[Bucket]*bucketStats
+}
+
+func New() *Meta {
+	return &Meta{buckets: make(map[Bucket]*bucketStats)}
+}
+
+// Week returns the Monday starting t's week, as YYYY-MM-DD.
+func Week(t time.Time) string {
+	t = t.UTC()
+	monday := t.AddDate(0, 0, -((int(t.Weekday()) + 6) % 7))
+	return monday.Format(time.DateOnly)
+}
+
+// LightBucket returns the lower bound of the light level's bucket.
+func LightBucket(light int) int32 {
+	return int32(light - light%LIGHT_BUCKET_SIZE)
+}
+
+// Won reports whether an entry counts as a win: the player completed the
+// activity and their team won it. PvE activities have no losing standing, so
+// there every completion counts as a win.
+func Won(entry bungie.Entry) bool {
+	return entry.Values.Completed == 1 && entry.Standing == 0
+}
+
+// Add counts the weapons of every entry of the PGCR.
+func (m *Meta) Add(pgcr *bungie.PGCR) {
+	mode := int32(0)
+	if n, err := strconv.ParseInt(pgcr.ActivityDetails.Mode.String(), 10, 32); err == nil {
+		mode = int32(n)
+	}
+	week := Week(pgcr.Period)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, entry := range pgcr.Entries {
+		bucket := Bucket{Week: week, Mode: mode, Light: LightBucket(entry.Player.LightLevel)}
+		stats := m.bucket(bucket)
+
+		won := Won(entry)
+		stats.totals.Entries++
+		if won {
+			stats.totals.Wins++
+		}
+
+		for _, weapon := range entry.Extended.Weapons {
+			id, err := strconv.ParseInt(weapon.ReferenceID.String(), 10, 64)
+			if err != nil {
+				continue
+			}
+			usage := Usage{
+				Entries:        1,
+				Kills:          int64(math.Round(weapon.Values.UniqueWeaponKills)),
+				PrecisionKills: int64(math.Round(weapon.Values.UniqueWeaponPrecisionKills)),
+			}
+			if won {
+				usage.Wins = 1
+			}
+			stats.weapon(id).add(usage)
+		}
+	}
+}
+
+func (m *Meta) bucket(b Bucket) *bucketStats {
+	stats, ok := m.buckets[b]
+	if !ok {
+		stats = &bucketStats{weapons: make(map[int64]*Usage)}
+		m.buckets[b] = stats
+	}
+	return stats
+}
+
+func (s *bucketStats) weapon(id int64) *Usage {
+	usage, ok := s.weapons[id]
+	if !ok {
+		usage = &Usage{}
+		s.weapons[id] = usage
+	}
+	return usage
+}
+
+// Merge adds every counter of o to m.
+func (m *Meta) Merge(o *Meta) {
+	buckets := o.export()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.merge(buckets)
+}
+
+func (m *Meta) merge(buckets []bucketFile) {
+	for _, b := range buckets {
+		stats := m.bucket(b.Bucket)
+		stats.totals.Entries += b.Totals.Entries
+		stats.totals.Wins += b.Totals.Wins
+		for _, w := range b.Weapons {
+			stats.weapon(w.ReferenceID).add(w.Usage)
+		}
+	}
+}
+
+// Len returns the number of buckets.
+func (m *Meta) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return len(m.buckets)
+}
+
+type bucketFile struct {
+	Bucket
+	Totals  Totals       `json:"totals"`
+	Weapons []weaponFile `json:"weapons"`
+}
+
+type weaponFile struct {
+	ReferenceID int64 `json:"referenceId"`
+	Usage
+}
+
+type metaFile struct {
+	Version int          `json:"version"`
+	Buckets []bucketFile `json:"buckets"`
+}
+
+// export copies every bucket, ordered by bucket then weapon.
+func (m *Meta) export() []bucketFile {
+	m.mu.RLock()
+	buckets := make([]bucketFile, 0, len(m.buckets))
+	for bucket, stats := range m.buckets {
+		b := bucketFile{Bucket: bucket, Totals: stats.totals, Weapons: make([]weaponFile, 0, len(stats.weapons))}
+		for id, usage := range stats.weapons {
+			b.Weapons = append(b.Weapons, weaponFile{ReferenceID: id, Usage: *usage})
+		}
+		sort.Slice(b.Weapons, func(i, j int) bool { return b.Weapons[i].ReferenceID < b.Weapons[j].ReferenceID })
+		buckets = append(buckets, b)
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Bucket.less(buckets[j].Bucket) })
+	return buckets
+}
+
+func (m *Meta) MarshalJSON() ([]byte, error) {
+	return json.Marshal(metaFile{Version: META_VERSION, Buckets: m.export()})
+}
+
+func (m *Meta) UnmarshalJSON(data []byte) error {
+	var file metaFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return err
+	}
+	if file.Version != META_VERSION {
+		return fmt.Errorf("Unsupported weapon meta version %d", file.Version)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.buckets = make(map[Bucket]*bucketStats, len(file.Buckets))
+	m.merge(file.Buckets)
+	return nil
+}
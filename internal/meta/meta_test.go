@@ -0,0 +1,132 @@
+package meta
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	bungie "github.com/deahtstroke/protheon/internal/bungie/types"
+)
+
+func player(light int, won bool, weapons map[string][2]float64) bungie.Entry {
+	e := bungie.Entry{Standing: 1}
+	e.Player.LightLevel = light
+	e.Values.Completed = 1
+	if won {
+		e.Standing = 0
+	}
+	for id, kills := range weapons {
+		e.Extended.Weapons = append(e.Extended.Weapons, bungie.Weapon{
+			ReferenceID: json.Number(id),
+			Values:      bungie.WeaponValues{UniqueWeaponKills: kills[0], UniqueWeaponPrecisionKills: kills[1]},
+		})
+	}
+	return e
+}
+
+func match(period time.Time, entries ...bungie.Entry) *bungie.PGCR {
+	return &bungie.PGCR{
+		Period:          period,
+		ActivityDetails: bungie.ActivityDetails{Mode: "5"},
+		Entries:         entries,
+	}
+}
+
+func matches() []*bungie.PGCR {
+	// A Wednesday and the Monday after.
+	week1 := time.Date(2024, 7, 3, 20, 0, 0, 0, time.UTC)
+	week2 := time.Date(2024, 7, 8, 1, 0, 0, 0, time.UTC)
+	return []*bungie.PGCR{
+		match(week1,
+			player(1995, true, map[string][2]float64{"100": {10, 5}}),
+			player(1991, true, map[string][2]float64{"100": {6, 3}, "200": {2, 0}}),
+			player(1989, false, map[string][2]float64{"200": {4, 1}}),
+			player(1990, false, nil)),
+		match(week2,
+			player(2000, true, map[string][2]float64{"100": {8, 2}}),
+			player(2000, false, map[string][2]float64{"200": {3, 3}})),
+	}
+}
+
+func TestWeekAndLightBucket(t *testing.T) {
+	if w := Week(time.Date(2024, 7, 7, 23, 0, 0, 0, time.UTC)); w != "2024-07-01" {
+		t.Fatalf("Expected Sunday to belong to the week of Monday 2024-07-01, got %s", w)
+	}
+	if b := LightBucket(1999); b != 1990 {
+		t.Fatalf("Expected bucket 1990, got %d", b)
+	}
+}
+
+func TestRowsByWeek(t *testing.T) {
+	m := New()
+	for _, pgcr := range matches() {
+		m.Add(pgcr)
+	}
+
+	rows := m.Rows(Breakdown{Week: true, Mode: true})
+	if len(rows) != 4 {
+		t.Fatalf("Expected 2 weapons over 2 weeks, got %+v", rows)
+	}
+
+	r := rows[0]
+	if r.Week != "2024-07-01" || r.Mode != 5 || r.Light != -1 || r.WeaponReferenceID != 100 {
+		t.Fatalf("Unexpected first row: %+v", r)
+	}
+	if r.Uses != 2 || r.UsageShare != 0.5 || r.KillsPerUse != 8 || r.PrecisionRatio != 0.5 || r.WinRate != 1 {
+		t.Fatalf("Unexpected stats: %+v", r)
+	}
+	// Both users of 100 won and neither non user did.
+	if math.Abs(r.WinCorrelation-1) > 1e-9 {
+		t.Fatalf("Expected a perfect win correlation, got %v", r.WinCorrelation)
+	}
+	if rows[1].WeaponReferenceID != 200 || rows[1].WinCorrelation != 0 {
+		t.Fatalf("Expected weapon 200 to be uncorrelated with winning, got %+v", rows[1])
+	}
+
+	byLight := m.Rows(Breakdown{Light: true})
+	if byLight[0].Light != 1980 || byLight[0].Week != "" || byLight[0].Mode != -1 {
+		t.Fatalf("Unexpected light breakdown: %+v", byLight[0])
+	}
+
+	var buf bytes.Buffer
+	if err := WriteCSV(&buf, rows); err != nil {
+		t.Fatalf("Error writing CSV: %v", err)
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines != 5 {
+		t.Fatalf("Expected a header and 4 rows, got %d lines", lines)
+	}
+}
+
+func TestMetaMergeAndSave(t *testing.T) {
+	whole, left, right := New(), New(), New()
+	for i, pgcr := range matches() {
+		whole.Add(pgcr)
+		if i == 0 {
+			left.Add(pgcr)
+		} else {
+			right.Add(pgcr)
+		}
+	}
+	merged := New()
+	merged.Merge(right)
+	merged.Merge(left)
+
+	path := filepath.Join(t.TempDir(), "meta.json")
+	if err := merged.Save(path); err != nil {
+		t.Fatalf("Error saving: %v", err)
+	}
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("Error loading: %v", err)
+	}
+
+	by := Breakdown{Week: true, Mode: true, Light: true}
+	if !reflect.DeepEqual(whole.Rows(by), loaded.Rows(by)) {
+		t.Fatal("Expected merged and saved meta to match the meta over every PGCR")
+	}
+}
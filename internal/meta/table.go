@@ -0,0 +1,188 @@
+package meta
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/deahtstroke/protheon/internal/atomicfile"
+)
+
+// Breakdown picks the dimensions rows are broken down by. Dimensions left
+// out are summed over, and reported as "" or -1 in rows.
+type Breakdown struct {
+	Week  bool
+	Mode  bool
+	Light bool
+}
+
+// Row is one weapon in one cell of a breakdown.
+type Row struct {
+	Week              string  `json:"week"`
+	Mode              int32   `json:"mode"`
+	Light             int32   `json:"light"`
+	WeaponReferenceID int64   `json:"weaponReferenceId"`
+	Uses              int64   `json:"uses"`
+	Kills             int64   `json:"kills"`
+	PrecisionKills    int64   `json:"precisionKills"`
+	UsageShare        float64 `json:"usageShare"`
+	KillsPerUse       float64 `json:"killsPerUse"`
+	PrecisionRatio    float64 `json:"precisionRatio"`
+	WinRate           float64 `json:"winRate"`
+	WinCorrelation    float64 `json:"winCorrelation"`
+}
+
+// Rows computes the meta table for a breakdown, ordered by week, mode, light
+// bucket and then by uses, most used weapon first. Usage share is the share
+// of entries in the cell that got kills with the weapon, and kills per use
+// the kills of each of those entries. Win correlation is the phi coefficient
+// between using the weapon and winning, from -1 to 1.
+func (m *Meta) Rows(by Breakdown) []Row {
+	type cell struct {
+		totals  Totals
+		weapons map[int64]*Usage
+	}
+	cells := make(map[Bucket]*cell)
+	for _, b := range m.export() {
+		key := b.Bucket
+		if !by.Week {
+			key.Week = ""
+		}
+		if !by.Mode {
+			key.Mode = -1
+		}
+		if !by.Light {
+			key.Light = -1
+		}
+
+		c, ok := cells[key]
+		if !ok {
+			c = &cell{weapons: make(map[int64]*Usage)}
+			cells[key] = c
+		}
+		c.totals.Entries += b.Totals.Entries
+		c.totals.Wins += b.Totals.Wins
+		for _, w := range b.Weapons {
+			usage, ok := c.weapons[w.ReferenceID]
+			if !ok {
+				usage = &Usage{}
+				c.weapons[w.ReferenceID] = usage
+			}
+			usage.add(w.Usage)
+		}
+	}
+
+	var rows []Row
+	for key, c := range cells {
+		for id, usage := range c.weapons {
+			rows = append(rows, row(key, id, c.totals, *usage))
+		}
+	}
+
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		if a.Week != b.Week {
+			return a.Week < b.Week
+		}
+		if a.Mode != b.Mode {
+			return a.Mode < b.Mode
+		}
+		if a.Light != b.Light {
+			return a.Light < b.Light
+		}
+		if a.Uses != b.Uses {
+			return a.Uses > b.Uses
+		}
+		return a.WeaponReferenceID < b.WeaponReferenceID
+	})
+	return rows
+}
+
+func row(key Bucket, id int64, totals Totals, usage Usage) Row {
+	r := Row{
+		Week:              key.Week,
+		Mode:              key.Mode,
+		Light:             key.Light,
+		WeaponReferenceID: id,
+		Uses:              usage.Entries,
+		Kills:             usage.Kills,
+		PrecisionKills:    usage.PrecisionKills,
+		UsageShare:        ratio(usage.Entries, totals.Entries),
+		KillsPerUse:       ratio(usage.Kills, usage.Entries),
+		PrecisionRatio:    ratio(usage.PrecisionKills, usage.Kills),
+		WinRate:           ratio(usage.Wins, usage.Entries),
+	}
+
+	// Phi over the 2x2 table of used/not used against won/lost.
+	n, used, wins, usedWins := float64(totals.Entries), float64(usage.Entries), float64(totals.Wins), float64(usage.Wins)
+	if denominator := math.Sqrt(used * (n - used) * wins * (n - wins)); denominator > 0 {
+		r.WinCorrelation = (usedWins*n - used*wins) / denominator
+	}
+	return r
+}
+
+func ratio(a, b int64) float64 {
+	if b == 0 {
+		return 0
+	}
+	return float64(a) / float64(b)
+}
+
+var csvHeader = []string{
+	"week", "mode", "light", "weapon_reference_id", "uses", "kills", "precision_kills", "usage_share",
+	"kills_per_use", "precision_ratio", "win_rate", "win_correlation",
+}
+
+// WriteCSV writes rows as a CSV table.
+func WriteCSV(w io.Writer, rows []Row) error {
+	out := csv.NewWriter(w)
+	out.Write(csvHeader)
+	for _, r := range rows {
+		out.Write([]string{
+			r.Week, strconv.Itoa(int(r.Mode)), strconv.Itoa(int(r.Light)),
+			strconv.FormatInt(r.WeaponReferenceID, 10), strconv.FormatInt(r.Uses, 10),
+			strconv.FormatInt(r.Kills, 10), strconv.FormatInt(r.PrecisionKills, 10),
+			formatFloat(r.UsageShare), formatFloat(r.KillsPerUse), formatFloat(r.PrecisionRatio),
+			formatFloat(r.WinRate), formatFloat(r.WinCorrelation),
+		})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', 4, 64)
+}
+
+// Load reads meta saved with Save. A missing file is empty meta.
+func Load(path string) (*Meta, error) {
+	m := New()
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error reading weapon meta [%s]: %v", path, err)
+	}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("Error decoding weapon meta [%s]: %v", path, err)
+	}
+	return m, nil
+}
+
+// Save writes the meta to path through a temporary file, so a crash never
+// leaves a half written file behind.
+func (m *Meta) Save(path string) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	return atomicfile.WriteFile(path, data, 0o644)
+}
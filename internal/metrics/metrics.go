@@ -0,0 +1,174 @@
+// Package metrics defines the Prometheus metrics of the conductor and the
+// minds. Names and labels are part of the interface dashboards and alerts are
+// built on, so they only ever get added to, never renamed. Per file series
+// only exist while the file is produced, so that they stay few.
+//
+// The conductor serves these on /metrics of its HTTP server:
+//
+//	protheon_conductor_pgcrs_total{result}            counter    records by result: read, published, filtered,
+//	                                                             duplicate, quarantined or failed
+//	protheon_conductor_file_size_bytes{file}           gauge      compressed size of a file being produced
+//	protheon_conductor_file_read_bytes{file}           gauge      compressed bytes of a file being produced read so far
+//	protheon_conductor_files{state}                    gauge      files by state: pending, producing or done
+//	protheon_conductor_publish_duration_seconds        histogram  time to hand a PGCR to the broker
+//	protheon_conductor_confirm_duration_seconds        histogram  time from publishing a PGCR to the broker's confirm
+//	protheon_conductor_unconfirmed_messages            gauge      published PGCRs the broker hasn't confirmed yet
+//	protheon_conductor_publish_nacks_total             counter    PGCRs the broker refused
+//	protheon_conductor_workers{state}                  gauge      registered minds by state: active or stale
+//
+// A mind serves these on /metrics of its --metrics-addr listener:
+//
+//	protheon_mind_messages_consumed_total              counter    deliveries received
+//	protheon_mind_messages_redelivered_total           counter    deliveries the broker delivered before
+//	protheon_mind_messages_acked_total                 counter    deliveries acked
+//	protheon_mind_messages_nacked_total{requeue}       counter    deliveries nacked, requeued ("true") or dropped ("false")
+//	protheon_mind_handle_duration_seconds              histogram  time to decode, validate and deduplicate a PGCR
+//	protheon_mind_sink_flush_duration_seconds{sink}    histogram  time to flush a sink, by sink type
+//	protheon_mind_sink_flush_errors_total{sink}        counter    failed flushes, by sink type
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "protheon"
+
+// Publisher instruments a broker publisher.
+type Publisher struct {
+	Duration    prometheus.Histogram
+	Confirm     prometheus.Histogram
+	Unconfirmed prometheus.Gauge
+	Nacks       prometheus.Counter
+}
+
+func newPublisher() *Publisher {
+	return &Publisher{
+		Duration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "conductor",
+			Name:      "publish_duration_seconds",
+			Help:      "Time to hand a PGCR to the broker.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+		}),
+		Confirm: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "conductor",
+			Name:      "confirm_duration_seconds",
+			Help:      "Time from publishing a PGCR to the broker confirming it.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 4, 10),
+		}),
+		Unconfirmed: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "conductor",
+			Name:      "unconfirmed_messages",
+			Help:      "Published PGCRs the broker hasn't confirmed yet.",
+		}),
+		Nacks: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "conductor",
+			Name:      "publish_nacks_total",
+			Help:      "PGCRs the broker refused.",
+		}),
+	}
+}
+
+// File is the progress of one file, read when metrics are scraped.
+type File struct {
+	Path  string `json:"path"`
+	State string `json:"state"`
+
+	// Records counts the file's records by result.
+	Records map[string]int64 `json:"records,omitempty"`
+
+	Size int64 `json:"size"`
+	Read int64 `json:"read"`
+}
+
+const (
+	FilePending   = "pending"
+	FileProducing = "producing"
+	FileDone      = "done"
+)
+
+var (
+	pgcrsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "conductor", "pgcrs_total"),
+		"Records by result.",
+		[]string{"result"}, nil)
+	fileSizeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "conductor", "file_size_bytes"),
+		"Compressed size of a file being produced.",
+		[]string{"file"}, nil)
+	fileReadDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "conductor", "file_read_bytes"),
+		"Compressed bytes of a file being produced read so far.",
+		[]string{"file"}, nil)
+	filesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "conductor", "files"),
+		"Files by state.",
+		[]string{"state"}, nil)
+	workersDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "conductor", "workers"),
+		"Registered minds by state.",
+		[]string{"state"}, nil)
+)
+
+// Conductor holds the conductor's metrics. File, record and worker series
+// are read from the Files, Records and Workers functions on every scrape,
+// rather than updated as things happen. Records returns the records produced
+// since the conductor started, by result.
+type Conductor struct {
+	Publisher *Publisher
+
+	Files   func() []File
+	Records func() map[string]int64
+	Workers func() map[string]int
+}
+
+// NewConductor creates the conductor's metrics and registers them with reg.
+func NewConductor(reg prometheus.Registerer, files func() []File, records func() map[string]int64, workers func() map[string]int) *Conductor {
+	c := &Conductor{
+		Publisher: newPublisher(),
+		Files:     files,
+		Records:   records,
+		Workers:   workers,
+	}
+	reg.MustRegister(c.Publisher.Duration, c.Publisher.Confirm, c.Publisher.Unconfirmed, c.Publisher.Nacks, c)
+	return c
+}
+
+func (c *Conductor) Describe(ch chan<- *prometheus.Desc) {
+	ch <- pgcrsDesc
+	ch <- fileSizeDesc
+	ch <- fileReadDesc
+	ch <- filesDesc
+	ch <- workersDesc
+}
+
+func (c *Conductor) Collect(ch chan<- prometheus.Metric) {
+	states := map[string]int{FilePending: 0, FileProducing: 0, FileDone: 0}
+	if c.Files != nil {
+		for _, f := range c.Files() {
+			states[f.State]++
+			if f.State != FileProducing {
+				continue
+			}
+			ch <- prometheus.MustNewConstMetric(fileSizeDesc, prometheus.GaugeValue, float64(f.Size), f.Path)
+			ch <- prometheus.MustNewConstMetric(fileReadDesc, prometheus.GaugeValue, float64(f.Read), f.Path)
+		}
+	}
+	if c.Records != nil {
+		for result, n := range c.Records() {
+			ch <- prometheus.MustNewConstMetric(pgcrsDesc, prometheus.CounterValue, float64(n), result)
+		}
+	}
+	for state, n := range states {
+		ch <- prometheus.MustNewConstMetric(filesDesc, prometheus.GaugeValue, float64(n), state)
+	}
+
+	if c.Workers != nil {
+		for state, n := range c.Workers() {
+			ch <- prometheus.MustNewConstMetric(workersDesc, prometheus.GaugeValue, float64(n), state)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestConductorCollectsFilesAndWorkers(t *testing.T) {
+	files := func() []File {
+		return []File{
+			{Path: "a.zst", State: FileDone, Size: 100, Read: 100, Records: map[string]int64{"read": 3, "published": 2, "filtered": 1}},
+			{Path: "b.zst", State: FileProducing, Size: 50, Read: 20},
+			{Path: "c.zst", State: FilePending, Size: 50},
+		}
+	}
+	records := func() map[string]int64 {
+		return map[string]int64{"read": 3, "published": 2, "filtered": 1}
+	}
+	workers := func() map[string]int {
+		return map[string]int{"active": 2, "stale": 1}
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	NewConductor(reg, files, records, workers)
+
+	expected := `
+# HELP protheon_conductor_files Files by state.
+# TYPE protheon_conductor_files gauge
+protheon_conductor_files{state="done"} 1
+protheon_conductor_files{state="pending"} 1
+protheon_conductor_files{state="producing"} 1
+# HELP protheon_conductor_file_read_bytes Compressed bytes of a file being produced read so far.
+# TYPE protheon_conductor_file_read_bytes gauge
+protheon_conductor_file_read_bytes{file="b.zst"} 20
+# HELP protheon_conductor_pgcrs_total Records by result.
+# TYPE protheon_conductor_pgcrs_total counter
+protheon_conductor_pgcrs_total{result="filtered"} 1
+protheon_conductor_pgcrs_total{result="published"} 2
+protheon_conductor_pgcrs_total{result="read"} 3
+# HELP protheon_conductor_workers Registered minds by state.
+# TYPE protheon_conductor_workers gauge
+protheon_conductor_workers{state="active"} 2
+protheon_conductor_workers{state="stale"} 1
+`
+	err := testutil.GatherAndCompare(reg, strings.NewReader(expected),
+		"protheon_conductor_files", "protheon_conductor_file_read_bytes", "protheon_conductor_pgcrs_total", "protheon_conductor_workers")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMindNacksByRequeue(t *testing.T) {
+	m := NewMind(prometheus.NewPedanticRegistry())
+	m.Nack(true)
+	m.Nack(true)
+	m.Nack(false)
+
+	if n := testutil.ToFloat64(m.Nacked.WithLabelValues("true")); n != 2 {
+		t.Fatalf("Expected 2 requeued nacks, got %v", n)
+	}
+	if n := testutil.ToFloat64(m.Nacked.WithLabelValues("false")); n != 1 {
+		t.Fatalf("Expected 1 dropped nack, got %v", n)
+	}
+}
@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Mind holds a mind's metrics.
+type Mind struct {
+	Consumed    prometheus.Counter
+	Redelivered prometheus.Counter
+	Acked       prometheus.Counter
+	Nacked      *prometheus.CounterVec
+
+	HandleDuration prometheus.Histogram
+
+	SinkFlushDuration *prometheus.HistogramVec
+	SinkFlushErrors   *prometheus.CounterVec
+}
+
+// NewMind creates a mind's metrics and registers them with reg.
+func NewMind(reg prometheus.Registerer) *Mind {
+	m := &Mind{
+		Consumed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "mind",
+			Name:      "messages_consumed_total",
+			Help:      "Deliveries received.",
+		}),
+		Redelivered: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "mind",
+			Name:      "messages_redelivered_total",
+			Help:      "Deliveries the broker delivered before.",
+		}),
+		Acked: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "mind",
+			Name:      "messages_acked_total",
+			Help:      "Deliveries acked.",
+		}),
+		Nacked: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "mind",
+			Name:      "messages_nacked_total",
+			Help:      "Deliveries nacked, by whether they were requeued.",
+		}, []string{"requeue"}),
+		HandleDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "mind",
+			Name:      "handle_duration_seconds",
+			Help:      "Time to decode, validate and deduplicate a PGCR.",
+			Buckets:   prometheus.ExponentialBuckets(0.00005, 4, 10),
+		}),
+		SinkFlushDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "mind",
+			Name:      "sink_flush_duration_seconds",
+			Help:      "Time to flush a sink, by sink type.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+		}, []string{"sink"}),
+		SinkFlushErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "mind",
+			Name:      "sink_flush_errors_total",
+			Help:      "Failed sink flushes, by sink type.",
+		}, []string{"sink"}),
+	}
+	reg.MustRegister(m.Consumed, m.Redelivered, m.Acked, m.Nacked, m.HandleDuration, m.SinkFlushDuration, m.SinkFlushErrors)
+	return m
+}
+
+// Nack counts a nacked delivery.
+func (m *Mind) Nack(requeue bool) {
+	if requeue {
+		m.Nacked.WithLabelValues("true").Inc()
+	} else {
+		m.Nacked.WithLabelValues("false").Inc()
+	}
+}
@@ -0,0 +1,192 @@
+package producer
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	bungie "github.com/deahtstroke/protheon/internal/bungie/types"
+)
+
+// Filter selects which PGCRs a producer publishes. Empty fields match
+// everything, and a PGCR must match every non-empty field to be published.
+//
+// A Filter is usually built from an expression of space separated terms,
+// where a term is key=value and a value can list alternatives with "|":
+//
+//	mode=4|82 isPrivate=false from=2024-06-04 to=2024-08-27
+//
+// Supported keys are mode, modes (matches if any of the PGCR's modes is
+// listed), isPrivate, membershipType, directorActivityHash, from (inclusive)
+// and to (exclusive). Dates are RFC 3339 timestamps or YYYY-MM-DD days.
+type Filter struct {
+	Modes                  []string   `json:"mode,omitempty"`
+	AnyModes               []string   `json:"modes,omitempty"`
+	IsPrivate              *bool      `json:"isPrivate,omitempty"`
+	MembershipTypes        []string   `json:"membershipType,omitempty"`
+	DirectorActivityHashes []string   `json:"directorActivityHash,omitempty"`
+	From                   *time.Time `json:"from,omitempty"`
+	To                     *time.Time `json:"to,omitempty"`
+}
+
+func ParseFilter(expr string) (*Filter, error) {
+	f := &Filter{}
+	for _, term := range strings.Fields(expr) {
+		key, value, ok := strings.Cut(term, "=")
+		if !ok || value == "" {
+			return nil, fmt.Errorf("Invalid filter term [%s], expected key=value", term)
+		}
+
+		switch key {
+		case "mode":
+			values, err := parseNumbers(key, value)
+			if err != nil {
+				return nil, err
+			}
+			f.Modes = append(f.Modes, values...)
+		case "modes":
+			values, err := parseNumbers(key, value)
+			if err != nil {
+				return nil, err
+			}
+			f.AnyModes = append(f.AnyModes, values...)
+		case "membershipType":
+			values, err := parseNumbers(key, value)
+			if err != nil {
+				return nil, err
+			}
+			f.MembershipTypes = append(f.MembershipTypes, values...)
+		case "directorActivityHash":
+			values, err := parseNumbers(key, value)
+			if err != nil {
+				return nil, err
+			}
+			f.DirectorActivityHashes = append(f.DirectorActivityHashes, values...)
+		case "isPrivate":
+			private, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid value for [%s]: %v", key, err)
+			}
+			f.IsPrivate = &private
+		case "from", "to":
+			t, err := parseTime(value)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid value for [%s]: %v", key, err)
+			}
+			if key == "from" {
+				f.From = &t
+			} else {
+				f.To = &t
+			}
+		default:
+			return nil, fmt.Errorf("Unknown filter key [%s]", key)
+		}
+	}
+
+	if f.From != nil && f.To != nil && !f.From.Before(*f.To) {
+		return nil, fmt.Errorf("Invalid filter, from [%s] must be before to [%s]", f.From, f.To)
+	}
+	return f, nil
+}
+
+func parseNumbers(key, value string) ([]string, error) {
+	values := strings.Split(value, "|")
+	for i, v := range values {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value [%s] for [%s]: expected an integer", v, key)
+		}
+		values[i] = strconv.FormatInt(n, 10)
+	}
+	return values, nil
+}
+
+func parseTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, value)
+}
+
+// Match reports whether the PGCR passes the filter. A nil filter matches
+// everything.
+func (f *Filter) Match(pgcr *bungie.PGCR) bool {
+	if f == nil {
+		return true
+	}
+
+	details := pgcr.ActivityDetails
+	if len(f.Modes) > 0 && !containsNumber(f.Modes, details.Mode) {
+		return false
+	}
+	if len(f.AnyModes) > 0 {
+		found := false
+		for _, mode := range details.Modes {
+			if containsNumber(f.AnyModes, mode) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.IsPrivate != nil && details.IsPrivate != *f.IsPrivate {
+		return false
+	}
+	if len(f.MembershipTypes) > 0 && !containsNumber(f.MembershipTypes, details.MembershipType) {
+		return false
+	}
+	if len(f.DirectorActivityHashes) > 0 && !containsNumber(f.DirectorActivityHashes, details.DirectorActivityHash) {
+		return false
+	}
+	if f.From != nil && pgcr.Period.Before(*f.From) {
+		return false
+	}
+	if f.To != nil && !pgcr.Period.Before(*f.To) {
+		return false
+	}
+	return true
+}
+
+func (f *Filter) String() string {
+	if f == nil {
+		return ""
+	}
+
+	var terms []string
+	add := func(key string, values []string) {
+		if len(values) > 0 {
+			terms = append(terms, key+"="+strings.Join(values, "|"))
+		}
+	}
+	add("mode", f.Modes)
+	add("modes", f.AnyModes)
+	if f.IsPrivate != nil {
+		terms = append(terms, "isPrivate="+strconv.FormatBool(*f.IsPrivate))
+	}
+	add("membershipType", f.MembershipTypes)
+	add("directorActivityHash", f.DirectorActivityHashes)
+	if f.From != nil {
+		terms = append(terms, "from="+f.From.Format(time.RFC3339))
+	}
+	if f.To != nil {
+		terms = append(terms, "to="+f.To.Format(time.RFC3339))
+	}
+	return strings.Join(terms, " ")
+}
+
+func containsNumber(values []string, n json.Number) bool {
+	s := n.String()
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		s = strconv.FormatInt(i, 10)
+	}
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package producer
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	bungie "github.com/deahtstroke/protheon/internal/bungie/types"
+)
+
+func raidPGCR(period time.Time, private bool) *bungie.PGCR {
+	return &bungie.PGCR{
+		Period: period,
+		ActivityDetails: bungie.ActivityDetails{
+			DirectorActivityHash: json.Number("1541433876"),
+			Mode:                 json.Number("4"),
+			Modes:                []json.Number{"7", "4"},
+			IsPrivate:            private,
+			MembershipType:       json.Number("3"),
+		},
+	}
+}
+
+func TestParseFilterMatch(t *testing.T) {
+	filter, err := ParseFilter("mode=4|82 modes=7 isPrivate=false membershipType=3 from=2024-06-04 to=2024-08-27")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	inSeason := time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		pgcr *bungie.PGCR
+		want bool
+	}{
+		{"matching raid", raidPGCR(inSeason, false), true},
+		{"private raid", raidPGCR(inSeason, true), false},
+		{"before season", raidPGCR(time.Date(2024, 6, 3, 23, 0, 0, 0, time.UTC), false), false},
+		{"on season end", raidPGCR(time.Date(2024, 8, 27, 0, 0, 0, 0, time.UTC), false), false},
+	}
+
+	for _, tt := range tests {
+		if got := filter.Match(tt.pgcr); got != tt.want {
+			t.Fatalf("%s: expected %v, got %v", tt.name, tt.want, got)
+		}
+	}
+
+	crucible := raidPGCR(inSeason, false)
+	crucible.ActivityDetails.Mode = json.Number("5")
+	crucible.ActivityDetails.Modes = []json.Number{"5"}
+	if filter.Match(crucible) {
+		t.Fatal("Expected crucible match to be filtered out")
+	}
+}
+
+func TestParseFilterEmptyMatchesEverything(t *testing.T) {
+	filter, err := ParseFilter("")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !filter.Match(raidPGCR(time.Now(), true)) {
+		t.Fatal("Expected empty filter to match")
+	}
+
+	var nilFilter *Filter
+	if !nilFilter.Match(raidPGCR(time.Now(), true)) {
+		t.Fatal("Expected nil filter to match")
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	for _, expr := range []string{
+		"mode",
+		"mode=raid",
+		"isPrivate=maybe",
+		"from=yesterday",
+		"color=blue",
+		"from=2024-08-27 to=2024-06-04",
+	} {
+		if _, err := ParseFilter(expr); err == nil {
+			t.Fatalf("Expected error for [%s], got none", expr)
+		}
+	}
+}
+
+func TestFilterStringRoundTrip(t *testing.T) {
+	filter, err := ParseFilter("mode=4|82 isPrivate=false from=2024-06-04")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	parsed, err := ParseFilter(filter.String())
+	if err != nil {
+		t.Fatalf("Expected round trip to parse, got %v", err)
+	}
+	if parsed.String() != filter.String() {
+		t.Fatalf("Expected %q, got %q", filter.String(), parsed.String())
+	}
+}
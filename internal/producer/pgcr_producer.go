@@ -2,15 +2,24 @@ package producer
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"io"
 	"os"
+	"sync/atomic"
 
 	bungie "github.com/deahtstroke/protheon/internal/bungie/types"
+	"github.com/deahtstroke/protheon/internal/dedupe"
+	"github.com/deahtstroke/protheon/internal/logging"
 	"github.com/deahtstroke/protheon/internal/rabbitmq"
+	"github.com/deahtstroke/protheon/internal/tracing"
+	"github.com/deahtstroke/protheon/internal/validate"
 	"github.com/klauspost/compress/zstd"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -21,18 +30,99 @@ type Producer interface {
 	Produce(ctx context.Context) error
 }
 
+// Stats counts what happened to the records of a source. Counters are updated
+// atomically so they can be read while the producer is running.
+type Stats struct {
+	Read        atomic.Int64
+	Published   atomic.Int64
+	Filtered    atomic.Int64
+	Duplicates  atomic.Int64
+	Quarantined atomic.Int64
+	Failed      atomic.Int64
+
+	// BytesRead is how much of the compressed source was read, for progress.
+	BytesRead atomic.Int64
+}
+
 type PgcrProducer struct {
-	Source    string
-	Publisher rabbitmq.Publisher
+	Source      string
+	Publisher   rabbitmq.Publisher
+	Filter      *Filter
+	Seen        *dedupe.Store
+	Force       bool
+	Quarantine  *Quarantine
+	ErrorBudget int64
+	Validator   *validate.Validator
+	MaxLineSize int
+	Stats       Stats
+
+	// malformed counts the lines against the error budget.
+	malformed int64
+}
+
+type Option func(*PgcrProducer)
+
+// WithFilter makes the producer skip PGCRs that don't match the filter.
+// Skipped records are counted in Stats.Filtered.
+func WithFilter(filter *Filter) Option {
+	return func(pp *PgcrProducer) {
+		pp.Filter = filter
+	}
+}
+
+// WithDedupe makes the producer skip PGCRs whose instance ID is already in the
+// seen store, and record the ID of every PGCR it publishes. With force set,
+// seen PGCRs are published again. Skipped records are counted in
+// Stats.Duplicates.
+func WithDedupe(seen *dedupe.Store, force bool) Option {
+	return func(pp *PgcrProducer) {
+		pp.Seen = seen
+		pp.Force = force
+	}
+}
+
+// WithQuarantine makes the producer write the lines it skips to the
+// quarantine, so they can be looked at later.
+func WithQuarantine(quarantine *Quarantine) Option {
+	return func(pp *PgcrProducer) {
+		pp.Quarantine = quarantine
+	}
+}
+
+// WithErrorBudget makes the producer give up on a file with
+// ErrBudgetExceeded once more than budget of its lines were malformed. A
+// budget of zero never gives up. Malformed lines within the budget are
+// skipped and counted in Stats.Failed, whether or not there is a quarantine.
+func WithErrorBudget(budget int64) Option {
+	return func(pp *PgcrProducer) {
+		pp.ErrorBudget = budget
+	}
+}
+
+// WithValidator makes the producer run every PGCR through the validator and
+// skip the ones with error level violations. Invalid PGCRs are counted in
+// Stats.Failed and quarantined like malformed lines, but never use up the
+// error budget, so a few of them don't abandon an otherwise good file.
+func WithValidator(validator *validate.Validator) Option {
+	return func(pp *PgcrProducer) {
+		pp.Validator = validator
+	}
 }
 
-func NewPgcrProducer(source string, publisher rabbitmq.Publisher) Producer {
-	return &PgcrProducer{
-		Source:    source,
-		Publisher: publisher,
+func NewPgcrProducer(source string, publisher rabbitmq.Publisher, opts ...Option) *PgcrProducer {
+	pp := &PgcrProducer{
+		Source:      source,
+		Publisher:   publisher,
+		MaxLineSize: MAX_CAPACITY,
+	}
+	for _, opt := range opts {
+		opt(pp)
 	}
+	return pp
 }
 
+// Produce publishes the PGCRs of the source until its end. Once ctx is done
+// it stops, and returns the cause of ctx, as the file wasn't produced whole.
 func (pp *PgcrProducer) Produce(ctx context.Context) error {
 	file, err := os.Open(pp.Source)
 	if err != nil {
@@ -41,35 +131,195 @@ func (pp *PgcrProducer) Produce(ctx context.Context) error {
 
 	defer file.Close()
 
-	bufReader := bufio.NewReader(file)
+	bufReader := bufio.NewReader(&countingReader{r: file, n: &pp.Stats.BytesRead})
 	decoder, err := zstd.NewReader(bufReader)
 	if err != nil {
 		return fmt.Errorf("Error creating ZSTD reader for source [%s]: %v", pp.Source, err)
 	}
+	defer decoder.Close()
 
-	buf := make([]byte, MAX_CAPACITY)
-	scanner := bufio.NewScanner(decoder)
-	scanner.Buffer(buf, MAX_CAPACITY)
+	if pp.Quarantine != nil {
+		defer func() {
+			if pp.Stats.Quarantined.Load() == 0 {
+				return
+			}
+			if err := pp.Quarantine.Flush(); err != nil {
+				logging.Component("producer").Error("Error flushing quarantine", "quarantine", pp.Quarantine.Path(), logging.KeyFile, pp.Source, "error", err)
+			}
+		}()
+	}
+
+	reader := bufio.NewReaderSize(decoder, 1024*1024)
+	buf := make([]byte, 0, 1024*1024)
+	var lineNumber int64
 
-	for scanner.Scan() {
+	for {
 		select {
 		case <-ctx.Done():
-			log.Printf("[Producer] Context cancelled. Finishing producing PGCRs...")
-			return nil
+			logging.Component("producer").Info("Context cancelled, stopped producing PGCRs", logging.KeyFile, pp.Source, logging.KeyLine, lineNumber)
+			return context.Cause(ctx)
 		default:
-			var pgcr bungie.PGCR
-			err = json.Unmarshal(scanner.Bytes(), &pgcr)
-			if err != nil {
+		}
+
+		var tooLong bool
+		buf, tooLong, err = readLine(reader, buf[:0], pp.MaxLineSize)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Error reading source [%s] at line %d: %v", pp.Source, lineNumber+1, err)
+		}
+		lineNumber++
+		if len(buf) == 0 && !tooLong {
+			continue
+		}
+		pp.Stats.Read.Add(1)
+
+		if tooLong {
+			err = fmt.Errorf("Line longer than %d bytes", pp.MaxLineSize)
+			if err := pp.reject(lineNumber, buf, err, true); err != nil {
 				return err
 			}
+			continue
+		}
 
-			err = pp.Publisher.Publish(ctx, scanner.Bytes())
-			if err != nil {
-				log.Printf("Error publishing pgcr [%s]: %v", pgcr.ActivityDetails.InstanceID, err)
+		var pgcr bungie.PGCR
+		err = json.Unmarshal(buf, &pgcr)
+		if err != nil {
+			if err := pp.reject(lineNumber, buf, err, true); err != nil {
 				return err
 			}
+			continue
+		}
+
+		if !pp.Filter.Match(&pgcr) {
+			pp.Stats.Filtered.Add(1)
+			continue
+		}
+
+		if pp.Validator != nil {
+			if err := validate.Err(pp.Validator.Validate(&pgcr), validate.Error); err != nil {
+				if err := pp.reject(lineNumber, buf, err, false); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		var instanceID uint64
+		if pp.Seen != nil {
+			instanceID, err = dedupe.ParseInstanceID(pgcr.ActivityDetails.InstanceID.String())
+			if err != nil {
+				if err := pp.reject(lineNumber, buf, err, true); err != nil {
+					return err
+				}
+				continue
+			}
+			if !pp.Force && pp.Seen.Contains(instanceID) {
+				pp.Stats.Duplicates.Add(1)
+				continue
+			}
+		}
+
+		spanCtx, span := tracing.Tracer().Start(ctx, "produce pgcr", trace.WithAttributes(
+			attribute.String("pgcr.instance_id", pgcr.ActivityDetails.InstanceID.String()),
+			attribute.String("pgcr.source", pp.Source),
+			attribute.Int64("pgcr.line", lineNumber),
+		))
+		err = pp.Publisher.Publish(spanCtx, buf)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			span.End()
+			pp.Stats.Failed.Add(1)
+			logging.Component("producer").ErrorContext(spanCtx, "Error publishing PGCR", logging.KeyFile, pp.Source, logging.KeyLine, lineNumber,
+				logging.KeyInstanceID, pgcr.ActivityDetails.InstanceID.String(), "error", err)
+			return err
+		}
+		span.End()
+		pp.Stats.Published.Add(1)
+
+		if pp.Seen != nil {
+			pp.Seen.Add(instanceID)
 		}
 	}
+}
 
+// reject counts a line that can't be published, and sends it to the
+// quarantine if there is one. Malformed lines use up the error budget, and
+// reject returns an error once the file ran out of it and should be
+// abandoned.
+func (pp *PgcrProducer) reject(lineNumber int64, line []byte, cause error, malformed bool) error {
+	pp.Stats.Failed.Add(1)
+	if pp.Quarantine != nil {
+		err := pp.Quarantine.Write(QuarantineRecord{
+			Source: pp.Source,
+			Line:   lineNumber,
+			Error:  cause.Error(),
+			Data:   string(line),
+		})
+		if err != nil {
+			return err
+		}
+		pp.Stats.Quarantined.Add(1)
+	} else {
+		logging.Component("producer").Debug("Skipped line", logging.KeyFile, pp.Source, logging.KeyLine, lineNumber, "error", cause)
+	}
+	if !malformed {
+		return nil
+	}
+
+	pp.malformed++
+	if pp.ErrorBudget > 0 && pp.malformed > pp.ErrorBudget {
+		return fmt.Errorf("%w for source [%s]: %d malformed lines, the last at line %d: %v", ErrBudgetExceeded, pp.Source, pp.malformed, lineNumber, cause)
+	}
 	return nil
 }
+
+// readLine appends the next line of r, without its line ending, to buf. Lines
+// longer than max are consumed but only their first max bytes are returned,
+// with tooLong set, so a single overlong record doesn't stop the file.
+func readLine(r *bufio.Reader, buf []byte, max int) (line []byte, tooLong bool, err error) {
+	read := false
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(chunk) > 0 {
+			read = true
+		}
+		if !tooLong {
+			if len(buf)+len(chunk) > max {
+				buf = append(buf, chunk[:max-len(buf)]...)
+				tooLong = true
+			} else {
+				buf = append(buf, chunk...)
+			}
+		}
+
+		switch {
+		case err == bufio.ErrBufferFull:
+			continue
+		case err == io.EOF && read:
+			return trimLineEnding(buf), tooLong, nil
+		case err != nil:
+			return buf, tooLong, err
+		default:
+			return trimLineEnding(buf), tooLong, nil
+		}
+	}
+}
+
+func trimLineEnding(line []byte) []byte {
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	return bytes.TrimSuffix(line, []byte("\r"))
+}
+
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
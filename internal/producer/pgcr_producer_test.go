@@ -0,0 +1,244 @@
+package producer
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/deahtstroke/protheon/internal/dedupe"
+	"github.com/deahtstroke/protheon/internal/validate"
+	"github.com/klauspost/compress/zstd"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+type fakePublisher struct {
+	published []string
+}
+
+func (p *fakePublisher) Publish(ctx context.Context, body []byte) error {
+	p.published = append(p.published, string(body))
+	return nil
+}
+
+func writeDump(t *testing.T, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "dump.zst")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Error creating dump: %v", err)
+	}
+	defer file.Close()
+
+	encoder, err := zstd.NewWriter(file)
+	if err != nil {
+		t.Fatalf("Error creating ZSTD writer: %v", err)
+	}
+	for _, line := range lines {
+		encoder.Write([]byte(line + "\n"))
+	}
+	if err := encoder.Close(); err != nil {
+		t.Fatalf("Error closing ZSTD writer: %v", err)
+	}
+	return path
+}
+
+func pgcrLine(instanceID string, mode string) string {
+	return `{"activityDetails":{"instanceId":"` + instanceID + `","mode":` + mode + `}}`
+}
+
+func readQuarantine(t *testing.T, path string) []QuarantineRecord {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Error opening quarantine: %v", err)
+	}
+	defer file.Close()
+
+	decoder, err := zstd.NewReader(file)
+	if err != nil {
+		t.Fatalf("Error creating ZSTD reader: %v", err)
+	}
+	defer decoder.Close()
+
+	var records []QuarantineRecord
+	scanner := bufio.NewScanner(decoder)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+	for scanner.Scan() {
+		var record QuarantineRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("Bad quarantine record: %v", err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestProduceFiltersAndDedupes(t *testing.T) {
+	source := writeDump(t,
+		pgcrLine("1", "4"),
+		pgcrLine("2", "5"),
+		pgcrLine("1", "4"),
+		pgcrLine("3", "4"),
+	)
+
+	filter, err := ParseFilter("mode=4")
+	if err != nil {
+		t.Fatalf("Error parsing filter: %v", err)
+	}
+	seen, _ := dedupe.Open("")
+	publisher := &fakePublisher{}
+
+	pp := NewPgcrProducer(source, publisher, WithFilter(filter), WithDedupe(seen, false))
+	if err := pp.Produce(context.Background()); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if len(publisher.published) != 2 {
+		t.Fatalf("Expected 2 published PGCRs, got %d", len(publisher.published))
+	}
+	if pp.Stats.Read.Load() != 4 || pp.Stats.Filtered.Load() != 1 || pp.Stats.Duplicates.Load() != 1 {
+		t.Fatalf("Unexpected stats: read=%d filtered=%d duplicates=%d",
+			pp.Stats.Read.Load(), pp.Stats.Filtered.Load(), pp.Stats.Duplicates.Load())
+	}
+
+	forced := NewPgcrProducer(source, publisher, WithFilter(filter), WithDedupe(seen, true))
+	if err := forced.Produce(context.Background()); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if forced.Stats.Published.Load() != 3 {
+		t.Fatalf("Expected force to republish 3 PGCRs, got %d", forced.Stats.Published.Load())
+	}
+}
+
+func TestProduceQuarantinesMalformedLines(t *testing.T) {
+	source := writeDump(t,
+		pgcrLine("1", "4"),
+		`{"activityDetails":`,
+		pgcrLine("2", "4"),
+		`{"blob":"`+strings.Repeat("x", 2*1024*1024)+`"}`,
+		pgcrLine("3", "4"),
+	)
+	quarantinePath := filepath.Join(t.TempDir(), "quarantine.jsonl.zst")
+	quarantine, err := OpenQuarantine(quarantinePath)
+	if err != nil {
+		t.Fatalf("Error opening quarantine: %v", err)
+	}
+	publisher := &fakePublisher{}
+
+	pp := NewPgcrProducer(source, publisher, WithQuarantine(quarantine))
+	pp.MaxLineSize = 1024 * 1024
+	if err := pp.Produce(context.Background()); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := quarantine.Close(); err != nil {
+		t.Fatalf("Error closing quarantine: %v", err)
+	}
+
+	if len(publisher.published) != 3 {
+		t.Fatalf("Expected 3 published PGCRs, got %d", len(publisher.published))
+	}
+
+	records := readQuarantine(t, quarantinePath)
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 quarantined lines, got %d", len(records))
+	}
+	if records[0].Line != 2 || records[0].Source != source || records[0].Error == "" {
+		t.Fatalf("Unexpected quarantine record: %+v", records[0])
+	}
+	if records[1].Line != 4 || !records[1].Truncated {
+		t.Fatalf("Expected overlong line 4 to be truncated, got line %d truncated=%v", records[1].Line, records[1].Truncated)
+	}
+}
+
+func TestProduceErrorBudget(t *testing.T) {
+	source := writeDump(t, "bad", "bad", "bad", pgcrLine("1", "4"))
+	quarantine, err := OpenQuarantine(filepath.Join(t.TempDir(), "quarantine.jsonl.zst"))
+	if err != nil {
+		t.Fatalf("Error opening quarantine: %v", err)
+	}
+	defer quarantine.Close()
+	publisher := &fakePublisher{}
+
+	pp := NewPgcrProducer(source, publisher, WithQuarantine(quarantine), WithErrorBudget(2))
+	err = pp.Produce(context.Background())
+	if !errors.Is(err, ErrBudgetExceeded) {
+		t.Fatalf("Expected budget exceeded, got %v", err)
+	}
+	if len(publisher.published) != 0 {
+		t.Fatalf("Expected nothing published, got %d", len(publisher.published))
+	}
+}
+
+func TestProduceWithoutQuarantineSkipsBadLines(t *testing.T) {
+	source := writeDump(t, pgcrLine("1", "4"), "bad", pgcrLine("2", "4"), "bad", "bad")
+	publisher := &fakePublisher{}
+
+	pp := NewPgcrProducer(source, publisher, WithErrorBudget(2))
+	if err := pp.Produce(context.Background()); !errors.Is(err, ErrBudgetExceeded) {
+		t.Fatalf("Expected budget exceeded, got %v", err)
+	}
+	if len(publisher.published) != 2 || pp.Stats.Failed.Load() != 3 {
+		t.Fatalf("Expected 2 published PGCRs and 3 skipped lines, got published=%d failed=%d", len(publisher.published), pp.Stats.Failed.Load())
+	}
+}
+
+func TestProduceSkipsInvalidPGCRs(t *testing.T) {
+	// PGCRs without a period or entries are invalid.
+	source := writeDump(t, pgcrLine("1", "4"), pgcrLine("2", "4"), pgcrLine("3", "4"))
+	publisher := &fakePublisher{}
+
+	pp := NewPgcrProducer(source, publisher, WithValidator(validate.NewValidator(validate.DefaultRules())))
+	if err := pp.Produce(context.Background()); err != nil {
+		t.Fatalf("Expected invalid PGCRs to be skipped, got %v", err)
+	}
+	if len(publisher.published) != 0 || pp.Stats.Failed.Load() != 3 {
+		t.Fatalf("Expected 3 skipped PGCRs, got published=%d failed=%d", len(publisher.published), pp.Stats.Failed.Load())
+	}
+}
+
+func TestProduceStartsASpanPerPublishedRecord(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(previous)
+
+	path := writeDump(t, pgcrLine("1", "4"), pgcrLine("2", "5"), pgcrLine("3", "4"))
+	filter, err := ParseFilter("mode=4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pp := NewPgcrProducer(path, &fakePublisher{}, WithFilter(filter))
+	if err := pp.Produce(context.Background()); err != nil {
+		t.Fatalf("Error producing: %v", err)
+	}
+
+	var ids []string
+	for _, span := range recorder.Ended() {
+		for _, attr := range span.Attributes() {
+			if attr.Key == "pgcr.instance_id" {
+				ids = append(ids, attr.Value.AsString())
+			}
+		}
+	}
+	if strings.Join(ids, ",") != "1,3" {
+		t.Fatalf("Expected spans for the published PGCRs 1 and 3, got %v", ids)
+	}
+}
+
+func TestProduceReportsCancellation(t *testing.T) {
+	source := writeDump(t, pgcrLine("1", "4"))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	pp := NewPgcrProducer(source, &fakePublisher{})
+	if err := pp.Produce(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected a cancelled produce to report it, got %v", err)
+	}
+}
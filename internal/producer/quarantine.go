@@ -0,0 +1,118 @@
+package producer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// MAX_QUARANTINED_LINE caps how much of an overlong line is kept in the
+	// quarantine, the rest is dropped and the record marked as truncated.
+	MAX_QUARANTINED_LINE = 64 * 1024
+)
+
+var ErrBudgetExceeded = errors.New("Error budget exceeded")
+
+// QuarantineRecord is one malformed line, written as a line of JSON.
+type QuarantineRecord struct {
+	Source    string    `json:"source"`
+	Line      int64     `json:"line"`
+	Error     string    `json:"error"`
+	Data      string    `json:"data"`
+	Truncated bool      `json:"truncated,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// Quarantine is a zstd compressed JSONL side file collecting the lines
+// producers could not publish, so they can be reviewed after an ingest.
+// It is safe to share between producers.
+type Quarantine struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	encoder *zstd.Encoder
+	count   int64
+}
+
+// OpenQuarantine opens the quarantine at path for appending. Each open
+// starts a new zstd frame, and concatenated frames decode as one stream.
+func OpenQuarantine(path string) (*Quarantine, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening quarantine [%s]: %v", path, err)
+	}
+
+	encoder, err := zstd.NewWriter(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Error creating ZSTD writer for quarantine [%s]: %v", path, err)
+	}
+
+	return &Quarantine{
+		path:    path,
+		file:    file,
+		encoder: encoder,
+	}, nil
+}
+
+func (q *Quarantine) Path() string {
+	return q.path
+}
+
+func (q *Quarantine) Write(record QuarantineRecord) error {
+	if len(record.Data) > MAX_QUARANTINED_LINE {
+		record.Data = record.Data[:MAX_QUARANTINED_LINE]
+		record.Truncated = true
+	}
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, err := q.encoder.Write(data); err != nil {
+		return fmt.Errorf("Error writing quarantine [%s]: %v", q.path, err)
+	}
+	q.count++
+	return nil
+}
+
+// Count returns the number of records written since the quarantine was opened.
+func (q *Quarantine) Count() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.count
+}
+
+// Flush makes the records written so far readable from the file.
+func (q *Quarantine) Flush() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.encoder.Flush()
+}
+
+func (q *Quarantine) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := q.encoder.Close(); err != nil {
+		q.file.Close()
+		return err
+	}
+	return q.file.Close()
+}
@@ -3,9 +3,9 @@ package rabbitmq
 import (
 	"context"
 	"errors"
-	"log"
 	"time"
 
+	"github.com/deahtstroke/protheon/internal/logging"
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
@@ -17,14 +17,14 @@ func dialWithRetry(ctx context.Context, dial DialFunc, url string, attempts int,
 	for i := range attempts {
 		select {
 		case <-ctx.Done():
-			log.Printf("Context cancelled, dialing cancelled...")
+			logging.Component("rabbitmq").Info("Context cancelled, dialing cancelled")
 			return nil, errors.New("Dialing cancelled")
 		default:
 			conn, err = dial(url)
 			if err == nil {
 				return conn, nil
 			}
-			log.Printf("amqp dial failed (attempt %d/%d): %v", i+1, attempts, err)
+			logging.Component("rabbitmq").Warn("AMQP dial failed", "attempt", i+1, "attempts", attempts, "error", err)
 			time.Sleep(backoff)
 			backoff *= 2
 		}
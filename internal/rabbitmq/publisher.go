@@ -3,10 +3,22 @@ package rabbitmq
 import (
 	"context"
 	"errors"
-	amqp "github.com/rabbitmq/amqp091-go"
+	"fmt"
+	"sync"
 	"time"
+
+	"github.com/deahtstroke/protheon/internal/metrics"
+	"github.com/deahtstroke/protheon/internal/tracing"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
+const PGCR_QUEUE = "pgcr_jobs"
+
 type Publisher interface {
 	Publish(ctx context.Context, body []byte) error
 }
@@ -16,6 +28,15 @@ type RabbitPublisher struct {
 	Queue   *amqp.Queue
 	Conn    *amqp.Connection
 	Channel *amqp.Channel
+
+	// metrics, unconfirmed and early, keyed by delivery tag, are set once
+	// the publisher is instrumented. A confirm can arrive before its
+	// publish is recorded, early keeps when it did until then. mu only
+	// guards them, publishes don't wait on each other.
+	mu          sync.Mutex
+	metrics     *metrics.Publisher
+	unconfirmed map[uint64]time.Time
+	early       map[uint64]time.Time
 }
 
 func NewPublisherCtx(ctx context.Context, url, queueName string) (*RabbitPublisher, error) {
@@ -45,15 +66,183 @@ func NewPublisherCtx(ctx context.Context, url, queueName string) (*RabbitPublish
 	}, nil
 }
 
+// Check reports whether the publisher's connection and channel are open, for
+// readiness probes.
+func (p *RabbitPublisher) Check(ctx context.Context) error {
+	if p.Conn == nil || p.Channel == nil {
+		return errors.New("Publisher not initialized")
+	}
+	if p.Conn.IsClosed() {
+		return errors.New("Broker connection is closed")
+	}
+	if p.Channel.IsClosed() {
+		return errors.New("Broker channel is closed")
+	}
+	return nil
+}
+
+// QueueStats is the broker's count of a queue's ready messages and
+// consumers.
+type QueueStats struct {
+	Name      string `json:"name"`
+	Messages  int    `json:"messages"`
+	Consumers int    `json:"consumers"`
+}
+
+// Stats asks the broker about the publisher's queue. It uses a channel of its
+// own, as a failed inspection closes the channel it ran on.
+func (p *RabbitPublisher) Stats(ctx context.Context) (QueueStats, error) {
+	if err := p.Check(ctx); err != nil {
+		return QueueStats{}, err
+	}
+	ch, err := p.Conn.Channel()
+	if err != nil {
+		return QueueStats{}, err
+	}
+	defer ch.Close()
+
+	q, err := ch.QueueDeclarePassive(p.Queue.Name, true, false, false, false, nil)
+	if err != nil {
+		return QueueStats{}, err
+	}
+	return QueueStats{Name: q.Name, Messages: q.Messages, Consumers: q.Consumers}, nil
+}
+
+// Instrument records publish latency in m, and puts the channel in confirm
+// mode to also record how long the broker takes to confirm each message.
+func (p *RabbitPublisher) Instrument(m *metrics.Publisher) error {
+	if p.Channel == nil {
+		return errors.New("Publisher not initialized")
+	}
+	if err := p.Channel.Confirm(false); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.metrics = m
+	p.unconfirmed = make(map[uint64]time.Time)
+	p.early = make(map[uint64]time.Time)
+	p.mu.Unlock()
+
+	confirms := p.Channel.NotifyPublish(make(chan amqp.Confirmation, 1024))
+	go func() {
+		for confirm := range confirms {
+			p.mu.Lock()
+			published, ok := p.unconfirmed[confirm.DeliveryTag]
+			if ok {
+				delete(p.unconfirmed, confirm.DeliveryTag)
+			} else {
+				p.early[confirm.DeliveryTag] = time.Now()
+			}
+			m.Unconfirmed.Set(float64(len(p.unconfirmed)))
+			p.mu.Unlock()
+
+			if ok {
+				m.Confirm.Observe(time.Since(published).Seconds())
+			}
+			if !confirm.Ack {
+				m.Nacks.Inc()
+			}
+		}
+	}()
+	return nil
+}
+
+// Publish sends body to the queue within a producer span, whose trace
+// context is injected into the message headers.
 func (p *RabbitPublisher) Publish(ctx context.Context, body []byte) error {
 	if p.Channel == nil || p.Queue == nil {
 		return errors.New("Publisher not initialized")
 	}
+	return p.publishTo(ctx, p.Queue.Name, body)
+}
+
+// ForQueue returns a publisher sending to another queue, which it declares,
+// over the publisher's channel.
+func (p *RabbitPublisher) ForQueue(name string) (Publisher, error) {
+	if p.Channel == nil || p.Queue == nil {
+		return nil, errors.New("Publisher not initialized")
+	}
+	if name == "" || name == p.Queue.Name {
+		return p, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err := p.Channel.QueueDeclare(name, true, false, false, false, nil); err != nil {
+		return nil, fmt.Errorf("Error declaring queue [%s]: %v", name, err)
+	}
+	return &queuePublisher{publisher: p, queue: name}, nil
+}
+
+type queuePublisher struct {
+	publisher *RabbitPublisher
+	queue     string
+}
+
+func (q *queuePublisher) Publish(ctx context.Context, body []byte) error {
+	return q.publisher.publishTo(ctx, q.queue, body)
+}
+
+func (p *RabbitPublisher) publishTo(ctx context.Context, queue string, body []byte) error {
+	ctx, span := tracing.Tracer().Start(ctx, queue+" publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			semconv.MessagingSystemRabbitMQ,
+			semconv.MessagingDestinationName(queue),
+			semconv.MessagingOperationTypePublish,
+			attribute.Int("messaging.message.body.size", len(body)),
+		))
+	defer span.End()
+
+	headers := amqp.Table{}
+	otel.GetTextMapPropagator().Inject(ctx, HeaderCarrier(headers))
 
-	return p.Channel.PublishWithContext(ctx, "", p.Queue.Name, false, false,
-		amqp.Publishing{
-			ContentType:  "application/json",
-			DeliveryMode: amqp.Persistent,
-			Body:         body,
-		})
+	msg := amqp.Publishing{
+		Headers:      headers,
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		Body:         body,
+	}
+
+	err := p.publish(ctx, queue, msg)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+// publish sends msg. Instrumented, it takes the delivery tag from the
+// channel, which assigns it as it sends, so concurrent publishes only
+// serialize on the channel itself.
+func (p *RabbitPublisher) publish(ctx context.Context, queue string, msg amqp.Publishing) error {
+	p.mu.Lock()
+	m := p.metrics
+	p.mu.Unlock()
+
+	if m == nil {
+		return p.Channel.PublishWithContext(ctx, "", queue, false, false, msg)
+	}
+
+	start := time.Now()
+	confirmation, err := p.Channel.PublishWithDeferredConfirmWithContext(ctx, "", queue, false, false, msg)
+	if err != nil {
+		return err
+	}
+	m.Duration.Observe(time.Since(start).Seconds())
+	if confirmation == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if confirmed, ok := p.early[confirmation.DeliveryTag]; ok {
+		delete(p.early, confirmation.DeliveryTag)
+		m.Confirm.Observe(confirmed.Sub(start).Seconds())
+		return nil
+	}
+	p.unconfirmed[confirmation.DeliveryTag] = start
+	m.Unconfirmed.Set(float64(len(p.unconfirmed)))
+	return nil
 }
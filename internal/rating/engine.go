@@ -0,0 +1,460 @@
+package rating
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/deahtstroke/protheon/internal/atomicfile"
+)
+
+const (
+	// DEFAULT_PERFORMANCE_WEIGHT is how much of a game's score comes from
+	// the player's score rank among their teammates rather than the result.
+	DEFAULT_PERFORMANCE_WEIGHT = 0.1
+
+	// DEFAULT_WINDOW is how long matches are held back for matches logged
+	// late, by default.
+	DEFAULT_WINDOW = 24 * time.Hour
+
+	SNAPSHOT_VERSION = 2
+)
+
+var (
+	ErrOutOfOrder = errors.New("Match is not newer than the last rated match of its mode")
+	ErrDuplicate  = errors.New("Match is already waiting to be rated")
+)
+
+// PlayerRating is a player's rating on one track.
+type PlayerRating struct {
+	Rating
+	Matches    int64     `json:"matches"`
+	LastPlayed time.Time `json:"lastPlayed"`
+}
+
+// Change is one rating update, the rating history is a list of them.
+type Change struct {
+	InstanceID   string    `json:"instanceId"`
+	Period       time.Time `json:"period"`
+	Mode         int32     `json:"mode"`
+	MembershipID string    `json:"membershipId"`
+	Score        float64   `json:"score"`
+	Before       Rating    `json:"before"`
+	After        Rating    `json:"after"`
+}
+
+// Engine rates players with Glicko-2, one rating track per playlist mode.
+// Every match is its own rating period. Each track rates its matches in time
+// order, so replaying the same matches always gives the same ratings.
+//
+// Minds log matches in the order they consume them rather than the order
+// they were played in. With a Window, matches are held back until a match
+// Window newer was processed, so that matches logged late within the window
+// are still rated in order.
+type Engine struct {
+	Tau               float64
+	PerformanceWeight float64
+	Window            time.Duration
+
+	// RecordHistory keeps every rating change, for History.
+	RecordHistory bool
+
+	tracks  map[int32]map[string]*PlayerRating
+	last    map[int32]Match
+	rated   int64
+	history []Change
+
+	// pending are the matches held back, in time order, and newest the
+	// period of the newest match processed.
+	pending []Match
+	newest  time.Time
+
+	// logs are the match logs already processed.
+	logs map[string]bool
+}
+
+func NewEngine() *Engine {
+	return &Engine{
+		Tau:               DEFAULT_TAU,
+		PerformanceWeight: DEFAULT_PERFORMANCE_WEIGHT,
+		tracks:            make(map[int32]map[string]*PlayerRating),
+		last:              make(map[int32]Match),
+		logs:              make(map[string]bool),
+	}
+}
+
+// Process rates a match, or holds it back until the window passed it. It
+// returns ErrOutOfOrder for matches that are not newer than the last one
+// rated in their mode, those need a replay from scratch, and ErrDuplicate for
+// matches already held back.
+func (e *Engine) Process(m Match) error {
+	if last, ok := e.last[m.Mode]; ok && !last.before(m) {
+		return ErrOutOfOrder
+	}
+	if e.Window <= 0 {
+		e.rate(m)
+		return nil
+	}
+
+	i := sort.Search(len(e.pending), func(i int) bool { return !e.pending[i].before(m) })
+	if i < len(e.pending) && e.pending[i].InstanceID == m.InstanceID {
+		return ErrDuplicate
+	}
+	e.pending = slices.Insert(e.pending, i, m)
+	if m.Period.After(e.newest) {
+		e.newest = m.Period
+	}
+	e.release(e.newest.Add(-e.Window))
+	return nil
+}
+
+// Flush rates every match held back, such as once no more matches are
+// expected.
+func (e *Engine) Flush() {
+	for _, m := range e.pending {
+		e.rate(m)
+	}
+	e.pending = nil
+}
+
+// Pending returns how many matches are held back.
+func (e *Engine) Pending() int {
+	return len(e.pending)
+}
+
+// release rates the matches held back that were played until then.
+func (e *Engine) release(until time.Time) {
+	n := 0
+	for n < len(e.pending) && !e.pending[n].Period.After(until) {
+		e.rate(e.pending[n])
+		n++
+	}
+	e.pending = slices.Delete(e.pending, 0, n)
+}
+
+func (e *Engine) rate(m Match) {
+
+	track, ok := e.tracks[m.Mode]
+	if !ok {
+		track = make(map[string]*PlayerRating)
+		e.tracks[m.Mode] = track
+	}
+
+	before := make([]Rating, len(m.Players))
+	for i, p := range m.Players {
+		before[i] = NewRating()
+		if current, ok := track[p.MembershipID]; ok {
+			before[i] = current.Rating
+		}
+	}
+
+	// Everyone is rated against the ratings from before the match.
+	after := make([]Rating, len(m.Players))
+	scores := make([]float64, len(m.Players))
+	for i := range m.Players {
+		outcomes := e.outcomes(m, before, i)
+		after[i] = update(before[i], outcomes, e.Tau)
+		for _, o := range outcomes {
+			scores[i] += o.score
+		}
+		if len(outcomes) > 0 {
+			scores[i] /= float64(len(outcomes))
+		}
+	}
+
+	for i, p := range m.Players {
+		current, ok := track[p.MembershipID]
+		if !ok {
+			current = &PlayerRating{}
+			track[p.MembershipID] = current
+		}
+		current.Rating = after[i]
+		current.Matches++
+		current.LastPlayed = m.Period
+
+		if e.RecordHistory {
+			e.history = append(e.history, Change{
+				InstanceID:   m.InstanceID,
+				Period:       m.Period,
+				Mode:         m.Mode,
+				MembershipID: p.MembershipID,
+				Score:        scores[i],
+				Before:       before[i],
+				After:        after[i],
+			})
+		}
+	}
+
+	e.last[m.Mode] = Match{InstanceID: m.InstanceID, Period: m.Period}
+	e.rated++
+}
+
+// outcomes lists player i's games in a match. In team modes each opposing
+// team is one opponent, rated as its average player. In free for all modes
+// every other player is an opponent. Results come from standings, with equal
+// team scores counting as draws, and are blended with the player's score
+// rank among their teammates.
+func (e *Engine) outcomes(m Match, ratings []Rating, i int) []outcome {
+	me := m.Players[i]
+	performance := e.performance(m, i)
+
+	teams := make(map[int][]int)
+	var order []int
+	for j, p := range m.Players {
+		if _, ok := teams[p.Team]; !ok {
+			order = append(order, p.Team)
+		}
+		teams[p.Team] = append(teams[p.Team], j)
+	}
+	sort.Ints(order)
+
+	var outcomes []outcome
+	if len(teams) < 2 {
+		for j, p := range m.Players {
+			if j == i {
+				continue
+			}
+			outcomes = append(outcomes, outcome{
+				opponent: ratings[j],
+				score:    e.blend(result(me.Standing, p.Standing), performance),
+			})
+		}
+		return outcomes
+	}
+
+	for _, team := range order {
+		if team == me.Team {
+			continue
+		}
+		members := teams[team]
+		var rating, variance float64
+		for _, j := range members {
+			rating += ratings[j].Rating
+			variance += ratings[j].Deviation * ratings[j].Deviation
+		}
+		opponent := Rating{
+			Rating:    rating / float64(len(members)),
+			Deviation: math.Sqrt(variance / float64(len(members))),
+		}
+
+		them := m.Players[members[0]]
+		score := result(me.Standing, them.Standing)
+		if me.TeamScore == them.TeamScore {
+			score = 0.5
+		}
+		outcomes = append(outcomes, outcome{opponent: opponent, score: e.blend(score, performance)})
+	}
+	return outcomes
+}
+
+// result scores two standings, where the lower standing placed better.
+func result(mine, theirs int) float64 {
+	switch {
+	case mine < theirs:
+		return 1
+	case mine > theirs:
+		return 0
+	default:
+		return 0.5
+	}
+}
+
+// performance ranks player i's score among their teammates, from 0 for the
+// lowest to 1 for the highest.
+func (e *Engine) performance(m Match, i int) float64 {
+	me := m.Players[i]
+	var others, rank float64
+	for j, p := range m.Players {
+		if j == i || p.Team != me.Team {
+			continue
+		}
+		others++
+		switch {
+		case me.Score > p.Score:
+			rank++
+		case me.Score == p.Score:
+			rank += 0.5
+		}
+	}
+	if others == 0 {
+		return 0.5
+	}
+	return rank / others
+}
+
+func (e *Engine) blend(score, performance float64) float64 {
+	return (1-e.PerformanceWeight)*score + e.PerformanceWeight*performance
+}
+
+// Replay sorts matches by time and processes every match newer than the last
+// one rated in its mode. It returns how many matches were too late or
+// duplicates, for an engine created from scratch that is none.
+func (e *Engine) Replay(matches []Match) int {
+	late := 0
+	for _, m := range Sort(matches) {
+		if err := e.Process(m); err != nil {
+			late++
+		}
+	}
+	return late
+}
+
+// Rated returns how many matches were processed.
+func (e *Engine) Rated() int64 {
+	return e.rated
+}
+
+// Last returns the period of the last match rated in mode.
+func (e *Engine) Last(mode int32) time.Time {
+	return e.last[mode].Period
+}
+
+// SeenLog reports whether the match log named name was processed, as
+// recorded with AddLog.
+func (e *Engine) SeenLog(name string) bool {
+	return e.logs[name]
+}
+
+// AddLog records that the match log named name was processed, so later runs
+// continuing from a snapshot skip it.
+func (e *Engine) AddLog(name string) {
+	e.logs[name] = true
+}
+
+// Modes lists the tracks.
+func (e *Engine) Modes() []int32 {
+	modes := make([]int32, 0, len(e.tracks))
+	for mode := range e.tracks {
+		modes = append(modes, mode)
+	}
+	sort.Slice(modes, func(i, j int) bool { return modes[i] < modes[j] })
+	return modes
+}
+
+func (e *Engine) Get(mode int32, membershipID string) (PlayerRating, bool) {
+	r, ok := e.tracks[mode][membershipID]
+	if !ok {
+		return PlayerRating{}, false
+	}
+	return *r, true
+}
+
+type Standing struct {
+	MembershipID string `json:"membershipId"`
+	PlayerRating
+}
+
+// Leaderboard returns a track's players with at least minMatches matches,
+// best conservative rating first.
+func (e *Engine) Leaderboard(mode int32, minMatches int64) []Standing {
+	var standings []Standing
+	for id, r := range e.tracks[mode] {
+		if r.Matches >= minMatches {
+			standings = append(standings, Standing{MembershipID: id, PlayerRating: *r})
+		}
+	}
+	sort.Slice(standings, func(i, j int) bool {
+		a, b := standings[i].Conservative(), standings[j].Conservative()
+		if a != b {
+			return a > b
+		}
+		return standings[i].MembershipID < standings[j].MembershipID
+	})
+	return standings
+}
+
+// History returns the recorded rating changes, in the order they happened.
+func (e *Engine) History() []Change {
+	return e.history
+}
+
+// WriteHistoryCSV writes rating changes as a CSV table.
+func WriteHistoryCSV(w io.Writer, changes []Change) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{
+		"period", "instance_id", "mode", "membership_id", "score", "rating_before", "deviation_before",
+		"rating_after", "deviation_after", "volatility_after",
+	})
+	for _, c := range changes {
+		out.Write([]string{
+			c.Period.UTC().Format(time.RFC3339), c.InstanceID, strconv.Itoa(int(c.Mode)), c.MembershipID,
+			formatFloat(c.Score), formatFloat(c.Before.Rating), formatFloat(c.Before.Deviation),
+			formatFloat(c.After.Rating), formatFloat(c.After.Deviation), strconv.FormatFloat(c.After.Volatility, 'f', 6, 64),
+		})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', 2, 64)
+}
+
+type snapshot struct {
+	Version int                                `json:"version"`
+	Last    map[int32]Match                    `json:"last"`
+	Rated   int64                              `json:"rated"`
+	Tracks  map[int32]map[string]*PlayerRating `json:"tracks"`
+	Pending []Match                            `json:"pending,omitempty"`
+	Newest  time.Time                          `json:"newest"`
+	Logs    []string                           `json:"logs,omitempty"`
+}
+
+// Save writes the engine's ratings, positions, held back matches and
+// processed logs to path, so later matches can be processed incrementally
+// after Load. History isn't saved.
+func (e *Engine) Save(path string) error {
+	logs := make([]string, 0, len(e.logs))
+	for name := range e.logs {
+		logs = append(logs, name)
+	}
+	sort.Strings(logs)
+	data, err := json.Marshal(snapshot{Version: SNAPSHOT_VERSION, Last: e.last, Rated: e.rated, Tracks: e.tracks,
+		Pending: e.pending, Newest: e.newest, Logs: logs})
+	if err != nil {
+		return err
+	}
+
+	return atomicfile.WriteFile(path, data, 0o644)
+}
+
+// Load reads an engine saved with Save. A missing file is a new engine.
+func Load(path string) (*Engine, error) {
+	e := NewEngine()
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return e, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error reading rating snapshot [%s]: %v", path, err)
+	}
+
+	var s snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("Error decoding rating snapshot [%s]: %v", path, err)
+	}
+	if s.Version != SNAPSHOT_VERSION {
+		return nil, fmt.Errorf("Unsupported rating snapshot version %d", s.Version)
+	}
+	e.rated = s.Rated
+	e.pending = s.Pending
+	e.newest = s.Newest
+	if s.Last != nil {
+		e.last = s.Last
+	}
+	if s.Tracks != nil {
+		e.tracks = s.Tracks
+	}
+	for _, name := range s.Logs {
+		e.logs[name] = true
+	}
+	return e, nil
+}
@@ -0,0 +1,125 @@
+package rating
+
+import (
+	"math"
+)
+
+const (
+	DEFAULT_RATING     = 1500.0
+	DEFAULT_DEVIATION  = 350.0
+	DEFAULT_VOLATILITY = 0.06
+
+	// DEFAULT_TAU constrains how fast volatility changes, Glickman suggests
+	// 0.3 to 1.2.
+	DEFAULT_TAU = 0.5
+
+	glicko2Scale = 173.7178
+	convergence  = 0.000001
+)
+
+// Rating is a Glicko-2 rating on the familiar Glicko scale.
+type Rating struct {
+	Rating     float64 `json:"rating"`
+	Deviation  float64 `json:"deviation"`
+	Volatility float64 `json:"volatility"`
+}
+
+func NewRating() Rating {
+	return Rating{
+		Rating:     DEFAULT_RATING,
+		Deviation:  DEFAULT_DEVIATION,
+		Volatility: DEFAULT_VOLATILITY,
+	}
+}
+
+// Conservative is the rating minus two deviations, which ranks players that
+// played few matches below equally rated players that played many.
+func (r Rating) Conservative() float64 {
+	return r.Rating - 2*r.Deviation
+}
+
+// outcome is one game against an opponent, with a score from 0 for a loss to
+// 1 for a win.
+type outcome struct {
+	opponent Rating
+	score    float64
+}
+
+func g(phi float64) float64 {
+	return 1 / math.Sqrt(1+3*phi*phi/(math.Pi*math.Pi))
+}
+
+func expected(mu, muJ, phiJ float64) float64 {
+	return 1 / (1 + math.Exp(-g(phiJ)*(mu-muJ)))
+}
+
+// update applies a rating period's outcomes to r, following Glickman's
+// "Example of the Glicko-2 system".
+func update(r Rating, outcomes []outcome, tau float64) Rating {
+	mu := (r.Rating - DEFAULT_RATING) / glicko2Scale
+	phi := r.Deviation / glicko2Scale
+	sigma := r.Volatility
+
+	if len(outcomes) == 0 {
+		r.Deviation = math.Sqrt(phi*phi+sigma*sigma) * glicko2Scale
+		return r
+	}
+
+	var vInverse, improvement float64
+	for _, o := range outcomes {
+		muJ := (o.opponent.Rating - DEFAULT_RATING) / glicko2Scale
+		phiJ := o.opponent.Deviation / glicko2Scale
+		e := expected(mu, muJ, phiJ)
+		vInverse += g(phiJ) * g(phiJ) * e * (1 - e)
+		improvement += g(phiJ) * (o.score - e)
+	}
+	v := 1 / vInverse
+	delta := v * improvement
+
+	sigma = volatility(phi, sigma, v, delta, tau)
+
+	phiStar := math.Sqrt(phi*phi + sigma*sigma)
+	phi = 1 / math.Sqrt(1/(phiStar*phiStar)+1/v)
+	mu += phi * phi * improvement
+
+	return Rating{
+		Rating:     mu*glicko2Scale + DEFAULT_RATING,
+		Deviation:  phi * glicko2Scale,
+		Volatility: sigma,
+	}
+}
+
+// volatility finds the new volatility with the Illinois algorithm.
+func volatility(phi, sigma, v, delta, tau float64) float64 {
+	a := math.Log(sigma * sigma)
+	f := func(x float64) float64 {
+		ex := math.Exp(x)
+		d := phi*phi + v + ex
+		return ex*(delta*delta-phi*phi-v-ex)/(2*d*d) - (x-a)/(tau*tau)
+	}
+
+	A := a
+	var B float64
+	if delta*delta > phi*phi+v {
+		B = math.Log(delta*delta - phi*phi - v)
+	} else {
+		k := 1.0
+		for f(a-k*tau) < 0 {
+			k++
+		}
+		B = a - k*tau
+	}
+
+	fA, fB := f(A), f(B)
+	for math.Abs(B-A) > convergence {
+		C := A + (A-B)*fA/(fB-fA)
+		fC := f(C)
+		if fC*fB <= 0 {
+			A, fA = B, fB
+		} else {
+			fA /= 2
+		}
+		B, fB = C, fC
+	}
+	return math.Exp(A / 2)
+}
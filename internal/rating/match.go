@@ -0,0 +1,149 @@
+package rating
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	bungie "github.com/deahtstroke/protheon/internal/bungie/types"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// MODE_ALL_PVP is listed in the modes of every Crucible activity.
+	MODE_ALL_PVP = 5
+)
+
+// Match is the part of a PvP PGCR the rating engine needs. Minds log matches
+// instead of updating ratings themselves, since ratings depend on the order
+// matches were played in, which consumers can't guarantee.
+type Match struct {
+	InstanceID string        `json:"instanceId"`
+	Period     time.Time     `json:"period"`
+	Mode       int32         `json:"mode"`
+	Players    []Participant `json:"players"`
+}
+
+type Participant struct {
+	MembershipID string  `json:"membershipId"`
+	Team         int     `json:"team"`
+	Standing     int     `json:"standing"`
+	Score        float64 `json:"score"`
+	TeamScore    float64 `json:"teamScore"`
+}
+
+// FromPGCR extracts the match of a PvP PGCR. It returns false for other
+// activities and for matches with fewer than two players.
+func FromPGCR(pgcr *bungie.PGCR) (Match, bool) {
+	pvp := false
+	for _, mode := range pgcr.ActivityDetails.Modes {
+		if mode.String() == strconv.Itoa(MODE_ALL_PVP) {
+			pvp = true
+			break
+		}
+	}
+	if !pvp {
+		return Match{}, false
+	}
+
+	m := Match{
+		InstanceID: pgcr.ActivityDetails.InstanceID.String(),
+		Period:     pgcr.Period,
+	}
+	if n, err := strconv.ParseInt(pgcr.ActivityDetails.Mode.String(), 10, 32); err == nil {
+		m.Mode = int32(n)
+	}
+
+	seen := make(map[string]bool)
+	for _, entry := range pgcr.Entries {
+		id := entry.Player.DestinyUserInfo.MembershipID.String()
+		if id == "" || seen[id] || entry.Values.TimePlayedSeconds <= 0 {
+			continue
+		}
+		seen[id] = true
+		m.Players = append(m.Players, Participant{
+			MembershipID: id,
+			Team:         int(entry.Values.Team),
+			Standing:     entry.Standing,
+			Score:        entry.Values.Score,
+			TeamScore:    entry.Values.TeamScore,
+		})
+	}
+	if len(m.Players) < 2 {
+		return Match{}, false
+	}
+	return m, true
+}
+
+// before orders matches by period, then by instance ID. Instance IDs are
+// numbers, so shorter IDs come first.
+func (m Match) before(o Match) bool {
+	if !m.Period.Equal(o.Period) {
+		return m.Period.Before(o.Period)
+	}
+	if len(m.InstanceID) != len(o.InstanceID) {
+		return len(m.InstanceID) < len(o.InstanceID)
+	}
+	return m.InstanceID < o.InstanceID
+}
+
+// Sort orders matches by time, the order they have to be rated in, and
+// drops duplicates.
+func Sort(matches []Match) []Match {
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].before(matches[j]) })
+
+	unique := matches[:0]
+	for i, m := range matches {
+		if i > 0 && m.InstanceID == matches[i-1].InstanceID && m.Period.Equal(matches[i-1].Period) {
+			continue
+		}
+		unique = append(unique, m)
+	}
+	return unique
+}
+
+// PartitionByMode splits matches into the independent rating tracks, one per
+// playlist mode, which can be rated in parallel. Matches can't be partitioned
+// by player, since every match links the ratings of everyone in it.
+func PartitionByMode(matches []Match) map[int32][]Match {
+	partitions := make(map[int32][]Match)
+	for _, m := range matches {
+		partitions[m.Mode] = append(partitions[m.Mode], m)
+	}
+	return partitions
+}
+
+// ReadMatches reads a zstd compressed JSONL match log, as written by the
+// rating sink.
+func ReadMatches(path string) ([]Match, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening match log [%s]: %v", path, err)
+	}
+	defer file.Close()
+
+	decoder, err := zstd.NewReader(bufio.NewReader(file))
+	if err != nil {
+		return nil, fmt.Errorf("Error creating ZSTD reader for match log [%s]: %v", path, err)
+	}
+	defer decoder.Close()
+
+	var matches []Match
+	scanner := bufio.NewScanner(decoder)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var m Match
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			return nil, fmt.Errorf("Error decoding match log [%s] at line %d: %v", path, line, err)
+		}
+		matches = append(matches, m)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading match log [%s]: %v", path, err)
+	}
+	return matches, nil
+}
@@ -0,0 +1,220 @@
+package rating
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	bungie "github.com/deahtstroke/protheon/internal/bungie/types"
+)
+
+func TestUpdateMatchesGlickmanExample(t *testing.T) {
+	r := update(Rating{Rating: 1500, Deviation: 200, Volatility: 0.06}, []outcome{
+		{opponent: Rating{Rating: 1400, Deviation: 30}, score: 1},
+		{opponent: Rating{Rating: 1550, Deviation: 100}, score: 0},
+		{opponent: Rating{Rating: 1700, Deviation: 300}, score: 0},
+	}, 0.5)
+
+	if math.Abs(r.Rating-1464.06) > 0.01 || math.Abs(r.Deviation-151.52) > 0.01 || math.Abs(r.Volatility-0.05999) > 0.00001 {
+		t.Fatalf("Expected 1464.06/151.52/0.05999, got %+v", r)
+	}
+}
+
+func teamMatch(id int, period time.Time, winners, losers []string) Match {
+	m := Match{InstanceID: strconv.Itoa(id), Period: period, Mode: 84}
+	for i, p := range winners {
+		m.Players = append(m.Players, Participant{MembershipID: p, Team: 17, Standing: 0, Score: float64(10 - i), TeamScore: 5})
+	}
+	for i, p := range losers {
+		m.Players = append(m.Players, Participant{MembershipID: p, Team: 18, Standing: 1, Score: float64(10 - i), TeamScore: 3})
+	}
+	return m
+}
+
+func matches() []Match {
+	start := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+	var matches []Match
+	for i := range 20 {
+		winners, losers := []string{"a", "b", "c"}, []string{"d", "e", "f"}
+		if i%4 == 3 {
+			winners, losers = losers, winners
+		}
+		matches = append(matches, teamMatch(i+1, start.Add(time.Duration(i)*time.Hour), winners, losers))
+	}
+	return matches
+}
+
+func TestEngineRatesWinnersAboveLosers(t *testing.T) {
+	engine := NewEngine()
+	if late := engine.Replay(matches()); late != 0 {
+		t.Fatalf("Expected no late matches, got %d", late)
+	}
+
+	a, _ := engine.Get(84, "a")
+	d, _ := engine.Get(84, "d")
+	if a.Rating.Rating <= d.Rating.Rating || a.Matches != 20 {
+		t.Fatalf("Expected the usual winners to rate higher, got %+v and %+v", a, d)
+	}
+	if a.Deviation >= DEFAULT_DEVIATION {
+		t.Fatalf("Expected deviation to shrink, got %v", a.Deviation)
+	}
+
+	board := engine.Leaderboard(84, 1)
+	if len(board) != 6 || board[0].MembershipID != "a" {
+		t.Fatalf("Expected the top scorer of the winning team first, got %+v", board)
+	}
+
+	err := engine.Process(teamMatch(1, time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC), []string{"a"}, []string{"d"}))
+	if !errors.Is(err, ErrOutOfOrder) {
+		t.Fatalf("Expected ErrOutOfOrder, got %v", err)
+	}
+}
+
+func TestReplayIsDeterministic(t *testing.T) {
+	ordered := NewEngine()
+	ordered.RecordHistory = true
+	ordered.Replay(matches())
+
+	shuffled := matches()
+	rand.New(rand.NewSource(1)).Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+	// Redeliveries log the same match twice.
+	shuffled = append(shuffled, shuffled[3])
+	replayed := NewEngine()
+	replayed.RecordHistory = true
+	replayed.Replay(shuffled)
+
+	if !reflect.DeepEqual(ordered.History(), replayed.History()) || ordered.Rated() != 20 || replayed.Rated() != 20 {
+		t.Fatal("Expected replaying shuffled matches to give the same history")
+	}
+}
+
+func TestSnapshotContinuesIncrementally(t *testing.T) {
+	all := matches()
+	full := NewEngine()
+	full.Replay(all)
+
+	first := NewEngine()
+	first.Replay(all[:12])
+	path := filepath.Join(t.TempDir(), "ratings.json")
+	if err := first.Save(path); err != nil {
+		t.Fatalf("Error saving: %v", err)
+	}
+
+	resumed, err := Load(path)
+	if err != nil {
+		t.Fatalf("Error loading: %v", err)
+	}
+	if late := resumed.Replay(all); late != 12 {
+		t.Fatalf("Expected the 12 rated matches to be skipped, got %d", late)
+	}
+
+	want, _ := full.Get(84, "e")
+	got, _ := resumed.Get(84, "e")
+	if math.Abs(want.Rating.Rating-got.Rating.Rating) > 1e-9 || want.Matches != got.Matches {
+		t.Fatalf("Expected %+v, got %+v", want, got)
+	}
+}
+
+func TestModesAreRatedIndependently(t *testing.T) {
+	start := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+	engine := NewEngine()
+	if err := engine.Process(teamMatch(1, start.Add(time.Hour), []string{"a"}, []string{"b"})); err != nil {
+		t.Fatalf("Error processing: %v", err)
+	}
+
+	older := teamMatch(2, start, []string{"c"}, []string{"d"})
+	older.Mode = 5
+	if err := engine.Process(older); err != nil {
+		t.Fatalf("Expected an older match of another mode to be rated, got %v", err)
+	}
+	older = teamMatch(3, start, []string{"a"}, []string{"b"})
+	if err := engine.Process(older); !errors.Is(err, ErrOutOfOrder) {
+		t.Fatalf("Expected an older match of the same mode to be late, got %v", err)
+	}
+}
+
+func TestWindowReordersLateMatches(t *testing.T) {
+	all := matches()
+	full := NewEngine()
+	full.Replay(all)
+
+	windowed := NewEngine()
+	windowed.Window = 3 * time.Hour
+	order := append(append([]Match{}, all[:8]...), all[10:]...)
+	order = append(order[:10], append([]Match{all[9], all[8]}, order[10:]...)...)
+	for _, m := range order {
+		if err := windowed.Process(m); err != nil {
+			t.Fatalf("Error processing match %s: %v", m.InstanceID, err)
+		}
+	}
+	if err := windowed.Process(all[19]); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("Expected a held back match to be a duplicate, got %v", err)
+	}
+	if windowed.Pending() != 3 {
+		t.Fatalf("Expected the last 3 matches to be held back, got %d", windowed.Pending())
+	}
+
+	path := filepath.Join(t.TempDir(), "ratings.json")
+	if err := windowed.Save(path); err != nil {
+		t.Fatalf("Error saving: %v", err)
+	}
+	resumed, err := Load(path)
+	if err != nil {
+		t.Fatalf("Error loading: %v", err)
+	}
+	resumed.Flush()
+	if resumed.Rated() != 20 || resumed.Pending() != 0 {
+		t.Fatalf("Expected every match to be rated, got %d rated, %d held back", resumed.Rated(), resumed.Pending())
+	}
+	for _, player := range []string{"a", "e"} {
+		want, _ := full.Get(84, player)
+		got, _ := resumed.Get(84, player)
+		if math.Abs(want.Rating.Rating-got.Rating.Rating) > 1e-9 || want.Matches != got.Matches {
+			t.Fatalf("Expected %+v, got %+v", want, got)
+		}
+	}
+}
+
+func TestSnapshotRemembersLogs(t *testing.T) {
+	engine := NewEngine()
+	engine.AddLog("part-1.jsonl.zst")
+	path := filepath.Join(t.TempDir(), "ratings.json")
+	if err := engine.Save(path); err != nil {
+		t.Fatalf("Error saving: %v", err)
+	}
+	resumed, err := Load(path)
+	if err != nil {
+		t.Fatalf("Error loading: %v", err)
+	}
+	if !resumed.SeenLog("part-1.jsonl.zst") || resumed.SeenLog("part-2.jsonl.zst") {
+		t.Fatalf("Expected only the saved log to be seen")
+	}
+}
+
+func TestFromPGCR(t *testing.T) {
+	pgcr := &bungie.PGCR{
+		ActivityDetails: bungie.ActivityDetails{InstanceID: "42", Mode: "84", Modes: []json.Number{"84", "5"}},
+	}
+	for _, id := range []string{"1", "2", "1"} {
+		entry := bungie.Entry{}
+		entry.Player.DestinyUserInfo.MembershipID = json.Number(id)
+		entry.Values.TimePlayedSeconds = 600
+		pgcr.Entries = append(pgcr.Entries, entry)
+	}
+
+	m, ok := FromPGCR(pgcr)
+	if !ok || len(m.Players) != 2 || m.Mode != 84 {
+		t.Fatalf("Unexpected match: %+v", m)
+	}
+
+	pgcr.ActivityDetails.Modes = []json.Number{"4"}
+	if _, ok := FromPGCR(pgcr); ok {
+		t.Fatal("Expected PvE activities to be skipped")
+	}
+}
@@ -0,0 +1,251 @@
+package sink
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/deahtstroke/protheon/internal/atomicfile"
+	bungie "github.com/deahtstroke/protheon/internal/bungie/types"
+	"github.com/deahtstroke/protheon/internal/logging"
+)
+
+// aggregate is a mergeable summary of PGCRs saved to a file, such as career
+// partials or the played-together graph.
+type aggregate[T any] interface {
+	json.Marshaler
+	json.Unmarshaler
+	Add(pgcr *bungie.PGCR)
+	Merge(o T)
+	Len() int
+	Save(path string) error
+}
+
+// aggregateLogHeader is the first line of an aggregate's log, naming the
+// saved aggregate the log's batches add to by the SHA-256 of its file.
+type aggregateLogHeader struct {
+	Base string `json:"base"`
+}
+
+// aggregateSink keeps an aggregate saved at path, continuing from the
+// aggregate already there. PGCRs written since the last flush are kept in a
+// separate pending aggregate, which Flush appends to a log next to path
+// rather than saving the whole aggregate again. Pending PGCRs are dropped
+// when appending fails: their PGCRs are requeued unless another sink stored
+// them, and counting them again would double count them.
+//
+// The log is folded into the file at path once it outgrows it, on open and on
+// Close. A log whose header names another file than the one at path was
+// already folded into it, and is ignored.
+type aggregateSink[T aggregate[T]] struct {
+	path   string
+	create func() T
+
+	mu        sync.Mutex
+	committed T
+	pending   T
+	log       *os.File
+	logSize   int64
+	baseSize  int64
+}
+
+func openAggregateSink[T aggregate[T]](path string, create func() T, load func(string) (T, error)) (*aggregateSink[T], error) {
+	if path == "" {
+		return nil, errors.New("Aggregate sink needs a path")
+	}
+
+	committed, err := load(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &aggregateSink[T]{
+		path:      path,
+		create:    create,
+		committed: committed,
+		pending:   create(),
+	}
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *aggregateSink[T]) logPath() string {
+	return s.path + ".log"
+}
+
+// baseHash hashes the file at path, or nothing when there is none yet.
+func (s *aggregateSink[T]) baseHash() (string, int64, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", 0, fmt.Errorf("Error reading aggregate [%s]: %v", s.path, err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), int64(len(data)), nil
+}
+
+// replay merges the batches of the log into the committed aggregate. A line
+// cut short by a crash is skipped.
+func (s *aggregateSink[T]) replay() error {
+	file, err := os.Open(s.logPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error reading aggregate log [%s]: %v", s.logPath(), err)
+	}
+	defer file.Close()
+
+	base, _, err := s.baseHash()
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(file)
+	var header aggregateLogHeader
+	line, err := reader.ReadBytes('\n')
+	if json.Unmarshal(line, &header) != nil || header.Base != base {
+		return nil
+	}
+	for err == nil {
+		line, err = reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		batch := s.create()
+		if uerr := json.Unmarshal(line, batch); uerr != nil {
+			logging.Component("sink").Warn("Skipping unreadable aggregate log line", "path", s.logPath(), "error", uerr)
+			continue
+		}
+		s.committed.Merge(batch)
+	}
+	if !errors.Is(err, io.EOF) {
+		return fmt.Errorf("Error reading aggregate log [%s]: %v", s.logPath(), err)
+	}
+	return nil
+}
+
+// compact saves the committed aggregate at path, and starts a new log for
+// it. Until the new log replaces the old one, the old log names the
+// previous file and is ignored.
+func (s *aggregateSink[T]) compact() error {
+	if err := s.committed.Save(s.path); err != nil {
+		return err
+	}
+	base, size, err := s.baseHash()
+	if err != nil {
+		return err
+	}
+	header, err := json.Marshal(aggregateLogHeader{Base: base})
+	if err != nil {
+		return err
+	}
+	header = append(header, '\n')
+	if err := atomicfile.WriteFile(s.logPath(), header, 0o644); err != nil {
+		return fmt.Errorf("Error resetting aggregate log [%s]: %v", s.logPath(), err)
+	}
+
+	log, err := os.OpenFile(s.logPath(), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("Error opening aggregate log [%s]: %v", s.logPath(), err)
+	}
+	if s.log != nil {
+		s.log.Close()
+	}
+	s.log = log
+	s.logSize = int64(len(header))
+	s.baseSize = size
+	return nil
+}
+
+// current returns the aggregate saved so far.
+func (s *aggregateSink[T]) current() T {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.committed
+}
+
+func (s *aggregateSink[T]) Write(ctx context.Context, pgcrs []*bungie.PGCR) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, pgcr := range pgcrs {
+		s.pending.Add(pgcr)
+	}
+	return nil
+}
+
+func (s *aggregateSink[T]) Flush(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pending.Len() == 0 {
+		return nil
+	}
+	pending := s.pending
+	s.pending = s.create()
+
+	if err := s.append(pending); err != nil {
+		return err
+	}
+	s.committed.Merge(pending)
+
+	if s.logSize > s.baseSize {
+		if err := s.compact(); err != nil {
+			// The log still holds every batch, and is folded in later.
+			logging.Component("sink").Warn("Error compacting aggregate log", "path", s.logPath(), "error", err)
+		}
+	}
+	return nil
+}
+
+// append writes a batch to the log. A batch written only in part is cut off
+// again, so it can't run into the next one.
+func (s *aggregateSink[T]) append(batch T) error {
+	if s.log == nil {
+		return fmt.Errorf("Error writing aggregate log [%s]: not open", s.logPath())
+	}
+	data, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if _, err := s.log.Write(data); err != nil {
+		s.log.Truncate(s.logSize)
+		return fmt.Errorf("Error writing aggregate log [%s]: %v", s.logPath(), err)
+	}
+	if err := s.log.Sync(); err != nil {
+		s.log.Truncate(s.logSize)
+		return fmt.Errorf("Error syncing aggregate log [%s]: %v", s.logPath(), err)
+	}
+	s.logSize += int64(len(data))
+	return nil
+}
+
+func (s *aggregateSink[T]) Close() error {
+	if err := s.Flush(context.Background()); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.log == nil {
+		return nil
+	}
+	err := s.compact()
+	s.log.Close()
+	s.log = nil
+	return err
+}
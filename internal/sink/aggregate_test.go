@@ -0,0 +1,105 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	bungie "github.com/deahtstroke/protheon/internal/bungie/types"
+)
+
+func activities(s *CareerSink) int64 {
+	var n int64
+	for _, a := range s.Partial().Aggregates() {
+		n += a.Totals.Activities
+	}
+	return n
+}
+
+func TestAggregateSinkReplaysItsLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "career.json")
+	day := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+
+	crashed, err := NewCareerSink(path)
+	if err != nil {
+		t.Fatalf("Error opening sink: %v", err)
+	}
+	// A full fireteam saved first leaves the second batch, of one player,
+	// smaller than the saved partial, so it is only appended to the log.
+	fireteam := testPGCR("1", "4", day)
+	for i := range 5 {
+		entry := fireteam.Entries[0]
+		entry.Player.DestinyUserInfo.MembershipID = json.Number(strconv.Itoa(i))
+		fireteam.Entries = append(fireteam.Entries, entry)
+	}
+	for i, pgcr := range []*bungie.PGCR{fireteam, testPGCR("2", "4", day)} {
+		if err := crashed.Write(context.Background(), []*bungie.PGCR{pgcr}); err != nil {
+			t.Fatalf("Error writing: %v", err)
+		}
+		if err := crashed.Flush(context.Background()); err != nil {
+			t.Fatalf("Error flushing %d: %v", i, err)
+		}
+	}
+	if log, _ := os.ReadFile(path + ".log"); bytes.Count(log, []byte("\n")) != 2 {
+		t.Fatalf("Expected the log to hold the second batch, got %s", log)
+	}
+
+	// The sink is never closed, as if the mind crashed.
+	s, err := NewCareerSink(path)
+	if err != nil {
+		t.Fatalf("Error reopening sink: %v", err)
+	}
+	if n := activities(s); n != 7 {
+		t.Fatalf("Expected every flushed activity, got %d", n)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Error closing: %v", err)
+	}
+
+	s, err = NewCareerSink(path)
+	if err != nil {
+		t.Fatalf("Error reopening sink: %v", err)
+	}
+	defer s.Close()
+	if n := activities(s); n != 7 {
+		t.Fatalf("Expected the folded log not to be counted again, got %d", n)
+	}
+}
+
+func TestAggregateSinkIgnoresStaleLogs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "career.json")
+	day := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+
+	s, err := NewCareerSink(path)
+	if err != nil {
+		t.Fatalf("Error opening sink: %v", err)
+	}
+	s.Write(context.Background(), []*bungie.PGCR{testPGCR("1", "4", day)})
+	if err := s.Close(); err != nil {
+		t.Fatalf("Error closing: %v", err)
+	}
+
+	// A log of batches already saved, left by a crash while folding it.
+	batch, err := s.Partial().MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := append([]byte(`{"base":"previous"}`+"\n"), append(batch, '\n')...)
+	if err := os.WriteFile(path+".log", stale, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = NewCareerSink(path)
+	if err != nil {
+		t.Fatalf("Error reopening sink: %v", err)
+	}
+	defer s.Close()
+	if n := activities(s); n != 1 {
+		t.Fatalf("Expected the stale log to be ignored, got %d activities", n)
+	}
+}
@@ -0,0 +1,101 @@
+package sink
+
+import (
+	"context"
+
+	"github.com/deahtstroke/protheon/internal/anomaly"
+	bungie "github.com/deahtstroke/protheon/internal/bungie/types"
+	"github.com/deahtstroke/protheon/internal/logging"
+)
+
+// AnomalySink checks the PGCRs it is given with an anomaly.Detector and logs
+// the flagged entries as zstd compressed JSONL files like the JSONL sink.
+// With a sketches path, the detector's distributions are loaded on open and
+// saved on every Flush, so a restarted mind keeps judging from where it was.
+//
+// The PGCRs' values reach the distributions only once their batch is flushed,
+// so a batch that fails and is redelivered is not counted twice. PGCRs of the
+// same batch therefore never move each other's thresholds.
+type AnomalySink struct {
+	*JSONLSink
+
+	detector *anomaly.Detector
+	sketches string
+	pending  []anomaly.Observation
+}
+
+// NewAnomalySink opens the sink. With a minClears path, the detector floors
+// clear times per activity with the times loaded by anomaly.LoadMinClears.
+func NewAnomalySink(config JSONLConfig, sketches, minClears string) (*AnomalySink, error) {
+	detector := anomaly.NewDetector()
+	if sketches != "" {
+		if err := detector.LoadSketches(sketches); err != nil {
+			return nil, err
+		}
+	}
+	if minClears != "" {
+		floors, err := anomaly.LoadMinClears(minClears)
+		if err != nil {
+			return nil, err
+		}
+		detector.MinClearSeconds = floors
+	}
+
+	s, err := NewJSONLSink(config)
+	if err != nil {
+		return nil, err
+	}
+	return &AnomalySink{JSONLSink: s, detector: detector, sketches: sketches}, nil
+}
+
+// Detector returns the sink's detector.
+func (s *AnomalySink) Detector() *anomaly.Detector {
+	return s.detector
+}
+
+func (s *AnomalySink) Write(ctx context.Context, pgcrs []*bungie.PGCR) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, pgcr := range pgcrs {
+		flags, observations := s.detector.Inspect(pgcr)
+		for _, flag := range flags {
+			if err := s.write(flag.InstanceID, flag); err != nil {
+				return err
+			}
+		}
+		s.pending = append(s.pending, observations...)
+	}
+	return nil
+}
+
+// Flush flushes the flags, then adds the batch's values to the distributions
+// and saves them. A batch whose flags fail to flush is dropped from the
+// distributions, as it will be redelivered.
+func (s *AnomalySink) Flush(ctx context.Context) error {
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+
+	if err := s.JSONLSink.Flush(ctx); err != nil {
+		return err
+	}
+	s.detector.Observe(pending)
+	if s.sketches == "" {
+		return nil
+	}
+	// The batch is already stored, so failing here would only have it
+	// redelivered and counted twice; the next flush saves it again.
+	if err := s.detector.SaveSketches(s.sketches); err != nil {
+		logging.Component("sink").Error("Error saving anomaly sketches", "path", s.sketches, "error", err)
+	}
+	return nil
+}
+
+func (s *AnomalySink) Close() error {
+	if err := s.Flush(context.Background()); err != nil {
+		return err
+	}
+	return s.JSONLSink.Close()
+}
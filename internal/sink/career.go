@@ -0,0 +1,26 @@
+package sink
+
+import (
+	"github.com/deahtstroke/protheon/internal/career"
+)
+
+// CareerSink keeps per player career aggregates and saves them as a career
+// partial at its path. Each flush only appends its batch to <path>.log, which
+// is folded into the partial once it outgrows it and when the sink closes.
+// Partials saved by several minds are combined with career.Partial.Merge.
+type CareerSink struct {
+	*aggregateSink[*career.Partial]
+}
+
+func NewCareerSink(path string) (*CareerSink, error) {
+	s, err := openAggregateSink(path, career.NewPartial, career.Load)
+	if err != nil {
+		return nil, err
+	}
+	return &CareerSink{s}, nil
+}
+
+// Partial returns the aggregates saved so far.
+func (s *CareerSink) Partial() *career.Partial {
+	return s.current()
+}
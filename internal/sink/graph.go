@@ -0,0 +1,25 @@
+package sink
+
+import (
+	"github.com/deahtstroke/protheon/internal/graph"
+)
+
+// GraphSink keeps a "played together" graph and saves it at its path, with
+// the batches of each flush appended to <path>.log like CareerSink. Graphs
+// saved by several minds are combined with graph.Graph.Merge.
+type GraphSink struct {
+	*aggregateSink[*graph.Graph]
+}
+
+func NewGraphSink(path string) (*GraphSink, error) {
+	s, err := openAggregateSink(path, graph.New, graph.Load)
+	if err != nil {
+		return nil, err
+	}
+	return &GraphSink{s}, nil
+}
+
+// Graph returns the graph saved so far.
+func (s *GraphSink) Graph() *graph.Graph {
+	return s.current()
+}
@@ -0,0 +1,305 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deahtstroke/protheon/internal/atomicfile"
+	bungie "github.com/deahtstroke/protheon/internal/bungie/types"
+	"github.com/deahtstroke/protheon/internal/logging"
+	"github.com/google/uuid"
+	"github.com/klauspost/compress/zstd"
+)
+
+type JSONLConfig struct {
+	Dir string
+
+	// MaxFileSize and MaxFileAge roll the file once it grew past that many
+	// compressed bytes or has been open that long.
+	MaxFileSize int64
+	MaxFileAge  time.Duration
+}
+
+// JSONLSink writes PGCRs as zstd compressed JSON lines, the same format as
+// the dumps the conductor ingests, so its output can be ingested again:
+//
+//	<Dir>/part-<time>-<id>.jsonl.zst
+//
+// Like the Parquet sink, files are written under a hidden temporary name and
+// renamed into place when they roll or the sink closes. Flush ends the
+// file's current zstd frame and syncs it, and records how much of the file
+// is flushed next to it. A sink opened after a crash cuts the files it finds
+// back to what was flushed and renames them into place.
+type JSONLSink struct {
+	config JSONLConfig
+
+	mu   sync.Mutex
+	file *jsonlFile
+}
+
+func NewJSONLSink(config JSONLConfig) (*JSONLSink, error) {
+	if config.Dir == "" {
+		return nil, errors.New("JSONL sink needs a directory")
+	}
+	if config.MaxFileSize <= 0 {
+		config.MaxFileSize = DEFAULT_MAX_FILE_SIZE
+	}
+	if config.MaxFileAge <= 0 {
+		config.MaxFileAge = DEFAULT_MAX_FILE_AGE
+	}
+
+	if err := os.MkdirAll(config.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("Error creating JSONL directory [%s]: %v", config.Dir, err)
+	}
+	if err := recoverJSONLFiles(config.Dir); err != nil {
+		return nil, err
+	}
+	if err := removeStaleParts(config.Dir); err != nil {
+		return nil, err
+	}
+
+	return &JSONLSink{config: config}, nil
+}
+
+func (s *JSONLSink) Write(ctx context.Context, pgcrs []*bungie.PGCR) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, pgcr := range pgcrs {
+		if err := s.write(pgcr.ActivityDetails.InstanceID.String(), pgcr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write appends one record, identified by id in errors, rolling the file
+// first when it is due. The caller holds mu.
+func (s *JSONLSink) write(id string, record any) error {
+	if s.file != nil && (s.file.counter.written >= s.config.MaxFileSize || time.Since(s.file.opened) >= s.config.MaxFileAge) {
+		file := s.file
+		s.file = nil
+		if err := file.finalize(); err != nil {
+			return err
+		}
+	}
+	if s.file == nil {
+		file, err := openJSONLFile(s.config.Dir)
+		if err != nil {
+			return err
+		}
+		s.file = file
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("Error encoding [%s]: %v", id, err)
+	}
+	data = append(data, '\n')
+	if !s.file.framed {
+		s.file.encoder.Reset(s.file.counter)
+		s.file.framed = true
+	}
+	if _, err := s.file.encoder.Write(data); err != nil {
+		return fmt.Errorf("Error writing to [%s]: %v", s.file.tmpPath, err)
+	}
+	return nil
+}
+
+// Flush makes the records written since the last flush durable, without
+// finalizing the file. A file that fails to flush is cut back to its last
+// flush and finalized, so the records written since are only delivered
+// again.
+func (s *JSONLSink) Flush(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	if err := s.file.checkpoint(); err != nil {
+		file := s.file
+		s.file = nil
+		file.file.Close()
+		if _, serr := os.Stat(file.flushedPath); errors.Is(serr, os.ErrNotExist) {
+			os.Remove(file.tmpPath)
+		} else if rerr := recoverJSONLFile(file.flushedPath); rerr != nil {
+			logging.Component("sink").Warn("Error recovering JSONL file", logging.KeyFile, file.tmpPath, "error", rerr)
+		}
+		return err
+	}
+	return nil
+}
+
+// Close finalizes the open file.
+func (s *JSONLSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	file := s.file
+	s.file = nil
+	return file.finalize()
+}
+
+// FLUSHED_SUFFIX ends the name of the file recording how many bytes of a
+// JSONL file being written are flushed, .<name>.flushed.
+const FLUSHED_SUFFIX = ".flushed"
+
+// recoverJSONLFiles finalizes the files a crash left behind, see
+// recoverJSONLFile.
+func recoverJSONLFiles(dir string) error {
+	matches, err := filepath.Glob(filepath.Join(dir, ".part-*"+FLUSHED_SUFFIX))
+	if err != nil {
+		return err
+	}
+	for _, path := range matches {
+		if err := recoverJSONLFile(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recoverJSONLFile cuts the file recorded as flushed at flushedPath back to
+// its flushed length, which ends on a zstd frame, and renames it into place.
+func recoverJSONLFile(flushedPath string) error {
+	dir, name := filepath.Split(flushedPath)
+	name = strings.TrimSuffix(strings.TrimPrefix(name, "."), FLUSHED_SUFFIX)
+	path := filepath.Join(dir, name)
+	tmpPath := filepath.Join(dir, "."+name+".tmp")
+
+	data, err := os.ReadFile(flushedPath)
+	if err != nil {
+		return fmt.Errorf("Error reading flushed length [%s]: %v", flushedPath, err)
+	}
+	flushed, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return fmt.Errorf("Error reading flushed length [%s]: %v", flushedPath, err)
+	}
+
+	// Without the temporary file the file was already renamed into place.
+	if _, err := os.Stat(tmpPath); err == nil {
+		if err := os.Truncate(tmpPath, flushed); err != nil {
+			return fmt.Errorf("Error truncating JSONL file [%s]: %v", tmpPath, err)
+		}
+		if err := os.Rename(tmpPath, path); err != nil {
+			return fmt.Errorf("Error finalizing JSONL file [%s]: %v", path, err)
+		}
+		if err := syncDir(dir); err != nil {
+			return err
+		}
+		logging.Component("sink").Info("Recovered flushed records", logging.KeyFile, path, "bytes", flushed)
+	}
+	if err := os.Remove(flushedPath); err != nil {
+		return fmt.Errorf("Error removing flushed length [%s]: %v", flushedPath, err)
+	}
+	return nil
+}
+
+type jsonlFile struct {
+	path    string
+	tmpPath string
+	file    *os.File
+	counter *countingWriter
+	encoder *zstd.Encoder
+	opened  time.Time
+
+	// framed is whether the encoder has a frame open, holding the records
+	// written since the last checkpoint.
+	framed      bool
+	flushedPath string
+}
+
+func openJSONLFile(dir string) (*jsonlFile, error) {
+	now := time.Now()
+	name := fmt.Sprintf("part-%s-%s.jsonl.zst", now.UTC().Format("20060102T150405"), uuid.New().String())
+	tmpPath := filepath.Join(dir, "."+name+".tmp")
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating JSONL file [%s]: %v", tmpPath, err)
+	}
+
+	counter := &countingWriter{buffer: bufio.NewWriterSize(file, 1024*1024)}
+	encoder, err := zstd.NewWriter(counter)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Error creating ZSTD writer for [%s]: %v", tmpPath, err)
+	}
+
+	return &jsonlFile{
+		path:    filepath.Join(dir, name),
+		tmpPath: tmpPath,
+		file:    file,
+		counter: counter,
+		encoder: encoder,
+		opened:  now,
+		framed:  true,
+
+		flushedPath: filepath.Join(dir, "."+name+FLUSHED_SUFFIX),
+	}, nil
+}
+
+// checkpoint ends the current frame, syncs the file and records its length.
+// zstd readers read concatenated frames as one stream, so the file is
+// readable up to that length.
+func (f *jsonlFile) checkpoint() error {
+	if !f.framed {
+		return nil
+	}
+	if err := f.encoder.Close(); err != nil {
+		return fmt.Errorf("Error compressing JSONL file [%s]: %v", f.tmpPath, err)
+	}
+	f.framed = false
+	if err := f.counter.buffer.Flush(); err != nil {
+		return fmt.Errorf("Error writing JSONL file [%s]: %v", f.tmpPath, err)
+	}
+	if err := f.file.Sync(); err != nil {
+		return fmt.Errorf("Error syncing JSONL file [%s]: %v", f.tmpPath, err)
+	}
+	if err := atomicfile.WriteFile(f.flushedPath, []byte(strconv.FormatInt(f.counter.written, 10)), 0o644); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(f.flushedPath))
+}
+
+func (f *jsonlFile) finalize() error {
+	if f.framed {
+		if err := f.encoder.Close(); err != nil {
+			f.file.Close()
+			return fmt.Errorf("Error compressing JSONL file [%s]: %v", f.tmpPath, err)
+		}
+	}
+	if err := f.counter.buffer.Flush(); err != nil {
+		f.file.Close()
+		return fmt.Errorf("Error writing JSONL file [%s]: %v", f.tmpPath, err)
+	}
+	if err := f.file.Sync(); err != nil {
+		f.file.Close()
+		return fmt.Errorf("Error syncing JSONL file [%s]: %v", f.tmpPath, err)
+	}
+	if err := f.file.Close(); err != nil {
+		return fmt.Errorf("Error closing JSONL file [%s]: %v", f.tmpPath, err)
+	}
+	if err := os.Rename(f.tmpPath, f.path); err != nil {
+		return fmt.Errorf("Error finalizing JSONL file [%s]: %v", f.path, err)
+	}
+	if err := syncDir(filepath.Dir(f.path)); err != nil {
+		return err
+	}
+	if err := os.Remove(f.flushedPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logging.Component("sink").Warn("Error removing flushed length", logging.KeyFile, f.flushedPath, "error", err)
+	}
+	return nil
+}
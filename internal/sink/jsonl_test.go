@@ -0,0 +1,244 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/deahtstroke/protheon/internal/anomaly"
+	bungie "github.com/deahtstroke/protheon/internal/bungie/types"
+	"github.com/deahtstroke/protheon/internal/handler"
+	"github.com/deahtstroke/protheon/internal/rating"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestJSONLSinkWritesReingestableDumps(t *testing.T) {
+	dir := t.TempDir()
+	s, err := handler.OpenSink(context.Background(), "jsonl:dir="+dir)
+	if err != nil {
+		t.Fatalf("Error opening sink: %v", err)
+	}
+
+	day := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+	if err := s.Write(context.Background(), []*bungie.PGCR{testPGCR("1", "4", day), testPGCR("2", "5", day)}); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	if final, _ := partFiles(t, dir); len(final) != 0 {
+		t.Fatalf("Expected no visible files before flush, got %v", final)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Error closing: %v", err)
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(dir, "*.jsonl.zst"))
+	if len(matches) != 1 {
+		t.Fatalf("Expected one finalized file, got %v", matches)
+	}
+
+	if ids := readJSONLIDs(t, matches[0]); len(ids) != 2 || ids[0] != "1" || ids[1] != "2" {
+		t.Fatalf("Unexpected PGCRs: %v", ids)
+	}
+}
+
+// readJSONLIDs reads the instance IDs of the PGCRs in a JSONL file.
+func readJSONLIDs(t *testing.T, path string) []string {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	decoder, err := zstd.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoder.Close()
+
+	var ids []string
+	scanner := bufio.NewScanner(decoder)
+	for scanner.Scan() {
+		var pgcr bungie.PGCR
+		if err := json.Unmarshal(scanner.Bytes(), &pgcr); err != nil {
+			t.Fatalf("Error decoding line: %v", err)
+		}
+		ids = append(ids, pgcr.ActivityDetails.InstanceID.String())
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("Error reading [%s]: %v", path, err)
+	}
+	return ids
+}
+
+func TestJSONLSinkFlushesIntoOneFile(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewJSONLSink(JSONLConfig{Dir: dir, MaxFileSize: 1 << 30})
+	if err != nil {
+		t.Fatalf("Error creating sink: %v", err)
+	}
+
+	day := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+	for _, id := range []string{"1", "2"} {
+		if err := s.Write(context.Background(), []*bungie.PGCR{testPGCR(id, "4", day)}); err != nil {
+			t.Fatalf("Error writing: %v", err)
+		}
+		if err := s.Flush(context.Background()); err != nil {
+			t.Fatalf("Error flushing: %v", err)
+		}
+	}
+	if final, _ := partFiles(t, dir); len(final) != 0 {
+		t.Fatalf("Expected no visible files before close, got %v", final)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Error closing: %v", err)
+	}
+
+	final, tmp := partFiles(t, dir)
+	if len(final) != 1 || len(tmp) != 0 {
+		t.Fatalf("Expected both flushes in one file, got %v and %v", final, tmp)
+	}
+	if ids := readJSONLIDs(t, final[0]); len(ids) != 2 || ids[0] != "1" || ids[1] != "2" {
+		t.Fatalf("Unexpected PGCRs: %v", ids)
+	}
+}
+
+func TestJSONLSinkRecoversFlushedRecords(t *testing.T) {
+	dir := t.TempDir()
+	crashed, err := NewJSONLSink(JSONLConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("Error creating sink: %v", err)
+	}
+
+	day := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+	if err := crashed.Write(context.Background(), []*bungie.PGCR{testPGCR("1", "4", day)}); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	if err := crashed.Flush(context.Background()); err != nil {
+		t.Fatalf("Error flushing: %v", err)
+	}
+	// Never flushed, so delivered again after the crash.
+	if err := crashed.Write(context.Background(), []*bungie.PGCR{testPGCR("2", "4", day)}); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	crashed.file.counter.buffer.Flush()
+
+	// The sink is never closed, as if the mind crashed.
+	s, err := NewJSONLSink(JSONLConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("Error reopening sink: %v", err)
+	}
+	defer s.Close()
+
+	final, tmp := partFiles(t, dir)
+	if len(final) != 1 || len(tmp) != 0 {
+		t.Fatalf("Expected one recovered file, got %v and %v", final, tmp)
+	}
+	if ids := readJSONLIDs(t, final[0]); len(ids) != 1 || ids[0] != "1" {
+		t.Fatalf("Expected the flushed PGCR only, got %v", ids)
+	}
+}
+
+func TestOpenSinkRejectsUnknownOptions(t *testing.T) {
+	if _, err := handler.OpenSink(context.Background(), "jsonl:dir="+t.TempDir()+",max-age=1m"); err == nil {
+		t.Fatal("Expected an error for an unknown option")
+	}
+}
+
+func TestRatingSinkLogsPvPMatches(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewRatingSink(JSONLConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("Error creating sink: %v", err)
+	}
+
+	day := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+	pvp := testPGCR("7", "84", day)
+	pvp.ActivityDetails.Modes = []json.Number{"84", "5"}
+	second := pvp.Entries[0]
+	second.Player.DestinyUserInfo.MembershipID = "4611686018400000000"
+	pvp.Entries = append(pvp.Entries, second)
+	for i := range pvp.Entries {
+		pvp.Entries[i].Values.TimePlayedSeconds = 600
+	}
+
+	if err := s.Write(context.Background(), []*bungie.PGCR{testPGCR("1", "4", day), pvp}); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Error closing: %v", err)
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(dir, "*.jsonl.zst"))
+	if len(matches) != 1 {
+		t.Fatalf("Expected one match log, got %v", matches)
+	}
+	logged, err := rating.ReadMatches(matches[0])
+	if err != nil {
+		t.Fatalf("Error reading matches: %v", err)
+	}
+	if len(logged) != 1 || logged[0].InstanceID != "7" || len(logged[0].Players) != 2 {
+		t.Fatalf("Expected only the PvP match, got %+v", logged)
+	}
+}
+
+func TestAnomalySinkSavesSketches(t *testing.T) {
+	dir := t.TempDir()
+	sketches := filepath.Join(dir, "sketches.json")
+	s, err := handler.OpenSink(context.Background(), "anomaly:dir="+filepath.Join(dir, "flags")+",sketches="+sketches)
+	if err != nil {
+		t.Fatalf("Error opening sink: %v", err)
+	}
+
+	day := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+	pgcr := testPGCR("1", "5", day)
+	for i := range pgcr.Entries {
+		pgcr.Entries[i].Values.TimePlayedSeconds = 900
+		pgcr.Entries[i].Values.ActivityDuration = 600
+	}
+	if err := s.Write(context.Background(), []*bungie.PGCR{pgcr}); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	staged := filepath.Join(dir, "staged.json")
+	if err := s.(*AnomalySink).Detector().SaveSketches(staged); err != nil {
+		t.Fatalf("Error saving sketches: %v", err)
+	}
+	if n := countSketches(t, staged); n != 0 {
+		t.Fatalf("Expected no values observed before the flush, got %d", n)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Error closing: %v", err)
+	}
+
+	if n := countSketches(t, sketches); n == 0 {
+		t.Fatalf("Expected the flushed values to be saved")
+	}
+	matches, _ := filepath.Glob(filepath.Join(dir, "flags", "*.jsonl.zst"))
+	if len(matches) != 1 {
+		t.Fatalf("Expected one flag log, got %v", matches)
+	}
+}
+
+// countSketches returns how many values the sketches saved at path hold.
+func countSketches(t *testing.T, path string) int64 {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Error reading sketches: %v", err)
+	}
+	var file struct {
+		Sketches []struct {
+			Sketch *anomaly.Sketch `json:"sketch"`
+		} `json:"sketches"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		t.Fatalf("Error decoding sketches: %v", err)
+	}
+	var n int64
+	for _, entry := range file.Sketches {
+		n += entry.Sketch.Count()
+	}
+	return n
+}
@@ -0,0 +1,24 @@
+package sink
+
+import (
+	"github.com/deahtstroke/protheon/internal/meta"
+)
+
+// MetaSink counts weapon usage and saves it at its path on every flush.
+// Meta saved by several minds is combined with meta.Meta.Merge.
+type MetaSink struct {
+	*aggregateSink[*meta.Meta]
+}
+
+func NewMetaSink(path string) (*MetaSink, error) {
+	s, err := openAggregateSink(path, meta.New, meta.Load)
+	if err != nil {
+		return nil, err
+	}
+	return &MetaSink{s}, nil
+}
+
+// Meta returns the weapon meta saved so far.
+func (s *MetaSink) Meta() *meta.Meta {
+	return s.current()
+}
@@ -0,0 +1,89 @@
+CREATE TABLE activities (
+    instance_id            INTEGER PRIMARY KEY,
+    period                 TEXT    NOT NULL,
+    archived               TEXT,
+    reference_id           INTEGER NOT NULL,
+    director_activity_hash INTEGER NOT NULL,
+    mode                   INTEGER NOT NULL,
+    modes                  TEXT    NOT NULL,
+    is_private             INTEGER NOT NULL,
+    membership_type        INTEGER NOT NULL,
+    starting_phase_index   INTEGER NOT NULL,
+    started_from_beginning INTEGER NOT NULL,
+    player_count           INTEGER NOT NULL,
+    duration_seconds       REAL    NOT NULL
+);
+
+CREATE INDEX activities_period ON activities (period);
+CREATE INDEX activities_mode_period ON activities (mode, period);
+CREATE INDEX activities_director_activity ON activities (director_activity_hash, period);
+
+CREATE TABLE players (
+    membership_id   INTEGER NOT NULL,
+    membership_type INTEGER NOT NULL,
+    display_name    TEXT    NOT NULL,
+    bungie_name     TEXT    NOT NULL,
+    last_seen       TEXT    NOT NULL,
+    PRIMARY KEY (membership_id, membership_type)
+);
+
+CREATE INDEX players_bungie_name ON players (bungie_name);
+
+CREATE TABLE characters (
+    character_id    INTEGER PRIMARY KEY,
+    membership_id   INTEGER NOT NULL,
+    membership_type INTEGER NOT NULL,
+    class_hash      INTEGER NOT NULL,
+    character_class TEXT    NOT NULL,
+    light_level     INTEGER NOT NULL,
+    last_seen       TEXT    NOT NULL,
+    FOREIGN KEY (membership_id, membership_type) REFERENCES players (membership_id, membership_type)
+);
+
+CREATE INDEX characters_player ON characters (membership_id, membership_type);
+
+CREATE TABLE entries (
+    instance_id          INTEGER NOT NULL REFERENCES activities (instance_id) ON DELETE CASCADE,
+    character_id         INTEGER NOT NULL,
+    membership_id        INTEGER NOT NULL,
+    membership_type      INTEGER NOT NULL,
+    light_level          INTEGER NOT NULL,
+    standing             INTEGER NOT NULL,
+    score                REAL    NOT NULL,
+    completed            INTEGER NOT NULL,
+    kills                REAL    NOT NULL,
+    deaths               REAL    NOT NULL,
+    assists              REAL    NOT NULL,
+    opponents_defeated   REAL    NOT NULL,
+    efficiency           REAL    NOT NULL,
+    kills_deaths_ratio   REAL    NOT NULL,
+    kills_deaths_assists REAL    NOT NULL,
+    time_played_seconds  REAL    NOT NULL,
+    start_seconds        REAL    NOT NULL,
+    fireteam_id          INTEGER NOT NULL,
+    team                 REAL    NOT NULL,
+    team_score           REAL    NOT NULL,
+    completion_reason    INTEGER NOT NULL,
+    precision_kills      REAL    NOT NULL,
+    weapon_kills_grenade REAL    NOT NULL,
+    weapon_kills_melee   REAL    NOT NULL,
+    weapon_kills_super   REAL    NOT NULL,
+    weapon_kills_ability REAL    NOT NULL,
+    PRIMARY KEY (instance_id, character_id)
+);
+
+CREATE INDEX entries_player ON entries (membership_id, membership_type);
+CREATE INDEX entries_character ON entries (character_id);
+CREATE INDEX entries_fireteam ON entries (instance_id, fireteam_id);
+
+CREATE TABLE weapon_stats (
+    instance_id         INTEGER NOT NULL,
+    character_id        INTEGER NOT NULL,
+    weapon_reference_id INTEGER NOT NULL,
+    kills               REAL    NOT NULL,
+    precision_kills     REAL    NOT NULL,
+    PRIMARY KEY (instance_id, character_id, weapon_reference_id),
+    FOREIGN KEY (instance_id, character_id) REFERENCES entries (instance_id, character_id) ON DELETE CASCADE
+);
+
+CREATE INDEX weapon_stats_weapon ON weapon_stats (weapon_reference_id);
@@ -0,0 +1,10 @@
+ALTER TABLE activities ADD COLUMN clear_kind  TEXT    NOT NULL DEFAULT '';
+ALTER TABLE activities ADD COLUMN full_clear  INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE activities ADD COLUMN checkpoint  INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE activities ADD COLUMN fresh       INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE activities ADD COLUMN lowman_size INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE activities ADD COLUMN solo        INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE activities ADD COLUMN flawless    INTEGER NOT NULL DEFAULT 0;
+
+CREATE INDEX activities_clears ON activities (director_activity_hash, clear_kind, lowman_size, flawless)
+    WHERE clear_kind != '';
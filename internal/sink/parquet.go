@@ -0,0 +1,442 @@
+package sink
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	bungie "github.com/deahtstroke/protheon/internal/bungie/types"
+	"github.com/deahtstroke/protheon/internal/logging"
+	"github.com/google/uuid"
+	"github.com/parquet-go/parquet-go"
+)
+
+const (
+	DEFAULT_ROW_GROUP_SIZE = 128 * 1024
+	DEFAULT_MAX_FILE_SIZE  = 256 * 1024 * 1024
+	DEFAULT_MAX_FILE_AGE   = 15 * time.Minute
+)
+
+type ParquetConfig struct {
+	Dir string
+
+	// RowGroupSize is the maximum number of rows per row group.
+	RowGroupSize int64
+
+	// MaxFileSize and MaxFileAge roll a partition's file once it grew past
+	// that many bytes or has been open that long. Size only counts finished
+	// row groups, so a file may overshoot by up to one row group.
+	MaxFileSize int64
+	MaxFileAge  time.Duration
+}
+
+// ParquetSink writes PGCRs to three Parquet tables, activities, entries and
+// weapons, under Dir. Files are partitioned Hive style by date and mode:
+//
+//	<Dir>/entries/date=2024-07-01/mode=4/part-<time>-<id>.parquet
+//
+// Files are written under a hidden temporary name and renamed into place once
+// their footer is written and synced, when they roll or the sink closes, so
+// readers never see a partial file. Parquet data is unreadable until then, so
+// Flush makes the rows written since the last flush durable in a write-ahead
+// log next to the file instead, and a sink opened after a crash rebuilds the
+// files of the logs it finds.
+type ParquetSink struct {
+	config ParquetConfig
+
+	mu         sync.Mutex
+	activities *parquetTable[ActivityRow]
+	entries    *parquetTable[EntryRow]
+	weapons    *parquetTable[WeaponRow]
+}
+
+func NewParquetSink(config ParquetConfig) (*ParquetSink, error) {
+	if config.Dir == "" {
+		return nil, errors.New("Parquet sink needs a directory")
+	}
+	if config.RowGroupSize <= 0 {
+		config.RowGroupSize = DEFAULT_ROW_GROUP_SIZE
+	}
+	if config.MaxFileSize <= 0 {
+		config.MaxFileSize = DEFAULT_MAX_FILE_SIZE
+	}
+	if config.MaxFileAge <= 0 {
+		config.MaxFileAge = DEFAULT_MAX_FILE_AGE
+	}
+
+	if err := os.MkdirAll(config.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("Error creating parquet directory [%s]: %v", config.Dir, err)
+	}
+
+	s := &ParquetSink{
+		config:     config,
+		activities: newParquetTable[ActivityRow]("activities", config),
+		entries:    newParquetTable[EntryRow]("entries", config),
+		weapons:    newParquetTable[WeaponRow]("weapons", config),
+	}
+	if err := errors.Join(s.activities.recover(), s.entries.recover(), s.weapons.recover()); err != nil {
+		return nil, err
+	}
+	if err := removeStaleParts(config.Dir); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *ParquetSink) Write(ctx context.Context, pgcrs []*bungie.PGCR) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, pgcr := range pgcrs {
+		rows := Flatten(pgcr)
+		partition := partitionOf(pgcr.Period, rows.Activity.Mode)
+
+		if err := s.activities.write(partition, []ActivityRow{rows.Activity}); err != nil {
+			return err
+		}
+		if err := s.entries.write(partition, rows.Entries); err != nil {
+			return err
+		}
+		if err := s.weapons.write(partition, rows.Weapons); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush appends the rows written since the last flush to the write-ahead
+// logs of their files, so they are durable once Flush returns. They become
+// visible to readers once their file is finalized.
+func (s *ParquetSink) Flush(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return errors.Join(s.activities.checkpointAll(), s.entries.checkpointAll(), s.weapons.checkpointAll())
+}
+
+// Close finalizes every open file.
+func (s *ParquetSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return errors.Join(s.activities.finalizeAll(), s.entries.finalizeAll(), s.weapons.finalizeAll())
+}
+
+func partitionOf(period time.Time, mode int32) string {
+	return fmt.Sprintf("date=%s/mode=%d", period.UTC().Format(time.DateOnly), mode)
+}
+
+// removeStaleParts deletes temporary files left behind by a crash, once what
+// was flushed to them has been recovered. The rest of their rows were never
+// acknowledged, so they will be delivered again.
+func removeStaleParts(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && strings.HasPrefix(d.Name(), ".part-") && (strings.HasSuffix(d.Name(), ".tmp") || strings.HasSuffix(d.Name(), WAL_SUFFIX) || strings.HasSuffix(d.Name(), FLUSHED_SUFFIX)) {
+			logging.Component("sink").Info("Removing unfinished file", logging.KeyFile, path)
+			return os.Remove(path)
+		}
+		return nil
+	})
+}
+
+type parquetTable[T any] struct {
+	name   string
+	config ParquetConfig
+	files  map[string]*parquetFile[T]
+}
+
+func newParquetTable[T any](name string, config ParquetConfig) *parquetTable[T] {
+	return &parquetTable[T]{
+		name:   name,
+		config: config,
+		files:  make(map[string]*parquetFile[T]),
+	}
+}
+
+func (t *parquetTable[T]) write(partition string, rows []T) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	file, ok := t.files[partition]
+	if ok && (file.size() >= t.config.MaxFileSize || time.Since(file.opened) >= t.config.MaxFileAge) {
+		delete(t.files, partition)
+		if err := file.finalize(); err != nil {
+			return err
+		}
+		ok = false
+	}
+	if !ok {
+		var err error
+		file, err = openParquetFile[T](filepath.Join(t.config.Dir, t.name, partition), t.config.RowGroupSize)
+		if err != nil {
+			return err
+		}
+		t.files[partition] = file
+	}
+
+	if _, err := file.writer.Write(rows); err != nil {
+		return fmt.Errorf("Error writing %s rows to [%s]: %v", t.name, file.tmpPath, err)
+	}
+	file.pending = append(file.pending, rows...)
+	return nil
+}
+
+func (t *parquetTable[T]) checkpointAll() error {
+	var errs []error
+	for _, file := range t.files {
+		if err := file.checkpoint(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// recover rebuilds the files of the write-ahead logs a crash left behind,
+// from the rows flushed to them. A log whose file was finalized is only
+// removed.
+func (t *parquetTable[T]) recover() error {
+	root := filepath.Join(t.config.Dir, t.name)
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && path == root {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasPrefix(d.Name(), ".part-") || !strings.HasSuffix(d.Name(), WAL_SUFFIX) {
+			return nil
+		}
+
+		final := filepath.Join(filepath.Dir(path), strings.TrimSuffix(strings.TrimPrefix(d.Name(), "."), WAL_SUFFIX))
+		if _, err := os.Stat(final); err == nil {
+			return os.Remove(path)
+		}
+		rows, err := readWAL[T](path)
+		if err != nil {
+			return err
+		}
+		file, err := createParquetFile[T](final, t.config.RowGroupSize)
+		if err != nil {
+			return err
+		}
+		if _, err := file.writer.Write(rows); err != nil {
+			file.file.Close()
+			return fmt.Errorf("Error writing %s rows to [%s]: %v", t.name, file.tmpPath, err)
+		}
+		if err := file.finalize(); err != nil {
+			return err
+		}
+		logging.Component("sink").Info("Recovered flushed rows", logging.KeyFile, final, "rows", len(rows))
+		return nil
+	})
+}
+
+func (t *parquetTable[T]) finalizeAll() error {
+	var errs []error
+	for partition, file := range t.files {
+		delete(t.files, partition)
+		if err := file.finalize(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// WAL_SUFFIX ends the name of the write-ahead log of a parquet file being
+// written, .<name>.wal, which holds the file's flushed rows as JSON lines.
+const WAL_SUFFIX = ".wal"
+
+type parquetFile[T any] struct {
+	path    string
+	tmpPath string
+	file    *os.File
+	counter *countingWriter
+	writer  *parquet.GenericWriter[T]
+	opened  time.Time
+
+	// pending holds the rows written since the last checkpoint, which are
+	// appended to the write-ahead log at walPath.
+	pending []T
+	walPath string
+	wal     *os.File
+	walSize int64
+}
+
+func openParquetFile[T any](dir string, rowGroupSize int64) (*parquetFile[T], error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("Error creating partition [%s]: %v", dir, err)
+	}
+
+	name := fmt.Sprintf("part-%s-%s.parquet", time.Now().UTC().Format("20060102T150405"), uuid.New().String())
+	return createParquetFile[T](filepath.Join(dir, name), rowGroupSize)
+}
+
+func createParquetFile[T any](path string, rowGroupSize int64) (*parquetFile[T], error) {
+	dir, name := filepath.Split(path)
+	tmpPath := filepath.Join(dir, "."+name+".tmp")
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating parquet file [%s]: %v", tmpPath, err)
+	}
+
+	counter := &countingWriter{buffer: bufio.NewWriterSize(file, 1024*1024)}
+	return &parquetFile[T]{
+		path:    path,
+		walPath: filepath.Join(dir, "."+name+WAL_SUFFIX),
+		tmpPath: tmpPath,
+		file:    file,
+		counter: counter,
+		writer: parquet.NewGenericWriter[T](counter,
+			parquet.MaxRowsPerRowGroup(rowGroupSize),
+			parquet.Compression(&parquet.Zstd),
+			// Buffering happens in the counter, so size() sees every
+			// finished row group.
+			parquet.WriteBufferSize(0)),
+		opened: time.Now(),
+	}, nil
+}
+
+// checkpoint appends the pending rows to the write-ahead log and syncs it. A
+// batch written only in part is cut off again, so it can't run into the next
+// one.
+func (f *parquetFile[T]) checkpoint() error {
+	if len(f.pending) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, row := range f.pending {
+		if err := encoder.Encode(row); err != nil {
+			return fmt.Errorf("Error encoding rows for [%s]: %v", f.walPath, err)
+		}
+	}
+
+	if f.wal == nil {
+		wal, err := os.OpenFile(f.walPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return fmt.Errorf("Error creating write-ahead log [%s]: %v", f.walPath, err)
+		}
+		f.wal = wal
+		if err := syncDir(filepath.Dir(f.walPath)); err != nil {
+			return err
+		}
+	}
+	if _, err := f.wal.Write(buf.Bytes()); err != nil {
+		f.wal.Truncate(f.walSize)
+		return fmt.Errorf("Error writing write-ahead log [%s]: %v", f.walPath, err)
+	}
+	if err := f.wal.Sync(); err != nil {
+		f.wal.Truncate(f.walSize)
+		return fmt.Errorf("Error syncing write-ahead log [%s]: %v", f.walPath, err)
+	}
+	f.walSize += int64(buf.Len())
+	f.pending = nil
+	return nil
+}
+
+// readWAL reads the rows of a write-ahead log. A line cut short by a crash
+// is skipped.
+func readWAL[T any](path string) ([]T, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading write-ahead log [%s]: %v", path, err)
+	}
+	defer file.Close()
+
+	var rows []T
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var row T
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			logging.Component("sink").Warn("Skipping unreadable write-ahead log line", logging.KeyFile, path, "error", err)
+			continue
+		}
+		rows = append(rows, row)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading write-ahead log [%s]: %v", path, err)
+	}
+	return rows, nil
+}
+
+func (f *parquetFile[T]) size() int64 {
+	return f.counter.written
+}
+
+// finalize writes the footer and renames the file into place. Its rows are
+// all in the file then, so the write-ahead log is removed.
+func (f *parquetFile[T]) finalize() error {
+	if f.wal != nil {
+		defer func() {
+			f.wal.Close()
+			f.wal = nil
+		}()
+	}
+	if err := f.writer.Close(); err != nil {
+		f.file.Close()
+		return fmt.Errorf("Error writing parquet footer [%s]: %v", f.tmpPath, err)
+	}
+	if err := f.counter.buffer.Flush(); err != nil {
+		f.file.Close()
+		return fmt.Errorf("Error writing parquet file [%s]: %v", f.tmpPath, err)
+	}
+	if err := f.file.Sync(); err != nil {
+		f.file.Close()
+		return fmt.Errorf("Error syncing parquet file [%s]: %v", f.tmpPath, err)
+	}
+	if err := f.file.Close(); err != nil {
+		return fmt.Errorf("Error closing parquet file [%s]: %v", f.tmpPath, err)
+	}
+	if err := os.Rename(f.tmpPath, f.path); err != nil {
+		return fmt.Errorf("Error finalizing parquet file [%s]: %v", f.path, err)
+	}
+	if err := syncDir(filepath.Dir(f.path)); err != nil {
+		return err
+	}
+	if f.wal != nil {
+		if err := os.Remove(f.walPath); err != nil {
+			logging.Component("sink").Warn("Error removing write-ahead log", logging.KeyFile, f.walPath, "error", err)
+		}
+	}
+	f.pending = nil
+	return nil
+}
+
+type countingWriter struct {
+	buffer  *bufio.Writer
+	written int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.buffer.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	// Some platforms can't sync directories, the rename is still atomic there.
+	if err := d.Sync(); err != nil && !errors.Is(err, os.ErrInvalid) {
+		logging.Component("sink").Warn("Error syncing directory", "dir", dir, "error", err)
+	}
+	return nil
+}
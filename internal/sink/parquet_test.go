@@ -0,0 +1,228 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	bungie "github.com/deahtstroke/protheon/internal/bungie/types"
+	"github.com/parquet-go/parquet-go"
+)
+
+func testPGCR(instanceID string, mode string, period time.Time) *bungie.PGCR {
+	return &bungie.PGCR{
+		Period: period,
+		ActivityDetails: bungie.ActivityDetails{
+			InstanceID: json.Number(instanceID),
+			Mode:       json.Number(mode),
+			Modes:      []json.Number{json.Number(mode), "7"},
+		},
+		Entries: []bungie.Entry{
+			{
+				Player: bungie.Player{
+					DestinyUserInfo: bungie.DestinyUserInfo{
+						MembershipID:                "4611686018467284386",
+						MembershipType:              3,
+						BungieGlobalDisplayName:     "Guardian",
+						BungieGlobalDisplayNameCode: 1234,
+					},
+				},
+				CharacterID: "2305843009301648414",
+				Values:      bungie.Values{Kills: 10, Completed: 1, ActivityDuration: 1800},
+				Extended: bungie.Extended{
+					Weapons: []bungie.Weapon{
+						{ReferenceID: "1363886209", Values: bungie.WeaponValues{UniqueWeaponKills: 8, UniqueWeaponPrecisionKills: 6}},
+					},
+				},
+			},
+		},
+	}
+}
+
+func partFiles(t *testing.T, dir string) (final []string, tmp []string) {
+	t.Helper()
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), ".") {
+			tmp = append(tmp, path)
+		} else {
+			final = append(final, path)
+		}
+		return nil
+	})
+	return final, tmp
+}
+
+func TestParquetSinkWritesPartitionedTables(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := NewParquetSink(ParquetConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("Error creating sink: %v", err)
+	}
+
+	day := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+	pgcrs := []*bungie.PGCR{
+		testPGCR("1", "4", day),
+		testPGCR("2", "4", day),
+		testPGCR("3", "5", day.Add(24*time.Hour)),
+	}
+	if err := sink.Write(context.Background(), pgcrs); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+
+	if err := sink.Flush(context.Background()); err != nil {
+		t.Fatalf("Error flushing: %v", err)
+	}
+	if final, _ := partFiles(t, dir); len(final) != 0 {
+		t.Fatalf("Expected no visible files before close, got %v", final)
+	}
+
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Error closing: %v", err)
+	}
+
+	final, tmp := partFiles(t, dir)
+	if len(tmp) != 0 {
+		t.Fatalf("Expected no temporary files after close, got %v", tmp)
+	}
+	// Three tables over two partitions.
+	if len(final) != 6 {
+		t.Fatalf("Expected 6 parquet files, got %v", final)
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(dir, "entries", "date=2024-07-01", "mode=4", "*.parquet"))
+	if len(matches) != 1 {
+		t.Fatalf("Expected one entries file for the raid partition, got %v", matches)
+	}
+	entries, err := parquet.ReadFile[EntryRow](matches[0])
+	if err != nil {
+		t.Fatalf("Error reading entries: %v", err)
+	}
+	if len(entries) != 2 || entries[0].BungieName != "Guardian#1234" || !entries[0].Completed {
+		t.Fatalf("Unexpected entries: %+v", entries)
+	}
+
+	matches, _ = filepath.Glob(filepath.Join(dir, "weapons", "date=2024-07-01", "mode=4", "*.parquet"))
+	weapons, err := parquet.ReadFile[WeaponRow](matches[0])
+	if err != nil {
+		t.Fatalf("Error reading weapons: %v", err)
+	}
+	if len(weapons) != 2 || weapons[0].WeaponReferenceID != 1363886209 || weapons[0].PrecisionRatio != 0.75 {
+		t.Fatalf("Unexpected weapons: %+v", weapons)
+	}
+}
+
+func TestParquetSinkRollsAndCleansUp(t *testing.T) {
+	dir := t.TempDir()
+	stale := filepath.Join(dir, "entries", "date=2024-07-01", "mode=4", ".part-crashed.parquet.tmp")
+	os.MkdirAll(filepath.Dir(stale), 0o755)
+	os.WriteFile(stale, []byte("partial"), 0o644)
+
+	sink, err := NewParquetSink(ParquetConfig{Dir: dir, RowGroupSize: 1, MaxFileSize: 1})
+	if err != nil {
+		t.Fatalf("Error creating sink: %v", err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatal("Expected stale temporary file to be removed")
+	}
+
+	day := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+	for _, id := range []string{"1", "2", "3"} {
+		if err := sink.Write(context.Background(), []*bungie.PGCR{testPGCR(id, "4", day)}); err != nil {
+			t.Fatalf("Error writing: %v", err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Error closing: %v", err)
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(dir, "activities", "date=2024-07-01", "mode=4", "*.parquet"))
+	if len(matches) < 2 {
+		t.Fatalf("Expected files to roll by size, got %v", matches)
+	}
+}
+
+func TestParquetSinkFlushesIntoOneFile(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := NewParquetSink(ParquetConfig{Dir: dir, MaxFileSize: 1 << 30})
+	if err != nil {
+		t.Fatalf("Error creating sink: %v", err)
+	}
+
+	day := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+	for _, id := range []string{"1", "2"} {
+		if err := sink.Write(context.Background(), []*bungie.PGCR{testPGCR(id, "4", day)}); err != nil {
+			t.Fatalf("Error writing: %v", err)
+		}
+		if err := sink.Flush(context.Background()); err != nil {
+			t.Fatalf("Error flushing: %v", err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Error closing: %v", err)
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(dir, "activities", "date=2024-07-01", "mode=4", "*.parquet"))
+	if len(matches) != 1 {
+		t.Fatalf("Expected both flushes in one file, got %v", matches)
+	}
+	activities, err := parquet.ReadFile[ActivityRow](matches[0])
+	if err != nil {
+		t.Fatalf("Error reading activities: %v", err)
+	}
+	if len(activities) != 2 {
+		t.Fatalf("Expected 2 activities, got %+v", activities)
+	}
+	if _, tmp := partFiles(t, dir); len(tmp) != 0 {
+		t.Fatalf("Expected no temporary files after close, got %v", tmp)
+	}
+}
+
+func TestParquetSinkRecoversFlushedRows(t *testing.T) {
+	dir := t.TempDir()
+	crashed, err := NewParquetSink(ParquetConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("Error creating sink: %v", err)
+	}
+
+	day := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+	if err := crashed.Write(context.Background(), []*bungie.PGCR{testPGCR("1", "4", day)}); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	if err := crashed.Flush(context.Background()); err != nil {
+		t.Fatalf("Error flushing: %v", err)
+	}
+	// Never flushed, so delivered again after the crash.
+	if err := crashed.Write(context.Background(), []*bungie.PGCR{testPGCR("2", "4", day)}); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+
+	// The sink is never closed, as if the mind crashed.
+	sink, err := NewParquetSink(ParquetConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("Error reopening sink: %v", err)
+	}
+	defer sink.Close()
+
+	final, tmp := partFiles(t, dir)
+	if len(tmp) != 0 {
+		t.Fatalf("Expected temporary files to be cleaned up, got %v", tmp)
+	}
+	if len(final) != 3 {
+		t.Fatalf("Expected one recovered file per table, got %v", final)
+	}
+	matches, _ := filepath.Glob(filepath.Join(dir, "activities", "date=2024-07-01", "mode=4", "*.parquet"))
+	activities, err := parquet.ReadFile[ActivityRow](matches[0])
+	if err != nil {
+		t.Fatalf("Error reading activities: %v", err)
+	}
+	if len(activities) != 1 || activities[0].InstanceID != 1 || !activities[0].Period.Equal(day) {
+		t.Fatalf("Expected the flushed activity only, got %+v", activities)
+	}
+}
@@ -0,0 +1,40 @@
+package sink
+
+import (
+	"context"
+
+	bungie "github.com/deahtstroke/protheon/internal/bungie/types"
+	"github.com/deahtstroke/protheon/internal/rating"
+)
+
+// RatingSink logs the PvP matches among the PGCRs it is given, as zstd
+// compressed JSONL files like the JSONL sink. Ratings depend on the order
+// matches were played in, so they are computed from these logs by replaying
+// them in time order with a rating.Engine, rather than by the minds.
+type RatingSink struct {
+	*JSONLSink
+}
+
+func NewRatingSink(config JSONLConfig) (*RatingSink, error) {
+	s, err := NewJSONLSink(config)
+	if err != nil {
+		return nil, err
+	}
+	return &RatingSink{s}, nil
+}
+
+func (s *RatingSink) Write(ctx context.Context, pgcrs []*bungie.PGCR) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, pgcr := range pgcrs {
+		match, ok := rating.FromPGCR(pgcr)
+		if !ok {
+			continue
+		}
+		if err := s.write(match.InstanceID, match); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package sink
+
+import (
+	"context"
+	"os"
+
+	"github.com/deahtstroke/protheon/internal/handler"
+)
+
+// The sinks in this package register themselves with the handler's sink
+// registry, so importing the package makes them available to OpenSink.
+func init() {
+	handler.RegisterSink("parquet", openParquet)
+	handler.RegisterSink("sqlite", openSQLite)
+	handler.RegisterSink("jsonl", openJSONL)
+	handler.RegisterSink("stdout", openStdout)
+	handler.RegisterSink("career", openCareer)
+	handler.RegisterSink("graph", openGraph)
+	handler.RegisterSink("meta", openMeta)
+	handler.RegisterSink("rating", openRating)
+	handler.RegisterSink("anomaly", openAnomaly)
+}
+
+func openParquet(ctx context.Context, options handler.SinkOptions) (handler.Sink, error) {
+	if err := options.Only("dir", "row-group-size", "max-file-size", "max-file-age"); err != nil {
+		return nil, err
+	}
+	rowGroupSize, err := options.Int64("row-group-size", DEFAULT_ROW_GROUP_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	maxFileSize, err := options.Int64("max-file-size", DEFAULT_MAX_FILE_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	maxFileAge, err := options.Duration("max-file-age", DEFAULT_MAX_FILE_AGE)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewParquetSink(ParquetConfig{
+		Dir:          options["dir"],
+		RowGroupSize: rowGroupSize,
+		MaxFileSize:  maxFileSize,
+		MaxFileAge:   maxFileAge,
+	})
+}
+
+func openSQLite(ctx context.Context, options handler.SinkOptions) (handler.Sink, error) {
+	if err := options.Only("path", "batch-size"); err != nil {
+		return nil, err
+	}
+	batchSize, err := options.Int64("batch-size", DEFAULT_BATCH_SIZE)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewSQLiteSink(ctx, SQLiteConfig{
+		Path:      options["path"],
+		BatchSize: int(batchSize),
+	})
+}
+
+func jsonlConfig(options handler.SinkOptions) (JSONLConfig, error) {
+	if err := options.Only("dir", "max-file-size", "max-file-age"); err != nil {
+		return JSONLConfig{}, err
+	}
+	maxFileSize, err := options.Int64("max-file-size", DEFAULT_MAX_FILE_SIZE)
+	if err != nil {
+		return JSONLConfig{}, err
+	}
+	maxFileAge, err := options.Duration("max-file-age", DEFAULT_MAX_FILE_AGE)
+	if err != nil {
+		return JSONLConfig{}, err
+	}
+
+	return JSONLConfig{
+		Dir:         options["dir"],
+		MaxFileSize: maxFileSize,
+		MaxFileAge:  maxFileAge,
+	}, nil
+}
+
+func openJSONL(ctx context.Context, options handler.SinkOptions) (handler.Sink, error) {
+	config, err := jsonlConfig(options)
+	if err != nil {
+		return nil, err
+	}
+	return NewJSONLSink(config)
+}
+
+func openStdout(ctx context.Context, options handler.SinkOptions) (handler.Sink, error) {
+	if err := options.Only(); err != nil {
+		return nil, err
+	}
+	return NewStdoutSink(os.Stdout), nil
+}
+
+func openCareer(ctx context.Context, options handler.SinkOptions) (handler.Sink, error) {
+	if err := options.Only("path"); err != nil {
+		return nil, err
+	}
+	return NewCareerSink(options["path"])
+}
+
+func openGraph(ctx context.Context, options handler.SinkOptions) (handler.Sink, error) {
+	if err := options.Only("path"); err != nil {
+		return nil, err
+	}
+	return NewGraphSink(options["path"])
+}
+
+func openMeta(ctx context.Context, options handler.SinkOptions) (handler.Sink, error) {
+	if err := options.Only("path"); err != nil {
+		return nil, err
+	}
+	return NewMetaSink(options["path"])
+}
+
+func openRating(ctx context.Context, options handler.SinkOptions) (handler.Sink, error) {
+	config, err := jsonlConfig(options)
+	if err != nil {
+		return nil, err
+	}
+	return NewRatingSink(config)
+}
+
+func openAnomaly(ctx context.Context, options handler.SinkOptions) (handler.Sink, error) {
+	jsonlOptions := make(handler.SinkOptions, len(options))
+	for key, value := range options {
+		if key != "sketches" && key != "min-clears" {
+			jsonlOptions[key] = value
+		}
+	}
+	config, err := jsonlConfig(jsonlOptions)
+	if err != nil {
+		return nil, err
+	}
+	return NewAnomalySink(config, options["sketches"], options["min-clears"])
+}
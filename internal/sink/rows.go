@@ -0,0 +1,221 @@
+package sink
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	bungie "github.com/deahtstroke/protheon/internal/bungie/types"
+	"github.com/deahtstroke/protheon/internal/clears"
+)
+
+// ActivityRow is one PGCR flattened into a row, without its entries.
+type ActivityRow struct {
+	InstanceID           int64     `parquet:"instance_id"`
+	Period               time.Time `parquet:"period,timestamp(millisecond)"`
+	Archived             time.Time `parquet:"archived,timestamp(millisecond)"`
+	ReferenceID          int64     `parquet:"reference_id"`
+	DirectorActivityHash int64     `parquet:"director_activity_hash"`
+	Mode                 int32     `parquet:"mode"`
+	Modes                []int32   `parquet:"modes,list"`
+	IsPrivate            bool      `parquet:"is_private"`
+	MembershipType       int32     `parquet:"membership_type"`
+	StartingPhaseIndex   int32     `parquet:"starting_phase_index"`
+	StartedFromBeginning bool      `parquet:"started_from_beginning"`
+	PlayerCount          int32     `parquet:"player_count"`
+	DurationSeconds      float64   `parquet:"duration_seconds"`
+
+	// Raid and dungeon clear classification, see clears.Classify. Empty for
+	// other activities.
+	ClearKind  string `parquet:"clear_kind"`
+	FullClear  bool   `parquet:"full_clear"`
+	Checkpoint bool   `parquet:"checkpoint"`
+	Fresh      bool   `parquet:"fresh"`
+	LowmanSize int32  `parquet:"lowman_size"`
+	Solo       bool   `parquet:"solo"`
+	Flawless   bool   `parquet:"flawless"`
+}
+
+// EntryRow is one player in one activity, with the player's identity, basic
+// values and extended values side by side.
+type EntryRow struct {
+	InstanceID         int64     `parquet:"instance_id"`
+	Period             time.Time `parquet:"period,timestamp(millisecond)"`
+	Mode               int32     `parquet:"mode"`
+	MembershipID       int64     `parquet:"membership_id"`
+	MembershipType     int32     `parquet:"membership_type"`
+	DisplayName        string    `parquet:"display_name"`
+	BungieName         string    `parquet:"bungie_name"`
+	CharacterID        int64     `parquet:"character_id"`
+	CharacterClass     string    `parquet:"character_class"`
+	ClassHash          int64     `parquet:"class_hash"`
+	LightLevel         int32     `parquet:"light_level"`
+	Standing           int32     `parquet:"standing"`
+	Score              float64   `parquet:"score"`
+	Completed          bool      `parquet:"completed"`
+	Kills              float64   `parquet:"kills"`
+	Deaths             float64   `parquet:"deaths"`
+	Assists            float64   `parquet:"assists"`
+	OpponentsDefeated  float64   `parquet:"opponents_defeated"`
+	Efficiency         float64   `parquet:"efficiency"`
+	KD                 float64   `parquet:"kills_deaths_ratio"`
+	KDA                float64   `parquet:"kills_deaths_assists"`
+	TimePlayedSeconds  float64   `parquet:"time_played_seconds"`
+	StartSeconds       float64   `parquet:"start_seconds"`
+	FireteamID         int64     `parquet:"fireteam_id"`
+	Team               float64   `parquet:"team"`
+	TeamScore          float64   `parquet:"team_score"`
+	CompletionReason   int32     `parquet:"completion_reason"`
+	PrecisionKills     float64   `parquet:"precision_kills"`
+	WeaponKillsGrenade float64   `parquet:"weapon_kills_grenade"`
+	WeaponKillsMelee   float64   `parquet:"weapon_kills_melee"`
+	WeaponKillsSuper   float64   `parquet:"weapon_kills_super"`
+	WeaponKillsAbility float64   `parquet:"weapon_kills_ability"`
+}
+
+// WeaponRow is one weapon used by one player in one activity.
+type WeaponRow struct {
+	InstanceID        int64     `parquet:"instance_id"`
+	Period            time.Time `parquet:"period,timestamp(millisecond)"`
+	Mode              int32     `parquet:"mode"`
+	MembershipID      int64     `parquet:"membership_id"`
+	CharacterID       int64     `parquet:"character_id"`
+	WeaponReferenceID int64     `parquet:"weapon_reference_id"`
+	Kills             float64   `parquet:"kills"`
+	PrecisionKills    float64   `parquet:"precision_kills"`
+	PrecisionRatio    float64   `parquet:"precision_ratio"`
+}
+
+// Rows is a PGCR flattened into the activity, entry and weapon tables.
+type Rows struct {
+	Activity ActivityRow
+	Entries  []EntryRow
+	Weapons  []WeaponRow
+}
+
+func Flatten(pgcr *bungie.PGCR) Rows {
+	details := pgcr.ActivityDetails
+	instanceID := number(details.InstanceID)
+	mode := int32(number(details.Mode))
+
+	modes := make([]int32, 0, len(details.Modes))
+	for _, m := range details.Modes {
+		modes = append(modes, int32(number(m)))
+	}
+
+	rows := Rows{
+		Activity: ActivityRow{
+			InstanceID:           instanceID,
+			Period:               pgcr.Period,
+			Archived:             pgcr.Archived,
+			ReferenceID:          number(details.ReferenceID),
+			DirectorActivityHash: number(details.DirectorActivityHash),
+			Mode:                 mode,
+			Modes:                modes,
+			IsPrivate:            details.IsPrivate,
+			MembershipType:       int32(number(details.MembershipType)),
+			StartingPhaseIndex:   int32(number(pgcr.StartingPhaseIndex)),
+			StartedFromBeginning: pgcr.ActivityWasStartedFromBeginning,
+			PlayerCount:          int32(len(pgcr.Entries)),
+		},
+	}
+
+	if c, ok := clears.Classify(pgcr); ok {
+		rows.Activity.ClearKind = string(c.Kind)
+		rows.Activity.FullClear = c.FullClear
+		rows.Activity.Checkpoint = c.Checkpoint
+		rows.Activity.Fresh = c.Fresh
+		if c.Lowman {
+			rows.Activity.LowmanSize = int32(c.Players)
+		}
+		rows.Activity.Solo = c.Solo
+		rows.Activity.Flawless = c.Flawless
+	}
+
+	for _, entry := range pgcr.Entries {
+		user := entry.Player.DestinyUserInfo
+		membershipID := number(user.MembershipID)
+		characterID := parseInt(entry.CharacterID)
+		values := entry.Values
+		extended := entry.Extended.Values
+
+		if values.ActivityDuration > rows.Activity.DurationSeconds {
+			rows.Activity.DurationSeconds = values.ActivityDuration
+		}
+
+		rows.Entries = append(rows.Entries, EntryRow{
+			InstanceID:         instanceID,
+			Period:             pgcr.Period,
+			Mode:               mode,
+			MembershipID:       membershipID,
+			MembershipType:     int32(user.MembershipType),
+			DisplayName:        user.DisplayName,
+			BungieName:         user.BungieName(),
+			CharacterID:        characterID,
+			CharacterClass:     entry.Player.CharacterClass,
+			ClassHash:          int64(entry.Player.ClassHash),
+			LightLevel:         int32(entry.Player.LightLevel),
+			Standing:           int32(entry.Standing),
+			Score:              values.Score,
+			Completed:          values.Completed == 1,
+			Kills:              values.Kills,
+			Deaths:             values.Deaths,
+			Assists:            values.Assists,
+			OpponentsDefeated:  values.OpponentsDefeated,
+			Efficiency:         values.Efficiency,
+			KD:                 values.KD,
+			KDA:                values.KDA,
+			TimePlayedSeconds:  values.TimePlayedSeconds,
+			StartSeconds:       values.StartSeconds,
+			FireteamID:         int64(values.FireteamID),
+			Team:               values.Team,
+			TeamScore:          values.TeamScore,
+			CompletionReason:   int32(values.CompletionReason),
+			PrecisionKills:     extended.PrecisionKills,
+			WeaponKillsGrenade: extended.WeaponKillsGrenade,
+			WeaponKillsMelee:   extended.WeaponKillsMelee,
+			WeaponKillsSuper:   extended.WeaponKillsSuper,
+			WeaponKillsAbility: extended.WeaponKillsAbility,
+		})
+
+		for _, weapon := range entry.Extended.Weapons {
+			kills := weapon.Values.UniqueWeaponKills
+			precision := weapon.Values.UniqueWeaponPrecisionKills
+			var ratio float64
+			if kills > 0 {
+				ratio = precision / kills
+			}
+			rows.Weapons = append(rows.Weapons, WeaponRow{
+				InstanceID:        instanceID,
+				Period:            pgcr.Period,
+				Mode:              mode,
+				MembershipID:      membershipID,
+				CharacterID:       characterID,
+				WeaponReferenceID: number(weapon.ReferenceID),
+				Kills:             kills,
+				PrecisionKills:    precision,
+				PrecisionRatio:    ratio,
+			})
+		}
+	}
+
+	return rows
+}
+
+func number(n json.Number) int64 {
+	return parseInt(n.String())
+}
+
+// parseInt parses IDs and hashes, which Bungie sends as unsigned 64 bit
+// values. Values above the int64 range wrap around, the same way Parquet and
+// SQLite readers reinterpret them.
+func parseInt(s string) int64 {
+	if s == "" {
+		return 0
+	}
+	if n, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return int64(n)
+	}
+	n, _ := strconv.ParseInt(s, 10, 64)
+	return n
+}
@@ -0,0 +1,335 @@
+package sink
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bungie "github.com/deahtstroke/protheon/internal/bungie/types"
+	"github.com/deahtstroke/protheon/internal/logging"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	DEFAULT_BATCH_SIZE = 500
+)
+
+//go:embed migrations/sqlite/*.sql
+var sqliteMigrations embed.FS
+
+type SQLiteConfig struct {
+	Path string
+
+	// BatchSize is how many PGCRs are buffered before they are written in a
+	// single transaction. Flush writes whatever is buffered.
+	BatchSize int
+}
+
+// SQLiteSink stores PGCRs in normalized activities, players, characters,
+// entries and weapon_stats tables of an embedded SQLite database. Writing a
+// PGCR whose instance ID is already stored replaces it, so replays are
+// idempotent. A PGCR the database refuses is logged and dropped.
+type SQLiteSink struct {
+	config SQLiteConfig
+	db     *sql.DB
+
+	mu      sync.Mutex
+	pending []*bungie.PGCR
+}
+
+func NewSQLiteSink(ctx context.Context, config SQLiteConfig) (*SQLiteSink, error) {
+	if config.Path == "" {
+		return nil, errors.New("SQLite sink needs a database path")
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = DEFAULT_BATCH_SIZE
+	}
+
+	dsn := "file:" + config.Path +
+		"?_pragma=foreign_keys(1)&_pragma=journal_mode(WAL)&_pragma=synchronous(FULL)&_pragma=busy_timeout(5000)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening SQLite database [%s]: %v", config.Path, err)
+	}
+	// A single connection serializes writers, which SQLite would do anyway.
+	db.SetMaxOpenConns(1)
+
+	if err := migrate(ctx, db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Error migrating SQLite database [%s]: %w", config.Path, err)
+	}
+
+	return &SQLiteSink{
+		config: config,
+		db:     db,
+	}, nil
+}
+
+// DB exposes the underlying database for queries.
+func (s *SQLiteSink) DB() *sql.DB {
+	return s.db
+}
+
+func (s *SQLiteSink) Write(ctx context.Context, pgcrs []*bungie.PGCR) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pending = append(s.pending, pgcrs...)
+	if len(s.pending) < s.config.BatchSize {
+		return nil
+	}
+	return s.flush(ctx)
+}
+
+func (s *SQLiteSink) Flush(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.flush(ctx)
+}
+
+func (s *SQLiteSink) Close() error {
+	err := s.Flush(context.Background())
+	return errors.Join(err, s.db.Close())
+}
+
+// flush writes the pending PGCRs in a single transaction. Each PGCR is
+// written within its own savepoint, so that one the database refuses, which
+// would fail every later flush too, is dropped instead of holding back the
+// others.
+func (s *SQLiteSink) flush(ctx context.Context) error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("Error starting SQLite transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	stmts, err := prepareStatements(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	for _, pgcr := range s.pending {
+		err := upsertIsolated(ctx, tx, stmts, pgcr)
+		if ctx.Err() != nil {
+			return fmt.Errorf("Error storing PGCR [%s]: %v", pgcr.ActivityDetails.InstanceID, ctx.Err())
+		}
+		if err != nil {
+			logging.Component("sink").Error("Dropping PGCR the database refused", logging.KeyInstanceID, pgcr.ActivityDetails.InstanceID.String(), "error", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("Error committing SQLite transaction: %v", err)
+	}
+	s.pending = s.pending[:0]
+	return nil
+}
+
+// upsertIsolated writes a PGCR within a savepoint, and rolls the PGCR back
+// if any of its rows fails.
+func upsertIsolated(ctx context.Context, tx *sql.Tx, stmts *statements, pgcr *bungie.PGCR) error {
+	if _, err := tx.ExecContext(ctx, "SAVEPOINT pgcr"); err != nil {
+		return err
+	}
+	if err := stmts.upsert(ctx, pgcr); err != nil {
+		if _, rerr := tx.ExecContext(ctx, "ROLLBACK TO pgcr"); rerr != nil {
+			return errors.Join(err, rerr)
+		}
+		tx.ExecContext(ctx, "RELEASE pgcr")
+		return err
+	}
+	_, err := tx.ExecContext(ctx, "RELEASE pgcr")
+	return err
+}
+
+type statements struct {
+	activity      *sql.Stmt
+	deleteEntries *sql.Stmt
+	player        *sql.Stmt
+	character     *sql.Stmt
+	entry         *sql.Stmt
+	weapon        *sql.Stmt
+}
+
+func prepareStatements(ctx context.Context, tx *sql.Tx) (*statements, error) {
+	stmts := &statements{}
+	queries := []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&stmts.activity, `
+			INSERT INTO activities (instance_id, period, archived, reference_id, director_activity_hash, mode, modes,
+				is_private, membership_type, starting_phase_index, started_from_beginning, player_count, duration_seconds,
+				clear_kind, full_clear, checkpoint, fresh, lowman_size, solo, flawless)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (instance_id) DO UPDATE SET
+				period = excluded.period, archived = excluded.archived, reference_id = excluded.reference_id,
+				director_activity_hash = excluded.director_activity_hash, mode = excluded.mode, modes = excluded.modes,
+				is_private = excluded.is_private, membership_type = excluded.membership_type,
+				starting_phase_index = excluded.starting_phase_index,
+				started_from_beginning = excluded.started_from_beginning,
+				player_count = excluded.player_count, duration_seconds = excluded.duration_seconds,
+				clear_kind = excluded.clear_kind, full_clear = excluded.full_clear, checkpoint = excluded.checkpoint,
+				fresh = excluded.fresh, lowman_size = excluded.lowman_size, solo = excluded.solo,
+				flawless = excluded.flawless`},
+		{&stmts.deleteEntries, `DELETE FROM entries WHERE instance_id = ?`},
+		{&stmts.player, `
+			INSERT INTO players (membership_id, membership_type, display_name, bungie_name, last_seen)
+			VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (membership_id, membership_type) DO UPDATE SET
+				display_name = CASE WHEN excluded.last_seen >= last_seen THEN excluded.display_name ELSE display_name END,
+				bungie_name = CASE WHEN excluded.last_seen >= last_seen THEN excluded.bungie_name ELSE bungie_name END,
+				last_seen = max(last_seen, excluded.last_seen)`},
+		{&stmts.character, `
+			INSERT INTO characters (character_id, membership_id, membership_type, class_hash, character_class,
+				light_level, last_seen)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (character_id) DO UPDATE SET
+				light_level = CASE WHEN excluded.last_seen >= last_seen THEN excluded.light_level ELSE light_level END,
+				last_seen = max(last_seen, excluded.last_seen)`},
+		{&stmts.entry, `
+			INSERT INTO entries (instance_id, character_id, membership_id, membership_type, light_level, standing,
+				score, completed, kills, deaths, assists, opponents_defeated, efficiency, kills_deaths_ratio,
+				kills_deaths_assists, time_played_seconds, start_seconds, fireteam_id, team, team_score,
+				completion_reason, precision_kills, weapon_kills_grenade, weapon_kills_melee, weapon_kills_super,
+				weapon_kills_ability)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (instance_id, character_id) DO NOTHING`},
+		{&stmts.weapon, `
+			INSERT INTO weapon_stats (instance_id, character_id, weapon_reference_id, kills, precision_kills)
+			VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (instance_id, character_id, weapon_reference_id) DO NOTHING`},
+	}
+
+	for _, q := range queries {
+		stmt, err := tx.PrepareContext(ctx, q.query)
+		if err != nil {
+			return nil, fmt.Errorf("Error preparing statement: %v", err)
+		}
+		*q.stmt = stmt
+	}
+	return stmts, nil
+}
+
+func (st *statements) upsert(ctx context.Context, pgcr *bungie.PGCR) error {
+	rows := Flatten(pgcr)
+	a := rows.Activity
+	period := formatTime(a.Period)
+
+	modes := make([]string, 0, len(a.Modes))
+	for _, mode := range a.Modes {
+		modes = append(modes, strconv.Itoa(int(mode)))
+	}
+
+	_, err := st.activity.ExecContext(ctx, a.InstanceID, period, formatTime(a.Archived), a.ReferenceID,
+		a.DirectorActivityHash, a.Mode, strings.Join(modes, ","), a.IsPrivate, a.MembershipType,
+		a.StartingPhaseIndex, a.StartedFromBeginning, a.PlayerCount, a.DurationSeconds,
+		a.ClearKind, a.FullClear, a.Checkpoint, a.Fresh, a.LowmanSize, a.Solo, a.Flawless)
+	if err != nil {
+		return err
+	}
+
+	// Entries are replaced as a whole, which also drops their weapon stats.
+	if _, err := st.deleteEntries.ExecContext(ctx, a.InstanceID); err != nil {
+		return err
+	}
+
+	for _, e := range rows.Entries {
+		if _, err := st.player.ExecContext(ctx, e.MembershipID, e.MembershipType, e.DisplayName, e.BungieName, period); err != nil {
+			return err
+		}
+		if _, err := st.character.ExecContext(ctx, e.CharacterID, e.MembershipID, e.MembershipType, e.ClassHash,
+			e.CharacterClass, e.LightLevel, period); err != nil {
+			return err
+		}
+		if _, err := st.entry.ExecContext(ctx, e.InstanceID, e.CharacterID, e.MembershipID, e.MembershipType,
+			e.LightLevel, e.Standing, e.Score, e.Completed, e.Kills, e.Deaths, e.Assists, e.OpponentsDefeated,
+			e.Efficiency, e.KD, e.KDA, e.TimePlayedSeconds, e.StartSeconds, e.FireteamID, e.Team, e.TeamScore,
+			e.CompletionReason, e.PrecisionKills, e.WeaponKillsGrenade, e.WeaponKillsMelee, e.WeaponKillsSuper,
+			e.WeaponKillsAbility); err != nil {
+			return err
+		}
+	}
+
+	for _, w := range rows.Weapons {
+		if _, err := st.weapon.ExecContext(ctx, w.InstanceID, w.CharacterID, w.WeaponReferenceID, w.Kills,
+			w.PrecisionKills); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// migrate applies every embedded migration newer than the database's
+// user_version, each in its own transaction. Migrations are named
+// NNNN_description.sql and applied in order of NNNN.
+func migrate(ctx context.Context, db *sql.DB) error {
+	var current int
+	if err := db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&current); err != nil {
+		return err
+	}
+
+	names, err := fs.Glob(sqliteMigrations, "migrations/sqlite/*.sql")
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		prefix, _, _ := strings.Cut(path.Base(name), "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return fmt.Errorf("Invalid migration name [%s]", name)
+		}
+		if version <= current {
+			continue
+		}
+
+		script, err := sqliteMigrations.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		if err := applyMigration(ctx, db, version, string(script)); err != nil {
+			return fmt.Errorf("Error applying migration [%s]: %v", name, err)
+		}
+		current = version
+	}
+	return nil
+}
+
+func applyMigration(ctx context.Context, db *sql.DB, version int, script string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", version)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,129 @@
+package sink
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bungie "github.com/deahtstroke/protheon/internal/bungie/types"
+)
+
+func count(t *testing.T, sink *SQLiteSink, table string) int {
+	t.Helper()
+	var n int
+	if err := sink.DB().QueryRow("SELECT count(*) FROM " + table).Scan(&n); err != nil {
+		t.Fatalf("Error counting %s: %v", table, err)
+	}
+	return n
+}
+
+func TestSQLiteSinkStoresNormalizedRows(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "pgcrs.db")
+	sink, err := NewSQLiteSink(ctx, SQLiteConfig{Path: path, BatchSize: 10})
+	if err != nil {
+		t.Fatalf("Error creating sink: %v", err)
+	}
+
+	day := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+	pgcrs := []*bungie.PGCR{testPGCR("1", "4", day), testPGCR("2", "4", day.Add(time.Hour))}
+	if err := sink.Write(ctx, pgcrs); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	if n := count(t, sink, "activities"); n != 0 {
+		t.Fatalf("Expected nothing stored before flush, got %d activities", n)
+	}
+	if err := sink.Flush(ctx); err != nil {
+		t.Fatalf("Error flushing: %v", err)
+	}
+
+	for table, want := range map[string]int{"activities": 2, "players": 1, "characters": 1, "entries": 2, "weapon_stats": 2} {
+		if n := count(t, sink, table); n != want {
+			t.Fatalf("Expected %d rows in %s, got %d", want, table, n)
+		}
+	}
+
+	var name, lastSeen string
+	if err := sink.DB().QueryRow("SELECT bungie_name, last_seen FROM players").Scan(&name, &lastSeen); err != nil {
+		t.Fatalf("Error querying player: %v", err)
+	}
+	if name != "Guardian#1234" || lastSeen != "2024-07-01T13:00:00Z" {
+		t.Fatalf("Unexpected player: %s %s", name, lastSeen)
+	}
+
+	var clearKind string
+	var solo bool
+	if err := sink.DB().QueryRow("SELECT clear_kind, solo FROM activities WHERE instance_id = 1").Scan(&clearKind, &solo); err != nil {
+		t.Fatalf("Error querying activity: %v", err)
+	}
+	if clearKind != "raid" || !solo {
+		t.Fatalf("Expected a solo raid clear, got %q solo=%v", clearKind, solo)
+	}
+
+	// Replaying an activity replaces it instead of duplicating it.
+	replay := testPGCR("1", "4", day)
+	replay.Entries[0].Values.Kills = 25
+	replay.Entries[0].Extended.Weapons = nil
+	if err := sink.Write(ctx, []*bungie.PGCR{replay}); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Error closing: %v", err)
+	}
+
+	sink, err = NewSQLiteSink(ctx, SQLiteConfig{Path: path})
+	if err != nil {
+		t.Fatalf("Error reopening sink: %v", err)
+	}
+	defer sink.Close()
+
+	if n := count(t, sink, "entries"); n != 2 {
+		t.Fatalf("Expected 2 entries after replay, got %d", n)
+	}
+	if n := count(t, sink, "weapon_stats"); n != 1 {
+		t.Fatalf("Expected replayed weapon stats to be replaced, got %d", n)
+	}
+	var kills float64
+	sink.DB().QueryRow("SELECT kills FROM entries WHERE instance_id = 1").Scan(&kills)
+	if kills != 25 {
+		t.Fatalf("Expected replayed entry to be updated, got %v kills", kills)
+	}
+
+	var version int
+	sink.DB().QueryRow("PRAGMA user_version").Scan(&version)
+	if version != 2 {
+		t.Fatalf("Expected schema version 2, got %d", version)
+	}
+}
+
+func TestSQLiteSinkDropsRefusedPGCRs(t *testing.T) {
+	ctx := context.Background()
+	sink, err := NewSQLiteSink(ctx, SQLiteConfig{Path: filepath.Join(t.TempDir(), "pgcrs.db")})
+	if err != nil {
+		t.Fatalf("Error creating sink: %v", err)
+	}
+	defer sink.Close()
+	poison := `CREATE TRIGGER poison BEFORE INSERT ON activities WHEN NEW.instance_id = 13
+		BEGIN SELECT RAISE(ABORT, 'poisoned PGCR'); END`
+	if _, err := sink.DB().Exec(poison); err != nil {
+		t.Fatalf("Error creating trigger: %v", err)
+	}
+
+	day := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+	sink.Write(ctx, []*bungie.PGCR{testPGCR("1", "4", day), testPGCR("13", "4", day), testPGCR("2", "4", day)})
+	if err := sink.Flush(ctx); err != nil {
+		t.Fatalf("Expected the refused PGCR to be dropped, got %v", err)
+	}
+	if n := count(t, sink, "activities"); n != 2 {
+		t.Fatalf("Expected the other PGCRs stored, got %d activities", n)
+	}
+	if n := count(t, sink, "entries WHERE instance_id = 13"); n != 0 {
+		t.Fatalf("Expected nothing of the refused PGCR stored, got %d entries", n)
+	}
+
+	sink.Write(ctx, []*bungie.PGCR{testPGCR("3", "4", day)})
+	if err := sink.Flush(ctx); err != nil || count(t, sink, "activities") != 3 {
+		t.Fatalf("Expected later flushes to store their PGCRs, got %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	bungie "github.com/deahtstroke/protheon/internal/bungie/types"
+)
+
+// StdoutSink writes PGCRs as JSON lines to a writer, usually os.Stdout, for
+// piping a mind's output into other tools or eyeballing it while testing.
+type StdoutSink struct {
+	mu     sync.Mutex
+	writer *bufio.Writer
+}
+
+func NewStdoutSink(w io.Writer) *StdoutSink {
+	return &StdoutSink{writer: bufio.NewWriter(w)}
+}
+
+func (s *StdoutSink) Write(ctx context.Context, pgcrs []*bungie.PGCR) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, pgcr := range pgcrs {
+		data, err := json.Marshal(pgcr)
+		if err != nil {
+			return fmt.Errorf("Error encoding PGCR [%s]: %v", pgcr.ActivityDetails.InstanceID, err)
+		}
+		s.writer.Write(data)
+		if err := s.writer.WriteByte('\n'); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *StdoutSink) Flush(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.writer.Flush()
+}
+
+func (s *StdoutSink) Close() error {
+	return s.Flush(context.Background())
+}
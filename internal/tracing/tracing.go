@@ -0,0 +1,134 @@
+// Package tracing sets up OpenTelemetry tracing for the conductor and the
+// minds. A PGCR's trace starts when the conductor publishes it, travels in the
+// message's AMQP headers and continues in the mind that consumes it:
+//
+//	conductor  produce pgcr                 one per published record
+//	conductor    pgcr_jobs publish          producer span, injected into the headers
+//	mind           pgcr_jobs process        consumer span, extracted from the headers
+//	mind             handle pgcr            decoding, validation and deduplication
+//	mind             sink write             one per sink
+//	mind       sink flush                   one per sink and checkpoint, linked to
+//	                                        the first 128 messages it made durable
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const TRACER_NAME = "github.com/deahtstroke/protheon"
+
+// Exporters accepted by Setup.
+const (
+	ExporterNone   = "none"
+	ExporterStdout = "stdout"
+	ExporterOTLP   = "otlp"
+)
+
+// Config selects where spans go.
+type Config struct {
+	Service string
+
+	// Exporter is one of none, stdout or otlp. OTLP spans are sent over HTTP
+	// to Endpoint, a host:port defaulting to a local collector, or to the
+	// standard OTEL_EXPORTER_OTLP_* environment variables when those are set.
+	Exporter string
+	Endpoint string
+	Insecure bool
+
+	// SampleRatio is the fraction of new traces recorded, from 0 for none to
+	// 1 for all. Traces started upstream follow their parent's decision.
+	SampleRatio float64
+
+	// Writer receives stdout spans, os.Stdout when nil.
+	Writer io.Writer
+}
+
+// Setup installs the global tracer provider and the W3C trace context
+// propagator. The returned function flushes pending spans and must be called
+// before exiting. With the none exporter, spans are still created and
+// propagated so upstream traces pass through, but nothing is recorded.
+func Setup(ctx context.Context, config Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch config.Exporter {
+	case "", ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterStdout:
+		w := config.Writer
+		if w == nil {
+			w = os.Stdout
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(w))
+	case ExporterOTLP:
+		var opts []otlptracehttp.Option
+		if config.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(config.Endpoint))
+		}
+		if config.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("Unknown trace exporter [%s], use none, stdout or otlp", config.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error creating %s trace exporter: %v", config.Exporter, err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(config.Service)))
+	if err != nil {
+		return nil, fmt.Errorf("Error creating trace resource: %v", err)
+	}
+
+	ratio := config.SampleRatio
+	if ratio < 0 || ratio > 1 {
+		return nil, fmt.Errorf("Error creating sampler: ratio [%g] isn't between 0 and 1", ratio)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// SampleRatio is a flag value for Config.SampleRatio, which refuses
+// fractions outside 0 to 1.
+type SampleRatio float64
+
+func (r *SampleRatio) String() string {
+	return strconv.FormatFloat(float64(*r), 'g', -1, 64)
+}
+
+func (r *SampleRatio) Set(value string) error {
+	ratio, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return err
+	}
+	if ratio < 0 || ratio > 1 {
+		return fmt.Errorf("ratio [%s] isn't between 0 and 1", value)
+	}
+	*r = SampleRatio(ratio)
+	return nil
+}
+
+// Tracer returns the tracer every protheon span is started with.
+func Tracer() trace.Tracer {
+	return otel.Tracer(TRACER_NAME)
+}
@@ -0,0 +1,85 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+func TestStdoutExporterContinuesPropagatedTraces(t *testing.T) {
+	var out bytes.Buffer
+	shutdown, err := Setup(context.Background(), Config{Service: "test", Exporter: ExporterStdout, SampleRatio: 1, Writer: &out})
+	if err != nil {
+		t.Fatalf("Error setting up tracing: %v", err)
+	}
+
+	ctx, publish := Tracer().Start(context.Background(), "publish")
+	headers := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, headers)
+	publish.End()
+
+	if headers["traceparent"] == "" {
+		t.Fatalf("Expected a traceparent header, got %v", headers)
+	}
+
+	consumed := otel.GetTextMapPropagator().Extract(context.Background(), headers)
+	_, process := Tracer().Start(consumed, "process")
+	process.End()
+
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatalf("Error shutting down tracing: %v", err)
+	}
+
+	traces := make(map[string]string)
+	decoder := json.NewDecoder(&out)
+	for decoder.More() {
+		var span struct {
+			Name        string
+			SpanContext struct{ TraceID string }
+		}
+		if err := decoder.Decode(&span); err != nil {
+			t.Fatalf("Error decoding span: %v", err)
+		}
+		traces[span.Name] = span.SpanContext.TraceID
+	}
+	if traces["publish"] == "" || traces["publish"] != traces["process"] {
+		t.Fatalf("Expected both spans in one trace, got %v", traces)
+	}
+}
+
+func TestUnknownExporter(t *testing.T) {
+	if _, err := Setup(context.Background(), Config{Exporter: "jaeger"}); err == nil {
+		t.Fatal("Expected an error for an unknown exporter")
+	}
+}
+
+func TestSampleRatio(t *testing.T) {
+	var out bytes.Buffer
+	shutdown, err := Setup(context.Background(), Config{Exporter: ExporterStdout, SampleRatio: 0, Writer: &out})
+	if err != nil {
+		t.Fatalf("Error setting up tracing: %v", err)
+	}
+	_, span := Tracer().Start(context.Background(), "unsampled")
+	span.End()
+	shutdown(context.Background())
+	if out.Len() != 0 {
+		t.Fatalf("Expected no spans with a ratio of 0, got %s", out.String())
+	}
+
+	if _, err := Setup(context.Background(), Config{Exporter: ExporterStdout, SampleRatio: 1.5}); err == nil {
+		t.Fatal("Expected an error for a ratio above 1")
+	}
+	var ratio SampleRatio
+	for _, value := range []string{"-0.1", "2", "all"} {
+		if err := ratio.Set(value); err == nil {
+			t.Fatalf("Expected %q to be refused", value)
+		}
+	}
+	if err := ratio.Set("0.25"); err != nil || ratio != 0.25 {
+		t.Fatalf("Expected 0.25, got %v %v", ratio, err)
+	}
+}
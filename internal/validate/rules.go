@@ -0,0 +1,184 @@
+package validate
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	bungie "github.com/deahtstroke/protheon/internal/bungie/types"
+)
+
+const (
+	// MAX_CLOCK_SKEW is how far in the future a Period may be before it is
+	// reported, to allow for clock differences with Bungie's servers.
+	MAX_CLOCK_SKEW = time.Hour
+)
+
+// DefaultRules returns the rules every PGCR is checked against unless
+// configured otherwise.
+func DefaultRules() []Rule {
+	return []Rule{
+		{Name: "missing-instance-id", Severity: Error, Check: checkMissingInstanceID},
+		{Name: "missing-period", Severity: Error, Check: checkMissingPeriod},
+		{Name: "future-period", Severity: Error, Check: checkFuturePeriod},
+		{Name: "no-entries", Severity: Error, Check: checkNoEntries},
+		{Name: "negative-time-played", Severity: Error, Check: checkNegativeTimePlayed},
+		{Name: "negative-stats", Severity: Error, Check: checkNegativeStats},
+		{Name: "player-count-mismatch", Severity: Warning, Check: checkPlayerCount},
+		{Name: "duplicate-entry", Severity: Warning, Check: checkDuplicateEntries},
+		{Name: "missing-membership-id", Severity: Info, Check: checkMissingMembershipID},
+	}
+}
+
+// ParseRules starts from the default rules and applies a comma separated
+// list of overrides of the form name=off or name=<severity>, for example
+// "player-count-mismatch=error,missing-membership-id=off".
+func ParseRules(spec string) ([]Rule, error) {
+	rules := DefaultRules()
+	if strings.TrimSpace(spec) == "" {
+		return rules, nil
+	}
+
+	for _, override := range strings.Split(spec, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(override), "=")
+		if !ok {
+			return nil, fmt.Errorf("Invalid rule override [%s], expected name=severity or name=off", override)
+		}
+
+		index := -1
+		for i, rule := range rules {
+			if rule.Name == name {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			return nil, fmt.Errorf("Unknown rule [%s]", name)
+		}
+
+		if value == "off" {
+			rules = append(rules[:index], rules[index+1:]...)
+			continue
+		}
+		severity, err := ParseSeverity(value)
+		if err != nil {
+			return nil, err
+		}
+		rules[index].Severity = severity
+	}
+	return rules, nil
+}
+
+func activity(message string, args ...any) []Finding {
+	return []Finding{{Entry: -1, Message: fmt.Sprintf(message, args...)}}
+}
+
+func checkMissingInstanceID(pgcr *bungie.PGCR, now time.Time) []Finding {
+	if pgcr.ActivityDetails.InstanceID == "" {
+		return activity("activity has no instance ID")
+	}
+	return nil
+}
+
+func checkMissingPeriod(pgcr *bungie.PGCR, now time.Time) []Finding {
+	if pgcr.Period.IsZero() {
+		return activity("activity has no period")
+	}
+	return nil
+}
+
+func checkFuturePeriod(pgcr *bungie.PGCR, now time.Time) []Finding {
+	if pgcr.Period.After(now.Add(MAX_CLOCK_SKEW)) {
+		return activity("period %s is in the future", pgcr.Period.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func checkNoEntries(pgcr *bungie.PGCR, now time.Time) []Finding {
+	if len(pgcr.Entries) == 0 {
+		return activity("activity has no entries")
+	}
+	return nil
+}
+
+func checkNegativeTimePlayed(pgcr *bungie.PGCR, now time.Time) []Finding {
+	var findings []Finding
+	for i, entry := range pgcr.Entries {
+		if entry.Values.TimePlayedSeconds < 0 {
+			findings = append(findings, Finding{
+				Entry:   i,
+				Message: fmt.Sprintf("timePlayedSeconds is %v", entry.Values.TimePlayedSeconds),
+			})
+		}
+	}
+	return findings
+}
+
+func checkNegativeStats(pgcr *bungie.PGCR, now time.Time) []Finding {
+	var findings []Finding
+	for i, entry := range pgcr.Entries {
+		values := entry.Values
+		stats := []struct {
+			name  string
+			value float64
+		}{
+			{"kills", values.Kills},
+			{"deaths", values.Deaths},
+			{"assists", values.Assists},
+			{"activityDurationSeconds", values.ActivityDuration},
+		}
+		for _, stat := range stats {
+			if stat.value < 0 {
+				findings = append(findings, Finding{
+					Entry:   i,
+					Message: fmt.Sprintf("%s is %v", stat.name, stat.value),
+				})
+			}
+		}
+	}
+	return findings
+}
+
+func checkPlayerCount(pgcr *bungie.PGCR, now time.Time) []Finding {
+	for i, entry := range pgcr.Entries {
+		count := int(entry.Values.PlayerCount)
+		if count > 0 && count != len(pgcr.Entries) {
+			return []Finding{{
+				Entry:   i,
+				Message: fmt.Sprintf("playerCount is %d but the activity has %d entries", count, len(pgcr.Entries)),
+			}}
+		}
+	}
+	return nil
+}
+
+func checkDuplicateEntries(pgcr *bungie.PGCR, now time.Time) []Finding {
+	var findings []Finding
+	seen := make(map[string]int)
+	for i, entry := range pgcr.Entries {
+		membershipID := entry.Player.DestinyUserInfo.MembershipID.String()
+		if membershipID == "" || entry.CharacterID == "" {
+			continue
+		}
+		key := membershipID + "/" + entry.CharacterID
+		if first, ok := seen[key]; ok {
+			findings = append(findings, Finding{
+				Entry:   i,
+				Message: fmt.Sprintf("character %s already appears in entry %d", entry.CharacterID, first),
+			})
+			continue
+		}
+		seen[key] = i
+	}
+	return findings
+}
+
+func checkMissingMembershipID(pgcr *bungie.PGCR, now time.Time) []Finding {
+	var findings []Finding
+	for i, entry := range pgcr.Entries {
+		if entry.Player.DestinyUserInfo.MembershipID == "" {
+			findings = append(findings, Finding{Entry: i, Message: "entry has no membership ID"})
+		}
+	}
+	return findings
+}
@@ -0,0 +1,173 @@
+package validate
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	bungie "github.com/deahtstroke/protheon/internal/bungie/types"
+)
+
+var ErrInvalid = errors.New("Invalid PGCR")
+
+type Severity int
+
+const (
+	Info Severity = iota
+	Warning
+	Error
+)
+
+func (s Severity) String() string {
+	switch s {
+	case Info:
+		return "info"
+	case Warning:
+		return "warning"
+	case Error:
+		return "error"
+	default:
+		return fmt.Sprintf("severity(%d)", int(s))
+	}
+}
+
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func ParseSeverity(s string) (Severity, error) {
+	switch s {
+	case "info":
+		return Info, nil
+	case "warning":
+		return Warning, nil
+	case "error":
+		return Error, nil
+	default:
+		return Info, fmt.Errorf("Unknown severity [%s], use info, warning or error", s)
+	}
+}
+
+// Violation is a single broken rule. Entry is the index of the offending
+// entry, or -1 when the rule is about the activity as a whole.
+type Violation struct {
+	Rule     string   `json:"rule"`
+	Severity Severity `json:"severity"`
+	Entry    int      `json:"entry"`
+	Message  string   `json:"message"`
+}
+
+func (v Violation) String() string {
+	if v.Entry < 0 {
+		return fmt.Sprintf("%s [%s]: %s", v.Severity, v.Rule, v.Message)
+	}
+	return fmt.Sprintf("%s [%s] entry %d: %s", v.Severity, v.Rule, v.Entry, v.Message)
+}
+
+// CheckFunc inspects a PGCR and returns a message per problem found. The
+// entry index is -1 for activity level problems.
+type CheckFunc func(pgcr *bungie.PGCR, now time.Time) []Finding
+
+type Finding struct {
+	Entry   int
+	Message string
+}
+
+type Rule struct {
+	Name     string
+	Severity Severity
+	Check    CheckFunc
+}
+
+// Validator runs a rule set over PGCRs and keeps a histogram of how often
+// each rule was violated. It is safe for concurrent use.
+type Validator struct {
+	Rules []Rule
+	Now   func() time.Time
+
+	mu        sync.Mutex
+	validated int64
+	histogram map[string]int64
+}
+
+func NewValidator(rules []Rule) *Validator {
+	return &Validator{
+		Rules:     rules,
+		Now:       time.Now,
+		histogram: make(map[string]int64),
+	}
+}
+
+// Validate checks a PGCR against the default rules.
+func Validate(pgcr *bungie.PGCR) []Violation {
+	return NewValidator(DefaultRules()).Validate(pgcr)
+}
+
+func (v *Validator) Validate(pgcr *bungie.PGCR) []Violation {
+	now := v.Now()
+
+	var violations []Violation
+	for _, rule := range v.Rules {
+		for _, finding := range rule.Check(pgcr, now) {
+			violations = append(violations, Violation{
+				Rule:     rule.Name,
+				Severity: rule.Severity,
+				Entry:    finding.Entry,
+				Message:  finding.Message,
+			})
+		}
+	}
+
+	v.mu.Lock()
+	v.validated++
+	for _, violation := range violations {
+		v.histogram[violation.Rule]++
+	}
+	v.mu.Unlock()
+
+	return violations
+}
+
+// Err returns an error wrapping ErrInvalid when any violation is at least as
+// severe as min, or nil otherwise.
+func Err(violations []Violation, min Severity) error {
+	var messages []string
+	for _, violation := range violations {
+		if violation.Severity >= min {
+			messages = append(messages, violation.String())
+		}
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrInvalid, strings.Join(messages, "; "))
+}
+
+type HistogramEntry struct {
+	Rule     string   `json:"rule"`
+	Severity Severity `json:"severity"`
+	Count    int64    `json:"count"`
+}
+
+// Histogram returns how many times each rule was violated, most frequent
+// first, along with the number of PGCRs validated.
+func (v *Validator) Histogram() ([]HistogramEntry, int64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	entries := make([]HistogramEntry, 0, len(v.Rules))
+	for _, rule := range v.Rules {
+		entries = append(entries, HistogramEntry{
+			Rule:     rule.Name,
+			Severity: rule.Severity,
+			Count:    v.histogram[rule.Name],
+		})
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Count > entries[j].Count
+	})
+	return entries, v.validated
+}
@@ -0,0 +1,132 @@
+package validate
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	bungie "github.com/deahtstroke/protheon/internal/bungie/types"
+)
+
+func entry(membershipID, characterID string, timePlayed, playerCount float64) bungie.Entry {
+	return bungie.Entry{
+		Player: bungie.Player{
+			DestinyUserInfo: bungie.DestinyUserInfo{MembershipID: json.Number(membershipID)},
+		},
+		CharacterID: characterID,
+		Values: bungie.Values{
+			TimePlayedSeconds: timePlayed,
+			PlayerCount:       playerCount,
+		},
+	}
+}
+
+func validPGCR(now time.Time) *bungie.PGCR {
+	return &bungie.PGCR{
+		Period: now.Add(-time.Hour),
+		ActivityDetails: bungie.ActivityDetails{
+			InstanceID: json.Number("15324001234"),
+		},
+		Entries: []bungie.Entry{
+			entry("4611686018467284386", "2305843009301648414", 1800, 2),
+			entry("4611686018471234567", "2305843009301111111", 1700, 2),
+		},
+	}
+}
+
+func ruleNames(t *testing.T, violations []Violation) []string {
+	t.Helper()
+	var names []string
+	for _, v := range violations {
+		names = append(names, v.Rule)
+	}
+	return names
+}
+
+func TestValidateValidPGCR(t *testing.T) {
+	now := time.Now()
+	validator := NewValidator(DefaultRules())
+	validator.Now = func() time.Time { return now }
+
+	if violations := validator.Validate(validPGCR(now)); len(violations) != 0 {
+		t.Fatalf("Expected no violations, got %v", violations)
+	}
+}
+
+func TestValidateViolations(t *testing.T) {
+	now := time.Now()
+	validator := NewValidator(DefaultRules())
+	validator.Now = func() time.Time { return now }
+
+	tests := []struct {
+		name   string
+		mutate func(*bungie.PGCR)
+		rule   string
+	}{
+		{"no entries", func(p *bungie.PGCR) { p.Entries = nil }, "no-entries"},
+		{"future period", func(p *bungie.PGCR) { p.Period = now.Add(24 * time.Hour) }, "future-period"},
+		{"negative time played", func(p *bungie.PGCR) { p.Entries[1].Values.TimePlayedSeconds = -5 }, "negative-time-played"},
+		{"player count", func(p *bungie.PGCR) { p.Entries[0].Values.PlayerCount = 6 }, "player-count-mismatch"},
+		{"duplicate entry", func(p *bungie.PGCR) {
+			p.Entries = append(p.Entries, p.Entries[0])
+			for i := range p.Entries {
+				p.Entries[i].Values.PlayerCount = 3
+			}
+		}, "duplicate-entry"},
+	}
+
+	for _, tt := range tests {
+		pgcr := validPGCR(now)
+		tt.mutate(pgcr)
+		names := ruleNames(t, validator.Validate(pgcr))
+		if len(names) != 1 || names[0] != tt.rule {
+			t.Fatalf("%s: expected only [%s], got %v", tt.name, tt.rule, names)
+		}
+	}
+
+	histogram, validated := validator.Histogram()
+	if validated != int64(len(tests)) {
+		t.Fatalf("Expected %d validated PGCRs, got %d", len(tests), validated)
+	}
+	for _, entry := range histogram {
+		if entry.Rule == "no-entries" && entry.Count != 1 {
+			t.Fatalf("Expected no-entries to be counted once, got %d", entry.Count)
+		}
+	}
+}
+
+func TestErrSeverityThreshold(t *testing.T) {
+	now := time.Now()
+	pgcr := validPGCR(now)
+	pgcr.Entries[0].Values.PlayerCount = 6
+
+	violations := Validate(pgcr)
+	if err := Err(violations, Error); err != nil {
+		t.Fatalf("Expected warning to pass at error threshold, got %v", err)
+	}
+	if err := Err(violations, Warning); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("Expected ErrInvalid at warning threshold, got %v", err)
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules("player-count-mismatch=error,no-entries=off")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for _, rule := range rules {
+		if rule.Name == "no-entries" {
+			t.Fatal("Expected no-entries to be disabled")
+		}
+		if rule.Name == "player-count-mismatch" && rule.Severity != Error {
+			t.Fatalf("Expected player-count-mismatch to be an error, got %s", rule.Severity)
+		}
+	}
+
+	for _, spec := range []string{"unknown=error", "no-entries", "no-entries=fatal"} {
+		if _, err := ParseRules(spec); err == nil {
+			t.Fatalf("Expected error for [%s], got none", spec)
+		}
+	}
+}